@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	// AuditActorHeader is the HTTP header with the user making a request, which is recorded in the audit log.
+	// It should be set by an authenticating reverse proxy in front of uniqush-push, and is ignored unless the request comes from trusted_proxies in [Audit].
+	AuditActorHeader = "X-Forwarded-User"
+
+	// defaultAuditMaxEntries is about how many entries of the audit log are kept, if max_entries isn't set in [Audit].
+	defaultAuditMaxEntries = 100000
+	// defaultAuditQueryCount and maxAuditQueryCount are the default and maximum number of entries returned by /audit.
+	defaultAuditQueryCount = 100
+	maxAuditQueryCount     = 1000
+)
+
+// newAuditEntry returns an entry of the audit log for a request to an administrative endpoint, such as /addpsp, authenticated as identity (See authenticate).
+// The handler of the endpoint fills in the result.
+func (api *RestAPI) newAuditEntry(r *http.Request, reqID string, identity string) *db.AuditEntry {
+	entry := &db.AuditEntry{
+		Time:       time.Now().UTC(),
+		Action:     r.URL.Path,
+		Identity:   identity,
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		RequestID:  reqID,
+	}
+	if api.isTrustedProxy(r.RemoteAddr) {
+		entry.Actor = r.Header.Get(AuditActorHeader)
+	}
+	return entry
+}
+
+// newSignalAuditEntry returns an entry of the audit log for a signal, such as SIGTERM stopping uniqush-push (action is /stop) or SIGHUP reloading uniqush.conf (action is /reload).
+func newSignalAuditEntry(action string, sig os.Signal) *db.AuditEntry {
+	return &db.AuditEntry{
+		Time:       time.Now().UTC(),
+		Action:     action,
+		RemoteAddr: "signal " + sig.String(),
+	}
+}
+
+// setAuditResult records the result of a request in its entry of the audit log.
+func setAuditResult(entry *db.AuditEntry, code string, errorMsg *string) {
+	entry.Code = code
+	if errorMsg != nil {
+		entry.ErrorMsg = *errorMsg
+	}
+}
+
+// auditPSP returns a snapshot of a PSP for the audit log, with secrets redacted, or nil if there is no PSP.
+func auditPSP(psp *push.PushServiceProvider) map[string]string {
+	if psp == nil {
+		return nil
+	}
+	return encodePSPForAPI(psp)
+}
+
+// findPushServiceProvider returns the stored PSP with the given name, or nil if there is none.
+func (api *RestAPI) findPushServiceProvider(name string, logger log.Logger) *push.PushServiceProvider {
+	psps, err := api.backend.GetPushServiceProviderConfigs()
+	if err != nil {
+		// Some PSPs may still have been returned.
+		logger.Errorf("Failed to get PSPs for the audit log: %v", err)
+	}
+	for _, psp := range psps {
+		if psp.Name() == name {
+			return psp
+		}
+	}
+	return nil
+}
+
+// SetAuditMaxEntries sets about how many entries of the audit log are kept (or 0 to keep every entry).
+func (api *RestAPI) SetAuditMaxEntries(maxEntries int64) {
+	api.settingsLock.Lock()
+	defer api.settingsLock.Unlock()
+	api.auditMaxEntries = maxEntries
+}
+
+func (api *RestAPI) getAuditMaxEntries() int64 {
+	api.settingsLock.RLock()
+	defer api.settingsLock.RUnlock()
+	return api.auditMaxEntries
+}
+
+// SetAuditTrustedProxies sets the addresses of the proxies whose AuditActorHeader is recorded in the audit log.
+func (api *RestAPI) SetAuditTrustedProxies(proxies []*net.IPNet) {
+	api.settingsLock.Lock()
+	defer api.settingsLock.Unlock()
+	api.auditTrustedProxies = proxies
+}
+
+// isTrustedProxy returns true if remoteAddr (host:port) is one of the trusted proxies.
+func (api *RestAPI) isTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	api.settingsLock.RLock()
+	defer api.settingsLock.RUnlock()
+	for _, proxy := range api.auditTrustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// audit appends an entry to the audit log. Failing to store it doesn't stop the request, but is logged with the entry.
+func (api *RestAPI) audit(entry *db.AuditEntry, logger log.Logger) {
+	if err := api.backend.AddAuditEntry(entry, api.getAuditMaxEntries()); err != nil {
+		data, _ := json.Marshal(entry)
+		logger.Errorf("Failed to add an entry to the audit log: %v: %s", err, data)
+	}
+}
+
+// queryAudit returns JSON with the newest entries of the audit log for /audit, optionally starting before the entry with the ID before.
+func (api *RestAPI) queryAudit(form map[string][]string, logger log.Logger) []byte {
+	type responseType struct {
+		Code     string           `json:"code"`
+		ErrorMsg *string          `json:"errorMsg,omitempty"`
+		Entries  []*db.AuditEntry `json:"entries"`
+	}
+	r := responseType{Code: UNIQUSH_SUCCESS, Entries: []*db.AuditEntry{}}
+	count := int64(defaultAuditQueryCount)
+	var err error
+	if values := form["count"]; len(values) > 0 && values[0] != "" {
+		count, err = strconv.ParseInt(values[0], 10, 64)
+		if err == nil && (count <= 0 || count > maxAuditQueryCount) {
+			err = fmt.Errorf("count must be between 1 and %d", maxAuditQueryCount)
+		} else if err != nil {
+			err = fmt.Errorf("Invalid count: %v", err)
+		}
+	}
+	if err == nil {
+		var before string
+		if values := form["before"]; len(values) > 0 {
+			before = values[0]
+		}
+		var entries []*db.AuditEntry
+		entries, err = api.backend.GetAuditEntries(before, count)
+		if entries != nil {
+			r.Entries = entries
+		}
+	}
+	if err != nil {
+		logger.Errorf("Query=Audit Failed: %v", err)
+		r.Code = UNIQUSH_ERROR_GENERIC
+		r.ErrorMsg = strPtrOfErr(err)
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to encode response")
+	}
+	return json
+}
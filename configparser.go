@@ -18,10 +18,14 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/uniqush/goconf/conf"
 	"github.com/uniqush/log"
@@ -41,6 +45,7 @@ const (
 	LoggerSubscriptions
 	LoggerServices
 	LoggerPreview
+	LoggerPreferences
 	NumberOfLoggers
 )
 
@@ -65,7 +70,7 @@ func extractLogLevel(loglevel string) (int, string) {
 	return level, warningMsg
 }
 
-func loadLogger(writer io.Writer, c *conf.ConfigFile, field string, prefix string) (log.Logger, error) {
+func loadLogger(writer io.Writer, c *conf.ConfigFile, field string, prefix string, format string) (log.Logger, error) {
 	var loglevel string
 	var logswitch bool
 	var err error
@@ -92,7 +97,12 @@ func loadLogger(writer io.Writer, c *conf.ConfigFile, field string, prefix strin
 		level = log.LOGLEVEL_SILENT
 	}
 
-	logger := log.NewLogger(writer, prefix, level)
+	var logger log.Logger
+	if format == logFormatJSON {
+		logger = newJSONLogger(writer, field, level)
+	} else {
+		logger = log.NewLogger(writer, prefix, level)
+	}
 	if warningMsg != "" {
 		logger.Warn(warningMsg)
 	}
@@ -143,6 +153,211 @@ func LoadDatabaseConfig(cf *conf.ConfigFile) (*db.DatabaseConfig, error) {
 	return c, nil
 }
 
+// LoadIdempotencyTTL returns how long the responses of /push requests with an idempotency key are stored, from idempotency_ttl (in seconds) in [WebFrontend].
+func LoadIdempotencyTTL(c *conf.ConfigFile) (time.Duration, error) {
+	if !c.HasOption("WebFrontend", "idempotency_ttl") {
+		return defaultIdempotencyTTL, nil
+	}
+	seconds, err := c.GetInt("WebFrontend", "idempotency_ttl")
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("[WebFrontend] idempotency_ttl must be a positive number of seconds")
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// LoadShutdownTimeout returns how long stopping waits for requests, pushes and retries to finish, from shutdown_timeout (in seconds) in [WebFrontend].
+func LoadShutdownTimeout(c *conf.ConfigFile) (time.Duration, error) {
+	if !c.HasOption("WebFrontend", "shutdown_timeout") {
+		return defaultShutdownTimeout, nil
+	}
+	seconds, err := c.GetInt("WebFrontend", "shutdown_timeout")
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("[WebFrontend] shutdown_timeout must be a non-negative number of seconds")
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// LoadFrequencyCaps returns the frequency caps in the [FrequencyCaps] section of uniqush.conf, by lowercase service name.
+// Each option is a service name (or "default", for other services) and a cap such as "10/1h".
+func LoadFrequencyCaps(c *conf.ConfigFile) (map[string]push.FrequencyCap, error) {
+	frequencyCaps := make(map[string]push.FrequencyCap)
+	for service, value := range push.SectionValues(c, "FrequencyCaps") {
+		frequencyCap, err := push.ParseFrequencyCap(value)
+		if err != nil {
+			return nil, fmt.Errorf("[FrequencyCaps] %s: %v", service, err)
+		}
+		frequencyCaps[strings.ToLower(service)] = frequencyCap
+	}
+	return frequencyCaps, nil
+}
+
+// LoadDeliveryPointExpiry returns the maximum ages of delivery points in the [DeliveryPointExpiry] section of uniqush.conf, by lowercase service name,
+// and how often expired delivery points are removed (sweep_interval).
+// Each other option is a service name (or "default", for other services) and a duration such as "8760h".
+func LoadDeliveryPointExpiry(c *conf.ConfigFile) (map[string]time.Duration, time.Duration, error) {
+	maxAges := make(map[string]time.Duration)
+	sweepInterval := defaultDeliveryPointSweepInterval
+	for option, value := range push.SectionValues(c, "DeliveryPointExpiry") {
+		duration, err := time.ParseDuration(strings.TrimSpace(value))
+		if strings.ToLower(option) == "sweep_interval" {
+			if err != nil || duration < time.Minute {
+				return nil, 0, fmt.Errorf("[DeliveryPointExpiry] sweep_interval must be a duration of at least 1m, got %q", value)
+			}
+			sweepInterval = duration
+			continue
+		}
+		if err != nil || duration < minDeliveryPointMaxAge {
+			return nil, 0, fmt.Errorf("[DeliveryPointExpiry] %s must be a duration of at least %v, got %q", option, minDeliveryPointMaxAge, value)
+		}
+		maxAges[strings.ToLower(option)] = duration
+	}
+	return maxAges, sweepInterval, nil
+}
+
+// LoadCertificateExpiry returns how long before a PSP's certificate expires that warnings are logged (warning_days),
+// and how often the certificates of all PSPs are checked (check_interval), from the [CertificateExpiry] section of uniqush.conf.
+func LoadCertificateExpiry(c *conf.ConfigFile) (time.Duration, time.Duration, error) {
+	warning := defaultCertificateExpiryWarning
+	checkInterval := defaultCertificateCheckInterval
+	if c.HasOption("CertificateExpiry", "warning_days") {
+		days, err := c.GetInt("CertificateExpiry", "warning_days")
+		if err != nil || days < 0 {
+			return 0, 0, fmt.Errorf("[CertificateExpiry] warning_days must be a non-negative number of days")
+		}
+		warning = time.Duration(days) * 24 * time.Hour
+	}
+	if c.HasOption("CertificateExpiry", "check_interval") {
+		value, err := c.GetString("CertificateExpiry", "check_interval")
+		if err != nil {
+			return 0, 0, err
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || duration < time.Minute {
+			return 0, 0, fmt.Errorf("[CertificateExpiry] check_interval must be a duration of at least 1m, got %q", value)
+		}
+		checkInterval = duration
+	}
+	return warning, checkInterval, nil
+}
+
+// LoadAuditMaxEntries returns about how many entries of the audit log are kept, from max_entries in the [Audit] section of uniqush.conf (0 keeps every entry).
+func LoadAuditMaxEntries(c *conf.ConfigFile) (int64, error) {
+	if !c.HasOption("Audit", "max_entries") {
+		return defaultAuditMaxEntries, nil
+	}
+	maxEntries, err := c.GetInt("Audit", "max_entries")
+	if err != nil || maxEntries < 0 {
+		return 0, fmt.Errorf("[Audit] max_entries must be a non-negative number")
+	}
+	return int64(maxEntries), nil
+}
+
+// LoadAuditTrustedProxies returns the addresses (IPs or CIDRs, comma separated) in trusted_proxies in the [Audit] section of uniqush.conf.
+// The AuditActorHeader of requests from these addresses is recorded in the audit log.
+func LoadAuditTrustedProxies(c *conf.ConfigFile) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	if !c.HasOption("Audit", "trusted_proxies") {
+		return proxies, nil
+	}
+	value, err := c.GetString("Audit", "trusted_proxies")
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range strings.Split(value, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("[Audit] trusted_proxies: invalid IP address %q", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("[Audit] trusted_proxies: %v", err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// Environment variables with base64 encoded AES keys, which take precedence over secrets_key_file and secrets_old_key_files in [Database].
+const (
+	secretsKeyEnv     = "UNIQUSH_SECRETS_KEY"
+	secretsOldKeysEnv = "UNIQUSH_SECRETS_OLD_KEYS"
+)
+
+// LoadSecretKeys returns the key used to encrypt PSP credentials in the database, and old keys which can still decrypt them (See push.SetSecretKeys).
+// Keys are base64 encoded, in files named by secrets_key_file and secrets_old_key_files (comma separated) in [Database],
+// or in the UNIQUSH_SECRETS_KEY and UNIQUSH_SECRETS_OLD_KEYS (comma separated) environment variables. The current key is nil if none is configured.
+func LoadSecretKeys(c *conf.ConfigFile) ([]byte, [][]byte, error) {
+	var currentKey []byte
+	if value := os.Getenv(secretsKeyEnv); value != "" {
+		key, err := decodeSecretKey(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", secretsKeyEnv, err)
+		}
+		currentKey = key
+	} else if filename, err := c.GetString("Database", "secrets_key_file"); err == nil && filename != "" {
+		key, err := readSecretKeyFile(filename)
+		if err != nil {
+			return nil, nil, fmt.Errorf("[Database] secrets_key_file: %v", err)
+		}
+		currentKey = key
+	}
+
+	var oldKeys [][]byte
+	if value := os.Getenv(secretsOldKeysEnv); value != "" {
+		for _, encoded := range strings.Split(value, ",") {
+			key, err := decodeSecretKey(encoded)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", secretsOldKeysEnv, err)
+			}
+			oldKeys = append(oldKeys, key)
+		}
+	} else if filenames, err := c.GetString("Database", "secrets_old_key_files"); err == nil && filenames != "" {
+		for _, filename := range strings.Split(filenames, ",") {
+			key, err := readSecretKeyFile(strings.TrimSpace(filename))
+			if err != nil {
+				return nil, nil, fmt.Errorf("[Database] secrets_old_key_files: %v", err)
+			}
+			oldKeys = append(oldKeys, key)
+		}
+	}
+	return currentKey, oldKeys, nil
+}
+
+func readSecretKeyFile(filename string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodeSecretKey(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return key, nil
+}
+
+func decodeSecretKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("expected a base64 encoded key: %v", err)
+	}
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, fmt.Errorf("expected a 16, 24, or 32 byte AES key, got %d bytes", len(key))
+	}
+	return key, nil
+}
+
 const (
 	defaultConfigFilePath = "/etc/uniqush/uniqush.conf"
 )
@@ -162,16 +377,28 @@ func OpenConfig(filename string) (c *conf.ConfigFile, err error) {
 // LoadLoggers will return an array of loggers, for each type in the enum.
 // The log level of individual loggers vary based on the config.
 func LoadLoggers(c *conf.ConfigFile) ([]log.Logger, error) {
-	var logfile io.Writer
+	loggers, _, err := loadLoggers(c)
+	return loggers, err
+}
 
+// loadLoggers returns the loggers for each type in the enum, and the logfile they write to, which is nil if they write to stderr.
+func loadLoggers(c *conf.ConfigFile) ([]log.Logger, io.Closer, error) {
+	format, err := c.GetString("default", "logformat")
+	if err != nil || format == "" {
+		format = "text"
+	}
+	if format != "text" && format != logFormatJSON {
+		return nil, nil, fmt.Errorf("Invalid logformat %q, expected text or json", format)
+	}
+
+	var logfile io.Writer = os.Stderr
+	var closer io.Closer
 	logfilename, err := c.GetString("default", "logfile")
 	if err == nil && logfilename != "" {
-		logfile, err = os.OpenFile(logfilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
-		if err != nil {
-			logfile = os.Stderr
+		if file, err := os.OpenFile(logfilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err == nil {
+			logfile = file
+			closer = file
 		}
-	} else {
-		logfile = os.Stderr
 	}
 
 	loggers := make([]log.Logger, NumberOfLoggers)
@@ -187,15 +414,89 @@ func LoadLoggers(c *conf.ConfigFile) ([]log.Logger, error) {
 		LoggerSubscriptions: "Subscriptions",
 		LoggerServices:      "Services",
 		LoggerPreview:       "Preview",
+		LoggerPreferences:   "Preferences",
 	}
 	for loggerIndex, loggerName := range loggerConfigs {
-		loggers[loggerIndex], err = loadLogger(logfile, c, loggerName, fmt.Sprintf("[%s]", loggerName))
+		loggers[loggerIndex], err = loadLogger(logfile, c, loggerName, fmt.Sprintf("[%s]", loggerName), format)
 		if err != nil {
-			return nil, err
+			if closer != nil {
+				closer.Close()
+			}
+			return nil, nil, err
 		}
 	}
 
-	return loggers, nil
+	return loggers, closer, nil
+}
+
+// splitAPIKeys returns the comma separated API keys in value.
+func splitAPIKeys(value string) []string {
+	var keys []string
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// LoadAPIKeys returns the API keys in uniqush.conf: admin_api_keys in [WebFrontend], and the API keys of each tenant in [Tenants],
+// with the quotas in [TenantQuotas] (a limit and period such as 100000/24h, like [FrequencyCaps]).
+// Options of [Tenants] are tenant names, and API keys are comma separated.
+func LoadAPIKeys(c *conf.ConfigFile) (*APIKeys, error) {
+	keys := &APIKeys{admin: make(map[string]bool), tenants: make(map[string]*Tenant)}
+	used := make(map[string]bool)
+	addKey := func(key string, owner string) (string, error) {
+		hash := hashAPIKey(key)
+		if used[hash] {
+			return "", fmt.Errorf("%s: an API key is used more than once", owner)
+		}
+		used[hash] = true
+		return hash, nil
+	}
+
+	if value, err := c.GetString("WebFrontend", "admin_api_keys"); err == nil {
+		for _, key := range splitAPIKeys(value) {
+			hash, err := addKey(key, "[WebFrontend] admin_api_keys")
+			if err != nil {
+				return nil, err
+			}
+			keys.admin[hash] = true
+		}
+	}
+
+	tenants := make(map[string]*Tenant)
+	for name, value := range push.SectionValues(c, "Tenants") {
+		if !validTenantPattern.MatchString(name) {
+			return nil, fmt.Errorf("[Tenants] %s: invalid tenant name. Accepted characters: a-z, A-Z, 0-9, -, _ or .", name)
+		}
+		apiKeys := splitAPIKeys(value)
+		if len(apiKeys) == 0 {
+			return nil, fmt.Errorf("[Tenants] %s: expected one or more comma separated API keys", name)
+		}
+		tenant := &Tenant{Name: name}
+		tenants[strings.ToLower(name)] = tenant
+		for _, key := range apiKeys {
+			hash, err := addKey(key, "[Tenants] "+name)
+			if err != nil {
+				return nil, err
+			}
+			keys.tenants[hash] = tenant
+		}
+	}
+
+	for name, value := range push.SectionValues(c, "TenantQuotas") {
+		tenant, ok := tenants[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("[TenantQuotas] %s: there is no tenant %q in [Tenants]", name, name)
+		}
+		quota, err := push.ParseFrequencyCap(value)
+		if err != nil {
+			return nil, fmt.Errorf("[TenantQuotas] %s: %v", name, err)
+		}
+		tenant.Quota = quota
+	}
+	return keys, nil
 }
 
 // LoadRestAddr returns the address to listen to HTTP requests on, or returns an error.
@@ -211,12 +512,13 @@ func LoadRestAddr(c *conf.ConfigFile) (string, error) {
 }
 
 // Run will load the configuration and start the uniqush-push server and REST API based on that config.
-func Run(conf, version string) error {
-	c, err := OpenConfig(conf)
+// The configuration can be reloaded without restarting with SIGHUP or /reload (See RestAPI.reload).
+func Run(sources ConfigSources, version string) error {
+	c, err := LoadConfig(sources)
 	if err != nil {
 		return err
 	}
-	loggers, err := LoadLoggers(c)
+	loggers, logfile, err := loadLoggers(c)
 	if err != nil {
 		return err
 	}
@@ -228,16 +530,28 @@ func Run(conf, version string) error {
 	if err != nil {
 		return err
 	}
+	settings, err := loadReloadableSettings(c)
+	if err != nil {
+		return err
+	}
 	psm := push.GetPushServiceManager()
-	psm.SetConfigFile(c)
+	if err := psm.SetConfigFile(c); err != nil {
+		return err
+	}
 
 	db, err := db.NewPushDatabaseWithoutCache(dbconf)
 	if err != nil {
 		return err
 	}
 
+	// The loggers are shared by the backend and the REST API, and replaced when the configuration is reloaded.
+	loggers = newReloadableLoggers(loggers)
 	backend := NewPushBackEnd(psm, db, loggers)
 	rest := NewRestAPI(psm, loggers, version, backend)
+	rest.SetConfigSources(sources, c, logfile)
+	if err := rest.applySettings(settings); err != nil {
+		return err
+	}
 	stopChan := make(chan bool)
 	go rest.signalSetup()
 	go rest.Run(addr, stopChan)
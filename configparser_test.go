@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/uniqush/goconf/conf"
 	"github.com/uniqush/log"
 	"github.com/uniqush/uniqush-push/db"
 	"github.com/uniqush/uniqush-push/push"
@@ -45,6 +47,76 @@ func TestOpenConfig(t *testing.T) {
 		PushServiceManager: push.GetPushServiceManager(),
 	}
 	test_util.ExpectEquals(t, *expectedDbConf, *dbConf, "expected config settings to be parsed")
+
+	shutdownTimeout, err := LoadShutdownTimeout(c)
+	if err != nil {
+		t.Fatalf("Failed to load shutdown timeout: %v", err)
+	}
+	test_util.ExpectEquals(t, defaultShutdownTimeout, shutdownTimeout, "expected the default shutdown timeout")
+
+	apiKeys, err := LoadAPIKeys(c)
+	if err != nil {
+		t.Fatalf("Failed to load API keys: %v", err)
+	}
+	test_util.ExpectEquals(t, true, apiKeys.isEmpty(), "expected the example API keys to be commented out")
+
+	frequencyCaps, err := LoadFrequencyCaps(c)
+	if err != nil {
+		t.Fatalf("Failed to load frequency caps: %v", err)
+	}
+	test_util.ExpectEquals(t, 0, len(frequencyCaps), "expected the example frequency caps to be commented out")
+
+	maxAges, sweepInterval, err := LoadDeliveryPointExpiry(c)
+	if err != nil {
+		t.Fatalf("Failed to load delivery point expiry: %v", err)
+	}
+	test_util.ExpectEquals(t, 0, len(maxAges), "expected the example maximum ages to be commented out")
+	test_util.ExpectEquals(t, defaultDeliveryPointSweepInterval, sweepInterval, "expected the default sweep interval")
+
+	certificateExpiryWarning, certificateCheckInterval, err := LoadCertificateExpiry(c)
+	if err != nil {
+		t.Fatalf("Failed to load certificate expiry: %v", err)
+	}
+	test_util.ExpectEquals(t, 30*24*time.Hour, certificateExpiryWarning, "expected the example warning_days")
+	test_util.ExpectEquals(t, defaultCertificateCheckInterval, certificateCheckInterval, "expected the default check interval")
+
+	auditMaxEntries, err := LoadAuditMaxEntries(c)
+	if err != nil {
+		t.Fatalf("Failed to load the audit log settings: %v", err)
+	}
+	test_util.ExpectEquals(t, int64(defaultAuditMaxEntries), auditMaxEntries, "expected the default maximum number of audit log entries")
+
+	trustedProxies, err := LoadAuditTrustedProxies(c)
+	if err != nil {
+		t.Fatalf("Failed to load the trusted proxies: %v", err)
+	}
+	test_util.ExpectEquals(t, 0, len(trustedProxies), "expected the example trusted proxies to be commented out")
+
+	secretsKey, oldSecretsKeys, err := LoadSecretKeys(c)
+	if err != nil {
+		t.Fatalf("Failed to load secrets keys: %v", err)
+	}
+	test_util.ExpectEquals(t, 0, len(secretsKey)+len(oldSecretsKeys), "expected the example secrets keys to be commented out")
+}
+
+// Options in the [default] section are inherited by every section, and aren't service names.
+func TestLoadConfigWithDefaultSection(t *testing.T) {
+	c := conf.NewConfigFile()
+	c.AddOption("default", "logfile", "/var/log/uniqush")
+	c.AddOption("FrequencyCaps", "myservice", "10/1h")
+	c.AddOption("DeliveryPointExpiry", "myservice", "2160h")
+
+	frequencyCaps, err := LoadFrequencyCaps(c)
+	if err != nil {
+		t.Fatalf("Failed to load frequency caps: %v", err)
+	}
+	test_util.ExpectEquals(t, map[string]push.FrequencyCap{"myservice": {Limit: 10, Period: time.Hour}}, frequencyCaps, "expected only the frequency caps of [FrequencyCaps]")
+
+	maxAges, _, err := LoadDeliveryPointExpiry(c)
+	if err != nil {
+		t.Fatalf("Failed to load delivery point expiry: %v", err)
+	}
+	test_util.ExpectEquals(t, map[string]time.Duration{"myservice": 2160 * time.Hour}, maxAges, "expected only the maximum ages of [DeliveryPointExpiry]")
 }
 
 func TestExtractLogLevel(t *testing.T) {
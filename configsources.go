@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/uniqush-push/push"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigSources are the sources the configuration of uniqush-push is merged from. Later sources take precedence over earlier ones:
+//
+//  1. The default value of each option.
+//  2. File, the INI-style uniqush.conf. It's skipped if File is empty.
+//  3. YAMLFile, a YAML file with a mapping of options for each section of uniqush.conf (e.g. WebFrontend, Database or apns). It's skipped if YAMLFile is empty.
+//  4. Environment variables named UNIQUSH_<SECTION>_<OPTION>, e.g. UNIQUSH_DATABASE_HOST or UNIQUSH_APNS_POOL_SIZE. Sections are case insensitive,
+//     and variables which don't name a section are ignored.
+type ConfigSources struct {
+	File     string
+	YAMLFile string
+	// Environ is the environment, in the format returned by os.Environ. If it's nil, the environment of uniqush-push is used.
+	Environ []string
+}
+
+// configEnvPrefix is the prefix of environment variables setting options of uniqush.conf.
+const configEnvPrefix = "UNIQUSH_"
+
+// configSections are the sections of uniqush.conf which can be set by environment variables, other than the sections of push service types (See installPushServices)
+// and sections already in the configuration.
+var configSections = []string{
+	"default",
+	"WebFrontend",
+	"AddPushServiceProvider",
+	"RemovePushServiceProvider",
+	"PSPs",
+	"Subscribe",
+	"Unsubscribe",
+	"Push",
+	"Subscriptions",
+	"Services",
+	"Preview",
+	"Preferences",
+	"FrequencyCaps",
+	"DeliveryPointExpiry",
+	"CertificateExpiry",
+	"Audit",
+	"Tenants",
+	"TenantQuotas",
+	"Database",
+}
+
+// redactedConfigOptions are the options whose values are replaced by PrintConfig, as are the values of every option in redactedConfigSections (in lowercase).
+var redactedConfigOptions = map[string]bool{"password": true, "admin_api_keys": true}
+var redactedConfigSections = map[string]bool{"tenants": true}
+
+// configOrigins are the sources (a filename or an environment variable) which set each option, by section and option.
+// Like the names of sections and options in conf.ConfigFile, these are case insensitive.
+type configOrigins map[string]map[string]string
+
+func (origins configOrigins) set(section string, option string, origin string) {
+	section = strings.ToLower(section)
+	if origins[section] == nil {
+		origins[section] = make(map[string]string)
+	}
+	origins[section][strings.ToLower(option)] = origin
+}
+
+func (origins configOrigins) get(section string, option string) string {
+	return origins[strings.ToLower(section)][strings.ToLower(option)]
+}
+
+// LoadConfig returns the configuration merged from sources, or an error if any of them can't be read.
+func LoadConfig(sources ConfigSources) (*conf.ConfigFile, error) {
+	c, _, err := loadConfig(sources)
+	return c, err
+}
+
+func loadConfig(sources ConfigSources) (*conf.ConfigFile, configOrigins, error) {
+	c := conf.NewConfigFile()
+	origins := make(configOrigins)
+	if sources.File != "" {
+		var err error
+		c, err = OpenConfig(sources.File)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, section := range c.GetSections() {
+			for option := range push.SectionValues(c, section) {
+				origins.set(section, option, sources.File)
+			}
+		}
+	}
+	if sources.YAMLFile != "" {
+		if err := mergeYAMLConfig(c, origins, sources.YAMLFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	environ := sources.Environ
+	if environ == nil {
+		environ = os.Environ()
+	}
+	mergeEnvConfig(c, origins, environ)
+	return c, origins, nil
+}
+
+// mergeYAMLConfig sets the options in the YAML file filename, which is a mapping of sections to mappings of options, e.g. "Database: {host: redis}".
+func mergeYAMLConfig(c *conf.ConfigFile, origins configOrigins, filename string) error {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var sections map[string]map[string]interface{}
+	if err := yaml.Unmarshal(contents, &sections); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	for section, options := range sections {
+		c.AddSection(section)
+		for option, value := range options {
+			s, err := yamlConfigValue(value)
+			if err != nil {
+				return fmt.Errorf("%s: %s.%s: %v", filename, section, option, err)
+			}
+			c.AddOption(section, option, s)
+			origins.set(section, option, filename)
+		}
+	}
+	return nil
+}
+
+// yamlConfigValue converts a value from a YAML file to the value of an option in uniqush.conf. Lists (e.g. of secrets_old_key_files) are comma separated.
+func yamlConfigValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case int, int64, uint64, float64, bool:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			if _, isList := item.([]interface{}); isList {
+				return "", fmt.Errorf("expected a list of strings, numbers or booleans, got a nested list")
+			}
+			s, err := yamlConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("expected a string, number, boolean or list, got %T", value)
+	}
+}
+
+// mergeEnvConfig sets the options in environment variables named UNIQUSH_<SECTION>_<OPTION>.
+// UNIQUSH_SECRETS_KEY and UNIQUSH_SECRETS_OLD_KEYS are skipped, they're read by LoadSecretKeys.
+// Other variables which don't start with the name of a section are skipped too, such as the UNIQUSH_SERVICE_HOST set by Kubernetes for a service named uniqush.
+func mergeEnvConfig(c *conf.ConfigFile, origins configOrigins, environ []string) {
+	var sections []string
+	sections = append(sections, configSections...)
+	sections = append(sections, push.GetPushServiceManager().PushServiceTypeNames()...)
+	sections = append(sections, c.GetSections()...)
+	for _, variable := range environ {
+		parts := strings.SplitN(variable, "=", 2)
+		name := parts[0]
+		if !strings.HasPrefix(name, configEnvPrefix) || name == secretsKeyEnv || name == secretsOldKeysEnv {
+			continue
+		}
+		value := ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		key := strings.SplitN(strings.TrimPrefix(name, configEnvPrefix), "_", 2)
+		if len(key) != 2 || key[1] == "" {
+			continue
+		}
+		section := ""
+		for _, s := range sections {
+			if strings.EqualFold(s, key[0]) {
+				section = s
+				break
+			}
+		}
+		if section == "" {
+			continue
+		}
+		option := strings.ToLower(key[1])
+		c.AddOption(section, option, value)
+		origins.set(section, option, name)
+	}
+}
+
+// PrintConfig writes the configuration merged from sources in the format of uniqush.conf, for --print-config.
+// Options which weren't set by sources.File are preceded by a comment with their source. Passwords and API keys are redacted.
+func PrintConfig(w io.Writer, sources ConfigSources) error {
+	c, origins, err := loadConfig(sources)
+	if err != nil {
+		return err
+	}
+	var names []string
+	if sources.File != "" {
+		names = append(names, sources.File)
+	}
+	if sources.YAMLFile != "" {
+		names = append(names, sources.YAMLFile)
+	}
+	names = append(names, configEnvPrefix+"<SECTION>_<OPTION> environment variables")
+	fmt.Fprintf(w, "# The configuration of uniqush-push, merged from (in increasing order of precedence): %s\n", strings.Join(names, ", "))
+
+	sections := c.GetSections()
+	sort.Slice(sections, func(i, j int) bool {
+		// The default section comes first, as it does in uniqush.conf.
+		if sections[i] == "default" || sections[j] == "default" {
+			return sections[i] == "default" && sections[j] != "default"
+		}
+		return sections[i] < sections[j]
+	})
+	for _, section := range sections {
+		values := push.SectionValues(c, section)
+		if len(values) == 0 {
+			continue
+		}
+		options := make([]string, 0, len(values))
+		for option := range values {
+			options = append(options, option)
+		}
+		sort.Strings(options)
+		fmt.Fprintf(w, "\n[%s]\n", section)
+		for _, option := range options {
+			if origin := origins.get(section, option); origin != sources.File {
+				fmt.Fprintf(w, "# From %s\n", origin)
+			}
+			value := values[option]
+			if (redactedConfigOptions[option] || redactedConfigSections[strings.ToLower(section)]) && value != "" {
+				value = redactedSecret
+			}
+			fmt.Fprintf(w, "%s=%s\n", option, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/test_util"
+)
+
+func writeTestYAMLConfig(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "uniqush-config")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	filename := filepath.Join(dir, "uniqush.yaml")
+	if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Unexpected error writing %s: %v", filename, err)
+	}
+	return filename, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	yamlFile, cleanup := writeTestYAMLConfig(t, `
+WebFrontend:
+  addr: 0.0.0.0:9898
+Database:
+  host: redis-yaml
+  port: 6379
+  secrets_old_key_files:
+    - /etc/uniqush/a.key
+    - /etc/uniqush/b.key
+apns:
+  pool_size: 5
+`)
+	defer cleanup()
+	sources := ConfigSources{
+		File:     "conf/uniqush-push.conf",
+		YAMLFile: yamlFile,
+		Environ: []string{
+			"UNIQUSH_DATABASE_HOST=redis-env",
+			"UNIQUSH_APNS_POOL_SIZE=20",
+			"UNIQUSH_SERVICE_HOST=10.0.0.1",
+			"UNIQUSH_PORT=tcp://10.0.0.1:9898",
+			"HOME=/root",
+		},
+	}
+	c, err := LoadConfig(sources)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	addr, err := LoadRestAddr(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test_util.ExpectStringEquals(t, "0.0.0.0:9898", addr, "expected addr from the YAML file")
+	dbConf, err := LoadDatabaseConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test_util.ExpectStringEquals(t, "redis-env", dbConf.Host, "expected host from the environment")
+	test_util.ExpectEquals(t, 6379, dbConf.Port, "expected port from the YAML file")
+	test_util.ExpectEquals(t, 1024, dbConf.CacheSize, "expected cachesize from uniqush.conf")
+
+	getString := func(section, option string) string {
+		s, err := c.GetString(section, option)
+		if err != nil {
+			t.Errorf("Failed to get section %q option %q: %v", section, option, err)
+		}
+		return s
+	}
+	test_util.ExpectStringEquals(t, "20", getString("apns", "pool_size"), "expected pool_size from the environment")
+	test_util.ExpectStringEquals(t, "/etc/uniqush/a.key,/etc/uniqush/b.key", getString("Database", "secrets_old_key_files"), "expected YAML lists to be comma separated")
+	test_util.ExpectStringEquals(t, "standard", getString("Push", "loglevel"), "expected loglevel from uniqush.conf")
+	if c.HasSection("service") || c.HasSection("port") {
+		t.Errorf("Expected environment variables which don't name a section to be ignored, got sections %v", c.GetSections())
+	}
+}
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	c, err := LoadConfig(ConfigSources{YAMLFile: "conf/uniqush-push.yaml", Environ: []string{"UNIQUSH_WEBFRONTEND_ADDR=localhost:8080"}})
+	if err != nil {
+		t.Fatalf("Unexpected error loading example YAML config: %v", err)
+	}
+	addr, err := LoadRestAddr(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test_util.ExpectStringEquals(t, "localhost:8080", addr, "expected addr from the environment")
+	dbConf, err := LoadDatabaseConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test_util.ExpectStringEquals(t, "redis", dbConf.Host, "expected host from the example YAML config")
+}
+
+func TestLoadConfigInvalidYAML(t *testing.T) {
+	for _, contents := range []string{"Database: [redis]\n", "Database:\n  host:\n    name: redis\n", "Database:\n  secrets_old_key_files: [[a]]\n"} {
+		yamlFile, cleanup := writeTestYAMLConfig(t, contents)
+		if _, err := LoadConfig(ConfigSources{YAMLFile: yamlFile, Environ: []string{}}); err == nil {
+			t.Errorf("Expected an error loading %q", contents)
+		}
+		cleanup()
+	}
+	if _, err := LoadConfig(ConfigSources{YAMLFile: "conf/missing.yaml", Environ: []string{}}); err == nil {
+		t.Errorf("Expected an error loading a missing YAML file")
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	yamlFile, cleanup := writeTestYAMLConfig(t, "Database:\n  password: hunter2\n")
+	defer cleanup()
+	var buf bytes.Buffer
+	err := PrintConfig(&buf, ConfigSources{File: "conf/uniqush-push.conf", YAMLFile: yamlFile, Environ: []string{"UNIQUSH_DATABASE_HOST=redis", "UNIQUSH_TENANTS_TEAMA=tenantkey"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	output := buf.String()
+	if strings.Contains(output, "hunter2") || strings.Contains(output, "tenantkey") {
+		t.Errorf("Expected the password and API keys to be redacted, got %s", output)
+	}
+	for _, expected := range []string{
+		"# From " + yamlFile + "\npassword=" + redactedSecret + "\n",
+		"# From UNIQUSH_DATABASE_HOST\nhost=redis\n",
+		"\n[apns]\npool_size=13\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected the printed config to contain %q, got %s", expected, output)
+		}
+	}
+	// The printed config can be read back.
+	dir, err := ioutil.TempDir("", "uniqush-config")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "uniqush.conf")
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c, err := OpenConfig(filename)
+	if err != nil {
+		t.Fatalf("Unexpected error reading the printed config: %v", err)
+	}
+	dbConf, err := LoadDatabaseConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test_util.ExpectStringEquals(t, "redis", dbConf.Host, "expected host in the printed config")
+}
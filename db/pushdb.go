@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/uniqush/log"
 	"github.com/uniqush/uniqush-push/push"
@@ -68,6 +69,12 @@ type PushDatabase interface {
 	// RebuildServiceSet() ensures that a set of all PSPs exists. After FixServiceSet is called on a pre-existing uniqush setup, the set of all PSPs will be accurate (Even after calls to AddPushServiceProvider/RemovePushServiceProvider)
 	RebuildServiceSet() error
 
+	// Ping checks the connections to the database, returning the result of each by name (e.g. redis_master and redis_slave).
+	Ping() map[string]error
+
+	// ReencryptPushServiceProviders saves every PSP again, encrypting secret fields with the current secrets key. It returns the number of PSPs saved.
+	ReencryptPushServiceProviders() (int, error)
+
 	// The delivery point may be anonymous whose Name is empty string
 	// For anonymous delivery point, it will be added to database and its Name will be set
 	// Return value: selected push service provider, error
@@ -84,13 +91,120 @@ type PushDatabase interface {
 
 	ModifyDeliveryPoint(dp *push.DeliveryPoint) error
 
+	// AddDeliveryPointsToService is a batch version of AddDeliveryPointToService. It returns the selected push service provider or error for each subscription.
+	AddDeliveryPointsToService(subscriptions []Subscription) ([]*push.PushServiceProvider, []error)
+
+	// RemoveDeliveryPointsFromService is a batch version of RemoveDeliveryPointFromService. It returns an error (or nil) for each subscription.
+	RemoveDeliveryPointsFromService(subscriptions []Subscription) []error
+
+	// RemoveAllDeliveryPointsFromServiceSubscriber removes every delivery point of a subscriber of a service.
+	// It returns the subscriptions which were found, and an error (or nil) for each.
+	RemoveAllDeliveryPointsFromServiceSubscriber(service string, subscriber string) ([]SubscriptionRef, []error, error)
+
+	// RemoveDeliveryPointsOfDevice removes the subscriptions of a device token (See push.DeliveryPoint.DeviceToken) from every service and subscriber.
+	// If servicePrefix is non-empty, only the subscriptions of services starting with it (e.g. the services of a tenant) are removed.
+	// It returns the subscriptions which were found, and an error (or nil) for each.
+	RemoveDeliveryPointsOfDevice(field string, token string, servicePrefix string) ([]SubscriptionRef, []error, error)
+
+	// GetServiceNames returns the names of all services with push service providers.
+	GetServiceNames() ([]string, error)
+
+	// GetSubscribersOfService returns the subscribers of a service which have delivery points.
+	GetSubscribersOfService(service string) ([]string, error)
+
+	// SetDeliveryPointsLastActive records the time each delivery point (by name) was last successfully pushed to.
+	// AddDeliveryPointToService and AddDeliveryPointsToService record this for the subscribed delivery points.
+	SetDeliveryPointsLastActive(times map[string]time.Time) error
+
+	// GetDeliveryPointsLastActive returns the time each delivery point was last subscribed or successfully pushed to, or the zero time if none was recorded.
+	GetDeliveryPointsLastActive(dpNames []string) ([]time.Time, error)
+
 	GetPushServiceProviderDeliveryPointPairs(service string, subscriber string, dpNamesRequested []string) ([]PushServiceProviderDeliveryPointPair, error)
 
 	GetSubscriptions(services []string, user string, logger log.Logger) ([]map[string]string, error)
 
+	// GetSubscriberPreferences returns the preferences of a subscriber of a service, or nil if none were set.
+	GetSubscriberPreferences(service string, subscriber string) (*push.SubscriberPreferences, error)
+
+	// SetSubscriberPreferences replaces the preferences of a subscriber of a service. Empty preferences are removed.
+	SetSubscriberPreferences(service string, subscriber string, prefs *push.SubscriberPreferences) error
+
+	// AdmitPush checks whether a push to a subscriber of a service repeats a recent dedupKey (if non-empty) or exceeds frequencyCap.
+	// If neither, the push is recorded for later checks.
+	AdmitPush(service string, subscriber string, dedupKey string, dedupTTL time.Duration, frequencyCap push.FrequencyCap) (PushAdmission, error)
+
+	// AdmitTenantPushes checks whether count more pushes by a tenant exceed its quota, the maximum number of pushes per period.
+	// If not, they're counted for later checks. Periods are fixed windows rather than sliding windows.
+	AdmitTenantPushes(tenant string, count int, quota push.FrequencyCap) (bool, error)
+
+	// ReserveIdempotencyKey marks the idempotency key of a /push request to a service as in progress, for at most pendingTTL.
+	// Idempotency keys are scoped by service, so different services may use the same keys.
+	// If the key was already used, it returns false and the response stored with SetIdempotentResponse (or nil if that request is still in progress).
+	ReserveIdempotencyKey(service string, key string, pendingTTL time.Duration) (bool, []byte, error)
+
+	// SetIdempotentResponse stores the response of the /push request which reserved key for service, to be returned to repeated requests for ttl.
+	SetIdempotentResponse(service string, key string, response []byte, ttl time.Duration) error
+
+	// AddAuditEntry appends an entry to the audit log, setting its ID. Only about the newest maxEntries entries are kept, or every entry if maxEntries is 0.
+	AddAuditEntry(entry *AuditEntry, maxEntries int64) error
+
+	// GetAuditEntries returns up to count entries of the audit log, newest first.
+	// If before is the ID of an entry, only entries added before it are returned.
+	GetAuditEntries(before string, count int64) ([]*AuditEntry, error)
+
 	FlushCache() error
 }
 
+// Subscription is a delivery point of a subscriber of a service, for batch operations such as AddDeliveryPointsToService.
+type Subscription struct {
+	Service       string
+	Subscriber    string
+	DeliveryPoint *push.DeliveryPoint
+}
+
+// SubscriptionRef identifies a delivery point of a subscriber of a service by name, for operations which don't need the delivery point's data.
+type SubscriptionRef struct {
+	Service           string
+	Subscriber        string
+	DeliveryPointName string
+}
+
+// PushAdmission is the result of checking a push to a subscriber with AdmitPush.
+type PushAdmission int
+
+// PushAdmitted and the other PushAdmission constants describe whether a push may be sent.
+const (
+	PushAdmitted PushAdmission = iota
+	// PushDuplicate means a push with the same dedup key was sent to the subscriber within the dedup TTL.
+	PushDuplicate
+	// PushFrequencyCapped means the subscriber was already sent the maximum number of pushes allowed within the frequency cap's period.
+	PushFrequencyCapped
+)
+
+// AuditEntry records a call to an administrative endpoint of the REST API, such as /addpsp or /stop.
+type AuditEntry struct {
+	// ID is assigned when the entry is added to the audit log. Entries are ordered by ID.
+	ID   string    `json:"id,omitempty"`
+	Time time.Time `json:"time"`
+	// Action is the path of the endpoint, e.g. "/addpsp".
+	Action string `json:"action"`
+	// Identity is the API key which authenticated the request, e.g. "tenant:team-a" or "admin:1a2b3c4d" (the start of the SHA-256 hash of the key).
+	Identity string `json:"identity,omitempty"`
+	// Actor is the user who made the request, if a trusted authenticating proxy reported one.
+	Actor      string `json:"actor,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	Service    string `json:"service,omitempty"`
+	// PushServiceProvider is the name of the PSP which was added or removed.
+	PushServiceProvider string `json:"psp,omitempty"`
+	// Before and After are the PSP before and after the change (with secrets redacted), or nil if it didn't exist.
+	Before   map[string]string `json:"before,omitempty"`
+	After    map[string]string `json:"after,omitempty"`
+	Code     string            `json:"code"`
+	ErrorMsg string            `json:"errorMsg,omitempty"`
+}
+
 type pushDatabaseOpts struct {
 	db pushRawDatabase
 	/* TODO Fine grained locks */
@@ -247,12 +361,136 @@ func (f *pushDatabaseOpts) AddDeliveryPointToService(service string,
 			if err != nil {
 				return nil, fmt.Errorf("Failed to set psp of delivery point: %v", err)
 			}
+			if field, token := deliveryPoint.DeviceToken(); token != "" {
+				err = f.db.AddDeliveryPointToDevice(field, token, service, subscriber, deliveryPoint.Name())
+				if err != nil {
+					return nil, fmt.Errorf("Failed to add delivery point to device: %v", err)
+				}
+			}
+			// Re-subscribing keeps a delivery point from expiring, even if it has no subscribe_date.
+			err = f.db.SetDeliveryPointsLastActive(map[string]time.Time{deliveryPoint.Name(): time.Now()})
+			if err != nil {
+				return nil, fmt.Errorf("Failed to set last activity of delivery point: %v", err)
+			}
 			return psp, nil
 		}
 	}
 	return nil, fmt.Errorf("Cannot Find Push Service Provider with Type %s", deliveryPoint.PushServiceName())
 }
 
+func (f *pushDatabaseOpts) AddDeliveryPointsToService(subscriptions []Subscription) ([]*push.PushServiceProvider, []error) {
+	psps := make([]*push.PushServiceProvider, len(subscriptions))
+	errs := make([]error, len(subscriptions))
+	f.dblock.Lock()
+	defer f.dblock.Unlock()
+
+	// Find the PSP of each subscription, fetching the PSPs of each service once.
+	pspsOfService := make(map[string][]*push.PushServiceProvider)
+	var valid []Subscription
+	var validIndices []int
+	var pspNames []string
+	for i, sub := range subscriptions {
+		if sub.DeliveryPoint == nil || len(sub.DeliveryPoint.Name()) == 0 {
+			errs[i] = errors.New("InvalidDeliveryPoint")
+			continue
+		}
+		servicePSPs, ok := pspsOfService[sub.Service]
+		if !ok {
+			var err error
+			servicePSPs, err = f.getPushServiceProvidersOfService(sub.Service)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			pspsOfService[sub.Service] = servicePSPs
+		}
+		for _, psp := range servicePSPs {
+			if psp.PushServiceName() == sub.DeliveryPoint.PushServiceName() {
+				psps[i] = psp
+				break
+			}
+		}
+		if psps[i] == nil {
+			errs[i] = fmt.Errorf("Cannot Find Push Service Provider with Type %s", sub.DeliveryPoint.PushServiceName())
+			continue
+		}
+		valid = append(valid, sub)
+		validIndices = append(validIndices, i)
+		pspNames = append(pspNames, psps[i].Name())
+	}
+	if len(valid) == 0 {
+		return psps, errs
+	}
+
+	now := time.Now()
+	lastActive := make(map[string]time.Time)
+	for j, err := range f.db.AddDeliveryPointsToServiceSubscribers(valid, pspNames) {
+		i := validIndices[j]
+		if err != nil {
+			psps[i] = nil
+			errs[i] = err
+			continue
+		}
+		lastActive[valid[j].DeliveryPoint.Name()] = now
+	}
+	if err := f.db.SetDeliveryPointsLastActive(lastActive); err != nil {
+		for i, psp := range psps {
+			if psp != nil {
+				psps[i] = nil
+				errs[i] = fmt.Errorf("Failed to set last activity of delivery point: %v", err)
+			}
+		}
+	}
+	return psps, errs
+}
+
+// getPushServiceProvidersOfService returns the PSPs of a service. The caller must hold dblock.
+func (f *pushDatabaseOpts) getPushServiceProvidersOfService(service string) ([]*push.PushServiceProvider, error) {
+	pspnames, err := f.db.GetPushServiceProvidersByService(service)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list services for %s: %v", service, err)
+	}
+	if pspnames == nil {
+		return nil, fmt.Errorf("Cannot Find Service %s", service)
+	}
+	psps := make([]*push.PushServiceProvider, 0, len(pspnames))
+	for _, pspname := range pspnames {
+		psp, err := f.db.GetPushServiceProvider(pspname)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get information for psp %s: %v", pspname, err)
+		}
+		if psp != nil {
+			psps = append(psps, psp)
+		}
+	}
+	return psps, nil
+}
+
+func (f *pushDatabaseOpts) RemoveDeliveryPointsFromService(subscriptions []Subscription) []error {
+	errs := make([]error, len(subscriptions))
+	var valid []Subscription
+	var validIndices []int
+	for i, sub := range subscriptions {
+		if sub.DeliveryPoint == nil || sub.DeliveryPoint.Name() == "" {
+			errs[i] = errors.New("InvalidDeliveryPoint")
+			continue
+		}
+		valid = append(valid, sub)
+		validIndices = append(validIndices, i)
+	}
+	if len(valid) == 0 {
+		return errs
+	}
+	f.dblock.Lock()
+	defer f.dblock.Unlock()
+	for j, err := range f.db.RemoveDeliveryPointsFromServiceSubscribers(valid) {
+		if err != nil {
+			errs[validIndices[j]] = fmt.Errorf("Failed to remove delivery point: %v", err)
+		}
+	}
+	return errs
+}
+
 func (f *pushDatabaseOpts) RemoveDeliveryPointFromService(service string,
 	subscriber string,
 	deliveryPoint *push.DeliveryPoint) error {
@@ -269,9 +507,79 @@ func (f *pushDatabaseOpts) RemoveDeliveryPointFromService(service string,
 	if err != nil {
 		return fmt.Errorf("Failed to remove psp info for delivery point: %v", err)
 	}
+	if field, token := deliveryPoint.DeviceToken(); token != "" {
+		err = f.db.RemoveDeliveryPointFromDevice(field, token, service, subscriber, deliveryPoint.Name())
+		if err != nil {
+			return fmt.Errorf("Failed to remove delivery point from device: %v", err)
+		}
+	}
 	return nil
 }
 
+// removeSubscriptionRef removes a delivery point from a service+subscriber, and from the subscriptions of its device token (if field is non-empty). The caller must hold dblock.
+func (f *pushDatabaseOpts) removeSubscriptionRef(ref SubscriptionRef, field, token string) error {
+	err := f.db.RemoveDeliveryPointFromServiceSubscriber(ref.Service, ref.Subscriber, ref.DeliveryPointName)
+	if err != nil {
+		return fmt.Errorf("Failed to remove delivery point: %v", err)
+	}
+	err = f.db.RemovePushServiceProviderOfServiceDeliveryPoint(ref.Service, ref.DeliveryPointName)
+	if err != nil {
+		return fmt.Errorf("Failed to remove psp info for delivery point: %v", err)
+	}
+	if field != "" {
+		err = f.db.RemoveDeliveryPointFromDevice(field, token, ref.Service, ref.Subscriber, ref.DeliveryPointName)
+		if err != nil {
+			return fmt.Errorf("Failed to remove delivery point from device: %v", err)
+		}
+	}
+	return nil
+}
+
+func (f *pushDatabaseOpts) RemoveAllDeliveryPointsFromServiceSubscriber(service string, subscriber string) ([]SubscriptionRef, []error, error) {
+	f.dblock.Lock()
+	defer f.dblock.Unlock()
+	dpNamesOfService, err := f.db.GetDeliveryPointsNameByServiceSubscriber(service, subscriber)
+	if err != nil {
+		return nil, nil, err
+	}
+	dpNames := dpNamesOfService[service]
+	refs := make([]SubscriptionRef, len(dpNames))
+	errs := make([]error, len(dpNames))
+	for i, dpName := range dpNames {
+		refs[i] = SubscriptionRef{Service: service, Subscriber: subscriber, DeliveryPointName: dpName}
+		// The delivery point's data is needed to find its device token. It is deleted along with the last subscription, so fetch it first.
+		var field, token string
+		if dp, err := f.db.GetDeliveryPoint(dpName); err == nil && dp != nil {
+			field, token = dp.DeviceToken()
+		}
+		errs[i] = f.removeSubscriptionRef(refs[i], field, token)
+	}
+	return refs, errs, nil
+}
+
+func (f *pushDatabaseOpts) RemoveDeliveryPointsOfDevice(field string, token string, servicePrefix string) ([]SubscriptionRef, []error, error) {
+	if field == "" || token == "" {
+		return nil, nil, errors.New("NoDeviceToken")
+	}
+	f.dblock.Lock()
+	defer f.dblock.Unlock()
+	allRefs, err := f.db.GetSubscriptionsOfDevice(field, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	var refs []SubscriptionRef
+	for _, ref := range allRefs {
+		if strings.HasPrefix(ref.Service, servicePrefix) {
+			refs = append(refs, ref)
+		}
+	}
+	errs := make([]error, len(refs))
+	for i, ref := range refs {
+		errs[i] = f.removeSubscriptionRef(ref, field, token)
+	}
+	return refs, errs, nil
+}
+
 // Fetch all of the delivery points of subscriber for a given service. If dpNames is not empty, limit the results to fetch to that subset.
 func (f *pushDatabaseOpts) GetPushServiceProviderDeliveryPointPairs(service string,
 	subscriber string, dpNamesRequested []string) ([]PushServiceProviderDeliveryPointPair, error) {
@@ -368,6 +676,24 @@ func (f *pushDatabaseOpts) GetServiceNames() ([]string, error) {
 	return serviceNames, nil
 }
 
+func (f *pushDatabaseOpts) GetSubscribersOfService(service string) ([]string, error) {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	return f.db.GetSubscribersOfService(service)
+}
+
+func (f *pushDatabaseOpts) SetDeliveryPointsLastActive(times map[string]time.Time) error {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	return f.db.SetDeliveryPointsLastActive(times)
+}
+
+func (f *pushDatabaseOpts) GetDeliveryPointsLastActive(dpNames []string) ([]time.Time, error) {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	return f.db.GetDeliveryPointsLastActive(dpNames)
+}
+
 func (f *pushDatabaseOpts) GetPushServiceProviderConfigs() ([]*push.PushServiceProvider, error) {
 	serviceNames, err := f.GetServiceNames()
 	if err != nil {
@@ -418,12 +744,78 @@ func (f *pushDatabaseOpts) GetSubscriptions(services []string, user string, logg
 	return subs, nil
 }
 
+func (f *pushDatabaseOpts) GetSubscriberPreferences(service string, subscriber string) (*push.SubscriberPreferences, error) {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	return f.db.GetSubscriberPreferences(service, subscriber)
+}
+
+func (f *pushDatabaseOpts) SetSubscriberPreferences(service string, subscriber string, prefs *push.SubscriberPreferences) error {
+	f.dblock.Lock()
+	defer f.dblock.Unlock()
+	return addErrorSource("SetSubscriberPreferences", f.db.SetSubscriberPreferences(service, subscriber, prefs))
+}
+
+func (f *pushDatabaseOpts) AdmitPush(service string, subscriber string, dedupKey string, dedupTTL time.Duration, frequencyCap push.FrequencyCap) (PushAdmission, error) {
+	// The check and update are a single atomic operation in the database, so this doesn't need the write lock.
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	admission, err := f.db.AdmitPush(service, subscriber, dedupKey, dedupTTL, frequencyCap)
+	return admission, addErrorSource("AdmitPush", err)
+}
+
+func (f *pushDatabaseOpts) AdmitTenantPushes(tenant string, count int, quota push.FrequencyCap) (bool, error) {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	admitted, err := f.db.AdmitTenantPushes(tenant, count, quota)
+	return admitted, addErrorSource("AdmitTenantPushes", err)
+}
+
+func (f *pushDatabaseOpts) ReserveIdempotencyKey(service string, key string, pendingTTL time.Duration) (bool, []byte, error) {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	reserved, response, err := f.db.ReserveIdempotencyKey(service, key, pendingTTL)
+	return reserved, response, addErrorSource("ReserveIdempotencyKey", err)
+}
+
+func (f *pushDatabaseOpts) SetIdempotentResponse(service string, key string, response []byte, ttl time.Duration) error {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	return addErrorSource("SetIdempotentResponse", f.db.SetIdempotentResponse(service, key, response, ttl))
+}
+
+// AddAuditEntry doesn't need the write lock, because the audit log is independent of the other data.
+func (f *pushDatabaseOpts) AddAuditEntry(entry *AuditEntry, maxEntries int64) error {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	return addErrorSource("AddAuditEntry", f.db.AddAuditEntry(entry, maxEntries))
+}
+
+func (f *pushDatabaseOpts) GetAuditEntries(before string, count int64) ([]*AuditEntry, error) {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	entries, err := f.db.GetAuditEntries(before, count)
+	return entries, addErrorSource("GetAuditEntries", err)
+}
+
 func (f *pushDatabaseOpts) RebuildServiceSet() error {
 	f.dblock.Lock()
 	defer f.dblock.Unlock()
 	return f.db.RebuildServiceSet()
 }
 
+// Ping doesn't lock the database, so that health checks aren't delayed by long operations such as RebuildServiceSet.
+func (f *pushDatabaseOpts) Ping() map[string]error {
+	return f.db.Ping()
+}
+
+func (f *pushDatabaseOpts) ReencryptPushServiceProviders() (int, error) {
+	f.dblock.Lock()
+	defer f.dblock.Unlock()
+	n, err := f.db.ReencryptPushServiceProviders()
+	return n, addErrorSource("ReencryptPushServiceProviders", err)
+}
+
 func addErrorSource(fnName string, err error) error {
 	if err == nil {
 		return nil
@@ -19,6 +19,7 @@ package db
 
 import (
 	"testing"
+	"time"
 
 	"github.com/uniqush/uniqush-push/push"
 	apns_mocks "github.com/uniqush/uniqush-push/srv/apns/http_api/mocks"
@@ -224,3 +225,179 @@ func TestInsertPushServiceProvidersConflictSameService(t *testing.T) {
 		test_util.ExpectEquals(t, []string{pspName}, storedServicesNames, "should be able to fetch the originally added service (not the new service) from the db")
 	}
 }
+
+func TestSetAndGetSubscriberPreferences(t *testing.T) {
+	client := connectDatabaseAndClearRedisData(t)
+
+	prefs, err := client.GetSubscriberPreferences(ServiceName, "subscriber1")
+	if err != nil {
+		t.Fatalf("Failed to get missing preferences: %v", err)
+	}
+	if prefs != nil {
+		t.Errorf("Expected no preferences, got %#v", prefs)
+	}
+
+	expected := &push.SubscriberPreferences{MutedCategories: []string{"marketing"}, TimeZone: "America/Toronto", QuietHours: []string{"22:00-07:00"}}
+	if err := client.SetSubscriberPreferences(ServiceName, "subscriber1", expected); err != nil {
+		t.Fatalf("Failed to set preferences: %v", err)
+	}
+	prefs, err = client.GetSubscriberPreferences(ServiceName, "subscriber1")
+	if err != nil {
+		t.Fatalf("Failed to get preferences: %v", err)
+	}
+	test_util.ExpectEquals(t, expected, prefs, "should be able to fetch the stored preferences")
+
+	if err := client.SetSubscriberPreferences(ServiceName, "subscriber1", &push.SubscriberPreferences{}); err != nil {
+		t.Fatalf("Failed to clear preferences: %v", err)
+	}
+	prefs, err = client.GetSubscriberPreferences(ServiceName, "subscriber1")
+	if err != nil || prefs != nil {
+		t.Errorf("Expected cleared preferences to be removed, got %#v, %v", prefs, err)
+	}
+}
+
+func TestAdmitPush(t *testing.T) {
+	client := connectDatabaseAndClearRedisData(t)
+
+	expectAdmission := func(expected PushAdmission, subscriber string, dedupKey string, frequencyCap push.FrequencyCap, msg string) {
+		admission, err := client.AdmitPush(ServiceName, subscriber, dedupKey, time.Hour, frequencyCap)
+		if err != nil {
+			t.Fatalf("Failed to admit push: %v", err)
+		}
+		test_util.ExpectEquals(t, expected, admission, msg)
+	}
+	expectAdmission(PushAdmitted, "subscriber1", "key1", push.FrequencyCap{}, "first push with a dedup key")
+	expectAdmission(PushDuplicate, "subscriber1", "key1", push.FrequencyCap{}, "repeated dedup key")
+	expectAdmission(PushAdmitted, "subscriber2", "key1", push.FrequencyCap{}, "dedup key of another subscriber")
+
+	frequencyCap := push.FrequencyCap{Limit: 2, Period: time.Hour}
+	expectAdmission(PushAdmitted, "subscriber3", "", frequencyCap, "first push within the frequency cap")
+	expectAdmission(PushAdmitted, "subscriber3", "", frequencyCap, "second push within the frequency cap")
+	expectAdmission(PushFrequencyCapped, "subscriber3", "key2", frequencyCap, "push exceeding the frequency cap")
+	// The rejected push wasn't recorded, so its dedup key can be used once the cap allows it.
+	expectAdmission(PushAdmitted, "subscriber3", "key2", push.FrequencyCap{}, "dedup key of a rejected push")
+}
+
+func TestAdmitTenantPushes(t *testing.T) {
+	client := connectDatabaseAndClearRedisData(t)
+
+	expectAdmitted := func(expected bool, tenant string, count int, quota push.FrequencyCap, msg string) {
+		admitted, err := client.AdmitTenantPushes(tenant, count, quota)
+		if err != nil {
+			t.Fatalf("Failed to admit tenant pushes: %v", err)
+		}
+		test_util.ExpectEquals(t, expected, admitted, msg)
+	}
+	quota := push.FrequencyCap{Limit: 10, Period: time.Hour}
+	expectAdmitted(true, "tenant1", 6, quota, "pushes within the quota")
+	expectAdmitted(false, "tenant1", 5, quota, "pushes exceeding the quota")
+	expectAdmitted(true, "tenant1", 4, quota, "pushes reaching the quota")
+	expectAdmitted(false, "tenant1", 1, quota, "push after reaching the quota")
+	expectAdmitted(true, "tenant2", 10, quota, "pushes of another tenant")
+	expectAdmitted(true, "tenant1", 100, push.FrequencyCap{}, "pushes without a quota")
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	client := connectDatabaseAndClearRedisData(t)
+
+	reserved, response, err := client.ReserveIdempotencyKey("service1", "key1", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to reserve the idempotency key: %v", err)
+	}
+	test_util.ExpectEquals(t, true, reserved, "first reservation")
+
+	reserved, response, err = client.ReserveIdempotencyKey("service1", "key1", time.Minute)
+	if err != nil || reserved || response != nil {
+		t.Errorf("Expected the key to be in progress, got (%v, %q, %v)", reserved, response, err)
+	}
+
+	if err := client.SetIdempotentResponse("service1", "key1", []byte(`{"type":"Push"}`), time.Hour); err != nil {
+		t.Fatalf("Failed to set the response: %v", err)
+	}
+	reserved, response, err = client.ReserveIdempotencyKey("service1", "key1", time.Minute)
+	if err != nil || reserved {
+		t.Errorf("Expected the key to be used, got (%v, %v)", reserved, err)
+	}
+	test_util.ExpectStringEquals(t, `{"type":"Push"}`, string(response), "stored response")
+
+	reserved, _, err = client.ReserveIdempotencyKey("service2", "key1", time.Minute)
+	if err != nil || !reserved {
+		t.Errorf("Expected the key to be unused by another service, got (%v, %v)", reserved, err)
+	}
+}
+
+func TestAuditEntries(t *testing.T) {
+	client := connectDatabaseAndClearRedisData(t)
+
+	for _, action := range []string{"/addpsp", "/rmpsp", "/stop"} {
+		entry := &AuditEntry{Time: time.Unix(1500000000, 0).UTC(), Action: action, RemoteAddr: "127.0.0.1:1234", Code: "UNIQUSH_SUCCESS"}
+		if err := client.AddAuditEntry(entry, 0); err != nil {
+			t.Fatalf("Failed to add the audit entry: %v", err)
+		}
+		if entry.ID == "" {
+			t.Errorf("Expected the ID of the audit entry to be set")
+		}
+	}
+
+	actions := func(entries []*AuditEntry) []string {
+		result := []string{}
+		for _, entry := range entries {
+			result = append(result, entry.Action)
+		}
+		return result
+	}
+	entries, err := client.GetAuditEntries("", 2)
+	if err != nil {
+		t.Fatalf("Failed to get the audit entries: %v", err)
+	}
+	test_util.ExpectEquals(t, []string{"/stop", "/rmpsp"}, actions(entries), "newest audit entries")
+	test_util.ExpectStringEquals(t, "127.0.0.1:1234", entries[0].RemoteAddr, "remote address of the entry")
+
+	entries, err = client.GetAuditEntries(entries[1].ID, 2)
+	if err != nil {
+		t.Fatalf("Failed to get the audit entries: %v", err)
+	}
+	test_util.ExpectEquals(t, []string{"/addpsp"}, actions(entries), "audit entries before the second newest")
+}
+
+func TestSubscribeSetsLastActive(t *testing.T) {
+	client := connectDatabaseAndClearRedisData(t)
+	psm := initializePushServiceManagerForTest()
+	if err := psm.RegisterPushServiceType(&apns_mocks.MockPushServiceType{}); err != nil {
+		t.Fatalf("apns PST already exists: %v", err)
+	}
+	psp, err := psm.BuildPushServiceProviderFromMap(defaultMockPSPData())
+	if err != nil {
+		t.Fatalf("Could not create a mock PSP: %v", err)
+	}
+	if err := client.AddPushServiceProviderToService(ServiceName, psp); err != nil {
+		t.Fatalf("Could not add the mock PSP: %v", err)
+	}
+	newDeliveryPoint := func(subscriber string) *push.DeliveryPoint {
+		dp, err := psm.BuildDeliveryPointFromMap(map[string]string{"pushservicetype": "apns", "service": ServiceName, "subscriber": subscriber, "devtoken": "0123456789abcdef"})
+		if err != nil {
+			t.Fatalf("Could not create a mock delivery point: %v", err)
+		}
+		return dp
+	}
+
+	before := time.Now().Add(-time.Second)
+	dp := newDeliveryPoint("subscriber1")
+	if _, err := client.AddDeliveryPointToService(ServiceName, "subscriber1", dp); err != nil {
+		t.Fatalf("Could not subscribe: %v", err)
+	}
+	batchDP := newDeliveryPoint("subscriber2")
+	if _, errs := client.AddDeliveryPointsToService([]Subscription{{Service: ServiceName, Subscriber: "subscriber2", DeliveryPoint: batchDP}}); errs[0] != nil {
+		t.Fatalf("Could not subscribe in a batch: %v", errs[0])
+	}
+
+	times, err := client.GetDeliveryPointsLastActive([]string{dp.Name(), batchDP.Name()})
+	if err != nil {
+		t.Fatalf("Could not get the last activity: %v", err)
+	}
+	for i, lastActive := range times {
+		if lastActive.Before(before) {
+			t.Errorf("Expected delivery point %d to be active after %v, got %v", i, before, lastActive)
+		}
+	}
+}
@@ -18,8 +18,11 @@
 package db
 
 import (
+	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 	"time"
@@ -39,17 +42,24 @@ type PushRedisDB struct {
 type redisClient interface {
 	Decr(key string) *redis.IntCmd
 	Del(keys ...string) *redis.IntCmd
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
 	Exists(keys ...string) *redis.IntCmd
 	FlushDb() *redis.StatusCmd // for tests only
 	Get(key string) *redis.StringCmd
 	Incr(key string) *redis.IntCmd
 	Keys(key string) *redis.StringSliceCmd
 	MGet(keys ...string) *redis.SliceCmd
+	Pipeline() redis.Pipeliner
+	Ping() *redis.StatusCmd
 	Save() *redis.StatusCmd
+	Scan(cursor uint64, match string, count int64) *redis.ScanCmd
 	SAdd(key string, members ...interface{}) *redis.IntCmd
 	SRem(key string, members ...interface{}) *redis.IntCmd
 	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
 	SMembers(key string) *redis.StringSliceCmd
+	XAdd(a *redis.XAddArgs) *redis.StringCmd
+	XRevRangeN(stream, start, stop string, count int64) *redis.XMessageSliceCmd
 }
 
 type redisMultiClient struct {
@@ -65,6 +75,10 @@ func (mc *redisMultiClient) Del(keys ...string) *redis.IntCmd {
 	return mc.masterClient.Del(keys...)
 }
 
+func (mc *redisMultiClient) Eval(script string, keys []string, args ...interface{}) *redis.Cmd {
+	return mc.masterClient.Eval(script, keys, args...)
+}
+
 func (mc *redisMultiClient) Exists(keys ...string) *redis.IntCmd {
 	return mc.slaveClient.Exists(keys...)
 }
@@ -89,10 +103,22 @@ func (mc *redisMultiClient) MGet(keys ...string) *redis.SliceCmd {
 	return mc.slaveClient.MGet(keys...)
 }
 
+func (mc *redisMultiClient) Pipeline() redis.Pipeliner {
+	return mc.masterClient.Pipeline()
+}
+
 func (mc *redisMultiClient) Save() *redis.StatusCmd {
 	return mc.masterClient.Save()
 }
 
+func (mc *redisMultiClient) Ping() *redis.StatusCmd {
+	return mc.masterClient.Ping()
+}
+
+func (mc *redisMultiClient) Scan(cursor uint64, match string, count int64) *redis.ScanCmd {
+	return mc.slaveClient.Scan(cursor, match, count)
+}
+
 func (mc *redisMultiClient) SAdd(key string, members ...interface{}) *redis.IntCmd {
 	return mc.masterClient.SAdd(key, members...)
 }
@@ -105,6 +131,18 @@ func (mc *redisMultiClient) Set(key string, value interface{}, expiration time.D
 	return mc.masterClient.Set(key, value, expiration)
 }
 
+func (mc *redisMultiClient) XAdd(a *redis.XAddArgs) *redis.StringCmd {
+	return mc.masterClient.XAdd(a)
+}
+
+func (mc *redisMultiClient) XRevRangeN(stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	return mc.slaveClient.XRevRangeN(stream, start, stop, count)
+}
+
+func (mc *redisMultiClient) SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	return mc.masterClient.SetNX(key, value, expiration)
+}
+
 func (mc *redisMultiClient) SMembers(key string) *redis.StringSliceCmd {
 	return mc.slaveClient.SMembers(key)
 }
@@ -125,6 +163,22 @@ const (
 	ServiceToPushServiceProvidersPrefix string = "srv-2-psp:"
 	// DeliveryPointCounterPrefix is the prefix of keys for a redis STRING - Maps a delivery point name to the number of subcribers(summed across each service).
 	DeliveryPointCounterPrefix string = "delivery.point.counter:"
+	// DeviceToDeliveryPointsPrefix is the prefix of keys for a redis SET - Maps a device token field + token (e.g. "devtoken:<token>") to a set of "service:subscriber:delivery point name" for the device's subscriptions
+	DeviceToDeliveryPointsPrefix string = "delivery.point.device:"
+	// DeliveryPointLastActivePrefix is the prefix of keys for a redis STRING - Maps a delivery point name to the unix timestamp of when it was last subscribed or successfully pushed to (or first checked for expiry)
+	DeliveryPointLastActivePrefix string = "delivery.point.last-active:"
+	// ServiceSubscriberToPreferencesPrefix is the prefix of keys for a redis STRING - Maps a service name + subscriber to a json blob of the subscriber's preferences
+	ServiceSubscriberToPreferencesPrefix string = "srv.sub-2-prefs:"
+	// ServiceSubscriberDedupKeyPrefix is the prefix of keys for a redis STRING with a TTL - Marks a service name + subscriber + uniqush.dedup_key as recently pushed
+	ServiceSubscriberDedupKeyPrefix string = "srv.sub-dedup:"
+	// ServiceSubscriberToPushTimesPrefix is the prefix of keys for a redis ZSET - Maps a service name + subscriber to the times of recent pushes, for frequency caps
+	ServiceSubscriberToPushTimesPrefix string = "srv.sub-2-pushtimes:"
+	// TenantPushCountPrefix is the prefix of keys for a redis STRING with a TTL - Maps a tenant + the start of a period of its quota (in unix milliseconds) to the number of pushes in that period
+	TenantPushCountPrefix string = "tenant-2-pushcount:"
+	// IdempotencyKeyPrefix is the prefix of keys for a redis STRING with a TTL - Maps a service name + the idempotency key of a /push request to its JSON response, or "" while the push is in progress
+	IdempotencyKeyPrefix string = "push.idempotency-key:"
+	// AuditStream is the key for a redis STREAM - The audit log of calls to administrative endpoints, with a json blob of each entry in the "entry" field.
+	AuditStream string = "audit.log"
 	// ServicesSet is the key for a redis SET - This is a set of service names.
 	ServicesSet string = "services{0}"
 )
@@ -336,7 +390,12 @@ func (r *PushRedisDB) GetPushServiceProviderConfigs(names []string) ([]*push.Pus
 
 // SetPushServiceProvider will add or update the push service provider psp. The redis key is based on a hash of FixedData.
 func (r *PushRedisDB) SetPushServiceProvider(psp *push.PushServiceProvider) error {
-	if err := r.client.Set(PushServiceProviderPrefix+psp.Name(), pushServiceProviderToValue(psp), 0).Err(); err != nil {
+	value := pushServiceProviderToValue(psp)
+	if value == nil {
+		// Don't overwrite the PSP with an empty value if it couldn't be serialized (or its secrets couldn't be encrypted).
+		return fmt.Errorf("SetPushServiceProvider %q failed: could not serialize the PSP", psp.Name())
+	}
+	if err := r.client.Set(PushServiceProviderPrefix+psp.Name(), value, 0).Err(); err != nil {
 		return fmt.Errorf("SetPushServiceProvider %q failed: %v", psp.Name(), err)
 	}
 	return nil
@@ -396,6 +455,216 @@ func (r *PushRedisDB) GetDeliveryPointsNameByServiceSubscriber(srv, sub string)
 	return ret, nil
 }
 
+// GetSubscriberPreferences fetches the preferences of a service+subscriber, returning nil if none were set.
+func (r *PushRedisDB) GetSubscriberPreferences(srv, sub string) (*push.SubscriberPreferences, error) {
+	b, err := r.client.Get(ServiceSubscriberToPreferencesPrefix + srv + ":" + sub).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GetSubscriberPreferences failed: %v", err)
+	}
+	prefs, err := push.UnmarshalSubscriberPreferences(b)
+	if err != nil {
+		return nil, fmt.Errorf("GetSubscriberPreferences has invalid preferences for \"%s:%s\": %v", srv, sub, err)
+	}
+	return prefs, nil
+}
+
+// SetSubscriberPreferences saves the preferences of a service+subscriber. Empty preferences are removed.
+func (r *PushRedisDB) SetSubscriberPreferences(srv, sub string, prefs *push.SubscriberPreferences) error {
+	key := ServiceSubscriberToPreferencesPrefix + srv + ":" + sub
+	if prefs == nil || prefs.IsEmpty() {
+		if err := r.client.Del(key).Err(); err != nil {
+			return fmt.Errorf("SetSubscriberPreferences failed to remove preferences: %v", err)
+		}
+		return nil
+	}
+	if err := r.client.Set(key, prefs.Marshal(), 0).Err(); err != nil {
+		return fmt.Errorf("SetSubscriberPreferences failed: %v", err)
+	}
+	return nil
+}
+
+// admitPushScript atomically checks and records a push to a subscriber.
+// KEYS[1] is the deduplication key, and KEYS[2] is the sorted set of the subscriber's recent push times.
+// ARGV is the deduplication TTL in seconds (0 to skip deduplication), the frequency cap's limit (0 for no cap), its period in milliseconds,
+// the current time in milliseconds, and a unique member for the sorted set.
+// Rejected pushes aren't recorded, so that they can be sent again later.
+const admitPushScript = `
+local dedupTTL = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local period = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+if dedupTTL > 0 and redis.call('EXISTS', KEYS[1]) == 1 then
+	return 1
+end
+if limit > 0 then
+	redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now - period)
+	if redis.call('ZCARD', KEYS[2]) >= limit then
+		return 2
+	end
+	redis.call('ZADD', KEYS[2], now, ARGV[5])
+	redis.call('PEXPIRE', KEYS[2], period)
+end
+if dedupTTL > 0 then
+	redis.call('SET', KEYS[1], '1', 'EX', dedupTTL)
+end
+return 0
+`
+
+// AdmitPush checks whether a push to a service+subscriber is a duplicate or exceeds the frequency cap, and records it if it is neither.
+func (r *PushRedisDB) AdmitPush(srv, sub, dedupKey string, dedupTTL time.Duration, frequencyCap push.FrequencyCap) (PushAdmission, error) {
+	dedupSeconds := int64(0)
+	if dedupKey != "" {
+		dedupSeconds = int64(dedupTTL / time.Second)
+		if dedupSeconds < 1 {
+			dedupSeconds = 1
+		}
+	}
+	limit, periodMillis := 0, int64(0)
+	if frequencyCap.IsEnabled() {
+		limit = frequencyCap.Limit
+		periodMillis = int64(frequencyCap.Period / time.Millisecond)
+	}
+	if dedupSeconds == 0 && limit == 0 {
+		return PushAdmitted, nil
+	}
+	var nonce [8]byte
+	io.ReadFull(rand.Reader, nonce[:])
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	member := fmt.Sprintf("%d-%x", now, nonce)
+	keys := []string{
+		ServiceSubscriberDedupKeyPrefix + srv + ":" + sub + ":" + dedupKey,
+		ServiceSubscriberToPushTimesPrefix + srv + ":" + sub,
+	}
+	result, err := r.client.Eval(admitPushScript, keys, dedupSeconds, limit, periodMillis, now, member).Result()
+	if err != nil {
+		return PushAdmitted, fmt.Errorf("AdmitPush failed: %v", err)
+	}
+	code, ok := result.(int64)
+	if !ok {
+		return PushAdmitted, fmt.Errorf("AdmitPush got an unexpected result %v", result)
+	}
+	return PushAdmission(code), nil
+}
+
+// admitTenantPushesScript atomically counts pushes by a tenant in the current period of its quota, unless they would exceed it.
+// KEYS[1] is the counter of the current period. ARGV is the number of pushes, the quota's limit, and its period in milliseconds.
+const admitTenantPushesScript = `
+local count = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+if current + count > limit then
+	return 0
+end
+redis.call('INCRBY', KEYS[1], count)
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`
+
+// AdmitTenantPushes checks whether count pushes by a tenant would exceed its quota in the current period, and counts them if not.
+func (r *PushRedisDB) AdmitTenantPushes(tenant string, count int, quota push.FrequencyCap) (bool, error) {
+	if !quota.IsEnabled() {
+		return true, nil
+	}
+	periodMillis := int64(quota.Period / time.Millisecond)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	key := TenantPushCountPrefix + tenant + ":" + strconv.FormatInt(now-now%periodMillis, 10)
+	result, err := r.client.Eval(admitTenantPushesScript, []string{key}, count, quota.Limit, periodMillis).Result()
+	if err != nil {
+		return false, fmt.Errorf("AdmitTenantPushes failed: %v", err)
+	}
+	admitted, ok := result.(int64)
+	if !ok {
+		return false, fmt.Errorf("AdmitTenantPushes got an unexpected result %v", result)
+	}
+	return admitted == 1, nil
+}
+
+// ReserveIdempotencyKey marks an idempotency key of a service as used by a push in progress, for at most pendingTTL.
+// If the key was already used, it returns false and the stored response (nil if that push is still in progress).
+func (r *PushRedisDB) ReserveIdempotencyKey(srv string, key string, pendingTTL time.Duration) (bool, []byte, error) {
+	redisKey := IdempotencyKeyPrefix + srv + ":" + key
+	reserved, err := r.client.SetNX(redisKey, "", pendingTTL).Result()
+	if err != nil {
+		return false, nil, fmt.Errorf("ReserveIdempotencyKey failed: %v", err)
+	}
+	if reserved {
+		return true, nil, nil
+	}
+	response, err := r.client.Get(redisKey).Bytes()
+	if err == redis.Nil || len(response) == 0 {
+		// The push is in progress, or the reservation just expired.
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, fmt.Errorf("ReserveIdempotencyKey failed to get the response: %v", err)
+	}
+	return false, response, nil
+}
+
+// SetIdempotentResponse stores the response of the push which reserved an idempotency key of a service, for ttl.
+func (r *PushRedisDB) SetIdempotentResponse(srv string, key string, response []byte, ttl time.Duration) error {
+	if err := r.client.Set(IdempotencyKeyPrefix+srv+":"+key, response, ttl).Err(); err != nil {
+		return fmt.Errorf("SetIdempotentResponse failed: %v", err)
+	}
+	return nil
+}
+
+// AddAuditEntry appends an entry to the audit log stream, setting its ID. Streams require redis 5.0 or newer.
+func (r *PushRedisDB) AddAuditEntry(entry *AuditEntry, maxEntries int64) error {
+	entry.ID = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("AddAuditEntry failed to serialize the entry: %v", err)
+	}
+	id, err := r.client.XAdd(&redis.XAddArgs{
+		Stream:       AuditStream,
+		MaxLenApprox: maxEntries,
+		ID:           "*",
+		Values:       map[string]interface{}{"entry": data},
+	}).Result()
+	if err != nil {
+		return fmt.Errorf("AddAuditEntry failed: %v", err)
+	}
+	entry.ID = id
+	return nil
+}
+
+// GetAuditEntries returns up to count entries of the audit log, newest first, starting after the entry with the ID before (if non-empty).
+func (r *PushRedisDB) GetAuditEntries(before string, count int64) ([]*AuditEntry, error) {
+	start, limit := "+", count
+	if before != "" {
+		// XREVRANGE includes the entry with the ID before, which is skipped below.
+		start, limit = before, count+1
+	}
+	messages, err := r.client.XRevRangeN(AuditStream, start, "-", limit).Result()
+	if err != nil {
+		return nil, fmt.Errorf("GetAuditEntries failed: %v", err)
+	}
+	entries := make([]*AuditEntry, 0, len(messages))
+	for _, message := range messages {
+		if message.ID == before {
+			continue
+		}
+		data, ok := message.Values["entry"].(string)
+		if !ok {
+			return nil, fmt.Errorf("GetAuditEntries: entry %s has no data", message.ID)
+		}
+		entry := new(AuditEntry)
+		if err := json.Unmarshal([]byte(data), entry); err != nil {
+			return nil, fmt.Errorf("GetAuditEntries: entry %s is invalid: %v", message.ID, err)
+		}
+		entry.ID = message.ID
+		entries = append(entries, entry)
+	}
+	if int64(len(entries)) > count {
+		entries = entries[:count]
+	}
+	return entries, nil
+}
+
 func (r *PushRedisDB) GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error) {
 	b, err := r.client.Get(ServiceDeliveryPointToPushServiceProviderPrefix + srv + ":" + dp).Result()
 	if err != nil {
@@ -436,7 +705,7 @@ func (r *PushRedisDB) RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp stri
 		if e0 != nil {
 			return fmt.Errorf("Failed to remove counter for %q: %v", dp, e0)
 		}
-		e1 := r.client.Del(DeliveryPointPrefix + dp).Err()
+		e1 := r.client.Del(DeliveryPointPrefix+dp, DeliveryPointLastActivePrefix+dp).Err()
 		if e1 != nil {
 			return fmt.Errorf("Failed to remove delivery point info for %q: %v", dp, e1)
 		}
@@ -444,6 +713,260 @@ func (r *PushRedisDB) RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp stri
 	return nil
 }
 
+// SetDeliveryPointsLastActive records the time each delivery point was last subscribed or successfully pushed to, which is used to expire stale delivery points.
+func (r *PushRedisDB) SetDeliveryPointsLastActive(times map[string]time.Time) error {
+	if len(times) == 0 {
+		return nil
+	}
+	pipe := r.client.Pipeline()
+	defer pipe.Close()
+	for dp, t := range times {
+		pipe.Set(DeliveryPointLastActivePrefix+dp, t.Unix(), 0)
+	}
+	_, err := pipe.Exec()
+	if err != nil {
+		return fmt.Errorf("SetDPsLastActive failed: %v", err)
+	}
+	return nil
+}
+
+// GetDeliveryPointsLastActive returns the time each delivery point was last subscribed or successfully pushed to, or the zero time if none was recorded.
+func (r *PushRedisDB) GetDeliveryPointsLastActive(dps []string) ([]time.Time, error) {
+	times := make([]time.Time, len(dps))
+	if len(dps) == 0 {
+		return times, nil
+	}
+	keys := make([]string, len(dps))
+	for i, dp := range dps {
+		keys[i] = DeliveryPointLastActivePrefix + dp
+	}
+	values, err := r.mgetStrings(keys...)
+	if err != nil {
+		return nil, fmt.Errorf("GetDPsLastActive failed: %v", err)
+	}
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		seconds, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("GetDPsLastActive: invalid timestamp %q for %q", value, dps[i])
+		}
+		times[i] = time.Unix(seconds, 0)
+	}
+	return times, nil
+}
+
+// escapeGlob escapes the characters of s which are special in redis patterns (e.g. in service names).
+func escapeGlob(s string) string {
+	var escaped []byte
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, s[i])
+	}
+	return string(escaped)
+}
+
+// GetSubscribersOfService returns the subscribers of a service which have delivery points.
+// This iterates over keys with SCAN instead of KEYS, so that redis isn't blocked while it is used by background jobs.
+func (r *PushRedisDB) GetSubscribersOfService(srv string) ([]string, error) {
+	prefix := ServiceSubscriberToDeliveryPointsPrefix + srv + ":"
+	var subscribers []string
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(cursor, escapeGlob(prefix)+"*", 1000).Result()
+		if err != nil {
+			return nil, fmt.Errorf("GetSubscribersOfService failed for %q: %v", srv, err)
+		}
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				subscribers = append(subscribers, key[len(prefix):])
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	return subscribers, nil
+}
+
+func deviceKey(field, token string) string {
+	return DeviceToDeliveryPointsPrefix + field + ":" + token
+}
+
+func deviceSubscriptionMember(srv, sub, dp string) string {
+	// Service names and subscribers can't contain ':' (See validServicePattern), but delivery point names do.
+	return srv + ":" + sub + ":" + dp
+}
+
+// AddDeliveryPointToDevice adds a subscription to the set of subscriptions of a device token (e.g. an APNs devtoken or a GCM regid).
+func (r *PushRedisDB) AddDeliveryPointToDevice(field, token, srv, sub, dp string) error {
+	err := r.client.SAdd(deviceKey(field, token), deviceSubscriptionMember(srv, sub, dp)).Err()
+	if err != nil {
+		return fmt.Errorf("AddDPToDevice failed for %s %q: %v", field, token, err)
+	}
+	return nil
+}
+
+// RemoveDeliveryPointFromDevice removes a subscription from the set of subscriptions of a device token.
+func (r *PushRedisDB) RemoveDeliveryPointFromDevice(field, token, srv, sub, dp string) error {
+	err := r.client.SRem(deviceKey(field, token), deviceSubscriptionMember(srv, sub, dp)).Err()
+	if err != nil {
+		return fmt.Errorf("RemoveDPFromDevice failed for %s %q: %v", field, token, err)
+	}
+	return nil
+}
+
+// GetSubscriptionsOfDevice returns the subscriptions of a device token which were added since the index of device tokens was introduced.
+func (r *PushRedisDB) GetSubscriptionsOfDevice(field, token string) ([]SubscriptionRef, error) {
+	members, err := r.client.SMembers(deviceKey(field, token)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("GetSubscriptionsOfDevice failed for %s %q: %v", field, token, err)
+	}
+	refs := make([]SubscriptionRef, 0, len(members))
+	for _, member := range members {
+		parts := strings.SplitN(member, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		refs = append(refs, SubscriptionRef{Service: parts[0], Subscriber: parts[1], DeliveryPointName: parts[2]})
+	}
+	return refs, nil
+}
+
+// AddDeliveryPointsToServiceSubscribers saves the delivery points of subscriptions, adds them to their service+subscriber, and sets their PSP (from pspNames).
+// This is a batch version of SetDeliveryPoint, AddDeliveryPointToServiceSubscriber and SetPushServiceProviderOfServiceDeliveryPoint, using redis pipelines.
+// It returns the error (or nil) for each subscription.
+func (r *PushRedisDB) AddDeliveryPointsToServiceSubscribers(subscriptions []Subscription, pspNames []string) []error {
+	errs := make([]error, len(subscriptions))
+	pipe := r.client.Pipeline()
+	defer pipe.Close()
+	setCmds := make([]*redis.StatusCmd, len(subscriptions))
+	addCmds := make([]*redis.IntCmd, len(subscriptions))
+	setPSPCmds := make([]*redis.StatusCmd, len(subscriptions))
+	addDeviceCmds := make([]*redis.IntCmd, len(subscriptions))
+	for i, sub := range subscriptions {
+		dpName := sub.DeliveryPoint.Name()
+		setCmds[i] = pipe.Set(DeliveryPointPrefix+dpName, deliveryPointToValue(sub.DeliveryPoint), 0)
+		addCmds[i] = pipe.SAdd(ServiceSubscriberToDeliveryPointsPrefix+sub.Service+":"+sub.Subscriber, dpName)
+		setPSPCmds[i] = pipe.Set(ServiceDeliveryPointToPushServiceProviderPrefix+sub.Service+":"+dpName, pspNames[i], 0)
+		if field, token := sub.DeliveryPoint.DeviceToken(); token != "" {
+			addDeviceCmds[i] = pipe.SAdd(deviceKey(field, token), deviceSubscriptionMember(sub.Service, sub.Subscriber, dpName))
+		}
+	}
+	// Errors are checked for each command.
+	pipe.Exec()
+
+	var counted []int
+	for i := range subscriptions {
+		if err := setCmds[i].Err(); err != nil {
+			errs[i] = fmt.Errorf("Failed to save new info for delivery point: %v", err)
+		} else if err := addCmds[i].Err(); err != nil {
+			errs[i] = fmt.Errorf("AddDPToServiceSubscriber failed: %v", err)
+		} else if err := setPSPCmds[i].Err(); err != nil {
+			errs[i] = fmt.Errorf("SetPSPOfServiceDP failed: %v", err)
+		} else if addDeviceCmds[i] != nil && addDeviceCmds[i].Err() != nil {
+			errs[i] = fmt.Errorf("AddDPToDevice failed: %v", addDeviceCmds[i].Err())
+		}
+		if addCmds[i].Err() == nil && addCmds[i].Val() > 0 {
+			counted = append(counted, i)
+		}
+	}
+	if len(counted) == 0 {
+		return errs
+	}
+
+	incrCmds := make([]*redis.IntCmd, len(counted))
+	for j, i := range counted {
+		incrCmds[j] = pipe.Incr(DeliveryPointCounterPrefix + subscriptions[i].DeliveryPoint.Name())
+	}
+	pipe.Exec()
+	for j, i := range counted {
+		if err := incrCmds[j].Err(); err != nil && errs[i] == nil {
+			errs[i] = fmt.Errorf("AddDPToServiceSubscriber count tracking failed: %v", err)
+		}
+	}
+	return errs
+}
+
+// RemoveDeliveryPointsFromServiceSubscribers is a batch version of RemoveDeliveryPointFromServiceSubscriber and RemovePushServiceProviderOfServiceDeliveryPoint, using redis pipelines.
+// It returns the error (or nil) for each subscription.
+func (r *PushRedisDB) RemoveDeliveryPointsFromServiceSubscribers(subscriptions []Subscription) []error {
+	errs := make([]error, len(subscriptions))
+	pipe := r.client.Pipeline()
+	defer pipe.Close()
+	remCmds := make([]*redis.IntCmd, len(subscriptions))
+	delPSPCmds := make([]*redis.IntCmd, len(subscriptions))
+	remDeviceCmds := make([]*redis.IntCmd, len(subscriptions))
+	for i, sub := range subscriptions {
+		dpName := sub.DeliveryPoint.Name()
+		remCmds[i] = pipe.SRem(ServiceSubscriberToDeliveryPointsPrefix+sub.Service+":"+sub.Subscriber, dpName)
+		delPSPCmds[i] = pipe.Del(ServiceDeliveryPointToPushServiceProviderPrefix + sub.Service + ":" + dpName)
+		if field, token := sub.DeliveryPoint.DeviceToken(); token != "" {
+			remDeviceCmds[i] = pipe.SRem(deviceKey(field, token), deviceSubscriptionMember(sub.Service, sub.Subscriber, dpName))
+		}
+	}
+	pipe.Exec()
+
+	var removed []int
+	for i, sub := range subscriptions {
+		if err := remCmds[i].Err(); err != nil {
+			errs[i] = fmt.Errorf("Removing the delivery point pointer %q from \"%s:%s\" failed: %v", sub.DeliveryPoint.Name(), sub.Service, sub.Subscriber, err)
+			continue
+		}
+		if err := delPSPCmds[i].Err(); err != nil {
+			errs[i] = fmt.Errorf("RemovePSPOfServiceDP failed for \"%s:%s\": %v", sub.Service, sub.DeliveryPoint.Name(), err)
+		} else if remDeviceCmds[i] != nil && remDeviceCmds[i].Err() != nil {
+			errs[i] = fmt.Errorf("RemoveDPFromDevice failed: %v", remDeviceCmds[i].Err())
+		}
+		if remCmds[i].Val() > 0 {
+			removed = append(removed, i)
+		}
+	}
+	if len(removed) == 0 {
+		return errs
+	}
+
+	decrCmds := make([]*redis.IntCmd, len(removed))
+	for j, i := range removed {
+		decrCmds[j] = pipe.Decr(DeliveryPointCounterPrefix + subscriptions[i].DeliveryPoint.Name())
+	}
+	pipe.Exec()
+	var unused []int
+	for j, i := range removed {
+		if err := decrCmds[j].Err(); err != nil {
+			if errs[i] == nil {
+				errs[i] = fmt.Errorf("Failed to decrement number of subscribers using dp %q: %v", subscriptions[i].DeliveryPoint.Name(), err)
+			}
+			continue
+		}
+		if decrCmds[j].Val() <= 0 {
+			unused = append(unused, i)
+		}
+	}
+	if len(unused) == 0 {
+		return errs
+	}
+
+	// Remove the delivery points which no longer have subscribers.
+	delCmds := make([]*redis.IntCmd, len(unused))
+	for j, i := range unused {
+		dpName := subscriptions[i].DeliveryPoint.Name()
+		delCmds[j] = pipe.Del(DeliveryPointCounterPrefix+dpName, DeliveryPointPrefix+dpName, DeliveryPointLastActivePrefix+dpName)
+	}
+	pipe.Exec()
+	for j, i := range unused {
+		if err := delCmds[j].Err(); err != nil && errs[i] == nil {
+			errs[i] = fmt.Errorf("Failed to remove delivery point info for %q: %v", subscriptions[i].DeliveryPoint.Name(), err)
+		}
+	}
+	return errs
+}
+
 // removeMissingDeliveryPointFromServiceSubscriber removes any associations from a subscription list to a dp with missing subscriptions.
 func (r *PushRedisDB) removeMissingDeliveryPointFromServiceSubscriber(service, subscriber, dpName string, logger log.Logger) {
 	// Precondition: DeliveryPointPrefix + dp was already missing. No need to remove it.
@@ -451,7 +974,7 @@ func (r *PushRedisDB) removeMissingDeliveryPointFromServiceSubscriber(service, s
 	if e0 != nil {
 		logger.Errorf("Error cleaning up delivery point with missing data for dp %q service %q FROM user %q's delivery points: %v", dpName, subscriber, service, e0)
 	}
-	e1 := r.client.Del(DeliveryPointCounterPrefix + dpName).Err() // TODO: Err instead
+	e1 := r.client.Del(DeliveryPointCounterPrefix+dpName, DeliveryPointLastActivePrefix+dpName).Err()
 	if e1 != nil {
 		logger.Errorf("Error cleaning up count for delivery point with missing data for delivery point %q (while processing subscriber %q, service %q): %v", dpName, subscriber, service, e1)
 	}
@@ -529,24 +1052,15 @@ func (r *PushRedisDB) GetServiceNames() ([]string, error) {
 func (r *PushRedisDB) RebuildServiceSet() error {
 	// Run KEYS, then replace the PSP set with the result of KEYS.
 	// If any step fails, then return an error.
-	pspKeys, err := r.client.Keys(PushServiceProviderPrefix + "*").Result()
+	pspNames, err := r.getAllPushServiceProviderNames()
 	if err != nil {
-		return fmt.Errorf("Failed to fetch PSPs using redis KEYS command: %v", err)
+		return err
 	}
 
-	if len(pspKeys) == 0 {
+	if len(pspNames) == 0 {
 		return nil
 	}
 
-	pspNames := make([]string, len(pspKeys))
-	N := len(PushServiceProviderPrefix)
-	for i, key := range pspKeys {
-		if len(key) < N || key[:N] != PushServiceProviderPrefix {
-			return fmt.Errorf("KEYS %s* returned %q - this shouldn't happen", PushServiceProviderPrefix, key)
-		}
-		pspNames[i] = key[N:]
-	}
-
 	psps, errs := r.GetPushServiceProviderConfigs(pspNames)
 	if len(errs) > 0 {
 		return fmt.Errorf("RebuildServiceSet: found one or more invalid psps: %v", errs)
@@ -572,6 +1086,55 @@ func (r *PushRedisDB) RebuildServiceSet() error {
 	return nil
 }
 
+// getAllPushServiceProviderNames uses KEYS to find every PSP, including PSPs missing from the set of services of installations predating 2.2.0.
+func (r *PushRedisDB) getAllPushServiceProviderNames() ([]string, error) {
+	pspKeys, err := r.client.Keys(PushServiceProviderPrefix + "*").Result()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch PSPs using redis KEYS command: %v", err)
+	}
+
+	pspNames := make([]string, len(pspKeys))
+	N := len(PushServiceProviderPrefix)
+	for i, key := range pspKeys {
+		if len(key) < N || key[:N] != PushServiceProviderPrefix {
+			return nil, fmt.Errorf("KEYS %s* returned %q - this shouldn't happen", PushServiceProviderPrefix, key)
+		}
+		pspNames[i] = key[N:]
+	}
+	return pspNames, nil
+}
+
+// ReencryptPushServiceProviders reads every PSP and saves it again, so that its secret fields are encrypted with the current secrets key (See push.SetSecretKeys).
+// This is used after setting or rotating the key. It returns the number of PSPs saved.
+func (r *PushRedisDB) ReencryptPushServiceProviders() (int, error) {
+	pspNames, err := r.getAllPushServiceProviderNames()
+	if err != nil {
+		return 0, err
+	}
+	psps, errs := r.GetPushServiceProviderConfigs(pspNames)
+	if len(errs) > 0 {
+		// Don't save some PSPs and not others - an old key is probably missing from the configuration.
+		return 0, fmt.Errorf("ReencryptPushServiceProviders: found one or more invalid psps: %v", errs)
+	}
+	for i, psp := range psps {
+		if err := r.SetPushServiceProvider(psp); err != nil {
+			return i, err
+		}
+	}
+	return len(psps), nil
+}
+
+// Ping checks the connections to the redis master, and to the redis slave if one is configured, returning the result of each by name.
+func (r *PushRedisDB) Ping() map[string]error {
+	if mc, ok := r.client.(*redisMultiClient); ok {
+		return map[string]error{
+			"redis_master": mc.masterClient.Ping().Err(),
+			"redis_slave":  mc.slaveClient.Ping().Err(),
+		}
+	}
+	return map[string]error{"redis_master": r.client.Ping().Err()}
+}
+
 func (r *PushRedisDB) FlushCache() error {
 	return r.client.Save().Err()
 }
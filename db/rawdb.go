@@ -18,6 +18,8 @@
 package db
 
 import (
+	"time"
+
 	"github.com/uniqush/log"
 	"github.com/uniqush/uniqush-push/push"
 )
@@ -53,15 +55,43 @@ type pushRawDatabaseWriter interface {
 	RemoveDeliveryPoint(dp string) error
 	RemovePushServiceProvider(psp string) error
 	RebuildServiceSet() error
+	ReencryptPushServiceProviders() (int, error)
 
 	AddDeliveryPointToServiceSubscriber(srv, sub, dp string) error
 	RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp string) error
 	SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp string) error
 	RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp string) error
 
+	// AddDeliveryPointToDevice and RemoveDeliveryPointFromDevice maintain the index of the subscriptions of each device token.
+	AddDeliveryPointToDevice(field, token, srv, sub, dp string) error
+	RemoveDeliveryPointFromDevice(field, token, srv, sub, dp string) error
+
+	// SetDeliveryPointsLastActive records the time each delivery point was last subscribed or successfully pushed to.
+	SetDeliveryPointsLastActive(times map[string]time.Time) error
+
 	AddPushServiceProviderToService(srv, psp string) error
 	RemovePushServiceProviderFromService(srv, psp string) error
 
+	// AddDeliveryPointsToServiceSubscribers and RemoveDeliveryPointsFromServiceSubscribers change many subscriptions at once, returning an error (or nil) for each.
+	AddDeliveryPointsToServiceSubscribers(subscriptions []Subscription, pspNames []string) []error
+	RemoveDeliveryPointsFromServiceSubscribers(subscriptions []Subscription) []error
+
+	// SetSubscriberPreferences saves the preferences of a service+subscriber, removing them if they are empty.
+	SetSubscriberPreferences(srv, sub string, prefs *push.SubscriberPreferences) error
+
+	// AdmitPush atomically checks a push to a service+subscriber against its deduplication key and frequency cap, recording it if it is admitted.
+	AdmitPush(srv, sub, dedupKey string, dedupTTL time.Duration, frequencyCap push.FrequencyCap) (PushAdmission, error)
+
+	// AdmitTenantPushes atomically counts pushes by a tenant, unless they would exceed its quota in the current period.
+	AdmitTenantPushes(tenant string, count int, quota push.FrequencyCap) (bool, error)
+
+	// ReserveIdempotencyKey atomically reserves an idempotency key of a service, or returns the response stored for it (nil while in progress).
+	ReserveIdempotencyKey(srv string, key string, pendingTTL time.Duration) (bool, []byte, error)
+	SetIdempotentResponse(srv string, key string, response []byte, ttl time.Duration) error
+
+	// AddAuditEntry appends an entry to the audit log, setting its ID and trimming the log to about maxEntries (if non-zero).
+	AddAuditEntry(entry *AuditEntry, maxEntries int64) error
+
 	FlushCache() error
 }
 
@@ -75,8 +105,20 @@ type pushRawDatabaseReader interface {
 
 	GetDeliveryPointsNameByServiceSubscriber(srv, sub string) (map[string][]string, error)
 	GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error)
+	GetSubscriptionsOfDevice(field, token string) ([]SubscriptionRef, error)
+	GetDeliveryPointsLastActive(dps []string) ([]time.Time, error)
+	GetSubscribersOfService(srv string) ([]string, error)
 
 	GetPushServiceProvidersByService(srv string) ([]string, error)
+
+	// GetSubscriberPreferences returns the preferences of a service+subscriber, or nil if there are none.
+	GetSubscriberPreferences(srv, sub string) (*push.SubscriberPreferences, error)
+
+	// Ping checks the connections to the database, returning the result of each by name (e.g. redis_master).
+	Ping() map[string]error
+
+	// GetAuditEntries returns up to count entries of the audit log added before the entry with the ID before (or the newest, if before is empty), newest first.
+	GetAuditEntries(before string, count int64) ([]*AuditEntry, error)
 }
 
 type pushRawDatabase interface {
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+const (
+	healthStatusOK    = "ok"
+	healthStatusError = "error"
+
+	// providerReachabilityTimeout is how long /readyz?providers=1 waits for each push service to respond.
+	providerReachabilityTimeout = 5 * time.Second
+)
+
+// healthCheck is the result of one of the checks of /healthz or /readyz.
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthResponse is the response of /healthz and /readyz. The HTTP status is 503 if any check failed.
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+func newHealthCheck(err error) healthCheck {
+	if err != nil {
+		return healthCheck{Status: healthStatusError, Error: err.Error()}
+	}
+	return healthCheck{Status: healthStatusOK}
+}
+
+// newHealthResponse returns a response which is ok only if every check is ok.
+func newHealthResponse(checks map[string]healthCheck) healthResponse {
+	response := healthResponse{Status: healthStatusOK, Checks: checks}
+	for _, check := range checks {
+		if check.Status != healthStatusOK {
+			response.Status = healthStatusError
+		}
+	}
+	return response
+}
+
+// liveness is the response of /healthz. It only reports that the process is serving requests, so that it isn't restarted because of problems with redis or push services.
+func (api *RestAPI) liveness() healthResponse {
+	return healthResponse{Status: healthStatusOK}
+}
+
+// readiness is the response of /readyz. It checks the connections to redis and that every PSP can be loaded (e.g. that its push service type is installed),
+// and if checkProviders is true, that the servers of push services such as APNS and FCM can be reached.
+func (api *RestAPI) readiness(checkProviders bool, logger log.Logger) healthResponse {
+	checks := make(map[string]healthCheck)
+	for name, err := range api.backend.Ping() {
+		checks[name] = newHealthCheck(err)
+	}
+
+	// PSPs of push service types which aren't installed (e.g. by an older version of uniqush-push) can't be loaded, so pushes to their services would fail.
+	_, err := api.backend.GetPushServiceProviderConfigs()
+	checks["push_service_providers"] = newHealthCheck(err)
+
+	if checkProviders {
+		for name, err := range api.psm.CheckReachability(providerReachabilityTimeout) {
+			checks["provider_"+name] = newHealthCheck(err)
+		}
+	}
+
+	response := newHealthResponse(checks)
+	if response.Status != healthStatusOK {
+		var failed []string
+		for name, check := range checks {
+			if check.Status != healthStatusOK {
+				failed = append(failed, fmt.Sprintf("%s: %s", name, check.Error))
+			}
+		}
+		sort.Strings(failed)
+		logger.Errorf("Not ready: %s", strings.Join(failed, "; "))
+	}
+	return response
+}
+
+// writeHealth writes the JSON response of /healthz or /readyz, with the HTTP status 503 if a check failed.
+func (api *RestAPI) writeHealth(w http.ResponseWriter, response healthResponse) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if response.Status != healthStatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, "%s\r\n", body)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+// logFormatJSON is the value of logformat in the [default] section of uniqush.conf which makes uniqush-push log JSON objects instead of text.
+const logFormatJSON = "json"
+
+// logFieldNames maps the keys of the Key=Value pairs logged by uniqush-push to the names of fields in JSON logs.
+// Other keys are converted to snake case (e.g. MsgID becomes msg_id).
+var logFieldNames = map[string]string{
+	"RequestID":           "request_id",
+	"RequestId":           "request_id",
+	"Service":             "service",
+	"Subscriber":          "subscriber",
+	"PushServiceProvider": "psp",
+	"DeliveryPoint":       "delivery_point",
+	"PushServiceType":     "push_service_type",
+	"Code":                "code",
+	"Latency":             "latency",
+	"From":                "remote_addr",
+}
+
+// reservedLogFields are set for every message, and can't be set by Key=Value pairs.
+var reservedLogFields = map[string]bool{"time": true, "level": true, "logger": true, "msg": true}
+
+// jsonLogger is a log.Logger which writes each message as a JSON object on its own line, for log pipelines.
+// The Key=Value pairs at the start of a message (e.g. "RequestID=abc Service=myservice Success!") become fields (See logFieldNames),
+// and the rest of the message becomes the msg field. latency is logged in milliseconds.
+type jsonLogger struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	name   string
+	level  int
+	now    func() time.Time
+}
+
+var _ log.Logger = &jsonLogger{}
+
+func newJSONLogger(writer io.Writer, name string, level int) *jsonLogger {
+	return &jsonLogger{writer: writer, name: name, level: level, now: time.Now}
+}
+
+func (l *jsonLogger) write(level int, levelName string, msg string) {
+	if level > l.level {
+		return
+	}
+	fields := parseLogFields(msg)
+	fields["time"] = l.now().UTC().Format(time.RFC3339Nano)
+	fields["level"] = levelName
+	fields["logger"] = l.name
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(fields); err != nil {
+		buf.Reset()
+		fmt.Fprintf(&buf, "{\"level\":\"error\",\"logger\":%q,\"msg\":%q}\n", l.name, "Failed to encode log message: "+err.Error())
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.writer.Write(buf.Bytes())
+}
+
+// parseLogFields returns the fields of a JSON log message, from the Key=Value pairs at the start of msg and the msg field with the rest.
+func parseLogFields(msg string) map[string]interface{} {
+	fields := make(map[string]interface{})
+	rest := strings.TrimLeft(msg, " ")
+	for rest != "" {
+		key, value, remaining, ok := parseLogPair(rest)
+		if !ok {
+			break
+		}
+		name, known := logFieldNames[key]
+		if !known {
+			name = toSnakeCase(key)
+		}
+		if _, exists := fields[name]; exists || reservedLogFields[name] {
+			break
+		}
+		fields[name] = logFieldValue(name, value)
+		rest = strings.TrimLeft(remaining, " ")
+	}
+	fields["msg"] = rest
+	return fields
+}
+
+// parseLogPair parses a Key=Value pair at the start of s, where Value is either quoted (as with %q) or ends at the next space.
+func parseLogPair(s string) (key string, value string, rest string, ok bool) {
+	i := 0
+	for i < len(s) && (s[i] >= 'a' && s[i] <= 'z' || s[i] >= 'A' && s[i] <= 'Z' || i > 0 && s[i] >= '0' && s[i] <= '9') {
+		i++
+	}
+	if i == 0 || i >= len(s) || s[i] != '=' {
+		return "", "", "", false
+	}
+	key, s = s[:i], s[i+1:]
+	if strings.HasPrefix(s, `"`) {
+		for j := 1; j < len(s); j++ {
+			if s[j] == '\\' {
+				j++
+			} else if s[j] == '"' {
+				if unquoted, err := strconv.Unquote(s[:j+1]); err == nil {
+					return key, unquoted, s[j+1:], true
+				}
+				break
+			}
+		}
+	}
+	if end := strings.IndexByte(s, ' '); end >= 0 {
+		return key, s[:end], s[end:], true
+	}
+	return key, s, "", true
+}
+
+// logFieldValue converts latency (e.g. "1.5s") to a number of milliseconds, and returns other values unchanged.
+func logFieldValue(name string, value string) interface{} {
+	if name == "latency" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return float64(d) / float64(time.Millisecond)
+		}
+	}
+	return value
+}
+
+// toSnakeCase converts a key such as MsgID or NrSubscribers to msg_id or nr_subscribers.
+func toSnakeCase(key string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		isUpper := c >= 'A' && c <= 'Z'
+		if isUpper && i > 0 {
+			prev := key[i-1]
+			prevIsUpper := prev >= 'A' && prev <= 'Z'
+			nextIsLower := i+1 < len(key) && key[i+1] >= 'a' && key[i+1] <= 'z'
+			if !prevIsUpper || nextIsLower {
+				buf.WriteByte('_')
+			}
+		}
+		if isUpper {
+			c += 'a' - 'A'
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
+
+func (l *jsonLogger) Alert(v ...interface{}) {
+	l.write(log.LOGLEVEL_ALERT, "alert", fmt.Sprint(v...))
+}
+
+func (l *jsonLogger) Alertf(f string, v ...interface{}) {
+	l.write(log.LOGLEVEL_ALERT, "alert", fmt.Sprintf(f, v...))
+}
+
+func (l *jsonLogger) Error(v ...interface{}) {
+	l.write(log.LOGLEVEL_ERROR, "error", fmt.Sprint(v...))
+}
+
+func (l *jsonLogger) Errorf(f string, v ...interface{}) {
+	l.write(log.LOGLEVEL_ERROR, "error", fmt.Sprintf(f, v...))
+}
+
+func (l *jsonLogger) Warn(v ...interface{}) {
+	l.write(log.LOGLEVEL_WARN, "warn", fmt.Sprint(v...))
+}
+
+func (l *jsonLogger) Warnf(f string, v ...interface{}) {
+	l.write(log.LOGLEVEL_WARN, "warn", fmt.Sprintf(f, v...))
+}
+
+func (l *jsonLogger) Config(v ...interface{}) {
+	l.write(log.LOGLEVEL_CONFIG, "config", fmt.Sprint(v...))
+}
+
+func (l *jsonLogger) Configf(f string, v ...interface{}) {
+	l.write(log.LOGLEVEL_CONFIG, "config", fmt.Sprintf(f, v...))
+}
+
+func (l *jsonLogger) Info(v ...interface{}) {
+	l.write(log.LOGLEVEL_INFO, "info", fmt.Sprint(v...))
+}
+
+func (l *jsonLogger) Infof(f string, v ...interface{}) {
+	l.write(log.LOGLEVEL_INFO, "info", fmt.Sprintf(f, v...))
+}
+
+func (l *jsonLogger) Debug(v ...interface{}) {
+	l.write(log.LOGLEVEL_DEBUG, "debug", fmt.Sprint(v...))
+}
+
+func (l *jsonLogger) Debugf(f string, v ...interface{}) {
+	l.write(log.LOGLEVEL_DEBUG, "debug", fmt.Sprintf(f, v...))
+}
+
+func (l *jsonLogger) Fatal(v ...interface{}) {
+	l.write(log.LOGLEVEL_ALERT, "fatal", fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+func (l *jsonLogger) Fatalf(f string, v ...interface{}) {
+	l.write(log.LOGLEVEL_ALERT, "fatal", fmt.Sprintf(f, v...))
+	os.Exit(1)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/test_util"
+)
+
+func TestParseLogFields(t *testing.T) {
+	test_util.ExpectEquals(t, map[string]interface{}{
+		"request_id":        "abc",
+		"service":           "myservice",
+		"subscriber":        "mysubscriber",
+		"psp":               "apns:123",
+		"delivery_point":    "apns:456",
+		"push_service_type": "apns",
+		"code":              "UNIQUSH_SUCCESS",
+		"latency":           1500.0,
+		"msg_id":            "apns:789",
+		"msg":               "Success!",
+	}, parseLogFields("RequestID=abc Service=myservice Subscriber=mysubscriber PushServiceProvider=apns:123 DeliveryPoint=apns:456 PushServiceType=apns Code=UNIQUSH_SUCCESS Latency=1.5s MsgID=apns:789 Success!"), "fields of a push result")
+
+	test_util.ExpectEquals(t, map[string]interface{}{
+		"request_id":      "abc",
+		"remote_addr":     "127.0.0.1:1234",
+		"idempotency_key": "my key",
+		"msg":             "Returning the stored response",
+	}, parseLogFields(`RequestId=abc From=127.0.0.1:1234 IdempotencyKey="my key" Returning the stored response`), "fields with a quoted value")
+
+	test_util.ExpectEquals(t, map[string]interface{}{"msg": "Error: a=b"}, parseLogFields("Error: a=b"), "fields of a message without Key=Value pairs")
+	test_util.ExpectEquals(t, map[string]interface{}{"service": "a", "msg": "Service=b"}, parseLogFields("Service=a Service=b"), "fields with a repeated key")
+}
+
+func TestToSnakeCase(t *testing.T) {
+	for key, expected := range map[string]string{
+		"MsgID":          "msg_id",
+		"NrSubscribers":  "nr_subscribers",
+		"IdempotencyKey": "idempotency_key",
+		"DedupKey":       "dedup_key",
+	} {
+		test_util.ExpectStringEquals(t, expected, toSnakeCase(key), "snake case of "+key)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newJSONLogger(&buf, "Push", log.LOGLEVEL_INFO)
+	logger.now = func() time.Time { return time.Unix(1500000000, 0) }
+
+	logger.Infof("RequestID=%v Service=%v <b>Success!</b>", "abc", "myservice")
+	logger.Debugf("RequestID=%v Not logged", "abc")
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatalf("Unexpected error parsing %q: %v", buf.String(), err)
+	}
+	test_util.ExpectEquals(t, map[string]interface{}{
+		"time":       "2017-07-14T02:40:00Z",
+		"level":      "info",
+		"logger":     "Push",
+		"request_id": "abc",
+		"service":    "myservice",
+		"msg":        "<b>Success!</b>",
+	}, fields, "logged fields")
+}
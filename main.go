@@ -25,16 +25,24 @@ import (
 	"github.com/uniqush/uniqush-push/srv"
 )
 
-var uniqushPushConfFlags = flag.String("config", "/etc/uniqush/uniqush-push.conf", "Config file path")
+var uniqushPushConfFlags = flag.String("config", "/etc/uniqush/uniqush-push.conf", "Config file path (or empty to only use -config-yaml and UNIQUSH_<SECTION>_<OPTION> environment variables)")
+var uniqushPushYAMLConfFlags = flag.String("config-yaml", "", "YAML config file path, overriding options in -config")
+var uniqushPushPrintConfigFlag = flag.Bool("print-config", false, "Print the effective configuration, merged from -config, -config-yaml and the environment, and exit")
 var uniqushPushShowVersionFlag = flag.Bool("version", false, "Version info")
 
 var uniqushPushVersion = "uniqush-push 2.6.1-dev"
 
+// installPushServices registers the push service types. /readyz checks that each push service type registered when the REST API is created is still registered.
 func installPushServices() {
 	srv.InstallGCM()
 	srv.InstallFCM()
 	srv.InstallAPNS()
 	srv.InstallADM()
+	srv.InstallHMS()
+	srv.InstallWebPush()
+	srv.InstallWebhook()
+	srv.InstallSMTP()
+	srv.InstallSMS()
 }
 
 func main() {
@@ -44,8 +52,16 @@ func main() {
 		return
 	}
 	installPushServices()
+	sources := ConfigSources{File: *uniqushPushConfFlags, YAMLFile: *uniqushPushYAMLConfFlags}
+	if *uniqushPushPrintConfigFlag {
+		if err := PrintConfig(os.Stdout, sources); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot load the configuration: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	err := Run(*uniqushPushConfFlags, uniqushPushVersion)
+	err := Run(sources, uniqushPushVersion)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Cannot start: %v\n", err)
 	}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// metricsContentType is the content type of the Prometheus text exposition format, used by /metrics.
+const metricsContentType = "text/plain; version=0.0.4"
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatMetricLabels formats pairs of label names and values, e.g. {service="myservice"}.
+func formatMetricLabels(namesAndValues ...string) string {
+	labels := make([]string, 0, len(namesAndValues)/2)
+	for i := 0; i+1 < len(namesAndValues); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, namesAndValues[i], metricLabelEscaper.Replace(namesAndValues[i+1])))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// writeMetrics writes the metrics for /metrics, in the Prometheus text format.
+func (api *RestAPI) writeMetrics(w io.Writer, now time.Time) {
+	statuses := api.backend.certificateStatuses()
+	warning := api.backend.getCertificateExpiryWarning()
+
+	fmt.Fprintln(w, "# HELP uniqush_certificate_expiry_timestamp_seconds When the client certificate of a PSP (e.g. APNS) expires, as a unix timestamp.")
+	fmt.Fprintln(w, "# TYPE uniqush_certificate_expiry_timestamp_seconds gauge")
+	for _, status := range statuses {
+		labels := formatMetricLabels("service", status.service, "psp", status.pspName, "pushservicetype", status.pushServiceType, "subject", status.info.Subject)
+		fmt.Fprintf(w, "uniqush_certificate_expiry_timestamp_seconds%s %d\n", labels, status.info.NotAfter.Unix())
+	}
+
+	fmt.Fprintln(w, "# HELP uniqush_certificate_expiring Whether the client certificate of a PSP has expired or expires within the warning period of [CertificateExpiry] (1) or not (0).")
+	fmt.Fprintln(w, "# TYPE uniqush_certificate_expiring gauge")
+	for _, status := range statuses {
+		labels := formatMetricLabels("service", status.service, "psp", status.pspName, "pushservicetype", status.pushServiceType, "subject", status.info.Subject)
+		expiring := 0
+		if status.info.ExpiresWithin(now, warning) {
+			expiring = 1
+		}
+		fmt.Fprintf(w, "uniqush_certificate_expiring%s %d\n", labels, expiring)
+	}
+}
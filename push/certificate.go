@@ -0,0 +1,33 @@
+package push
+
+import "time"
+
+// CertificateInfo describes the client certificate a PSP uses to connect to its push service, such as an APNS certificate.
+type CertificateInfo struct {
+	NotAfter time.Time
+	// Subject is the common name of the certificate's subject.
+	Subject string
+	// Topic is the app (e.g. the APNS bundle id) the certificate can push to, if known.
+	Topic string
+	// Environment is where the certificate can be used (e.g. "sandbox" or "production" for APNS), if known.
+	Environment string
+}
+
+// ExpiresWithin returns whether the certificate has expired or will expire within d of now.
+func (info *CertificateInfo) ExpiresWithin(now time.Time, d time.Duration) bool {
+	return !now.Add(d).Before(info.NotAfter)
+}
+
+// CertificateInspector is implemented by push service types whose PSPs use client certificates, so that their expiry can be monitored.
+type CertificateInspector interface {
+	InspectCertificate(psp *PushServiceProvider) (*CertificateInfo, error)
+}
+
+// InspectCertificate returns information about the client certificate of psp, or nil if its push service type doesn't use client certificates.
+func (m *PushServiceManager) InspectCertificate(psp *PushServiceProvider) (*CertificateInfo, error) {
+	inspector, ok := psp.pushServiceType.(CertificateInspector)
+	if !ok {
+		return nil, nil
+	}
+	return inspector.InspectCertificate(psp)
+}
@@ -0,0 +1,133 @@
+package push
+
+import (
+	"sync"
+	"time"
+)
+
+// Options for the circuit breakers of PSPs, in the section of uniqush.conf with the name of the push service type, e.g. [fcm].
+const (
+	CIRCUIT_BREAKER_THRESHOLD = "circuit_breaker_threshold" // The number of consecutive failed pushes to a PSP before it is considered unavailable. 0 disables the circuit breaker.
+	CIRCUIT_BREAKER_COOLDOWN  = "circuit_breaker_cooldown"  // The number of seconds to wait before sending another push to an unavailable PSP.
+)
+
+// Circuit breaker states, as shown in /psps
+const (
+	CircuitClosed   = "closed"    // Pushes are sent normally.
+	CircuitOpen     = "open"      // Pushes fail immediately with PushServiceProviderUnavailable.
+	CircuitHalfOpen = "half_open" // A single push is being sent to check if the PSP is working again.
+)
+
+// CircuitBreakerConfig contains the settings of the circuit breakers of a push service type.
+type CircuitBreakerConfig struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+var defaultCircuitBreakerConfig = CircuitBreakerConfig{
+	Threshold: 5,
+	Cooldown:  60 * time.Second,
+}
+
+// loadCircuitBreakerConfig reads the circuit breaker settings for a push service type from uniqush.conf. Invalid settings are ignored.
+func loadCircuitBreakerConfig(c *PushServiceConfig) CircuitBreakerConfig {
+	result := defaultCircuitBreakerConfig
+	if threshold, err := c.GetInt(CIRCUIT_BREAKER_THRESHOLD); err == nil && threshold >= 0 {
+		result.Threshold = threshold
+	}
+	if seconds, err := c.GetInt(CIRCUIT_BREAKER_COOLDOWN); err == nil && seconds > 0 {
+		result.Cooldown = time.Duration(seconds) * time.Second
+	}
+	return result
+}
+
+// CircuitBreakerStatus describes the state of the circuit breaker for a PSP.
+type CircuitBreakerStatus struct {
+	State               string
+	ConsecutiveFailures int
+	RetryAt             time.Time // When the next push will be attempted, if the state is CircuitOpen.
+	LastError           string
+}
+
+// circuitBreaker stops sending pushes to a PSP after several consecutive pushes failed with provider-level errors
+// (e.g. an invalid API key or certificate), until a push sent after the cooldown succeeds.
+type circuitBreaker struct {
+	mutex               sync.Mutex
+	state               string
+	consecutiveFailures int
+	retryAt             time.Time
+	lastError           string
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{state: CircuitClosed}
+}
+
+// allow returns true if a push may be sent. If the cooldown has elapsed, this lets a single push through to probe the PSP.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if now.Before(b.retryAt) {
+			return false
+		}
+		b.state = CircuitHalfOpen
+		return true
+	case CircuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// recordSuccess closes the circuit breaker.
+func (b *circuitBreaker) recordSuccess() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.state = CircuitClosed
+	b.consecutiveFailures = 0
+	b.lastError = ""
+}
+
+// recordFailure counts a failed push, and returns true if this caused the circuit breaker to open.
+func (b *circuitBreaker) recordFailure(now time.Time, config CircuitBreakerConfig, err error) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.consecutiveFailures++
+	b.lastError = err.Error()
+	if b.state == CircuitHalfOpen || (b.state == CircuitClosed && config.Threshold > 0 && b.consecutiveFailures >= config.Threshold) {
+		opened := b.state == CircuitClosed
+		b.state = CircuitOpen
+		b.retryAt = now.Add(config.Cooldown)
+		return opened
+	}
+	return false
+}
+
+// recordInconclusive is called when a push neither succeeded nor failed with a provider-level error, e.g. if every delivery point was invalid.
+func (b *circuitBreaker) recordInconclusive() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == CircuitHalfOpen {
+		// Let the next push probe the PSP.
+		b.state = CircuitOpen
+	}
+}
+
+func (b *circuitBreaker) status() CircuitBreakerStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return CircuitBreakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.consecutiveFailures,
+		RetryAt:             b.retryAt,
+		LastError:           b.lastError,
+	}
+}
+
+// isProviderFailure returns true for errors which indicate that every push sent with a PSP would fail.
+func isProviderFailure(err Error) bool {
+	_, ok := err.(*BadPushServiceProvider)
+	return ok
+}
@@ -0,0 +1,112 @@
+package push
+
+import (
+	"testing"
+	"time"
+)
+
+// flakyPushServiceType sends a success or a BadPushServiceProvider error for each delivery point.
+type flakyPushServiceType struct {
+	testPushServiceType
+	fail   bool
+	pushes int
+}
+
+func (pst *flakyPushServiceType) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *Result, notif *Notification) {
+	defer close(resQueue)
+	pst.pushes++
+	for dp := range dpQueue {
+		res := &Result{Provider: psp, Destination: dp, Content: notif}
+		if pst.fail {
+			res.Err = NewBadPushServiceProviderWithDetails(psp, "Unauthorized")
+		}
+		resQueue <- res
+	}
+}
+
+func pushToOneDeliveryPoint(psm *PushServiceManager, psp *PushServiceProvider) []*Result {
+	dpQueue := make(chan *DeliveryPoint, 1)
+	dpQueue <- NewEmptyDeliveryPoint()
+	close(dpQueue)
+	resQueue := make(chan *Result)
+	go psm.Push(psp, dpQueue, resQueue, NewEmptyNotification())
+	var results []*Result
+	for res := range resQueue {
+		results = append(results, res)
+	}
+	return results
+}
+
+func TestCircuitBreakerOpensAndCloses(t *testing.T) {
+	psm := newPushServiceManager()
+	pst := &flakyPushServiceType{testPushServiceType: testPushServiceType{name: "flaky"}, fail: true}
+	if err := psm.RegisterPushServiceType(pst); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	psm.serviceTypes["flaky"].circuitBreakerConfig = CircuitBreakerConfig{Threshold: 2, Cooldown: 50 * time.Millisecond}
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{"pushservicetype": "flaky", "service": "myservice"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		results := pushToOneDeliveryPoint(psm, psp)
+		if _, ok := results[0].Err.(*BadPushServiceProvider); !ok {
+			t.Fatalf("Expected BadPushServiceProvider, got %v", results[0].Err)
+		}
+	}
+	if state := psm.CircuitBreakerStatus(psp).State; state != CircuitOpen {
+		t.Fatalf("Expected the circuit breaker to be open after 2 failures, got %q", state)
+	}
+
+	results := pushToOneDeliveryPoint(psm, psp)
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+	if _, ok := results[0].Err.(*PushServiceProviderUnavailable); !ok {
+		t.Fatalf("Expected PushServiceProviderUnavailable, got %v", results[0].Err)
+	}
+	if pst.pushes != 2 {
+		t.Errorf("Expected no push to be sent while the circuit breaker is open, got %d pushes", pst.pushes)
+	}
+
+	// After the cooldown, a successful push closes the circuit breaker.
+	time.Sleep(60 * time.Millisecond)
+	pst.fail = false
+	results = pushToOneDeliveryPoint(psm, psp)
+	if results[0].Err != nil {
+		t.Fatalf("Expected the probe to succeed, got %v", results[0].Err)
+	}
+	status := psm.CircuitBreakerStatus(psp)
+	if status.State != CircuitClosed || status.ConsecutiveFailures != 0 {
+		t.Errorf("Expected the circuit breaker to be closed, got %#v", status)
+	}
+
+	psm.ForgetPushServiceProvider(psp)
+	if len(psm.circuitBreakers) != 0 {
+		t.Errorf("Expected the circuit breaker to be removed with the PSP, got %v", psm.circuitBreakers)
+	}
+}
+
+func TestCircuitBreakerReopensAfterFailedProbe(t *testing.T) {
+	b := newCircuitBreaker()
+	config := CircuitBreakerConfig{Threshold: 1, Cooldown: time.Minute}
+	now := time.Now()
+	if !b.recordFailure(now, config, NewError("Unauthorized")) {
+		t.Fatal("Expected the circuit breaker to open")
+	}
+	if b.allow(now.Add(30 * time.Second)) {
+		t.Fatal("Expected pushes to be rejected during the cooldown")
+	}
+	if !b.allow(now.Add(61 * time.Second)) {
+		t.Fatal("Expected a probe to be allowed after the cooldown")
+	}
+	if b.allow(now.Add(61 * time.Second)) {
+		t.Fatal("Expected only one probe to be allowed at a time")
+	}
+	b.recordFailure(now.Add(62*time.Second), config, NewError("Unauthorized"))
+	status := b.status()
+	if status.State != CircuitOpen || !status.RetryAt.Equal(now.Add(62*time.Second+time.Minute)) {
+		t.Errorf("Expected the circuit breaker to reopen for another cooldown, got %#v", status)
+	}
+}
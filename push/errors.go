@@ -43,6 +43,7 @@ var _ Error = &BadPushServiceProvider{}
 var _ Error = &UnsubscribeUpdate{}
 var _ Error = &InvalidRegistrationUpdate{}
 var _ Error = &ConnectionError{}
+var _ Error = &PushServiceProviderUnavailable{}
 
 // InfoReport is not an actual error.
 // But it is worthy to be reported to the user.
@@ -284,3 +285,21 @@ func (e *ConnectionError) Error() string {
 func NewConnectionError(err error) *ConnectionError {
 	return &ConnectionError{Err: err}
 }
+
+/*********************/
+
+// PushServiceProviderUnavailable is returned instead of sending a push, when the circuit breaker for a PSP is open after repeated failures.
+type PushServiceProviderUnavailable struct {
+	implementsPushError
+	Provider *PushServiceProvider
+	RetryAt  time.Time
+	Reason   string
+}
+
+func (e *PushServiceProviderUnavailable) Error() string {
+	return fmt.Sprintf("PushServiceProvider=%v Unavailable until %v after repeated failures: %v", e.Provider.Name(), e.RetryAt.Format(time.RFC3339), e.Reason)
+}
+
+func NewPushServiceProviderUnavailable(psp *PushServiceProvider, retryAt time.Time, reason string) *PushServiceProviderUnavailable {
+	return &PushServiceProviderUnavailable{Provider: psp, RetryAt: retryAt, Reason: reason}
+}
@@ -0,0 +1,45 @@
+package push
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FrequencyCap limits the number of pushes sent to each subscriber of a service within a sliding window of Period.
+// The zero value doesn't limit pushes.
+type FrequencyCap struct {
+	Limit  int
+	Period time.Duration
+}
+
+// ParseFrequencyCap parses a frequency cap such as "10/1h" (at most 10 pushes per subscriber per hour).
+// The period uses the syntax of time.ParseDuration.
+func ParseFrequencyCap(value string) (FrequencyCap, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return FrequencyCap{}, fmt.Errorf("invalid frequency cap %q, expected a limit and period such as 10/1h", value)
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || limit <= 0 {
+		return FrequencyCap{}, fmt.Errorf("invalid frequency cap %q, the limit must be a positive integer", value)
+	}
+	period, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil || period < time.Second {
+		return FrequencyCap{}, fmt.Errorf("invalid frequency cap %q, the period must be a duration of at least 1s", value)
+	}
+	return FrequencyCap{Limit: limit, Period: period}, nil
+}
+
+// IsEnabled returns true if this limits the number of pushes.
+func (c FrequencyCap) IsEnabled() bool {
+	return c.Limit > 0 && c.Period > 0
+}
+
+func (c FrequencyCap) String() string {
+	if !c.IsEnabled() {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d/%v", c.Limit, c.Period)
+}
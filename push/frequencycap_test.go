@@ -0,0 +1,22 @@
+package push
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/test_util"
+)
+
+func TestParseFrequencyCap(t *testing.T) {
+	frequencyCap, err := ParseFrequencyCap("10/1h")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test_util.ExpectEquals(t, FrequencyCap{Limit: 10, Period: time.Hour}, frequencyCap, "frequency cap")
+
+	for _, value := range []string{"10", "0/1h", "10/1ms", "10/an hour", "ten/1h"} {
+		if _, err := ParseFrequencyCap(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
@@ -23,8 +23,14 @@ import (
 
 type Notification struct {
 	Data map[string]string
+	// RequestID is the ID of the request to the REST API which sent this notification, for logging.
+	// It isn't part of the payload, but push service types using HTTP send it in the RequestIDHeader of their requests.
+	RequestID string
 }
 
+// RequestIDHeader is the HTTP header with the ID of a request, which is accepted by the REST API and sent to push services.
+const RequestIDHeader = "X-Request-ID"
+
 func (n *Notification) String() string {
 	ret, _ := json.Marshal(n.Data)
 	return string(ret)
@@ -43,7 +49,7 @@ func (n *Notification) Clone() *Notification {
 	for k, v := range n.Data {
 		Data[k] = v
 	}
-	return &Notification{Data: Data}
+	return &Notification{Data: Data, RequestID: n.RequestID}
 }
 
 // IsEmpty returns true if there are fields in this notification
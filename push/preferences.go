@@ -0,0 +1,173 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SubscriberPreferences are the notification preferences of a subscriber of a service, set through /preferences.
+type SubscriberPreferences struct {
+	// MutedCategories are the values of uniqush.category for which pushes are not sent.
+	MutedCategories []string `json:"muted_categories,omitempty"`
+	// TimeZone is the IANA time zone name (e.g. "America/Toronto") used for QuietHours. Defaults to UTC.
+	TimeZone string `json:"time_zone,omitempty"`
+	// QuietHours are windows of local time ("HH:MM-HH:MM", possibly spanning midnight) during which pushes are deferred until the window ends.
+	QuietHours []string `json:"quiet_hours,omitempty"`
+}
+
+// quietHoursWindow is a parsed window of quiet hours, in minutes after midnight.
+type quietHoursWindow struct {
+	start int
+	end   int
+}
+
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseQuietHoursWindow(value string) (quietHoursWindow, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return quietHoursWindow{}, fmt.Errorf("invalid quiet hours %q, expected HH:MM-HH:MM", value)
+	}
+	start, err := parseTimeOfDay(parts[0])
+	if err != nil {
+		return quietHoursWindow{}, err
+	}
+	end, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return quietHoursWindow{}, err
+	}
+	if start == end {
+		return quietHoursWindow{}, fmt.Errorf("invalid quiet hours %q, the start and end are the same", value)
+	}
+	return quietHoursWindow{start: start, end: end}, nil
+}
+
+// ParseQuietHours parses a comma separated list of quiet hours windows, e.g. "22:00-07:00,12:00-13:00".
+func ParseQuietHours(value string) ([]string, error) {
+	var windows []string
+	for _, window := range strings.Split(value, ",") {
+		window = strings.TrimSpace(window)
+		if window == "" {
+			continue
+		}
+		if _, err := parseQuietHoursWindow(window); err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// Validate returns an error if the time zone or quiet hours are invalid.
+func (p *SubscriberPreferences) Validate() error {
+	if _, err := p.location(); err != nil {
+		return err
+	}
+	for _, window := range p.QuietHours {
+		if _, err := parseQuietHoursWindow(window); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsEmpty returns true if these preferences have no effect on pushes.
+func (p *SubscriberPreferences) IsEmpty() bool {
+	return len(p.MutedCategories) == 0 && len(p.QuietHours) == 0 && p.TimeZone == ""
+}
+
+func (p *SubscriberPreferences) location() (*time.Location, error) {
+	if p.TimeZone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %v", p.TimeZone, err)
+	}
+	return loc, nil
+}
+
+// IsMuted returns true if pushes with the given uniqush.category should not be sent.
+func (p *SubscriberPreferences) IsMuted(category string) bool {
+	if category == "" {
+		return false
+	}
+	for _, muted := range p.MutedCategories {
+		if muted == category {
+			return true
+		}
+	}
+	return false
+}
+
+// QuietHoursEnd returns the time at which the quiet hours containing now end, and false if now is outside of quiet hours.
+// Overlapping or adjacent windows are treated as a single window.
+func (p *SubscriberPreferences) QuietHoursEnd(now time.Time) (time.Time, bool) {
+	loc, err := p.location()
+	if err != nil {
+		return time.Time{}, false
+	}
+	windows := make([]quietHoursWindow, 0, len(p.QuietHours))
+	for _, value := range p.QuietHours {
+		if window, err := parseQuietHoursWindow(value); err == nil {
+			windows = append(windows, window)
+		}
+	}
+
+	t := now.In(loc)
+	quiet := false
+	// Each iteration moves t to the end of a window containing t, so this terminates after at most len(windows) iterations unless the windows cover the whole day.
+	for i := 0; i <= len(windows); i++ {
+		end, inWindow := quietHoursWindowEnd(windows, t)
+		if !inWindow {
+			break
+		}
+		quiet = true
+		t = end
+	}
+	return t, quiet
+}
+
+// quietHoursWindowEnd returns the end of the first window containing t.
+func quietHoursWindowEnd(windows []quietHoursWindow, t time.Time) (time.Time, bool) {
+	minute := t.Hour()*60 + t.Minute()
+	// time.Date normalizes the minutes, and accounts for changes to daylight saving time.
+	endOfWindow := func(w quietHoursWindow, days int) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day()+days, 0, w.end, 0, 0, t.Location())
+	}
+	for _, w := range windows {
+		switch {
+		case w.start < w.end && minute >= w.start && minute < w.end:
+			return endOfWindow(w, 0), true
+		case w.start > w.end && minute >= w.start:
+			// The window ends tomorrow.
+			return endOfWindow(w, 1), true
+		case w.start > w.end && minute < w.end:
+			return endOfWindow(w, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Marshal serializes the preferences as JSON, to be stored in the database.
+func (p *SubscriberPreferences) Marshal() []byte {
+	data, _ := json.Marshal(p)
+	return data
+}
+
+// UnmarshalSubscriberPreferences parses preferences serialized with Marshal.
+func UnmarshalSubscriberPreferences(data []byte) (*SubscriberPreferences, error) {
+	p := new(SubscriberPreferences)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
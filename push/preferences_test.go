@@ -0,0 +1,57 @@
+package push
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietHoursEnd(t *testing.T) {
+	prefs := &SubscriberPreferences{TimeZone: "America/Toronto", QuietHours: []string{"22:00-07:00", "06:30-08:00", "12:00-13:00"}}
+	if err := prefs.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	loc, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Skipf("Time zone data is unavailable: %v", err)
+	}
+	for _, testCase := range []struct {
+		now   time.Time
+		end   time.Time
+		quiet bool
+	}{
+		// Overnight, continuing into the overlapping morning window
+		{time.Date(2018, 7, 1, 23, 15, 0, 0, loc), time.Date(2018, 7, 2, 8, 0, 0, 0, loc), true},
+		{time.Date(2018, 7, 2, 1, 0, 0, 0, loc), time.Date(2018, 7, 2, 8, 0, 0, 0, loc), true},
+		{time.Date(2018, 7, 2, 12, 59, 0, 0, loc), time.Date(2018, 7, 2, 13, 0, 0, 0, loc), true},
+		{time.Date(2018, 7, 2, 13, 0, 0, 0, loc), time.Time{}, false},
+		{time.Date(2018, 7, 2, 21, 59, 0, 0, loc), time.Time{}, false},
+	} {
+		end, quiet := prefs.QuietHoursEnd(testCase.now.UTC())
+		if quiet != testCase.quiet || (quiet && !end.Equal(testCase.end)) {
+			t.Errorf("At %v, expected (%v, %v), got (%v, %v)", testCase.now, testCase.end, testCase.quiet, end, quiet)
+		}
+	}
+}
+
+func TestSubscriberPreferencesValidate(t *testing.T) {
+	for _, prefs := range []*SubscriberPreferences{
+		{TimeZone: "Not/AZone"},
+		{QuietHours: []string{"22:00"}},
+		{QuietHours: []string{"25:00-07:00"}},
+		{QuietHours: []string{"07:00-07:00"}},
+	} {
+		if err := prefs.Validate(); err == nil {
+			t.Errorf("Expected an error for %#v", prefs)
+		}
+	}
+}
+
+func TestIsMuted(t *testing.T) {
+	prefs := &SubscriberPreferences{MutedCategories: []string{"marketing"}}
+	if !prefs.IsMuted("marketing") {
+		t.Error("Expected marketing to be muted")
+	}
+	if prefs.IsMuted("") || prefs.IsMuted("alerts") {
+		t.Error("Expected pushes without a muted category to be sent")
+	}
+}
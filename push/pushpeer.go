@@ -106,14 +106,18 @@ func (p *PushPeer) Marshal() []byte {
 	if p.pushServiceType == nil {
 		return nil
 	}
+	return marshalPushPeer(p.pushServiceType.Name(), p.FixedData, p.VolatileData)
+}
+
+func marshalPushPeer(pushServiceName string, fixedData, volatileData map[string]string) []byte {
 	s := make([]map[string]string, 2)
-	s[0] = p.FixedData
-	s[1] = p.VolatileData
+	s[0] = fixedData
+	s[1] = volatileData
 	b, err := json.Marshal(s)
 	if err != nil {
 		return nil
 	}
-	str := p.pushServiceType.Name() + ":" + string(b)
+	str := pushServiceName + ":" + string(b)
 	return []byte(str)
 }
 
@@ -149,6 +153,20 @@ func NewEmptyDeliveryPoint() *DeliveryPoint {
 	return ret
 }
 
+// DeviceTokenFields are the FixedData fields which identify the device (or app installation) of a delivery point, for each push service type.
+var DeviceTokenFields = []string{"devtoken", "regid"}
+
+// DeviceToken returns the name and value of the FixedData field identifying this delivery point's device, or empty strings if it has none.
+// Because the name of a delivery point also depends on its service and subscriber, this is used to find every subscription of a device.
+func (dp *DeliveryPoint) DeviceToken() (string, string) {
+	for _, field := range DeviceTokenFields {
+		if token, ok := dp.FixedData[field]; ok && token != "" {
+			return field, token
+		}
+	}
+	return "", ""
+}
+
 // AddCommonData adds both mandatory and optional data, which could be present in a delivery point for any push service type. On failure, returns an error.
 func (dp *DeliveryPoint) AddCommonData(kv map[string]string) error {
 	err := dp.addFixedData(kv)
@@ -195,6 +213,33 @@ func (dp *DeliveryPoint) addVolatileData(kv map[string]string) error {
 // PushServiceProvider contains the data needed to send pushes to an external push notifications service provider (certificates, pushservicetype, server address, etc.).
 type PushServiceProvider struct {
 	PushPeer
+	// rateLimiter is shared by all copies of a PSP with the same name. It is set by the PushServiceManager before pushing, and guarded by PushPeer.m.
+	rateLimiter *RateLimiter
+}
+
+// setRateLimiter is called before each push, which may use the same PSP concurrently.
+func (psp *PushServiceProvider) setRateLimiter(limiter *RateLimiter) {
+	psp.m.Lock()
+	defer psp.m.Unlock()
+	psp.rateLimiter = limiter
+}
+
+func (psp *PushServiceProvider) getRateLimiter() *RateLimiter {
+	psp.m.Lock()
+	defer psp.m.Unlock()
+	return psp.rateLimiter
+}
+
+// AcquireRequestSlot blocks until this PSP's rate limit and in-flight limit allow another request to be sent to the push service.
+// The returned func must be called once the request has finished. It releases the slot on the same RateLimiter,
+// even if the PSP's limits are changed (replacing its RateLimiter) while the request is in progress.
+func (psp *PushServiceProvider) AcquireRequestSlot() (release func()) {
+	limiter := psp.getRateLimiter()
+	if limiter == nil {
+		return func() {}
+	}
+	limiter.Acquire()
+	return limiter.Release
 }
 
 func NewEmptyPushServiceProvider() *PushServiceProvider {
@@ -138,3 +138,15 @@ func TestCompatability(t *testing.T) {
 		t.Errorf("Should be compatible, but %q != %q\n", serviceNamePSP, serviceNameDP)
 	}
 }
+
+func TestDeviceToken(t *testing.T) {
+	dp := NewEmptyDeliveryPoint()
+	dp.FixedData["service"] = "myservice"
+	if field, token := dp.DeviceToken(); field != "" || token != "" {
+		t.Errorf("Expected no device token, got %q %q", field, token)
+	}
+	dp.FixedData["regid"] = "abc"
+	if field, token := dp.DeviceToken(); field != "regid" || token != "abc" {
+		t.Errorf("Expected the regid abc, got %q %q", field, token)
+	}
+}
@@ -1,7 +1,11 @@
 package push
 
-import "errors"
-import "github.com/uniqush/goconf/conf"
+import (
+	"errors"
+	"sort"
+
+	"github.com/uniqush/goconf/conf"
+)
 
 type PushServiceConfig struct {
 	c    *conf.ConfigFile
@@ -28,3 +32,52 @@ func (config *PushServiceConfig) GetInt(option string) (int, error) {
 	}
 	return config.c.GetInt(config.name, option)
 }
+
+// ChangedOptions returns the options of section which were added, removed, or changed between the configs old and c, sorted by name.
+// Either config may be nil. Options inherited from the [default] section are only compared for the default section itself.
+func ChangedOptions(old, c *conf.ConfigFile, section string) []string {
+	oldValues := SectionValues(old, section)
+	values := SectionValues(c, section)
+	var changed []string
+	for option, value := range values {
+		if oldValue, ok := oldValues[option]; !ok || oldValue != value {
+			changed = append(changed, option)
+		}
+	}
+	for option := range oldValues {
+		if _, ok := values[option]; !ok {
+			changed = append(changed, option)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// SectionValues returns the raw values of the options in a section of c, excluding options inherited from the [default] section (See ChangedOptions).
+func SectionValues(c *conf.ConfigFile, section string) map[string]string {
+	values := make(map[string]string)
+	if c == nil || !c.HasSection(section) {
+		return values
+	}
+	options, err := c.GetOptions(section)
+	if err != nil {
+		return values
+	}
+	inherited := make(map[string]bool)
+	if section != "default" {
+		if defaultOptions, err := c.GetOptions("default"); err == nil {
+			for _, option := range defaultOptions {
+				inherited[option] = true
+			}
+		}
+	}
+	for _, option := range options {
+		if inherited[option] {
+			continue
+		}
+		if value, err := c.GetRawString(section, option); err == nil {
+			values[option] = value
+		}
+	}
+	return values
+}
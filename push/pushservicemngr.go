@@ -20,20 +20,37 @@ package push
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/uniqush/goconf/conf"
 )
 
 type serviceType struct {
 	pst PushServiceType
+	// rateLimitDefaults are the limits for PSPs of this type which don't have their own limits.
+	rateLimitDefaults    RateLimitConfig
+	circuitBreakerConfig CircuitBreakerConfig
 }
 
 type PushServiceManager struct {
-	serviceTypes map[string]*serviceType
-	errChan      chan<- Error
-	configFile   *conf.ConfigFile
+	// serviceTypesLock guards serviceTypes while push service types are registered, for HasPushServiceType, PushServiceTypeNames and ReloadConfigFile.
+	// Other methods are only called once the push service types are registered.
+	serviceTypesLock sync.RWMutex
+	serviceTypes     map[string]*serviceType
+	errChan          chan<- Error
+	configFile       *conf.ConfigFile
+
+	// serviceConfigLock guards configFile and the rateLimitDefaults and circuitBreakerConfig of serviceTypes, which are replaced by ReloadConfigFile.
+	serviceConfigLock sync.RWMutex
+
+	rateLimitersLock sync.Mutex
+	rateLimiters     map[string]*RateLimiter // maps PSP names to their rate limiters
+
+	circuitBreakersLock sync.Mutex
+	circuitBreakers     map[string]*circuitBreaker // maps PSP names to their circuit breakers
 }
 
 var (
@@ -45,6 +62,8 @@ var (
 func newPushServiceManager() *PushServiceManager {
 	ret := new(PushServiceManager)
 	ret.serviceTypes = make(map[string]*serviceType, 5)
+	ret.rateLimiters = make(map[string]*RateLimiter)
+	ret.circuitBreakers = make(map[string]*circuitBreaker)
 	return ret
 }
 
@@ -56,22 +75,29 @@ func GetPushServiceManager() *PushServiceManager {
 }
 
 func (m *PushServiceManager) ClearAllPushServiceTypesForUnitTest() {
+	m.serviceTypesLock.Lock()
+	defer m.serviceTypesLock.Unlock()
 	m.serviceTypes = make(map[string]*serviceType, 5)
 }
 
 func (m *PushServiceManager) RegisterPushServiceType(pt PushServiceType) error {
+	m.serviceTypesLock.Lock()
+	defer m.serviceTypesLock.Unlock()
 	name := pt.Name()
-	pair := new(serviceType)
+	pair := &serviceType{circuitBreakerConfig: defaultCircuitBreakerConfig}
 	if existing, ok := m.serviceTypes[name]; ok {
 		return fmt.Errorf("Attempted to register handler for %q, but %#v already exists", name, existing)
 	}
 	if m.errChan != nil {
 		pt.SetErrorReportChan(m.errChan)
 	}
-	if m.configFile != nil {
-		pt.SetPushServiceConfig(NewPushServiceConfig(m.configFile, name))
-	}
 	pair.pst = pt
+	if c := m.getConfigFile(); c != nil {
+		if err := validatePushServiceConfig(pt, c); err != nil {
+			return err
+		}
+		m.setPushServiceConfig(pair)
+	}
 	m.serviceTypes[name] = pair
 	return nil
 }
@@ -96,10 +122,57 @@ func (m *PushServiceManager) BuildPushServiceProviderFromMap(kv map[string]strin
 		psp = nil
 		return
 	}
+	err = addRateLimitData(kv, psp)
+	if err != nil {
+		psp = nil
+		return
+	}
 	psp.pushServiceType = pst
 	return
 }
 
+// addRateLimitData validates the optional limits on requests in kv, and adds them to the PSP's VolatileData.
+func addRateLimitData(kv map[string]string, psp *PushServiceProvider) error {
+	if _, err := ParseRateLimitConfig(kv, RateLimitConfig{}); err != nil {
+		return err
+	}
+	for _, key := range []string{RATE_LIMIT, RATE_BURST, MAX_IN_FLIGHT} {
+		if value, ok := kv[key]; ok && value != "" {
+			psp.VolatileData[key] = value
+		}
+	}
+	return nil
+}
+
+// getRateLimiter returns the RateLimiter shared by all PSPs with the same name as psp, or nil if requests for psp are unlimited.
+// The RateLimiter is replaced if the limits were changed through /addpsp or uniqush.conf.
+func (m *PushServiceManager) getRateLimiter(psp *PushServiceProvider) *RateLimiter {
+	var defaults RateLimitConfig
+	if pair, ok := m.serviceTypes[psp.PushServiceName()]; ok {
+		m.serviceConfigLock.RLock()
+		defaults = pair.rateLimitDefaults
+		m.serviceConfigLock.RUnlock()
+	}
+	config, err := ParseRateLimitConfig(psp.VolatileData, defaults)
+	if err != nil {
+		// This was validated in /addpsp, but the PSP may have been edited in the database.
+		config = defaults
+	}
+	name := psp.Name()
+	m.rateLimitersLock.Lock()
+	defer m.rateLimitersLock.Unlock()
+	if config.IsUnlimited() {
+		delete(m.rateLimiters, name)
+		return nil
+	}
+	if limiter, ok := m.rateLimiters[name]; ok && limiter.Config() == config.withDefaultBurst() {
+		return limiter
+	}
+	limiter := NewRateLimiter(config)
+	m.rateLimiters[name] = limiter
+	return limiter
+}
+
 func (m *PushServiceManager) BuildPushServiceProviderFromBytes(value []byte) (psp *PushServiceProvider, err error) {
 	s := string(value)
 	parts := strings.SplitN(s, ":", 2)
@@ -175,11 +248,19 @@ func (m *PushServiceManager) Push(psp *PushServiceProvider, dpQueue <-chan *Deli
 	wg := new(sync.WaitGroup)
 
 	if psp.pushServiceType != nil {
+		breaker, breakerConfig := m.getCircuitBreaker(psp)
+		if !breaker.allow(time.Now()) {
+			rejectPush(psp, breaker.status(), dpQueue, resQueue, notif)
+			return
+		}
+		psp.setRateLimiter(m.getRateLimiter(psp))
+		results := make(chan *Result)
 		wg.Add(1)
 		go func() {
-			psp.pushServiceType.Push(psp, dpQueue, resQueue, notif)
+			psp.pushServiceType.Push(psp, dpQueue, results, notif)
 			wg.Done()
 		}()
+		m.forwardResults(psp, breaker, breakerConfig, results, resQueue)
 	} else {
 		r := new(Result)
 		r.Provider = psp
@@ -193,6 +274,89 @@ func (m *PushServiceManager) Push(psp *PushServiceProvider, dpQueue <-chan *Deli
 	wg.Wait()
 }
 
+// getCircuitBreaker returns the circuit breaker shared by all PSPs with the same name as psp, and the settings for its push service type.
+func (m *PushServiceManager) getCircuitBreaker(psp *PushServiceProvider) (*circuitBreaker, CircuitBreakerConfig) {
+	config := defaultCircuitBreakerConfig
+	if pair, ok := m.serviceTypes[psp.PushServiceName()]; ok {
+		m.serviceConfigLock.RLock()
+		config = pair.circuitBreakerConfig
+		m.serviceConfigLock.RUnlock()
+	}
+	name := psp.Name()
+	m.circuitBreakersLock.Lock()
+	defer m.circuitBreakersLock.Unlock()
+	breaker, ok := m.circuitBreakers[name]
+	if !ok {
+		breaker = newCircuitBreaker()
+		m.circuitBreakers[name] = breaker
+	}
+	return breaker, config
+}
+
+// CircuitBreakerStatus returns the state of the circuit breaker for psp.
+func (m *PushServiceManager) CircuitBreakerStatus(psp *PushServiceProvider) CircuitBreakerStatus {
+	m.circuitBreakersLock.Lock()
+	breaker, ok := m.circuitBreakers[psp.Name()]
+	m.circuitBreakersLock.Unlock()
+	if !ok {
+		return CircuitBreakerStatus{State: CircuitClosed}
+	}
+	return breaker.status()
+}
+
+// ForgetPushServiceProvider removes the rate limiter and circuit breaker of psp, once it has been removed from the database.
+// Pushes which are still being sent keep using them.
+func (m *PushServiceManager) ForgetPushServiceProvider(psp *PushServiceProvider) {
+	name := psp.Name()
+	m.rateLimitersLock.Lock()
+	delete(m.rateLimiters, name)
+	m.rateLimitersLock.Unlock()
+	m.circuitBreakersLock.Lock()
+	delete(m.circuitBreakers, name)
+	m.circuitBreakersLock.Unlock()
+}
+
+// forwardResults sends the results of a push to resQueue and closes it, and updates the PSP's circuit breaker with the outcome of the push.
+// A push fails if there were provider-level errors and no deliveries succeeded.
+func (m *PushServiceManager) forwardResults(psp *PushServiceProvider, breaker *circuitBreaker, config CircuitBreakerConfig, results <-chan *Result, resQueue chan<- *Result) {
+	defer close(resQueue)
+	succeeded := false
+	var providerErr Error
+	for res := range results {
+		if res.Err == nil {
+			succeeded = true
+		} else if isProviderFailure(res.Err) {
+			providerErr = res.Err
+		}
+		resQueue <- res
+	}
+	switch {
+	case succeeded:
+		breaker.recordSuccess()
+	case providerErr != nil:
+		if breaker.recordFailure(time.Now(), config, providerErr) && m.errChan != nil {
+			status := breaker.status()
+			m.errChan <- NewErrorf("PushServiceProvider=%v CircuitBreaker=%v Not sending pushes until %v after %d consecutive failures: %v", psp.Name(), status.State, status.RetryAt.Format(time.RFC3339), status.ConsecutiveFailures, providerErr)
+		}
+	default:
+		breaker.recordInconclusive()
+	}
+}
+
+// rejectPush fails a push to each delivery point immediately, because the PSP's circuit breaker is open.
+func rejectPush(psp *PushServiceProvider, status CircuitBreakerStatus, dpQueue <-chan *DeliveryPoint, resQueue chan<- *Result, notif *Notification) {
+	defer close(resQueue)
+	err := NewPushServiceProviderUnavailable(psp, status.RetryAt, status.LastError)
+	for dp := range dpQueue {
+		resQueue <- &Result{
+			Provider:    psp,
+			Destination: dp,
+			Content:     notif,
+			Err:         err,
+		}
+	}
+}
+
 func (m *PushServiceManager) Preview(pushServiceType string, notif *Notification) ([]byte, Error) {
 	if pst, ok := m.serviceTypes[pushServiceType]; ok && pst != nil {
 		return pst.pst.Preview(notif)
@@ -207,11 +371,150 @@ func (m *PushServiceManager) SetErrorReportChan(errChan chan<- Error) {
 	}
 }
 
-func (m *PushServiceManager) SetConfigFile(c *conf.ConfigFile) {
+// SetConfigFile sets the config of each push service type, returning an error without setting anything if the config of a push service type is invalid (See ConfigValidator).
+func (m *PushServiceManager) SetConfigFile(c *conf.ConfigFile) error {
+	if err := m.ValidateConfigFile(c); err != nil {
+		return err
+	}
+	m.serviceConfigLock.Lock()
+	m.configFile = c
+	m.serviceConfigLock.Unlock()
+	for _, t := range m.serviceTypes {
+		m.setPushServiceConfig(t)
+	}
+	return nil
+}
+
+func (m *PushServiceManager) setPushServiceConfig(t *serviceType) {
+	c := NewPushServiceConfig(m.getConfigFile(), t.pst.Name())
+	m.setManagerConfig(t, c)
+	t.pst.SetPushServiceConfig(c)
+}
+
+func (m *PushServiceManager) getConfigFile() *conf.ConfigFile {
+	m.serviceConfigLock.RLock()
+	defer m.serviceConfigLock.RUnlock()
+	return m.configFile
+}
+
+// setManagerConfig sets the options of a push service type which are used by the push service manager, rather than by the push service type itself.
+func (m *PushServiceManager) setManagerConfig(t *serviceType, c *PushServiceConfig) {
+	rateLimitDefaults := loadRateLimitConfig(c)
+	circuitBreakerConfig := loadCircuitBreakerConfig(c)
+	m.serviceConfigLock.Lock()
+	defer m.serviceConfigLock.Unlock()
+	t.rateLimitDefaults = rateLimitDefaults
+	t.circuitBreakerConfig = circuitBreakerConfig
+}
+
+// managerOptions are the options in each push service type's section of uniqush.conf which are used by the push service manager (See setManagerConfig).
+var managerOptions = map[string]bool{
+	RATE_LIMIT:                true,
+	RATE_BURST:                true,
+	MAX_IN_FLIGHT:             true,
+	CIRCUIT_BREAKER_THRESHOLD: true,
+	CIRCUIT_BREAKER_COOLDOWN:  true,
+}
+
+// ConfigValidator is implemented by push service types with options which can be invalid (e.g. http_proxy),
+// so that uniqush-push fails to start, and /reload fails, instead of ignoring those options.
+type ConfigValidator interface {
+	// ValidatePushServiceConfig returns an error if the config for this push service type can't be used.
+	ValidatePushServiceConfig(c *PushServiceConfig) error
+}
+
+func validatePushServiceConfig(pst PushServiceType, c *conf.ConfigFile) error {
+	validator, ok := pst.(ConfigValidator)
+	if !ok {
+		return nil
+	}
+	if err := validator.ValidatePushServiceConfig(NewPushServiceConfig(c, pst.Name())); err != nil {
+		return fmt.Errorf("Invalid config for [%s]: %v", pst.Name(), err)
+	}
+	return nil
+}
+
+// ValidateConfigFile returns an error if the config of any registered push service type is invalid (See ConfigValidator).
+func (m *PushServiceManager) ValidateConfigFile(c *conf.ConfigFile) error {
+	m.serviceTypesLock.RLock()
+	defer m.serviceTypesLock.RUnlock()
+	names := make([]string, 0, len(m.serviceTypes))
+	for name := range m.serviceTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := validatePushServiceConfig(m.serviceTypes[name].pst, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigReloader is implemented by push service types which can apply a new config while pushes are being sent (e.g. APNS, which resizes its connection pools).
+type ConfigReloader interface {
+	// ReloadPushServiceConfig applies the new config for this push service type.
+	// It returns the options which changed but can't be applied until uniqush-push is restarted.
+	ReloadPushServiceConfig(c *PushServiceConfig) []string
+}
+
+// ReloadConfigFile applies a new uniqush.conf while pushes are being sent, returning the options (e.g. "[gcm] http_timeout") which changed but can't be applied until uniqush-push is restarted.
+// The limits on requests and circuit breakers are always applied. Other options are only applied to push service types implementing ConfigReloader,
+// because the others set them up once when they are registered.
+func (m *PushServiceManager) ReloadConfigFile(c *conf.ConfigFile) []string {
+	m.serviceConfigLock.Lock()
+	old := m.configFile
 	m.configFile = c
+	m.serviceConfigLock.Unlock()
+	// Push service types registered from now on use c.
+	m.serviceTypesLock.RLock()
+	serviceTypes := make(map[string]*serviceType, len(m.serviceTypes))
+	names := make([]string, 0, len(m.serviceTypes))
+	for name, t := range m.serviceTypes {
+		serviceTypes[name] = t
+		names = append(names, name)
+	}
+	m.serviceTypesLock.RUnlock()
+	sort.Strings(names)
+
+	var notApplied []string
+	for _, name := range names {
+		t := serviceTypes[name]
+		serviceConfig := NewPushServiceConfig(c, name)
+		m.setManagerConfig(t, serviceConfig)
+		var options []string
+		if reloader, ok := t.pst.(ConfigReloader); ok {
+			options = reloader.ReloadPushServiceConfig(serviceConfig)
+		} else {
+			for _, option := range ChangedOptions(old, c, name) {
+				if !managerOptions[option] {
+					options = append(options, option)
+				}
+			}
+		}
+		for _, option := range options {
+			notApplied = append(notApplied, fmt.Sprintf("[%s] %s", name, option))
+		}
+	}
+	return notApplied
+}
+
+// Drainer is implemented by push service types which process the results of pushes asynchronously, after Push returns (e.g. APNS),
+// so that these can finish before Finalize closes connections.
+type Drainer interface {
+	// Drain waits until results of pushes are no longer being processed, returning false if they still are at the deadline.
+	Drain(deadline time.Time) bool
+}
+
+// Drain waits for each push service type implementing Drainer, returning false if any of them timed out.
+func (m *PushServiceManager) Drain(deadline time.Time) bool {
+	drained := true
 	for _, t := range m.serviceTypes {
-		t.pst.SetPushServiceConfig(NewPushServiceConfig(m.configFile, t.pst.Name()))
+		if drainer, ok := t.pst.(Drainer); ok && !drainer.Drain(deadline) {
+			drained = false
+		}
 	}
+	return drained
 }
 
 func (m *PushServiceManager) Finalize() {
@@ -0,0 +1,111 @@
+package push
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/uniqush/goconf/conf"
+)
+
+func newTestConfigFile(options map[string]string) *conf.ConfigFile {
+	c := conf.NewConfigFile()
+	c.AddSection("testService")
+	for option, value := range options {
+		c.AddOption("testService", option, value)
+	}
+	return c
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	psm := newPushServiceManager()
+	if err := psm.RegisterPushServiceType(newTestPushServiceType()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	psm.SetConfigFile(newTestConfigFile(map[string]string{RATE_LIMIT: "10", "http_timeout": "5", "pool_size": "2"}))
+
+	c := newTestConfigFile(map[string]string{RATE_LIMIT: "20", "http_timeout": "10", "pool_size": "2"})
+	c.AddOption("default", "logfile", "/var/log/uniqush")
+	notApplied := psm.ReloadConfigFile(c)
+	// testPushServiceType doesn't implement ConfigReloader, so only the options used by the push service manager can be applied.
+	if expected := []string{"[testService] http_timeout"}; !reflect.DeepEqual(notApplied, expected) {
+		t.Errorf("Expected the options not applied to be %v, got %v", expected, notApplied)
+	}
+	if rate := psm.serviceTypes["testService"].rateLimitDefaults.Rate; rate != 20 {
+		t.Errorf("Expected the reloaded rate_limit to be 20, got %v", rate)
+	}
+}
+
+func TestReloadConfigFileWhileRegistering(t *testing.T) {
+	psm := newPushServiceManager()
+	psm.SetConfigFile(newTestConfigFile(map[string]string{RATE_LIMIT: "10"}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		psm.ReloadConfigFile(newTestConfigFile(map[string]string{RATE_LIMIT: "20"}))
+	}()
+	if err := psm.RegisterPushServiceType(newTestPushServiceType()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	<-done
+}
+
+// validatingPushServiceType rejects configs with an http_proxy.
+type validatingPushServiceType struct {
+	testPushServiceType
+}
+
+func (pst *validatingPushServiceType) ValidatePushServiceConfig(c *PushServiceConfig) error {
+	if proxy, err := c.GetString("http_proxy"); err == nil && proxy != "" {
+		return errors.New("invalid http_proxy")
+	}
+	return nil
+}
+
+func TestSetConfigFileInvalid(t *testing.T) {
+	psm := newPushServiceManager()
+	if err := psm.RegisterPushServiceType(&validatingPushServiceType{testPushServiceType{name: "testService"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := psm.SetConfigFile(newTestConfigFile(map[string]string{"http_proxy": "proxy"})); err == nil {
+		t.Error("Expected an error for an invalid config")
+	}
+	if psm.configFile != nil {
+		t.Error("Expected the invalid config not to be set")
+	}
+	if err := psm.SetConfigFile(newTestConfigFile(map[string]string{RATE_LIMIT: "10"})); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := psm.ValidateConfigFile(newTestConfigFile(map[string]string{"http_proxy": "proxy"})); err == nil {
+		t.Error("Expected an error validating an invalid config")
+	}
+}
+
+func TestChangedOptions(t *testing.T) {
+	old := newTestConfigFile(map[string]string{"a": "1", "b": "2", "c": "3"})
+	c := newTestConfigFile(map[string]string{"a": "1", "b": "4", "d": "5"})
+	if changed, expected := ChangedOptions(old, c, "testService"), []string{"b", "c", "d"}; !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Expected the changed options to be %v, got %v", expected, changed)
+	}
+	if changed := ChangedOptions(old, old, "testService"); len(changed) != 0 {
+		t.Errorf("Expected no changed options, got %v", changed)
+	}
+	if changed, expected := ChangedOptions(nil, c, "testService"), []string{"a", "b", "d"}; !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Expected every option to be changed from a nil config, got %v", changed)
+	}
+}
+
+func TestPushServiceTypeNames(t *testing.T) {
+	psm := newPushServiceManager()
+	for _, name := range []string{"webpush", "apns"} {
+		if err := psm.RegisterPushServiceType(&testPushServiceType{name: name}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if names, expected := psm.PushServiceTypeNames(), []string{"apns", "webpush"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected the push service types to be %v, got %v", expected, names)
+	}
+	if !psm.HasPushServiceType("apns") || psm.HasPushServiceType("gcm") {
+		t.Errorf("Expected only registered push service types to be found")
+	}
+}
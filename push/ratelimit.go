@@ -0,0 +1,153 @@
+package push
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Keys for limiting the requests sent to a push service. These may be set in a PSP's VolatileData (through /addpsp),
+// or as defaults for all PSPs in the section of uniqush.conf with the name of the push service type, e.g. [apns].
+const (
+	RATE_LIMIT    = "rate_limit"    // The maximum average number of requests per second. 0 means unlimited.
+	RATE_BURST    = "rate_burst"    // The maximum number of requests which may be sent at once, after a period of inactivity. Defaults to rate_limit, rounded up.
+	MAX_IN_FLIGHT = "max_in_flight" // The maximum number of requests which may be waiting for a response. 0 means unlimited.
+)
+
+// RateLimitConfig contains the limits on the requests sent to a push service by a PSP.
+type RateLimitConfig struct {
+	Rate        float64
+	Burst       int
+	MaxInFlight int
+}
+
+// IsUnlimited returns true if neither the rate of requests nor the number of requests in flight is limited.
+func (c RateLimitConfig) IsUnlimited() bool {
+	return c.Rate <= 0 && c.MaxInFlight <= 0
+}
+
+// withDefaultBurst returns a copy of c where a missing burst size is replaced with the rate limit, rounded up.
+func (c RateLimitConfig) withDefaultBurst() RateLimitConfig {
+	if c.Rate > 0 && c.Burst <= 0 {
+		c.Burst = int(c.Rate)
+		if float64(c.Burst) < c.Rate {
+			c.Burst++
+		}
+	}
+	return c
+}
+
+// ParseRateLimitConfig overrides the limits in defaults with any limits found in kv. An error is returned if any limit is invalid.
+func ParseRateLimitConfig(kv map[string]string, defaults RateLimitConfig) (RateLimitConfig, error) {
+	result := defaults
+	if value, ok := kv[RATE_LIMIT]; ok && value != "" {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 {
+			return defaults, fmt.Errorf("Invalid %s %q, expected a non-negative number of requests per second", RATE_LIMIT, value)
+		}
+		result.Rate = rate
+	}
+	if value, ok := kv[RATE_BURST]; ok && value != "" {
+		burst, err := strconv.Atoi(value)
+		if err != nil || burst < 0 {
+			return defaults, fmt.Errorf("Invalid %s %q, expected a non-negative integer", RATE_BURST, value)
+		}
+		result.Burst = burst
+	}
+	if value, ok := kv[MAX_IN_FLIGHT]; ok && value != "" {
+		maxInFlight, err := strconv.Atoi(value)
+		if err != nil || maxInFlight < 0 {
+			return defaults, fmt.Errorf("Invalid %s %q, expected a non-negative integer", MAX_IN_FLIGHT, value)
+		}
+		result.MaxInFlight = maxInFlight
+	}
+	return result, nil
+}
+
+// loadRateLimitConfig reads the default limits for a push service type from uniqush.conf. Invalid limits are ignored.
+func loadRateLimitConfig(c *PushServiceConfig) RateLimitConfig {
+	kv := make(map[string]string, 3)
+	for _, key := range []string{RATE_LIMIT, RATE_BURST, MAX_IN_FLIGHT} {
+		if value, err := c.GetString(key); err == nil {
+			kv[key] = value
+		}
+	}
+	result, err := ParseRateLimitConfig(kv, RateLimitConfig{})
+	if err != nil {
+		return RateLimitConfig{}
+	}
+	return result
+}
+
+// RateLimiter is a token bucket limiting the rate of requests, combined with a limit on the number of requests in flight.
+// Callers which exceed the limits block (i.e. the excess requests are queued) instead of failing.
+type RateLimiter struct {
+	config RateLimitConfig
+	// slots is nil if the number of requests in flight is unlimited.
+	slots chan struct{}
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a RateLimiter with the given limits. The bucket starts out full.
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	config = config.withDefaultBurst()
+	l := &RateLimiter{
+		config: config,
+		tokens: float64(config.Burst),
+		last:   time.Now(),
+	}
+	if config.MaxInFlight > 0 {
+		l.slots = make(chan struct{}, config.MaxInFlight)
+	}
+	return l
+}
+
+// Config returns the limits of this RateLimiter.
+func (l *RateLimiter) Config() RateLimitConfig {
+	return l.config
+}
+
+// Acquire blocks until a request may be sent. Release must be called once the request has finished.
+func (l *RateLimiter) Acquire() {
+	if l.slots != nil {
+		l.slots <- struct{}{}
+	}
+	if l.config.Rate <= 0 {
+		return
+	}
+	for {
+		wait := l.takeToken()
+		if wait <= 0 {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// takeToken takes a token from the bucket if one is available, and otherwise returns how long to wait for the next token.
+func (l *RateLimiter) takeToken() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.config.Rate
+	if max := float64(l.config.Burst); l.tokens > max {
+		l.tokens = max
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.config.Rate * float64(time.Second))
+}
+
+// Release marks a request acquired with Acquire as finished.
+func (l *RateLimiter) Release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,144 @@
+package push
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRateLimitConfig(t *testing.T) {
+	defaults := RateLimitConfig{Rate: 100, MaxInFlight: 10}
+	config, err := ParseRateLimitConfig(map[string]string{}, defaults)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config != defaults {
+		t.Errorf("Expected defaults %#v, got %#v", defaults, config)
+	}
+
+	config, err = ParseRateLimitConfig(map[string]string{RATE_LIMIT: "2.5", RATE_BURST: "5", MAX_IN_FLIGHT: "0"}, defaults)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := RateLimitConfig{Rate: 2.5, Burst: 5, MaxInFlight: 0}
+	if config != expected {
+		t.Errorf("Expected %#v, got %#v", expected, config)
+	}
+
+	for _, kv := range []map[string]string{
+		{RATE_LIMIT: "fast"},
+		{RATE_LIMIT: "-1"},
+		{RATE_BURST: "1.5"},
+		{MAX_IN_FLIGHT: "-3"},
+	} {
+		if _, err := ParseRateLimitConfig(kv, defaults); err == nil {
+			t.Errorf("Expected an error for %v", kv)
+		}
+	}
+}
+
+func TestRateLimiterDefaultBurst(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{Rate: 2.5})
+	if burst := limiter.Config().Burst; burst != 3 {
+		t.Errorf("Expected the burst to default to the rate rounded up (3), got %d", burst)
+	}
+}
+
+func TestRateLimiterMaxInFlight(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{MaxInFlight: 2})
+	limiter.Acquire()
+	limiter.Acquire()
+
+	acquired := make(chan bool)
+	go func() {
+		limiter.Acquire()
+		acquired <- true
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Expected the third request to wait until a request in flight was released")
+	case <-time.After(50 * time.Millisecond):
+	}
+	limiter.Release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the third request to be sent after a request in flight was released")
+	}
+}
+
+func TestRateLimiterRate(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{Rate: 20, Burst: 2})
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		limiter.Acquire()
+		limiter.Release()
+	}
+	// The first 2 requests are sent immediately, the next 2 are sent 50ms apart.
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Expected requests exceeding the burst to be delayed, took %v", elapsed)
+	}
+}
+
+func TestReleaseRequestSlotAfterLimitsChange(t *testing.T) {
+	psp := NewEmptyPushServiceProvider()
+	old := NewRateLimiter(RateLimitConfig{MaxInFlight: 1})
+	psp.setRateLimiter(old)
+	release := psp.AcquireRequestSlot()
+	// e.g. the limits were changed with /addpsp while the request was in progress.
+	psp.setRateLimiter(NewRateLimiter(RateLimitConfig{MaxInFlight: 1}))
+
+	released := make(chan bool)
+	go func() {
+		release()
+		released <- true
+	}()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request slot to be released without blocking")
+	}
+	old.Acquire()
+	old.Release()
+
+	psp.setRateLimiter(nil)
+	psp.AcquireRequestSlot()()
+}
+
+func TestBuildPushServiceProviderRateLimits(t *testing.T) {
+	psm := newPushServiceManager()
+	if err := psm.RegisterPushServiceType(newTestPushServiceType()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": "testService",
+		"service":         "myservice",
+		RATE_LIMIT:        "10",
+		MAX_IN_FLIGHT:     "4",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if psp.VolatileData[RATE_LIMIT] != "10" || psp.VolatileData[MAX_IN_FLIGHT] != "4" {
+		t.Errorf("Expected the limits to be stored in VolatileData, got %v", psp.VolatileData)
+	}
+	limiter := psm.getRateLimiter(psp)
+	if limiter == nil {
+		t.Fatal("Expected a rate limiter")
+	}
+	if psm.getRateLimiter(psp) != limiter {
+		t.Error("Expected the rate limiter to be reused for the same PSP")
+	}
+	psm.ForgetPushServiceProvider(psp)
+	if len(psm.rateLimiters) != 0 {
+		t.Errorf("Expected the rate limiter to be removed with the PSP, got %v", psm.rateLimiters)
+	}
+
+	_, err = psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": "testService",
+		"service":         "myservice",
+		MAX_IN_FLIGHT:     "many",
+	})
+	if err == nil {
+		t.Error("Expected an error for an invalid max_in_flight")
+	}
+}
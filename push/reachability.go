@@ -0,0 +1,58 @@
+package push
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReachabilityChecker is implemented by push service types which send pushes to fixed servers, so that /readyz can check that those servers can be reached.
+type ReachabilityChecker interface {
+	CheckReachability(timeout time.Duration) error
+}
+
+// HasPushServiceType returns whether a push service type with the given name (e.g. "apns") was registered.
+func (m *PushServiceManager) HasPushServiceType(name string) bool {
+	m.serviceTypesLock.RLock()
+	defer m.serviceTypesLock.RUnlock()
+	_, ok := m.serviceTypes[name]
+	return ok
+}
+
+// PushServiceTypeNames returns the sorted names of the registered push service types.
+func (m *PushServiceManager) PushServiceTypeNames() []string {
+	m.serviceTypesLock.RLock()
+	defer m.serviceTypesLock.RUnlock()
+	names := make([]string, 0, len(m.serviceTypes))
+	for name := range m.serviceTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckReachability checks whether the servers of each push service type implementing ReachabilityChecker can be reached, concurrently.
+// It returns the result for each push service type by name.
+func (m *PushServiceManager) CheckReachability(timeout time.Duration) map[string]error {
+	var wg sync.WaitGroup
+	var resultsLock sync.Mutex
+	results := make(map[string]error)
+	m.serviceTypesLock.RLock()
+	defer m.serviceTypesLock.RUnlock()
+	for name, pair := range m.serviceTypes {
+		checker, ok := pair.pst.(ReachabilityChecker)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, checker ReachabilityChecker) {
+			defer wg.Done()
+			err := checker.CheckReachability(timeout)
+			resultsLock.Lock()
+			defer resultsLock.Unlock()
+			results[name] = err
+		}(name, checker)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,209 @@
+package push
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// SecretFields are the keys of PSP FixedData and VolatileData holding credentials.
+// They are encrypted when PSPs are saved, if a key was set with SetSecretKeys, and redacted by /psps.
+var SecretFields = []string{
+	"apikey",            // gcm, fcm
+	"clientsecret",      // adm, hms
+	"token",             // adm's cached access token
+	"password",          // sms, smtp
+	"params",            // sms, may contain API keys
+	"headers",           // webhook, may contain authorization headers
+	"vapid_private_key", // webpush
+	"key_pem",           // apns
+}
+
+// encryptedSecretPrefix starts encrypted values, which have the form "enc:v1:<key id>:<base64 of nonce and ciphertext>".
+const encryptedSecretPrefix = "enc:v1:"
+
+type secretKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+var (
+	secretKeysLock   sync.RWMutex
+	currentSecretKey *secretKey
+	// secretKeysByID contains the current key and the old keys, which can only be used to decrypt.
+	secretKeysByID map[string]*secretKey
+)
+
+// IsSecretField returns whether a PSP field holds a credential (See SecretFields).
+func IsSecretField(key string) bool {
+	for _, field := range SecretFields {
+		if key == field {
+			return true
+		}
+	}
+	return false
+}
+
+func newSecretKey(key []byte) (*secretKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// The id lets old keys be found when decrypting, without revealing the key.
+	sum := sha256.Sum256(key)
+	return &secretKey{id: fmt.Sprintf("%x", sum[:4]), aead: aead}, nil
+}
+
+// SetSecretKeys sets the AES key (16, 24, or 32 bytes) used to encrypt the secret fields of PSPs when they are saved,
+// and old keys which are only used to decrypt PSPs saved before the key was rotated.
+// If current is empty, secret fields are saved in plaintext. Secret fields saved in plaintext can always be read.
+func SetSecretKeys(current []byte, old ...[]byte) error {
+	keys := make(map[string]*secretKey, len(old)+1)
+	for i, key := range old {
+		k, err := newSecretKey(key)
+		if err != nil {
+			return fmt.Errorf("Invalid old secrets key #%d: %v", i+1, err)
+		}
+		keys[k.id] = k
+	}
+	var currentKey *secretKey
+	if len(current) > 0 {
+		k, err := newSecretKey(current)
+		if err != nil {
+			return fmt.Errorf("Invalid secrets key: %v", err)
+		}
+		keys[k.id] = k
+		currentKey = k
+	}
+	secretKeysLock.Lock()
+	defer secretKeysLock.Unlock()
+	currentSecretKey = currentKey
+	secretKeysByID = keys
+	return nil
+}
+
+// HasSecretKey returns whether a key for encrypting secret fields was set with SetSecretKeys.
+func HasSecretKey() bool {
+	secretKeysLock.RLock()
+	defer secretKeysLock.RUnlock()
+	return currentSecretKey != nil
+}
+
+// IsEncryptedSecret returns whether a value was encrypted with one of the secrets keys.
+func IsEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, encryptedSecretPrefix)
+}
+
+func encryptSecret(value string) (string, error) {
+	secretKeysLock.RLock()
+	key := currentSecretKey
+	secretKeysLock.RUnlock()
+	if key == nil || IsEncryptedSecret(value) {
+		return value, nil
+	}
+	nonce := make([]byte, key.aead.NonceSize(), key.aead.NonceSize()+len(value)+key.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := key.aead.Seal(nonce, nonce, []byte(value), nil)
+	return encryptedSecretPrefix + key.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(value string) (string, error) {
+	if !IsEncryptedSecret(value) {
+		return value, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedSecretPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("Invalid encrypted secret")
+	}
+	secretKeysLock.RLock()
+	key := secretKeysByID[parts[0]]
+	secretKeysLock.RUnlock()
+	if key == nil {
+		return "", fmt.Errorf("No secrets key with id %q to decrypt secret", parts[0])
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("Invalid encrypted secret: %v", err)
+	}
+	nonceSize := key.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errors.New("Invalid encrypted secret: too short")
+	}
+	plaintext, err := key.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("Failed to decrypt secret with key %q: %v", parts[0], err)
+	}
+	return string(plaintext), nil
+}
+
+// encryptSecrets returns a copy of data with the secret fields encrypted. data is not modified.
+func encryptSecrets(data map[string]string) (map[string]string, error) {
+	result := make(map[string]string, len(data))
+	for k, v := range data {
+		if IsSecretField(k) {
+			encrypted, err := encryptSecret(v)
+			if err != nil {
+				return nil, err
+			}
+			v = encrypted
+		}
+		result[k] = v
+	}
+	return result, nil
+}
+
+// decryptSecrets decrypts the secret fields of data in place.
+func decryptSecrets(data map[string]string) error {
+	for k, v := range data {
+		if !IsSecretField(k) {
+			continue
+		}
+		decrypted, err := decryptSecret(v)
+		if err != nil {
+			return fmt.Errorf("Field %q: %v", k, err)
+		}
+		data[k] = decrypted
+	}
+	return nil
+}
+
+// Marshal serializes this PSP, encrypting the values of SecretFields if a key was set with SetSecretKeys.
+// The PSP's name is computed from the plaintext FixedData, so it does not change when keys are rotated.
+func (psp *PushServiceProvider) Marshal() []byte {
+	if psp.pushServiceType == nil {
+		return nil
+	}
+	fixedData, err := encryptSecrets(psp.FixedData)
+	if err != nil {
+		return nil
+	}
+	volatileData, err := encryptSecrets(psp.VolatileData)
+	if err != nil {
+		return nil
+	}
+	return marshalPushPeer(psp.pushServiceType.Name(), fixedData, volatileData)
+}
+
+// Unmarshal deserializes a PSP saved by Marshal, decrypting the values of SecretFields.
+func (psp *PushServiceProvider) Unmarshal(value []byte) error {
+	if err := psp.PushPeer.Unmarshal(value); err != nil {
+		return err
+	}
+	if err := decryptSecrets(psp.FixedData); err != nil {
+		return err
+	}
+	return decryptSecrets(psp.VolatileData)
+}
@@ -0,0 +1,92 @@
+package push
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func newTestSecretPSP() *PushServiceProvider {
+	psp := NewEmptyPushServiceProvider()
+	psp.pushServiceType = newTestPushServiceType()
+	psp.FixedData["service"] = "testServiceName"
+	psp.FixedData["clientsecret"] = "fixed-secret"
+	psp.VolatileData["apikey"] = "volatile-secret"
+	psp.VolatileData["addr"] = "https://example.com"
+	return psp
+}
+
+func unmarshalTestPSP(t *testing.T, value []byte) *PushServiceProvider {
+	psp := NewEmptyPushServiceProvider()
+	psp.pushServiceType = newTestPushServiceType()
+	parts := strings.SplitN(string(value), ":", 2)
+	if err := psp.Unmarshal([]byte(parts[1])); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	return psp
+}
+
+func TestPSPSecretsEncryption(t *testing.T) {
+	defer SetSecretKeys(nil)
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	psp := newTestSecretPSP()
+	name := psp.Name()
+
+	// Without a key, secrets are stored as plaintext.
+	if err := SetSecretKeys(nil); err != nil {
+		t.Fatal(err)
+	}
+	plaintext := psp.Marshal()
+	if !bytes.Contains(plaintext, []byte("volatile-secret")) {
+		t.Errorf("Expected plaintext secrets without a key, got %s", plaintext)
+	}
+
+	if err := SetSecretKeys(oldKey); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := psp.Marshal()
+	for _, secret := range []string{"fixed-secret", "volatile-secret"} {
+		if bytes.Contains(encrypted, []byte(secret)) {
+			t.Errorf("Expected %q to be encrypted in %s", secret, encrypted)
+		}
+	}
+	if !bytes.Contains(encrypted, []byte("https://example.com")) {
+		t.Errorf("Expected fields which aren't secret to remain plaintext in %s", encrypted)
+	}
+	if psp.FixedData["clientsecret"] != "fixed-secret" {
+		t.Errorf("Marshal modified the PSP: %v", psp.FixedData)
+	}
+
+	// PSPs saved before a key was set and PSPs saved with the current key can be read.
+	for _, value := range [][]byte{plaintext, encrypted} {
+		decoded := unmarshalTestPSP(t, value)
+		if decoded.FixedData["clientsecret"] != "fixed-secret" || decoded.VolatileData["apikey"] != "volatile-secret" {
+			t.Errorf("Unexpected decrypted data %v %v", decoded.FixedData, decoded.VolatileData)
+		}
+		if decoded.Name() != name {
+			t.Errorf("Expected name %q, got %q", name, decoded.Name())
+		}
+	}
+
+	// After rotation, PSPs encrypted with the old key can be read and are re-encrypted with the new key.
+	if err := SetSecretKeys(newKey, oldKey); err != nil {
+		t.Fatal(err)
+	}
+	reencrypted := unmarshalTestPSP(t, encrypted).Marshal()
+	if err := SetSecretKeys(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if decoded := unmarshalTestPSP(t, reencrypted); decoded.VolatileData["apikey"] != "volatile-secret" {
+		t.Errorf("Unexpected data after rotation %v", decoded.VolatileData)
+	}
+	parts := strings.SplitN(string(encrypted), ":", 2)
+	if err := NewEmptyPushServiceProvider().Unmarshal([]byte(parts[1])); err == nil {
+		t.Errorf("Expected an error decrypting with a removed key")
+	}
+
+	if err := SetSecretKeys([]byte("too short")); err == nil {
+		t.Errorf("Expected an error for an invalid key length")
+	}
+}
@@ -19,12 +19,25 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/uniqush/log"
 	"github.com/uniqush/uniqush-push/db"
 	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/util"
+)
+
+const (
+	// notificationCategoryKey is the optional category of a push, which subscribers can mute through /preferences.
+	notificationCategoryKey = "uniqush.category"
+	// notificationDedupKey is an optional key identifying a push. Pushes repeating it for a subscriber within notificationDedupTTLKey seconds are rejected.
+	notificationDedupKey    = "uniqush.dedup_key"
+	notificationDedupTTLKey = "uniqush.dedup_ttl"
+	defaultDedupTTL         = time.Hour
 )
 
 // PushBackEnd contains the data structures associated with sending pushes, managing subscriptions, and logging the results.
@@ -33,15 +46,80 @@ type PushBackEnd struct {
 	db      db.PushDatabase
 	loggers []log.Logger
 	errChan chan push.Error
+
+	frequencyCapsLock sync.RWMutex
+	// frequencyCaps maps lowercase service names (or "default") to the frequency cap for their subscribers.
+	frequencyCaps map[string]push.FrequencyCap
+
+	deliveryPointMaxAgesLock sync.RWMutex
+	// deliveryPointMaxAges maps lowercase service names (or "default") to how long delivery points are kept after they were last subscribed or successfully pushed to.
+	deliveryPointMaxAges map[string]time.Duration
+	// sweeperStop is closed to stop the goroutine removing expired delivery points (See StartDeliveryPointSweeper).
+	sweeperStop chan struct{}
+	sweeperDone sync.WaitGroup
+	// lastActive buffers the times of successful pushes to delivery points, which lastActiveFlush writes to the database in batches (See recordLastActive).
+	lastActiveLock  sync.Mutex
+	lastActive      map[string]time.Time
+	lastActiveFlush *time.Timer
+
+	certificatesLock sync.RWMutex
+	// certificates maps PSP names to the most recently checked certificates of PSPs, for /metrics.
+	certificates             map[string]*certificateStatus
+	certificateExpiryWarning time.Duration
+	// certificateMonitorStop is closed to stop the goroutine checking certificates (See StartCertificateMonitor).
+	certificateMonitorStop chan struct{}
+	certificateMonitorDone sync.WaitGroup
+
+	// retries counts the retries of pushes which are scheduled or in progress (See Drain).
+	retries util.PendingWork
+	// deferred are the pushes waiting for the end of the quiet hours of their subscriber, and resumes counts those being sent (See deferPush).
+	deferredLock    sync.Mutex
+	deferred        map[*deferredPush]bool
+	deferredStopped bool
+	resumes         util.PendingWork
+	// draining is closed by Drain, so that scheduled retries are sent immediately instead of waiting.
+	draining     chan struct{}
+	drainingOnce sync.Once
+	// errorsDone is closed once processError has handled every error reported by push services.
+	errorsDone chan struct{}
 }
 
 // Finalize will save all subscriptions (and perform other cleanup) as part of the push service shutting down.
 func (backend *PushBackEnd) Finalize() {
 	// TODO: Add an option to prevent calling SAVE in implementations such as redis.
 	// Users may want this if saving is time-consuming or already configured to happen periodically.
-	backend.db.FlushCache()
-	close(backend.errChan)
+	backend.stopDeliveryPointSweeper()
+	backend.stopCertificateMonitor()
+	backend.dropDeferredPushes()
+	// Close the connections to push services before errChan, so that they can still report the results of pushes while closing.
 	backend.psm.Finalize()
+	close(backend.errChan)
+	if backend.errorsDone != nil {
+		<-backend.errorsDone
+	}
+	backend.flushLastActive()
+	backend.db.FlushCache()
+}
+
+// Drain waits until scheduled retries have been sent and push services have processed the results of pushes, returning false if there is still work in progress at the deadline.
+// Retries are sent immediately once Drain is called. Pushes deferred until the end of quiet hours are dropped and logged, unless they're already being sent.
+// This should be called before Finalize, after the REST API stops accepting requests.
+func (backend *PushBackEnd) Drain(deadline time.Time) bool {
+	backend.drainingOnce.Do(func() {
+		if backend.draining != nil {
+			close(backend.draining)
+		}
+	})
+	backend.dropDeferredPushes()
+	for {
+		// Results of pushes may schedule retries, and retries may send pushes, so wait until neither has any work in progress.
+		if !backend.resumes.Wait(deadline) || !backend.retries.Wait(deadline) || !backend.psm.Drain(deadline) {
+			return false
+		}
+		if backend.retries.Idle() && backend.resumes.Idle() {
+			return true
+		}
+	}
 }
 
 // NewPushBackEnd creates and sets up the only instance of the push implementation.
@@ -51,19 +129,57 @@ func NewPushBackEnd(psm *push.PushServiceManager, database db.PushDatabase, logg
 	ret.db = database
 	ret.loggers = loggers
 	ret.errChan = make(chan push.Error)
+	ret.errorsDone = make(chan struct{})
+	ret.draining = make(chan struct{})
+	ret.certificateExpiryWarning = defaultCertificateExpiryWarning
 	go ret.processError()
 	psm.SetErrorReportChan(ret.errChan)
 	return ret
 }
 
+// SetFrequencyCaps replaces the frequency caps of services (See LoadFrequencyCaps).
+func (backend *PushBackEnd) SetFrequencyCaps(frequencyCaps map[string]push.FrequencyCap) {
+	backend.frequencyCapsLock.Lock()
+	defer backend.frequencyCapsLock.Unlock()
+	backend.frequencyCaps = frequencyCaps
+}
+
+func (backend *PushBackEnd) frequencyCap(service string) push.FrequencyCap {
+	backend.frequencyCapsLock.RLock()
+	defer backend.frequencyCapsLock.RUnlock()
+	if frequencyCap, ok := backend.frequencyCaps[strings.ToLower(service)]; ok {
+		return frequencyCap
+	}
+	return backend.frequencyCaps["default"]
+}
+
+// getDedupFromNotification returns the uniqush.dedup_key of a push (or "" if there is none) and how long it is remembered.
+func getDedupFromNotification(notif *push.Notification) (string, time.Duration, error) {
+	dedupKey := notif.Data[notificationDedupKey]
+	ttlValue, ok := notif.Data[notificationDedupTTLKey]
+	if !ok {
+		return dedupKey, defaultDedupTTL, nil
+	}
+	ttl, err := strconv.Atoi(ttlValue)
+	if err != nil || ttl <= 0 {
+		return "", 0, fmt.Errorf("invalid %s %q, expected a positive number of seconds", notificationDedupTTLKey, ttlValue)
+	}
+	return dedupKey, time.Duration(ttl) * time.Second, nil
+}
+
 // AddPushServiceProvider is used by /addpsp to add a push service provider (for a service+push type) to the database.
 func (backend *PushBackEnd) AddPushServiceProvider(service string, psp *push.PushServiceProvider) error {
 	return backend.db.AddPushServiceProviderToService(service, psp)
 }
 
 // RemovePushServiceProvider is used by /rmpsp to remove a push service provider (for a service+push type) from the database.
+// The PSP's rate limiter and circuit breaker are also removed.
 func (backend *PushBackEnd) RemovePushServiceProvider(service string, psp *push.PushServiceProvider) error {
-	return backend.db.RemovePushServiceProviderFromService(service, psp)
+	if err := backend.db.RemovePushServiceProviderFromService(service, psp); err != nil {
+		return err
+	}
+	backend.psm.ForgetPushServiceProvider(psp)
+	return nil
 }
 
 // GetPushServiceProviderConfigs lists all known push service providers for /psps.
@@ -81,7 +197,59 @@ func (backend *PushBackEnd) Unsubscribe(service, sub string, dp *push.DeliveryPo
 	return backend.db.RemoveDeliveryPointFromService(service, sub, dp)
 }
 
+// GetSubscriberPreferences returns the preferences of a service+subscriber, or nil if none were set.
+func (backend *PushBackEnd) GetSubscriberPreferences(service, sub string) (*push.SubscriberPreferences, error) {
+	return backend.db.GetSubscriberPreferences(service, sub)
+}
+
+// SetSubscriberPreferences replaces the preferences of a service+subscriber in the database.
+func (backend *PushBackEnd) SetSubscriberPreferences(service, sub string, prefs *push.SubscriberPreferences) error {
+	return backend.db.SetSubscriberPreferences(service, sub, prefs)
+}
+
+// ReserveIdempotencyKey reserves the idempotency key of a /push request, or returns the stored response of the request which used it (See db.PushDatabase).
+func (backend *PushBackEnd) ReserveIdempotencyKey(service string, key string, pendingTTL time.Duration) (bool, []byte, error) {
+	return backend.db.ReserveIdempotencyKey(service, key, pendingTTL)
+}
+
+// SetIdempotentResponse stores the response of the /push request which reserved an idempotency key.
+func (backend *PushBackEnd) SetIdempotentResponse(service string, key string, response []byte, ttl time.Duration) error {
+	return backend.db.SetIdempotentResponse(service, key, response, ttl)
+}
+
+// SubscribeBatch adds many delivery points (subscriptions) to the database at once, returning the selected PSP or error for each.
+func (backend *PushBackEnd) SubscribeBatch(subscriptions []db.Subscription) ([]*push.PushServiceProvider, []error) {
+	return backend.db.AddDeliveryPointsToService(subscriptions)
+}
+
+// UnsubscribeBatch removes many delivery points (subscriptions) from the database at once, returning an error (or nil) for each.
+func (backend *PushBackEnd) UnsubscribeBatch(subscriptions []db.Subscription) []error {
+	return backend.db.RemoveDeliveryPointsFromService(subscriptions)
+}
+
+// UnsubscribeAll removes every delivery point (subscription) of a service+subscriber, returning the subscriptions found and an error (or nil) for each.
+func (backend *PushBackEnd) UnsubscribeAll(service, sub string) ([]db.SubscriptionRef, []error, error) {
+	return backend.db.RemoveAllDeliveryPointsFromServiceSubscriber(service, sub)
+}
+
+// UnsubscribeDevice removes every subscription of a device token (e.g. an APNs devtoken or a GCM regid), across all services and subscribers,
+// or only the services starting with servicePrefix if it's non-empty.
+func (backend *PushBackEnd) UnsubscribeDevice(field, token, servicePrefix string) ([]db.SubscriptionRef, []error, error) {
+	return backend.db.RemoveDeliveryPointsOfDevice(field, token, servicePrefix)
+}
+
+// GetServiceNames returns the names of all services with push service providers.
+func (backend *PushBackEnd) GetServiceNames() ([]string, error) {
+	return backend.db.GetServiceNames()
+}
+
+// AdmitTenantPushes checks whether count more pushes by a tenant exceed its quota, counting them if not (See db.PushDatabase).
+func (backend *PushBackEnd) AdmitTenantPushes(tenant string, count int, quota push.FrequencyCap) (bool, error) {
+	return backend.db.AdmitTenantPushes(tenant, count, quota)
+}
+
 func (backend *PushBackEnd) processError() {
+	defer close(backend.errorsDone)
 	for err := range backend.errChan {
 		rid := randomUniqID()
 		nullHandler := &NullAPIResponseHandler{}
@@ -130,6 +298,7 @@ func (backend *PushBackEnd) fixError(
 }
 
 // fixRetryError will retry sending the push with longer and longer intervals, and give up when the interval exceeds 1 minute.
+// Once Drain is called, retries are sent without waiting for the interval.
 func (backend *PushBackEnd) fixRetryError(
 	err *push.RetryError,
 	reqID string,
@@ -163,8 +332,16 @@ func (backend *PushBackEnd) fixRetryError(
 		return
 	}
 	logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Retry after %v", reqID, service, sub, providerName, destinationName, after)
+	if listener, ok := handler.(retryListener); ok {
+		listener.retryScheduled()
+	}
+	backend.retries.Add()
 	go func() {
-		<-time.After(after)
+		defer backend.retries.Done()
+		select {
+		case <-time.After(after):
+		case <-backend.draining:
+		}
 		subs := make([]string, 1)
 		subs[0] = sub
 		after = 2 * after
@@ -312,6 +489,14 @@ func getProviderNameOrUnknown(provider *push.PushServiceProvider) string {
 	return "Unknown"
 }
 
+func getPushServiceTypeOrUnknown(provider *push.PushServiceProvider) string {
+	if provider != nil {
+		return provider.PushServiceName()
+	}
+	return "Unknown"
+}
+
+// collectResult logs the results of sending a push to the delivery points of a PSP, which started at start, and adds them to the handler.
 func (backend *PushBackEnd) collectResult(
 	reqID string,
 	remoteAddr string,
@@ -320,6 +505,7 @@ func (backend *PushBackEnd) collectResult(
 	logger log.Logger,
 	after time.Duration,
 	handler APIResponseHandler,
+	start time.Time,
 ) {
 	for res := range resChan {
 		var sub string
@@ -345,15 +531,27 @@ func (backend *PushBackEnd) collectResult(
 			dpName := getDeliveryPointNameOrUnknown(res.Destination)
 			pspName := getProviderNameOrUnknown(res.Provider)
 			msgID := res.MsgID
-			logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v MsgID=%v Success!", reqID, service, subRepr, pspName, dpName, msgID)
+			logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v PushServiceType=%v Code=%v Latency=%v MsgID=%v Success!", reqID, service, subRepr, pspName, dpName, getPushServiceTypeOrUnknown(res.Provider), UNIQUSH_SUCCESS, time.Since(start), msgID)
+			if res.Destination != nil {
+				// This is used to expire delivery points which haven't been successfully pushed to in a long time.
+				backend.recordLastActive(dpName, time.Now())
+			}
 			handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, MessageId: &msgID, Code: UNIQUSH_SUCCESS})
 			continue
 		}
+		if unavailableErr, isUnavailable := res.Err.(*push.PushServiceProviderUnavailable); isUnavailable {
+			// The circuit breaker for this PSP is open. The failure which opened it was already logged, so avoid logging this for each delivery point.
+			dpName := getDeliveryPointNameOrUnknown(res.Destination)
+			pspName := getProviderNameOrUnknown(res.Provider)
+			logger.Debugf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v PushServiceType=%v Code=%v Failed: %v", reqID, service, subRepr, pspName, dpName, getPushServiceTypeOrUnknown(res.Provider), UNIQUSH_ERROR_PSP_UNAVAILABLE, unavailableErr)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_PSP_UNAVAILABLE, ErrorMsg: strPtrOfErr(unavailableErr)})
+			continue
+		}
 		err := backend.fixError(reqID, remoteAddr, res.Err, logger, after, handler)
 		if err != nil {
 			dpName := getDeliveryPointNameOrUnknown(res.Destination)
 			pspName := getProviderNameOrUnknown(res.Provider)
-			logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failed: %v", reqID, service, subRepr, pspName, dpName, err)
+			logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v PushServiceType=%v Code=%v Latency=%v Failed: %v", reqID, service, subRepr, pspName, dpName, getPushServiceTypeOrUnknown(res.Provider), UNIQUSH_ERROR_GENERIC, time.Since(start), err)
 			handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)})
 		}
 	}
@@ -405,9 +603,45 @@ func (backend *PushBackEnd) RebuildServiceSet() error {
 	return backend.db.RebuildServiceSet()
 }
 
+// Ping checks the connections to the database for /readyz, returning the result of each by name.
+func (backend *PushBackEnd) Ping() map[string]error {
+	return backend.db.Ping()
+}
+
+// ReencryptPushServiceProviders saves every PSP with its secrets encrypted with the current secrets key, returning the number of PSPs saved.
+func (backend *PushBackEnd) ReencryptPushServiceProviders() (int, error) {
+	if !push.HasSecretKey() {
+		return 0, errors.New("No secrets key is configured")
+	}
+	return backend.db.ReencryptPushServiceProviders()
+}
+
+// AddAuditEntry appends an entry to the audit log, keeping about maxEntries entries (or every entry, if 0).
+func (backend *PushBackEnd) AddAuditEntry(entry *db.AuditEntry, maxEntries int64) error {
+	return backend.db.AddAuditEntry(entry, maxEntries)
+}
+
+// GetAuditEntries returns up to count entries of the audit log added before the entry with the ID before (if non-empty), newest first.
+func (backend *PushBackEnd) GetAuditEntries(before string, count int64) ([]*db.AuditEntry, error) {
+	return backend.db.GetAuditEntries(before, count)
+}
+
 // Push will send a push notification to the given subscriber(s) of a push service.
-func (backend *PushBackEnd) Push(reqID string, remoteAddr string, service string, subs []string, dpNamesRequested []string, notif *push.Notification, perdp map[string][]string, logger log.Logger, handler APIResponseHandler) {
-	backend.pushImpl(reqID, remoteAddr, service, subs, dpNamesRequested, notif, perdp, logger, nil, nil, 0*time.Second, handler)
+// If fallback is non-empty, each subscriber is only sent pushes with the first push service type in fallback which delivers the push (See pushWithFallback).
+func (backend *PushBackEnd) Push(reqID string, remoteAddr string, service string, subs []string, dpNamesRequested []string, notif *push.Notification, perdp map[string][]string, fallback []string, logger log.Logger, handler APIResponseHandler) {
+	if len(fallback) == 0 {
+		backend.pushImpl(reqID, remoteAddr, service, subs, dpNamesRequested, notif, perdp, logger, nil, nil, 0*time.Second, handler)
+		return
+	}
+	wg := new(sync.WaitGroup)
+	for _, sub := range subs {
+		wg.Add(1)
+		go func(sub string) {
+			backend.pushWithFallback(reqID, remoteAddr, service, sub, dpNamesRequested, notif, perdp, fallback, logger, handler)
+			wg.Done()
+		}(sub)
+	}
+	wg.Wait()
 }
 
 // pushImpl will fetch subscriptions and send push notifications using the corresponding service.
@@ -426,16 +660,23 @@ func (backend *PushBackEnd) pushImpl(
 	after time.Duration,
 	handler APIResponseHandler,
 ) {
-	// dpChanMap maps a PushServiceProvider(by name) to a list of delivery points to send data to (from various subscriptions).
-	// If there are multiple subscriptions, lazily adding to a channel is probably faster than passing a list,
-	// because you'd need to fetch all subscriptions from the DB before starting to push otherwise.
-	dpChanMap := make(map[string]chan *push.DeliveryPoint)
-	// wg is used to wait for all pushes and push responses to complete before returning.
-	wg := new(sync.WaitGroup)
+	dispatcher := backend.newPushDispatcher(reqID, remoteAddr, service, notif, perdp, logger, after, handler)
 
 	// Loop over all subscriptions, fetching the list of corresponding delivery points to send to from the db, starting to push and send pushes.
 	for _, sub := range subs {
-		dpidx := 0
+		if provider == nil || dest == nil {
+			// Retries already passed this check.
+			sub := sub
+			resume := func() {
+				backend.pushImpl(reqID, remoteAddr, service, []string{sub}, dpNamesRequested, notif, perdp, backend.loggers[LoggerPush], nil, nil, 0*time.Second, &NullAPIResponseHandler{})
+			}
+			if !backend.checkPreferences(reqID, remoteAddr, service, sub, notif, logger, handler, resume) {
+				continue
+			}
+			if !backend.admitPush(reqID, remoteAddr, service, sub, notif, logger, handler) {
+				continue
+			}
+		}
 		var pspDpList []db.PushServiceProviderDeliveryPointPair
 		if provider != nil && dest != nil {
 			// Note: subs always has length 1 when dest != nil
@@ -458,59 +699,301 @@ func (backend *PushBackEnd) pushImpl(
 			continue
 		}
 
+		dispatcher.dispatch(sub, pspDpList)
+	}
+	dispatcher.wait()
+}
+
+// pushWithFallback sends a push to the delivery points of sub with the first push service type in fallback for which sub has delivery points.
+// If none of those delivery points report success or schedule a retry (e.g. every push fails or is dropped), it moves on to the next push service type.
+func (backend *PushBackEnd) pushWithFallback(
+	reqID string,
+	remoteAddr string,
+	service string,
+	sub string,
+	dpNamesRequested []string,
+	notif *push.Notification,
+	perdp map[string][]string,
+	fallback []string,
+	logger log.Logger,
+	handler APIResponseHandler,
+) {
+	resume := func() {
+		backend.pushWithFallback(reqID, remoteAddr, service, sub, dpNamesRequested, notif, perdp, fallback, backend.loggers[LoggerPush], &NullAPIResponseHandler{})
+	}
+	if !backend.checkPreferences(reqID, remoteAddr, service, sub, notif, logger, handler, resume) {
+		return
+	}
+	if !backend.admitPush(reqID, remoteAddr, service, sub, notif, logger, handler) {
+		return
+	}
+	pspDpList, err := backend.db.GetPushServiceProviderDeliveryPointPairs(service, sub, dpNamesRequested)
+	if err != nil {
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed: Database Error: %v", reqID, service, sub, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)})
+		return
+	}
+
+	triedTier := false
+	for _, pushServiceType := range fallback {
+		var tierPairs []db.PushServiceProviderDeliveryPointPair
 		for _, pair := range pspDpList {
-			psp := pair.PushServiceProvider
-			dp := pair.DeliveryPoint
-			if psp == nil {
-				logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed once: nil Push Service Provider", reqID, service, sub)
-				handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_NO_PUSH_SERVICE_PROVIDER})
-				continue
-			}
-			if dp == nil {
-				logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed once: nil Delivery Point", reqID, service, sub)
-				handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_NO_DELIVERY_POINT})
-				continue
+			if pair.PushServiceProvider != nil && pair.PushServiceProvider.PushServiceName() == pushServiceType {
+				tierPairs = append(tierPairs, pair)
 			}
-			var dpQueue chan *push.DeliveryPoint
-			var ok bool
-			if dpQueue, ok = dpChanMap[psp.Name()]; !ok {
-				dpQueue = make(chan *push.DeliveryPoint)
-				dpChanMap[psp.Name()] = dpQueue
-				resChan := make(chan *push.Result)
-				wg.Add(1)
-				note := notif
-				if len(perdp) > 0 {
-					note = notif.Clone()
-					for k, v := range perdp {
-						value := v[dpidx%len(v)]
-						note.Data[k] = value
-					}
-					dpidx++
+		}
+		if len(tierPairs) == 0 {
+			continue
+		}
+		triedTier = true
+		tierHandler := newFallbackTierHandler(handler, pushServiceType)
+		dispatcher := backend.newPushDispatcher(reqID, remoteAddr, service, notif, perdp, logger, 0*time.Second, tierHandler)
+		dispatcher.dispatch(sub, tierPairs)
+		dispatcher.wait()
+		if tierHandler.delivered() {
+			logger.Infof("RequestID=%v Service=%v Subscriber=%v FallbackTier=%v Delivered", reqID, service, sub, pushServiceType)
+			return
+		}
+		if tierHandler.retrying() {
+			// Falling back would notify the subscriber twice if the retry succeeds.
+			logger.Infof("RequestID=%v Service=%v Subscriber=%v FallbackTier=%v Retrying, not trying the next tier", reqID, service, sub, pushServiceType)
+			return
+		}
+		logger.Infof("RequestID=%v Service=%v Subscriber=%v FallbackTier=%v Not delivered, trying the next tier", reqID, service, sub, pushServiceType)
+	}
+
+	if !triedTier {
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed: No device for fallback tiers %v", reqID, service, sub, fallback)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_NO_DEVICE})
+		return
+	}
+	logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed: Every fallback tier failed", reqID, service, sub)
+}
+
+// checkPreferences returns true if the push should be sent to sub now.
+// If sub muted the uniqush.category of the push, it is dropped.
+// If sub is in quiet hours, resume is called once they end. Deferred pushes are only kept in memory, and are dropped (and logged) if uniqush-push is stopped.
+func (backend *PushBackEnd) checkPreferences(
+	reqID string,
+	remoteAddr string,
+	service string,
+	sub string,
+	notif *push.Notification,
+	logger log.Logger,
+	handler APIResponseHandler,
+	resume func(),
+) bool {
+	prefs, err := backend.db.GetSubscriberPreferences(service, sub)
+	if err != nil {
+		// Sending a push the subscriber didn't want is better than losing one they did.
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v Could not get preferences, sending anyway: %v", reqID, service, sub, err)
+		return true
+	}
+	if prefs == nil {
+		return true
+	}
+	category := notif.Data[notificationCategoryKey]
+	if prefs.IsMuted(category) {
+		logger.Infof("RequestID=%v Service=%v Subscriber=%v Category=%v Suppressed: Muted", reqID, service, sub, category)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_SUPPRESSED_MUTED})
+		return false
+	}
+	now := time.Now()
+	if end, quiet := prefs.QuietHoursEnd(now); quiet {
+		deferredUntil := end.UTC().Format(time.RFC3339)
+		logger.Infof("RequestID=%v Service=%v Subscriber=%v Deferred until %v: Quiet hours", reqID, service, sub, deferredUntil)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_DEFERRED_QUIET_HOURS, DeferredUntil: &deferredUntil})
+		backend.deferPush(reqID, service, sub, end, resume)
+		return false
+	}
+	return true
+}
+
+// admitPush returns true if the push should be sent to sub, i.e. it doesn't repeat a recent uniqush.dedup_key for sub and doesn't exceed the frequency cap of the service.
+// This is checked and recorded atomically in the database, before any push service is contacted.
+func (backend *PushBackEnd) admitPush(
+	reqID string,
+	remoteAddr string,
+	service string,
+	sub string,
+	notif *push.Notification,
+	logger log.Logger,
+	handler APIResponseHandler,
+) bool {
+	// The API already validated uniqush.dedup_ttl.
+	dedupKey, dedupTTL, _ := getDedupFromNotification(notif)
+	frequencyCap := backend.frequencyCap(service)
+	if dedupKey == "" && !frequencyCap.IsEnabled() {
+		return true
+	}
+	admission, err := backend.db.AdmitPush(service, sub, dedupKey, dedupTTL, frequencyCap)
+	if err != nil {
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed: Database Error: %v", reqID, service, sub, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)})
+		return false
+	}
+	switch admission {
+	case db.PushDuplicate:
+		logger.Infof("RequestID=%v Service=%v Subscriber=%v DedupKey=%v Rejected: Duplicate", reqID, service, sub, dedupKey)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_REJECTED_DUPLICATE})
+		return false
+	case db.PushFrequencyCapped:
+		logger.Infof("RequestID=%v Service=%v Subscriber=%v FrequencyCap=%v Rejected: Frequency cap exceeded", reqID, service, sub, frequencyCap)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_REJECTED_FREQUENCY_CAP})
+		return false
+	}
+	return true
+}
+
+// pushDispatcher groups the delivery points of a push by PushServiceProvider, sending to each PSP and collecting the results asynchronously.
+type pushDispatcher struct {
+	backend    *PushBackEnd
+	reqID      string
+	remoteAddr string
+	service    string
+	notif      *push.Notification
+	perdp      map[string][]string
+	logger     log.Logger
+	after      time.Duration
+	handler    APIResponseHandler
+	// dpChanMap maps a PushServiceProvider(by name) to a list of delivery points to send data to (from various subscriptions).
+	// If there are multiple subscriptions, lazily adding to a channel is probably faster than passing a list,
+	// because you'd need to fetch all subscriptions from the DB before starting to push otherwise.
+	dpChanMap map[string]chan *push.DeliveryPoint
+	// wg is used to wait for all pushes and push responses to complete before returning.
+	wg *sync.WaitGroup
+}
+
+func (backend *PushBackEnd) newPushDispatcher(reqID string, remoteAddr string, service string, notif *push.Notification, perdp map[string][]string, logger log.Logger, after time.Duration, handler APIResponseHandler) *pushDispatcher {
+	return &pushDispatcher{
+		backend:    backend,
+		reqID:      reqID,
+		remoteAddr: remoteAddr,
+		service:    service,
+		notif:      notif,
+		perdp:      perdp,
+		logger:     logger,
+		after:      after,
+		handler:    handler,
+		dpChanMap:  make(map[string]chan *push.DeliveryPoint),
+		wg:         new(sync.WaitGroup),
+	}
+}
+
+// dispatch starts sending the push to the delivery points of one subscriber.
+func (d *pushDispatcher) dispatch(sub string, pspDpList []db.PushServiceProviderDeliveryPointPair) {
+	reqID, remoteAddr, service := d.reqID, d.remoteAddr, d.service
+	dpidx := 0
+	for _, pair := range pspDpList {
+		psp := pair.PushServiceProvider
+		dp := pair.DeliveryPoint
+		if psp == nil {
+			d.logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed once: nil Push Service Provider", reqID, service, sub)
+			d.handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_NO_PUSH_SERVICE_PROVIDER})
+			continue
+		}
+		if dp == nil {
+			d.logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed once: nil Delivery Point", reqID, service, sub)
+			d.handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_NO_DELIVERY_POINT})
+			continue
+		}
+		var dpQueue chan *push.DeliveryPoint
+		var ok bool
+		if dpQueue, ok = d.dpChanMap[psp.Name()]; !ok {
+			dpQueue = make(chan *push.DeliveryPoint)
+			d.dpChanMap[psp.Name()] = dpQueue
+			resChan := make(chan *push.Result)
+			d.wg.Add(1)
+			note := d.notif
+			if len(d.perdp) > 0 {
+				note = d.notif.Clone()
+				for k, v := range d.perdp {
+					value := v[dpidx%len(v)]
+					note.Data[k] = value
 				}
-				// Make the pushservicemanager send to (each delivery point of) the PSP asyncronously
-				go func() {
-					backend.psm.Push(psp, dpQueue, resChan, note)
-					wg.Done()
-				}()
-				wg.Add(1)
-				// Wait for the response from the PSP asynchronously
-				go func() {
-					// Note: if this is a retry, the duration `after` will increase, and fixError will account for that when deciding to retry
-					backend.collectResult(reqID, remoteAddr, service, resChan, logger, after, handler)
-					wg.Done()
-				}()
+				dpidx++
 			}
-
-			// Add this delivery point to the group for that psp.Name()
-			dpQueue <- dp
+			start := time.Now()
+			// Make the pushservicemanager send to (each delivery point of) the PSP asyncronously
+			go func() {
+				d.backend.psm.Push(psp, dpQueue, resChan, note)
+				d.wg.Done()
+			}()
+			d.wg.Add(1)
+			// Wait for the response from the PSP asynchronously
+			go func() {
+				// Note: if this is a retry, the duration `after` will increase, and fixError will account for that when deciding to retry
+				d.backend.collectResult(reqID, remoteAddr, service, resChan, d.logger, d.after, d.handler, start)
+				d.wg.Done()
+			}()
 		}
+
+		// Add this delivery point to the group for that psp.Name()
+		dpQueue <- dp
 	}
+}
+
+// wait signals that there are no more delivery points, and waits for every push and result to be processed.
+func (d *pushDispatcher) wait() {
 	// Signal that there are no more delivery points so that goroutines can stop reading the next delivery point.
-	for _, dpch := range dpChanMap {
+	for _, dpch := range d.dpChanMap {
 		close(dpch)
 	}
-	// Wait for every goroutine started by this method to finish.
-	wg.Wait()
+	// Wait for every goroutine started by this dispatcher to finish.
+	d.wg.Wait()
+}
+
+// retryListener is implemented by APIResponseHandlers which need to know when fixRetryError schedules a retry of a push.
+type retryListener interface {
+	retryScheduled()
+}
+
+// fallbackTierHandler forwards the results of one tier of a push with uniqush.fallback, recording whether any delivery point succeeded or will be retried.
+type fallbackTierHandler struct {
+	APIResponseHandler
+	tier             string
+	mutex            sync.Mutex
+	succeeded        bool
+	retriesScheduled bool
+}
+
+var _ APIResponseHandler = &fallbackTierHandler{}
+var _ retryListener = &fallbackTierHandler{}
+
+func newFallbackTierHandler(handler APIResponseHandler, tier string) *fallbackTierHandler {
+	return &fallbackTierHandler{APIResponseHandler: handler, tier: tier}
+}
+
+// AddDetailsToHandler records the tier in the details, and forwards them to the handler of the push.
+func (handler *fallbackTierHandler) AddDetailsToHandler(v APIResponseDetails) {
+	tier := handler.tier
+	v.FallbackTier = &tier
+	if v.Code == UNIQUSH_SUCCESS && v.DeliveryPoint != nil {
+		handler.mutex.Lock()
+		handler.succeeded = true
+		handler.mutex.Unlock()
+	}
+	handler.APIResponseHandler.AddDetailsToHandler(v)
+}
+
+// delivered returns true if the push was sent to at least one delivery point of this tier.
+func (handler *fallbackTierHandler) delivered() bool {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	return handler.succeeded
+}
+
+func (handler *fallbackTierHandler) retryScheduled() {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	handler.retriesScheduled = true
+}
+
+// retrying returns true if the push to a delivery point of this tier will be retried.
+func (handler *fallbackTierHandler) retrying() bool {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	return handler.retriesScheduled
 }
 
 // Preview will return the payload data (usually JSON) that would be sent to the given push service type for the given API params.
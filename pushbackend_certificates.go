@@ -0,0 +1,147 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	// defaultCertificateExpiryWarning is how long before a PSP's certificate expires that warnings are logged, if warning_days isn't set in [CertificateExpiry].
+	defaultCertificateExpiryWarning = 30 * 24 * time.Hour
+	// defaultCertificateCheckInterval is how often the certificates of all PSPs are checked, if check_interval isn't set in [CertificateExpiry].
+	defaultCertificateCheckInterval = 24 * time.Hour
+)
+
+// certificateStatus is the most recently checked certificate of a PSP, for /metrics.
+type certificateStatus struct {
+	service         string
+	pspName         string
+	pushServiceType string
+	info            push.CertificateInfo
+}
+
+// SetCertificateExpiryWarning sets how long before a PSP's certificate expires that warnings are logged and the certificate is reported as expiring in /metrics.
+func (backend *PushBackEnd) SetCertificateExpiryWarning(warning time.Duration) {
+	backend.certificatesLock.Lock()
+	defer backend.certificatesLock.Unlock()
+	backend.certificateExpiryWarning = warning
+}
+
+func (backend *PushBackEnd) getCertificateExpiryWarning() time.Duration {
+	backend.certificatesLock.RLock()
+	defer backend.certificatesLock.RUnlock()
+	return backend.certificateExpiryWarning
+}
+
+// StartCertificateMonitor checks the certificates of all PSPs now and every interval, until Finalize is called.
+func (backend *PushBackEnd) StartCertificateMonitor(interval time.Duration) {
+	stop := make(chan struct{})
+	backend.certificateMonitorStop = stop
+	backend.certificateMonitorDone.Add(1)
+	go func() {
+		defer backend.certificateMonitorDone.Done()
+		backend.checkCertificates(time.Now())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				backend.checkCertificates(time.Now())
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopCertificateMonitor stops the goroutine started by StartCertificateMonitor.
+func (backend *PushBackEnd) stopCertificateMonitor() {
+	if backend.certificateMonitorStop == nil {
+		return
+	}
+	close(backend.certificateMonitorStop)
+	backend.certificateMonitorDone.Wait()
+	backend.certificateMonitorStop = nil
+}
+
+// checkCertificates checks the certificates of all PSPs, replacing the statuses reported in /metrics.
+func (backend *PushBackEnd) checkCertificates(now time.Time) {
+	logger := backend.loggers[LoggerPSPs]
+	psps, err := backend.db.GetPushServiceProviderConfigs()
+	if err != nil {
+		// Some PSPs may still have been returned.
+		logger.Errorf("Failed to get PSPs to check their certificates: %v", err)
+	}
+	statuses := make(map[string]*certificateStatus)
+	for _, psp := range psps {
+		if status := backend.inspectCertificate(psp, now, logger); status != nil {
+			statuses[status.pspName] = status
+		}
+	}
+	backend.certificatesLock.Lock()
+	defer backend.certificatesLock.Unlock()
+	backend.certificates = statuses
+}
+
+// checkCertificate checks the certificate of a PSP added or updated through /addpsp.
+func (backend *PushBackEnd) checkCertificate(psp *push.PushServiceProvider, now time.Time, logger log.Logger) {
+	status := backend.inspectCertificate(psp, now, logger)
+	if status == nil {
+		return
+	}
+	backend.certificatesLock.Lock()
+	defer backend.certificatesLock.Unlock()
+	if backend.certificates == nil {
+		backend.certificates = make(map[string]*certificateStatus)
+	}
+	backend.certificates[status.pspName] = status
+}
+
+// forgetCertificate stops reporting the certificate of a PSP removed through /rmpsp.
+func (backend *PushBackEnd) forgetCertificate(psp *push.PushServiceProvider) {
+	backend.certificatesLock.Lock()
+	defer backend.certificatesLock.Unlock()
+	delete(backend.certificates, psp.Name())
+}
+
+// inspectCertificate returns the status of a PSP's certificate, or nil if the PSP has no certificate or it could not be loaded.
+// It logs a warning if the certificate expires within the warning period.
+func (backend *PushBackEnd) inspectCertificate(psp *push.PushServiceProvider, now time.Time, logger log.Logger) *certificateStatus {
+	info, err := backend.psm.InspectCertificate(psp)
+	service := psp.FixedData["service"]
+	if err != nil {
+		logger.Errorf("Service=%v PushServiceProvider=%v Failed to load the certificate: %v", service, psp.Name(), err)
+		return nil
+	}
+	if info == nil {
+		return nil
+	}
+	if now.After(info.NotAfter) {
+		logger.Warnf("Service=%v PushServiceProvider=%v Subject=%q NotAfter=%v The certificate has expired", service, psp.Name(), info.Subject, info.NotAfter.UTC().Format(time.RFC3339))
+	} else if info.ExpiresWithin(now, backend.getCertificateExpiryWarning()) {
+		logger.Warnf("Service=%v PushServiceProvider=%v Subject=%q NotAfter=%v The certificate expires in %d days", service, psp.Name(), info.Subject, info.NotAfter.UTC().Format(time.RFC3339), int(info.NotAfter.Sub(now)/(24*time.Hour)))
+	}
+	return &certificateStatus{
+		service:         service,
+		pspName:         psp.Name(),
+		pushServiceType: psp.PushServiceName(),
+		info:            *info,
+	}
+}
+
+// certificateStatuses returns the statuses of the certificates of all PSPs, sorted by PSP name.
+func (backend *PushBackEnd) certificateStatuses() []certificateStatus {
+	backend.certificatesLock.RLock()
+	defer backend.certificatesLock.RUnlock()
+	statuses := make([]certificateStatus, 0, len(backend.certificates))
+	for _, status := range backend.certificates {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].pspName < statuses[j].pspName
+	})
+	return statuses
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+)
+
+// deferredPush is a push to a subscriber which is waiting for the end of their quiet hours (See checkPreferences).
+type deferredPush struct {
+	reqID   string
+	service string
+	sub     string
+	until   time.Time
+	timer   *time.Timer
+}
+
+// deferPush calls resume at until, unless uniqush-push is stopped first.
+// Deferred pushes are only kept in memory. Those which are dropped by Drain or Finalize are logged.
+func (backend *PushBackEnd) deferPush(reqID string, service string, sub string, until time.Time, resume func()) {
+	d := &deferredPush{reqID: reqID, service: service, sub: sub, until: until}
+	backend.deferredLock.Lock()
+	defer backend.deferredLock.Unlock()
+	if backend.deferredStopped {
+		backend.logDroppedPush(d)
+		return
+	}
+	if backend.deferred == nil {
+		backend.deferred = make(map[*deferredPush]bool)
+	}
+	backend.deferred[d] = true
+	d.timer = time.AfterFunc(time.Until(until), func() {
+		backend.deferredLock.Lock()
+		if !backend.deferred[d] {
+			// This was dropped while the timer fired.
+			backend.deferredLock.Unlock()
+			return
+		}
+		delete(backend.deferred, d)
+		backend.resumes.Add()
+		backend.deferredLock.Unlock()
+
+		defer backend.resumes.Done()
+		resume()
+	})
+}
+
+// dropDeferredPushes stops the timers of the deferred pushes which haven't been sent yet and logs them. Pushes deferred afterwards are dropped immediately.
+func (backend *PushBackEnd) dropDeferredPushes() {
+	backend.deferredLock.Lock()
+	defer backend.deferredLock.Unlock()
+	backend.deferredStopped = true
+	for d := range backend.deferred {
+		d.timer.Stop()
+		backend.logDroppedPush(d)
+	}
+	backend.deferred = nil
+}
+
+func (backend *PushBackEnd) logDroppedPush(d *deferredPush) {
+	backend.loggers[LoggerPush].Errorf("RequestID=%v Service=%v Subscriber=%v DeferredUntil=%v Dropped: Stopped during quiet hours", d.reqID, d.service, d.sub, d.until.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	// defaultDeliveryPointSweepInterval is how often expired delivery points are removed, if sweep_interval isn't set in [DeliveryPointExpiry].
+	defaultDeliveryPointSweepInterval = time.Hour
+	// minDeliveryPointMaxAge guards against removing every delivery point of a service because of a typo such as "30m" instead of "30d".
+	minDeliveryPointMaxAge = time.Hour
+	// lastActiveFlushDelay is how long the times of successful pushes are buffered before they are written to the database in one batch.
+	lastActiveFlushDelay = 5 * time.Second
+)
+
+// SetDeliveryPointMaxAges replaces the maximum ages of the delivery points of services (See LoadDeliveryPointExpiry).
+func (backend *PushBackEnd) SetDeliveryPointMaxAges(maxAges map[string]time.Duration) {
+	backend.deliveryPointMaxAgesLock.Lock()
+	defer backend.deliveryPointMaxAgesLock.Unlock()
+	backend.deliveryPointMaxAges = maxAges
+}
+
+// deliveryPointMaxAge returns how long the delivery points of a service are kept after they were last subscribed or successfully pushed to, or 0 if they don't expire.
+func (backend *PushBackEnd) deliveryPointMaxAge(service string) time.Duration {
+	backend.deliveryPointMaxAgesLock.RLock()
+	defer backend.deliveryPointMaxAgesLock.RUnlock()
+	if maxAge, ok := backend.deliveryPointMaxAges[strings.ToLower(service)]; ok {
+		return maxAge
+	}
+	return backend.deliveryPointMaxAges["default"]
+}
+
+// recordLastActive buffers the time of a successful push to a delivery point, so that pushes don't wait for a database write.
+// The buffered times are written within lastActiveFlushDelay, or by Finalize.
+func (backend *PushBackEnd) recordLastActive(dpName string, t time.Time) {
+	backend.lastActiveLock.Lock()
+	defer backend.lastActiveLock.Unlock()
+	if backend.lastActive == nil {
+		backend.lastActive = make(map[string]time.Time)
+	}
+	backend.lastActive[dpName] = t
+	if backend.lastActiveFlush == nil {
+		backend.lastActiveFlush = time.AfterFunc(lastActiveFlushDelay, backend.flushLastActive)
+	}
+}
+
+// flushLastActive writes the times buffered by recordLastActive to the database.
+func (backend *PushBackEnd) flushLastActive() {
+	backend.lastActiveLock.Lock()
+	times := backend.lastActive
+	backend.lastActive = nil
+	if backend.lastActiveFlush != nil {
+		backend.lastActiveFlush.Stop()
+		backend.lastActiveFlush = nil
+	}
+	backend.lastActiveLock.Unlock()
+
+	if len(times) == 0 {
+		return
+	}
+	if err := backend.db.SetDeliveryPointsLastActive(times); err != nil {
+		backend.loggers[LoggerPush].Errorf("DeliveryPoints=%v Failed to record successful pushes: %v", len(times), err)
+	}
+}
+
+// StartDeliveryPointSweeper removes expired delivery points every interval, until Finalize is called.
+func (backend *PushBackEnd) StartDeliveryPointSweeper(interval time.Duration) {
+	stop := make(chan struct{})
+	backend.sweeperStop = stop
+	backend.sweeperDone.Add(1)
+	go func() {
+		defer backend.sweeperDone.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				backend.sweepExpiredDeliveryPoints(time.Now(), stop)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopDeliveryPointSweeper stops the sweeper started by StartDeliveryPointSweeper, waiting for a sweep in progress to stop.
+func (backend *PushBackEnd) stopDeliveryPointSweeper() {
+	if backend.sweeperStop == nil {
+		return
+	}
+	close(backend.sweeperStop)
+	backend.sweeperDone.Wait()
+	backend.sweeperStop = nil
+}
+
+// sweepExpiredDeliveryPoints removes the delivery points of services with a maximum age which weren't subscribed or successfully pushed to within that age.
+// They are removed the same way as when a push service provider reports that a device unsubscribed, logging UNIQUSH_UPDATE_UNSUBSCRIBE.
+// It returns the number of delivery points removed.
+func (backend *PushBackEnd) sweepExpiredDeliveryPoints(now time.Time, stop <-chan struct{}) int {
+	logger := backend.loggers[LoggerPush]
+	services, err := backend.db.GetServiceNames()
+	if err != nil {
+		logger.Errorf("Failed to list services to expire delivery points: %v", err)
+		return 0
+	}
+	removed := 0
+	for _, service := range services {
+		maxAge := backend.deliveryPointMaxAge(service)
+		if maxAge <= 0 {
+			continue
+		}
+		subs, err := backend.db.GetSubscribersOfService(service)
+		if err != nil {
+			logger.Errorf("Service=%v Failed to list subscribers to expire delivery points: %v", service, err)
+			continue
+		}
+		for _, sub := range subs {
+			select {
+			case <-stop:
+				return removed
+			default:
+			}
+			removed += backend.expireDeliveryPoints(service, sub, now, maxAge, logger)
+		}
+	}
+	if removed > 0 {
+		logger.Infof("Removed %d expired delivery points", removed)
+	}
+	return removed
+}
+
+// expireDeliveryPoints removes the delivery points of a subscriber of a service which were last active before now-maxAge, returning the number removed.
+func (backend *PushBackEnd) expireDeliveryPoints(service, sub string, now time.Time, maxAge time.Duration, logger log.Logger) int {
+	pairs, err := backend.db.GetPushServiceProviderDeliveryPointPairs(service, sub, nil)
+	if err != nil {
+		logger.Errorf("Service=%v Subscriber=%v Failed to get delivery points to expire: %v", service, sub, err)
+		return 0
+	}
+	dpNames := make([]string, len(pairs))
+	for i, pair := range pairs {
+		dpNames[i] = pair.DeliveryPoint.Name()
+	}
+	lastActiveTimes, err := backend.db.GetDeliveryPointsLastActive(dpNames)
+	if err != nil {
+		logger.Errorf("Service=%v Subscriber=%v Failed to get the last activity of delivery points: %v", service, sub, err)
+		return 0
+	}
+
+	reqID := randomUniqID()
+	removed := 0
+	for i, pair := range pairs {
+		if pair.PushServiceProvider == nil {
+			continue
+		}
+		lastActive := lastActiveTimes[i]
+		if subscribeDate, ok := getSubscribeDate(pair.DeliveryPoint); ok && subscribeDate.After(lastActive) {
+			lastActive = subscribeDate
+		}
+		if lastActive.IsZero() {
+			// Delivery points not subscribed or pushed to since upgrading expire maxAge after they are first checked.
+			if err := backend.db.SetDeliveryPointsLastActive(map[string]time.Time{dpNames[i]: now}); err != nil {
+				logger.Errorf("Service=%v Subscriber=%v DeliveryPoint=%v Failed to start tracking expiry: %v", service, sub, dpNames[i], err)
+			}
+			continue
+		}
+		if now.Sub(lastActive) <= maxAge {
+			continue
+		}
+		logger.Infof("RequestID=%v Service=%v Subscriber=%v DeliveryPoint=%v LastActive=%v Expired", reqID, service, sub, dpNames[i], lastActive.UTC().Format(time.RFC3339))
+		backend.fixError(reqID, "", push.NewUnsubscribeUpdate(pair.PushServiceProvider, pair.DeliveryPoint), logger, 0, &NullAPIResponseHandler{})
+		removed++
+	}
+	return removed
+}
+
+// getSubscribeDate returns the subscribe_date of a delivery point (a unix timestamp), if it was provided when subscribing.
+func getSubscribeDate(dp *push.DeliveryPoint) (time.Time, bool) {
+	value, ok := dp.VolatileData[push.SUBSCRIBE_DATE]
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/test_util"
+)
+
+// mockPushServiceType succeeds or fails to send to every delivery point, and counts the delivery points it was sent.
+type mockPushServiceType struct {
+	name  string
+	fail  bool
+	retry bool
+	mutex sync.Mutex
+	sent  int
+	// msgs are the msg of each push sent.
+	msgs []string
+}
+
+var _ push.PushServiceType = &mockPushServiceType{}
+
+func (pst *mockPushServiceType) SetErrorReportChan(errChan chan<- push.Error)   {}
+func (pst *mockPushServiceType) SetPushServiceConfig(c *push.PushServiceConfig) {}
+func (pst *mockPushServiceType) Name() string                                   { return pst.name }
+func (pst *mockPushServiceType) Finalize()                                      {}
+
+func (pst *mockPushServiceType) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
+	psp.FixedData["service"] = kv["service"]
+	if apikey, ok := kv["apikey"]; ok {
+		psp.VolatileData["apikey"] = apikey
+	}
+	return nil
+}
+
+func (pst *mockPushServiceType) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
+	dp.FixedData["regid"] = kv["regid"]
+	return dp.AddCommonData(kv)
+}
+
+func (pst *mockPushServiceType) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	defer close(resQueue)
+	for dp := range dpQueue {
+		pst.mutex.Lock()
+		pst.sent++
+		pst.msgs = append(pst.msgs, notif.Data["msg"])
+		pst.mutex.Unlock()
+		res := &push.Result{Provider: psp, Destination: dp, Content: notif, MsgID: "msg"}
+		if pst.fail {
+			res.Err = push.NewBadNotificationWithDetails("mock failure")
+		} else if pst.retry {
+			res.Err = push.NewRetryError(psp, dp, notif, time.Second)
+		}
+		resQueue <- res
+	}
+}
+
+func (pst *mockPushServiceType) Preview(notif *push.Notification) ([]byte, push.Error) {
+	return []byte("{}"), nil
+}
+
+// mockCertificatePushServiceType is a mockPushServiceType whose PSPs use a client certificate.
+type mockCertificatePushServiceType struct {
+	mockPushServiceType
+	certificate push.CertificateInfo
+}
+
+var _ push.CertificateInspector = &mockCertificatePushServiceType{}
+
+func (pst *mockCertificatePushServiceType) InspectCertificate(psp *push.PushServiceProvider) (*push.CertificateInfo, error) {
+	info := pst.certificate
+	return &info, nil
+}
+
+// mockPushDatabase returns fixed delivery points and preferences for every subscriber. Other methods of db.PushDatabase aren't implemented.
+type mockPushDatabase struct {
+	db.PushDatabase
+	pairs []db.PushServiceProviderDeliveryPointPair
+	prefs *push.SubscriberPreferences
+	// admission is returned by AdmitPush, which records the frequency caps it was called with.
+	admission     db.PushAdmission
+	frequencyCaps []push.FrequencyCap
+	// idempotentResponses maps idempotency keys to stored responses ("" while in progress).
+	idempotentResponses map[string]string
+	// subscriptions are the subscriptions added by AddDeliveryPointsToService, which uses the PSP of the first pair.
+	subscriptions []db.Subscription
+	// deviceSubscriptions maps "field:token" to the subscriptions of a device, which are removed by RemoveDeliveryPointsOfDevice.
+	deviceSubscriptions map[string][]db.SubscriptionRef
+	// lastActive is recorded by SetDeliveryPointsLastActive, which is called concurrently by pushes.
+	lastActiveLock sync.Mutex
+	lastActive     map[string]time.Time
+	// removed are the names of the delivery points removed by RemoveDeliveryPointFromService.
+	removed []string
+	// pspConfigsError is returned by GetPushServiceProviderConfigs.
+	pspConfigsError error
+	// pingErrors is returned by Ping.
+	pingErrors map[string]error
+	// flushed is set by FlushCache.
+	flushed bool
+	// auditEntries are the entries of the audit log, oldest first.
+	auditEntries []*db.AuditEntry
+	// serviceNames are returned by GetServiceNames.
+	serviceNames []string
+	// tenantPushes are the pushes counted by AdmitTenantPushes, by tenant.
+	tenantPushes map[string]int
+}
+
+func (mockDB *mockPushDatabase) Ping() map[string]error {
+	return mockDB.pingErrors
+}
+
+// AddPushServiceProviderToService adds a pair without a delivery point, so that GetPushServiceProviderConfigs returns the PSP.
+func (mockDB *mockPushDatabase) AddPushServiceProviderToService(service string, psp *push.PushServiceProvider) error {
+	mockDB.pairs = append(mockDB.pairs, db.PushServiceProviderDeliveryPointPair{PushServiceProvider: psp})
+	return nil
+}
+
+func (mockDB *mockPushDatabase) RemovePushServiceProviderFromService(service string, psp *push.PushServiceProvider) error {
+	var pairs []db.PushServiceProviderDeliveryPointPair
+	for _, pair := range mockDB.pairs {
+		if pair.PushServiceProvider.Name() != psp.Name() {
+			pairs = append(pairs, pair)
+		}
+	}
+	mockDB.pairs = pairs
+	return nil
+}
+
+func (mockDB *mockPushDatabase) AddAuditEntry(entry *db.AuditEntry, maxEntries int64) error {
+	entry.ID = strconv.Itoa(len(mockDB.auditEntries) + 1)
+	mockDB.auditEntries = append(mockDB.auditEntries, entry)
+	return nil
+}
+
+// GetAuditEntries ignores before, returning the newest entries.
+func (mockDB *mockPushDatabase) GetAuditEntries(before string, count int64) ([]*db.AuditEntry, error) {
+	var entries []*db.AuditEntry
+	for i := len(mockDB.auditEntries) - 1; i >= 0 && int64(len(entries)) < count; i-- {
+		entries = append(entries, mockDB.auditEntries[i])
+	}
+	return entries, nil
+}
+
+func (mockDB *mockPushDatabase) FlushCache() error {
+	mockDB.flushed = true
+	return nil
+}
+
+func (mockDB *mockPushDatabase) GetPushServiceProviderDeliveryPointPairs(service string, subscriber string, dpNamesRequested []string) ([]db.PushServiceProviderDeliveryPointPair, error) {
+	return mockDB.pairs, nil
+}
+
+// GetPushServiceProviderConfigs returns the PSPs of the fixed delivery points.
+func (mockDB *mockPushDatabase) GetPushServiceProviderConfigs() ([]*push.PushServiceProvider, error) {
+	if mockDB.pspConfigsError != nil {
+		return nil, mockDB.pspConfigsError
+	}
+	psps := make([]*push.PushServiceProvider, len(mockDB.pairs))
+	for i, pair := range mockDB.pairs {
+		psps[i] = pair.PushServiceProvider
+	}
+	return psps, nil
+}
+
+func (mockDB *mockPushDatabase) GetSubscriberPreferences(service string, subscriber string) (*push.SubscriberPreferences, error) {
+	return mockDB.prefs, nil
+}
+
+func (mockDB *mockPushDatabase) AdmitPush(service string, subscriber string, dedupKey string, dedupTTL time.Duration, frequencyCap push.FrequencyCap) (db.PushAdmission, error) {
+	mockDB.frequencyCaps = append(mockDB.frequencyCaps, frequencyCap)
+	return mockDB.admission, nil
+}
+
+func (mockDB *mockPushDatabase) ReserveIdempotencyKey(service string, key string, pendingTTL time.Duration) (bool, []byte, error) {
+	if mockDB.idempotentResponses == nil {
+		mockDB.idempotentResponses = make(map[string]string)
+	}
+	response, ok := mockDB.idempotentResponses[service+":"+key]
+	if !ok {
+		mockDB.idempotentResponses[service+":"+key] = ""
+		return true, nil, nil
+	}
+	if response == "" {
+		return false, nil, nil
+	}
+	return false, []byte(response), nil
+}
+
+func (mockDB *mockPushDatabase) SetIdempotentResponse(service string, key string, response []byte, ttl time.Duration) error {
+	mockDB.idempotentResponses[service+":"+key] = string(response)
+	return nil
+}
+
+func (mockDB *mockPushDatabase) AddDeliveryPointsToService(subscriptions []db.Subscription) ([]*push.PushServiceProvider, []error) {
+	mockDB.subscriptions = append(mockDB.subscriptions, subscriptions...)
+	psps := make([]*push.PushServiceProvider, len(subscriptions))
+	for i := range psps {
+		psps[i] = mockDB.pairs[0].PushServiceProvider
+	}
+	return psps, make([]error, len(subscriptions))
+}
+
+func (mockDB *mockPushDatabase) RemoveAllDeliveryPointsFromServiceSubscriber(service string, subscriber string) ([]db.SubscriptionRef, []error, error) {
+	var refs []db.SubscriptionRef
+	var remaining []db.Subscription
+	for _, sub := range mockDB.subscriptions {
+		if sub.Service == service && sub.Subscriber == subscriber {
+			refs = append(refs, db.SubscriptionRef{Service: service, Subscriber: subscriber, DeliveryPointName: sub.DeliveryPoint.Name()})
+		} else {
+			remaining = append(remaining, sub)
+		}
+	}
+	mockDB.subscriptions = remaining
+	return refs, make([]error, len(refs)), nil
+}
+
+func (mockDB *mockPushDatabase) RemoveDeliveryPointsOfDevice(field string, token string, servicePrefix string) ([]db.SubscriptionRef, []error, error) {
+	var refs, remaining []db.SubscriptionRef
+	for _, ref := range mockDB.deviceSubscriptions[field+":"+token] {
+		if strings.HasPrefix(ref.Service, servicePrefix) {
+			refs = append(refs, ref)
+		} else {
+			remaining = append(remaining, ref)
+		}
+	}
+	mockDB.deviceSubscriptions[field+":"+token] = remaining
+	return refs, make([]error, len(refs)), nil
+}
+
+// GetServiceNames returns serviceNames, or just myservice if it's nil.
+func (mockDB *mockPushDatabase) GetServiceNames() ([]string, error) {
+	if mockDB.serviceNames != nil {
+		return mockDB.serviceNames, nil
+	}
+	return []string{"myservice"}, nil
+}
+
+// AdmitTenantPushes counts the pushes of each tenant in tenantPushes, admitting them unless they exceed the limit of the quota.
+func (mockDB *mockPushDatabase) AdmitTenantPushes(tenant string, count int, quota push.FrequencyCap) (bool, error) {
+	if mockDB.tenantPushes == nil {
+		mockDB.tenantPushes = make(map[string]int)
+	}
+	if quota.IsEnabled() && mockDB.tenantPushes[tenant]+count > quota.Limit {
+		return false, nil
+	}
+	mockDB.tenantPushes[tenant] += count
+	return true, nil
+}
+
+// GetSubscriptions returns the subscriptions added by AddDeliveryPointsToService of the subscriber, in the given services.
+func (mockDB *mockPushDatabase) GetSubscriptions(services []string, subscriber string, logger log.Logger) ([]map[string]string, error) {
+	result := []map[string]string{}
+	for _, sub := range mockDB.subscriptions {
+		for _, service := range services {
+			if sub.Service == service && sub.Subscriber == subscriber {
+				result = append(result, map[string]string{"service": service, db.DeliveryPointID: sub.DeliveryPoint.Name()})
+			}
+		}
+	}
+	return result, nil
+}
+
+func (mockDB *mockPushDatabase) GetSubscribersOfService(service string) ([]string, error) {
+	return []string{"mysubscriber"}, nil
+}
+
+func (mockDB *mockPushDatabase) SetDeliveryPointsLastActive(times map[string]time.Time) error {
+	mockDB.lastActiveLock.Lock()
+	defer mockDB.lastActiveLock.Unlock()
+	if mockDB.lastActive == nil {
+		mockDB.lastActive = make(map[string]time.Time)
+	}
+	for dpName, t := range times {
+		mockDB.lastActive[dpName] = t
+	}
+	return nil
+}
+
+func (mockDB *mockPushDatabase) GetDeliveryPointsLastActive(dpNames []string) ([]time.Time, error) {
+	mockDB.lastActiveLock.Lock()
+	defer mockDB.lastActiveLock.Unlock()
+	times := make([]time.Time, len(dpNames))
+	for i, dpName := range dpNames {
+		times[i] = mockDB.lastActive[dpName]
+	}
+	return times, nil
+}
+
+func (mockDB *mockPushDatabase) RemoveDeliveryPointFromService(service string, subscriber string, deliveryPoint *push.DeliveryPoint) error {
+	mockDB.removed = append(mockDB.removed, deliveryPoint.Name())
+	return nil
+}
+
+func newMockPair(t *testing.T, psm *push.PushServiceManager, pushServiceType string, regid string) db.PushServiceProviderDeliveryPointPair {
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{"pushservicetype": pushServiceType, "service": "myservice"})
+	if err != nil {
+		t.Fatalf("Unexpected error building PSP: %v", err)
+	}
+	dp, err := psm.BuildDeliveryPointFromMap(map[string]string{"pushservicetype": pushServiceType, "service": "myservice", "subscriber": "mysubscriber", "regid": regid})
+	if err != nil {
+		t.Fatalf("Unexpected error building delivery point: %v", err)
+	}
+	return db.PushServiceProviderDeliveryPointPair{PushServiceProvider: psp, DeliveryPoint: dp}
+}
+
+func newMockPushBackEnd(psm *push.PushServiceManager, database db.PushDatabase) (*PushBackEnd, log.Logger) {
+	logger := log.NewLogger(ioutil.Discard, "", log.LOGLEVEL_DEBUG)
+	loggers := make([]log.Logger, NumberOfLoggers)
+	for i := range loggers {
+		loggers[i] = logger
+	}
+	return &PushBackEnd{psm: psm, db: database, loggers: loggers}, logger
+}
+
+func TestPushWithFallback(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	failing := &mockPushServiceType{name: "mockfailing", fail: true}
+	working := &mockPushServiceType{name: "mockworking"}
+	unused := &mockPushServiceType{name: "mockunused"}
+	for _, pst := range []*mockPushServiceType{failing, working, unused} {
+		if err := psm.RegisterPushServiceType(pst); err != nil {
+			t.Fatalf("Unexpected error registering %s: %v", pst.name, err)
+		}
+	}
+	mockDB := &mockPushDatabase{pairs: []db.PushServiceProviderDeliveryPointPair{
+		newMockPair(t, psm, "mockunused", "unused1"),
+		newMockPair(t, psm, "mockfailing", "failing1"),
+		newMockPair(t, psm, "mockfailing", "failing2"),
+		newMockPair(t, psm, "mockworking", "working1"),
+	}}
+	backend, logger := newMockPushBackEnd(psm, mockDB)
+
+	handler := newPushResponseHandler(logger)
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"msg": "hello"}
+	backend.Push("requestid", "127.0.0.1", "myservice", []string{"mysubscriber"}, nil, notif, nil, []string{"mocknodevices", "mockfailing", "mockworking", "mockunused"}, logger, handler)
+
+	test_util.ExpectEquals(t, 2, failing.sent, "delivery points sent to by the first tier")
+	test_util.ExpectEquals(t, 1, working.sent, "delivery points sent to by the second tier")
+	test_util.ExpectEquals(t, 0, unused.sent, "delivery points sent to after the push was delivered")
+
+	var response APIPushResponse
+	if err := json.Unmarshal(handler.ToJSON(), &response); err != nil {
+		t.Fatalf("Unexpected error parsing the response: %v", err)
+	}
+	test_util.ExpectEquals(t, 1, response.SuccessCount, "success count")
+	test_util.ExpectEquals(t, 2, response.FailureCount, "failure count")
+	test_util.ExpectStringEquals(t, "mockworking", *response.SuccessDetails[0].FallbackTier, "fallback tier of the success")
+	test_util.ExpectStringEquals(t, "mockfailing", *response.FailureDetails[0].FallbackTier, "fallback tier of the failure")
+}
+
+func TestPushWithFallbackRetry(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	retrying := &mockPushServiceType{name: "mockretrying", retry: true}
+	next := &mockPushServiceType{name: "mocknexttier"}
+	for _, pst := range []*mockPushServiceType{retrying, next} {
+		if err := psm.RegisterPushServiceType(pst); err != nil {
+			t.Fatalf("Unexpected error registering %s: %v", pst.name, err)
+		}
+	}
+	mockDB := &mockPushDatabase{pairs: []db.PushServiceProviderDeliveryPointPair{
+		newMockPair(t, psm, "mockretrying", "retrying1"),
+		newMockPair(t, psm, "mocknexttier", "next1"),
+	}}
+	backend, logger := newMockPushBackEnd(psm, mockDB)
+	backend.draining = make(chan struct{})
+
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"msg": "hello"}
+	backend.Push("requestid", "127.0.0.1", "myservice", []string{"mysubscriber"}, nil, notif, nil, []string{"mockretrying", "mocknexttier"}, logger, &NullAPIResponseHandler{})
+	if backend.retries.Idle() {
+		t.Fatal("Expected a retry to be scheduled")
+	}
+	if !backend.Drain(time.Now().Add(5 * time.Second)) {
+		t.Fatal("Expected Drain to finish before the deadline")
+	}
+	next.mutex.Lock()
+	defer next.mutex.Unlock()
+	test_util.ExpectEquals(t, 0, next.sent, "delivery points sent to by the next tier while the first tier is retried")
+}
+
+func TestPushWithFallbackNoDevice(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	pst := &mockPushServiceType{name: "mockotherservice"}
+	psm.RegisterPushServiceType(pst)
+	mockDB := &mockPushDatabase{pairs: []db.PushServiceProviderDeliveryPointPair{newMockPair(t, psm, "mockotherservice", "other1")}}
+	backend, logger := newMockPushBackEnd(psm, mockDB)
+
+	handler := newPushResponseHandler(logger)
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"msg": "hello"}
+	backend.Push("requestid", "127.0.0.1", "myservice", []string{"mysubscriber"}, nil, notif, nil, []string{"mocknodevices"}, logger, handler)
+
+	test_util.ExpectEquals(t, 0, pst.sent, "delivery points sent to")
+	var response APIPushResponse
+	if err := json.Unmarshal(handler.ToJSON(), &response); err != nil {
+		t.Fatalf("Unexpected error parsing the response: %v", err)
+	}
+	if response.FailureCount != 1 || response.FailureDetails[0].Code != UNIQUSH_ERROR_NO_DEVICE {
+		t.Errorf("Expected UNIQUSH_ERROR_NO_DEVICE, got %s", handler.ToJSON())
+	}
+}
+
+func TestGetFallbackFromMap(t *testing.T) {
+	fallback, err := getFallbackFromMap(map[string]string{"uniqush.fallback": "apns, fcm,,sms"})
+	test_util.ExpectEquals(t, nil, err, "error")
+	test_util.ExpectEquals(t, []string{"apns", "fcm", "sms"}, fallback, "fallback")
+
+	if _, err := getFallbackFromMap(map[string]string{"uniqush.fallback": ","}); err == nil {
+		t.Error("Expected an error for an empty fallback")
+	}
+}
+
+func TestPushWithPreferences(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	pst := &mockPushServiceType{name: "mockpreferences"}
+	psm.RegisterPushServiceType(pst)
+	mockDB := &mockPushDatabase{pairs: []db.PushServiceProviderDeliveryPointPair{newMockPair(t, psm, "mockpreferences", "prefs1")}}
+	backend, logger := newMockPushBackEnd(psm, mockDB)
+
+	pushWithCategory := func(category string) APIPushResponse {
+		handler := newPushResponseHandler(logger)
+		notif := push.NewEmptyNotification()
+		notif.Data = map[string]string{"msg": "hello", "uniqush.category": category}
+		backend.Push("requestid", "127.0.0.1", "myservice", []string{"mysubscriber"}, nil, notif, nil, nil, logger, handler)
+		var response APIPushResponse
+		if err := json.Unmarshal(handler.ToJSON(), &response); err != nil {
+			t.Fatalf("Unexpected error parsing the response: %v", err)
+		}
+		return response
+	}
+
+	mockDB.prefs = &push.SubscriberPreferences{MutedCategories: []string{"marketing"}}
+	response := pushWithCategory("marketing")
+	test_util.ExpectEquals(t, 0, pst.sent, "delivery points sent to for a muted category")
+	test_util.ExpectEquals(t, 1, response.SuppressedCount, "suppressed count")
+	test_util.ExpectStringEquals(t, UNIQUSH_SUPPRESSED_MUTED, response.SuppressedDetails[0].Code, "code")
+
+	response = pushWithCategory("alerts")
+	test_util.ExpectEquals(t, 1, pst.sent, "delivery points sent to for a category which isn't muted")
+	test_util.ExpectEquals(t, 1, response.SuccessCount, "success count")
+
+	// These quiet hours span the whole day, so the deferred push won't be sent during this test.
+	mockDB.prefs = &push.SubscriberPreferences{QuietHours: []string{"00:00-12:00", "12:00-00:00"}}
+	response = pushWithCategory("alerts")
+	test_util.ExpectEquals(t, 1, pst.sent, "delivery points sent to during quiet hours")
+	test_util.ExpectEquals(t, 1, response.SuppressedCount, "suppressed count")
+	test_util.ExpectStringEquals(t, UNIQUSH_DEFERRED_QUIET_HOURS, response.SuppressedDetails[0].Code, "code")
+	if response.SuppressedDetails[0].DeferredUntil == nil {
+		t.Error("Expected deferredUntil to be set")
+	}
+
+	// Stopping drops (and logs) the deferred push.
+	test_util.ExpectEquals(t, 1, len(backend.deferred), "deferred pushes")
+	if !backend.Drain(time.Now().Add(5 * time.Second)) {
+		t.Fatal("Expected Drain to finish without waiting for quiet hours")
+	}
+	test_util.ExpectEquals(t, 0, len(backend.deferred), "deferred pushes after Drain")
+	pushWithCategory("alerts")
+	test_util.ExpectEquals(t, 0, len(backend.deferred), "pushes deferred after Drain")
+}
+
+func TestDeferPush(t *testing.T) {
+	backend, _ := newMockPushBackEnd(push.GetPushServiceManager(), &mockPushDatabase{})
+	resumed := make(chan struct{})
+	backend.deferPush("requestid", "myservice", "mysubscriber", time.Now().Add(10*time.Millisecond), func() { close(resumed) })
+	select {
+	case <-resumed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the deferred push to be resumed")
+	}
+	if !backend.Drain(time.Now().Add(5 * time.Second)) {
+		t.Fatal("Expected Drain to finish")
+	}
+	backend.deferredLock.Lock()
+	defer backend.deferredLock.Unlock()
+	test_util.ExpectEquals(t, 0, len(backend.deferred), "deferred pushes after they were resumed")
+}
+
+func TestPushRejectedByAdmission(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	pst := &mockPushServiceType{name: "mockadmission"}
+	psm.RegisterPushServiceType(pst)
+	mockDB := &mockPushDatabase{pairs: []db.PushServiceProviderDeliveryPointPair{newMockPair(t, psm, "mockadmission", "admission1")}}
+	backend, logger := newMockPushBackEnd(psm, mockDB)
+	backend.SetFrequencyCaps(map[string]push.FrequencyCap{"myservice": {Limit: 10, Period: time.Hour}})
+
+	for _, testCase := range []struct {
+		admission db.PushAdmission
+		code      string
+	}{
+		{db.PushDuplicate, UNIQUSH_REJECTED_DUPLICATE},
+		{db.PushFrequencyCapped, UNIQUSH_REJECTED_FREQUENCY_CAP},
+	} {
+		mockDB.admission = testCase.admission
+		handler := newPushResponseHandler(logger)
+		notif := push.NewEmptyNotification()
+		notif.Data = map[string]string{"msg": "hello", "uniqush.dedup_key": "order-1234"}
+		backend.Push("requestid", "127.0.0.1", "MyService", []string{"mysubscriber"}, nil, notif, nil, nil, logger, handler)
+
+		var response APIPushResponse
+		if err := json.Unmarshal(handler.ToJSON(), &response); err != nil {
+			t.Fatalf("Unexpected error parsing the response: %v", err)
+		}
+		test_util.ExpectEquals(t, 0, pst.sent, "delivery points sent to")
+		test_util.ExpectEquals(t, 1, response.SuppressedCount, "suppressed count")
+		test_util.ExpectStringEquals(t, testCase.code, response.SuppressedDetails[0].Code, "code")
+	}
+	test_util.ExpectEquals(t, push.FrequencyCap{Limit: 10, Period: time.Hour}, mockDB.frequencyCaps[0], "frequency cap of the service")
+}
+
+func TestGetDedupFromNotification(t *testing.T) {
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"uniqush.dedup_key": "order-1234", "uniqush.dedup_ttl": "60"}
+	dedupKey, ttl, err := getDedupFromNotification(notif)
+	test_util.ExpectEquals(t, nil, err, "error")
+	test_util.ExpectStringEquals(t, "order-1234", dedupKey, "dedup key")
+	test_util.ExpectEquals(t, time.Minute, ttl, "dedup TTL")
+
+	notif.Data["uniqush.dedup_ttl"] = "-1"
+	if _, _, err := getDedupFromNotification(notif); err == nil {
+		t.Error("Expected an error for a negative TTL")
+	}
+}
+
+func TestSweepExpiredDeliveryPoints(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	psm.RegisterPushServiceType(&mockPushServiceType{name: "mockexpiry"})
+	now := time.Unix(1500000000, 0)
+	subscribedLongAgo := strconv.FormatInt(now.Add(-48*time.Hour).Unix(), 10)
+
+	expired := newMockPair(t, psm, "mockexpiry", "expired")
+	expired.DeliveryPoint.VolatileData[push.SUBSCRIBE_DATE] = subscribedLongAgo
+	pushedRecently := newMockPair(t, psm, "mockexpiry", "pushedrecently")
+	pushedRecently.DeliveryPoint.VolatileData[push.SUBSCRIBE_DATE] = subscribedLongAgo
+	untracked := newMockPair(t, psm, "mockexpiry", "untracked")
+
+	mockDB := &mockPushDatabase{pairs: []db.PushServiceProviderDeliveryPointPair{expired, pushedRecently, untracked}}
+	mockDB.SetDeliveryPointsLastActive(map[string]time.Time{pushedRecently.DeliveryPoint.Name(): now.Add(-time.Hour)})
+	backend, _ := newMockPushBackEnd(psm, mockDB)
+
+	test_util.ExpectEquals(t, 0, backend.sweepExpiredDeliveryPoints(now, nil), "number removed without a maximum age")
+	backend.SetDeliveryPointMaxAges(map[string]time.Duration{"default": 24 * time.Hour})
+	test_util.ExpectEquals(t, 1, backend.sweepExpiredDeliveryPoints(now, nil), "number removed")
+	test_util.ExpectEquals(t, []string{expired.DeliveryPoint.Name()}, mockDB.removed, "removed delivery points")
+	test_util.ExpectEquals(t, now, mockDB.lastActive[untracked.DeliveryPoint.Name()], "time the untracked delivery point was first checked")
+}
+
+func TestRecordLastActive(t *testing.T) {
+	mockDB := &mockPushDatabase{}
+	backend, _ := newMockPushBackEnd(push.GetPushServiceManager(), mockDB)
+	now := time.Unix(1500000000, 0)
+	backend.recordLastActive("dp1", now.Add(-time.Second))
+	backend.recordLastActive("dp2", now)
+	backend.recordLastActive("dp1", now)
+	test_util.ExpectEquals(t, 0, len(mockDB.lastActive), "number of times written before flushing")
+
+	backend.flushLastActive()
+	test_util.ExpectEquals(t, map[string]time.Time{"dp1": now, "dp2": now}, mockDB.lastActive, "times written by flushing")
+	if backend.lastActiveFlush != nil {
+		t.Error("Expected the scheduled flush to be stopped")
+	}
+}
+
+func TestCheckCertificates(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	now := time.Unix(1500000000, 0)
+	pst := &mockCertificatePushServiceType{
+		mockPushServiceType: mockPushServiceType{name: "mockcertificate"},
+		certificate:         push.CertificateInfo{NotAfter: now.Add(10 * 24 * time.Hour), Subject: `Test "certificate"`},
+	}
+	psm.RegisterPushServiceType(pst)
+	pair := newMockPair(t, psm, "mockcertificate", "certificate1")
+	mockDB := &mockPushDatabase{pairs: []db.PushServiceProviderDeliveryPointPair{pair}}
+	backend, _ := newMockPushBackEnd(psm, mockDB)
+	api := &RestAPI{backend: backend}
+	metrics := func() string {
+		var buf bytes.Buffer
+		api.writeMetrics(&buf, now)
+		return buf.String()
+	}
+	labels := `{service="myservice",psp="` + pair.PushServiceProvider.Name() + `",pushservicetype="mockcertificate",subject="Test \"certificate\""}`
+
+	backend.SetCertificateExpiryWarning(30 * 24 * time.Hour)
+	backend.checkCertificates(now)
+	for _, line := range []string{
+		"uniqush_certificate_expiry_timestamp_seconds" + labels + " " + strconv.FormatInt(now.Unix()+10*24*3600, 10) + "\n",
+		"uniqush_certificate_expiring" + labels + " 1\n",
+	} {
+		if !strings.Contains(metrics(), line) {
+			t.Errorf("Expected %q in the metrics:\n%s", line, metrics())
+		}
+	}
+
+	backend.SetCertificateExpiryWarning(7 * 24 * time.Hour)
+	if line := "uniqush_certificate_expiring" + labels + " 0\n"; !strings.Contains(metrics(), line) {
+		t.Errorf("Expected %q in the metrics:\n%s", line, metrics())
+	}
+
+	backend.forgetCertificate(pair.PushServiceProvider)
+	if strings.Contains(metrics(), "mockcertificate") {
+		t.Errorf("Expected the removed PSP's certificate to be forgotten:\n%s", metrics())
+	}
+}
+
+func TestDrainSendsScheduledRetries(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	pst := &mockPushServiceType{name: "mockdrain"}
+	psm.RegisterPushServiceType(pst)
+	pair := newMockPair(t, psm, "mockdrain", "drain1")
+	backend, logger := newMockPushBackEnd(psm, &mockPushDatabase{})
+	backend.draining = make(chan struct{})
+
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"msg": "hello"}
+	retry := push.NewRetryError(pair.PushServiceProvider, pair.DeliveryPoint, notif, 30*time.Second)
+	backend.fixRetryError(retry, "requestid", "127.0.0.1", logger, 30*time.Second, &NullAPIResponseHandler{})
+	if backend.retries.Idle() {
+		t.Fatal("Expected the retry to be scheduled")
+	}
+
+	start := time.Now()
+	if !backend.Drain(start.Add(5 * time.Second)) {
+		t.Fatal("Expected Drain to finish before the deadline")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the retry to be sent without waiting, took %v", elapsed)
+	}
+	pst.mutex.Lock()
+	defer pst.mutex.Unlock()
+	test_util.ExpectEquals(t, 1, pst.sent, "retries sent")
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// reloadableSettings are the settings from uniqush.conf which can be changed without restarting uniqush-push (See RestAPI.reload).
+type reloadableSettings struct {
+	frequencyCaps            map[string]push.FrequencyCap
+	idempotencyTTL           time.Duration
+	shutdownTimeout          time.Duration
+	deliveryPointMaxAges     map[string]time.Duration
+	sweepInterval            time.Duration
+	certificateExpiryWarning time.Duration
+	certificateCheckInterval time.Duration
+	auditMaxEntries          int64
+	auditTrustedProxies      []*net.IPNet
+	secretsKey               []byte
+	oldSecretsKeys           [][]byte
+	apiKeys                  *APIKeys
+}
+
+// reloadedDatabaseOptions are the options in the [Database] section which are applied when uniqush.conf is reloaded. The others need a restart.
+var reloadedDatabaseOptions = map[string]bool{
+	"secrets_key_file":      true,
+	"secrets_old_key_files": true,
+}
+
+// loadReloadableSettings returns the settings from uniqush.conf which can be changed without restarting uniqush-push, or an error if any of them are invalid.
+func loadReloadableSettings(c *conf.ConfigFile) (*reloadableSettings, error) {
+	settings := new(reloadableSettings)
+	var err error
+	if settings.frequencyCaps, err = LoadFrequencyCaps(c); err != nil {
+		return nil, err
+	}
+	if settings.idempotencyTTL, err = LoadIdempotencyTTL(c); err != nil {
+		return nil, err
+	}
+	if settings.shutdownTimeout, err = LoadShutdownTimeout(c); err != nil {
+		return nil, err
+	}
+	if settings.deliveryPointMaxAges, settings.sweepInterval, err = LoadDeliveryPointExpiry(c); err != nil {
+		return nil, err
+	}
+	if settings.certificateExpiryWarning, settings.certificateCheckInterval, err = LoadCertificateExpiry(c); err != nil {
+		return nil, err
+	}
+	if settings.auditMaxEntries, err = LoadAuditMaxEntries(c); err != nil {
+		return nil, err
+	}
+	if settings.auditTrustedProxies, err = LoadAuditTrustedProxies(c); err != nil {
+		return nil, err
+	}
+	if settings.secretsKey, settings.oldSecretsKeys, err = LoadSecretKeys(c); err != nil {
+		return nil, err
+	}
+	if settings.apiKeys, err = LoadAPIKeys(c); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// SetConfigSources sets the sources of the configuration, the config loaded from them, and the logfile opened for the loggers (or nil), so that they can be replaced by reload.
+func (api *RestAPI) SetConfigSources(sources ConfigSources, c *conf.ConfigFile, logfile io.Closer) {
+	api.reloadLock.Lock()
+	defer api.reloadLock.Unlock()
+	api.configSources = sources
+	api.config = c
+	api.logfile = logfile
+}
+
+// applySettings applies settings to the REST API and the backend.
+// The delivery point sweeper and the certificate monitor are started, or restarted if their intervals changed since settings were last applied.
+func (api *RestAPI) applySettings(settings *reloadableSettings) error {
+	if err := push.SetSecretKeys(settings.secretsKey, settings.oldSecretsKeys...); err != nil {
+		return err
+	}
+	backend := api.backend
+	backend.SetFrequencyCaps(settings.frequencyCaps)
+	backend.SetDeliveryPointMaxAges(settings.deliveryPointMaxAges)
+	backend.SetCertificateExpiryWarning(settings.certificateExpiryWarning)
+	api.SetIdempotencyTTL(settings.idempotencyTTL)
+	api.SetShutdownTimeout(settings.shutdownTimeout)
+	api.SetAuditMaxEntries(settings.auditMaxEntries)
+	api.SetAuditTrustedProxies(settings.auditTrustedProxies)
+	api.SetAPIKeys(settings.apiKeys)
+
+	old := api.settings
+	if old == nil || old.sweepInterval != settings.sweepInterval {
+		backend.stopDeliveryPointSweeper()
+		backend.StartDeliveryPointSweeper(settings.sweepInterval)
+	}
+	if old == nil || old.certificateCheckInterval != settings.certificateCheckInterval {
+		backend.stopCertificateMonitor()
+		backend.StartCertificateMonitor(settings.certificateCheckInterval)
+	}
+	api.settings = settings
+	return nil
+}
+
+// reload re-reads the configuration (See ConfigSources) and applies it without restarting uniqush-push, for /reload and SIGHUP.
+// It returns JSON with the options which changed but can't be applied until uniqush-push is restarted, and records the result in entry.
+func (api *RestAPI) reload(entry *db.AuditEntry) []byte {
+	type responseType struct {
+		Code       string   `json:"code"`
+		ErrorMsg   *string  `json:"errorMsg,omitempty"`
+		NotApplied []string `json:"notApplied"`
+	}
+	logger := api.loggers[LoggerWeb]
+	r := responseType{Code: UNIQUSH_SUCCESS, NotApplied: []string{}}
+	notApplied, err := api.reloadConfig()
+	if err != nil {
+		logger.Errorf("Failed to reload the configuration (requested by %v): %v", entry.RemoteAddr, err)
+		r.Code = UNIQUSH_ERROR_GENERIC
+		r.ErrorMsg = strPtrOfErr(err)
+	} else {
+		logger.Infof("Reloaded the configuration (requested by %v)", entry.RemoteAddr)
+		if len(notApplied) > 0 {
+			r.NotApplied = notApplied
+			logger.Warnf("Not applied until uniqush-push is restarted: %s", strings.Join(notApplied, ", "))
+			entry.After = map[string]string{"notApplied": strings.Join(notApplied, ", ")}
+		}
+	}
+	setAuditResult(entry, r.Code, r.ErrorMsg)
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to encode response")
+	}
+	return json
+}
+
+// reloadOnSignal reloads uniqush.conf when uniqush-push receives SIGHUP, unless it's stopping.
+func (api *RestAPI) reloadOnSignal(sig os.Signal) {
+	if !api.beginRequest() {
+		return
+	}
+	defer api.inFlight.Done()
+	entry := newSignalAuditEntry(ReloadConfigURL, sig)
+	api.reload(entry)
+	api.audit(entry, api.loggers[LoggerWeb])
+}
+
+// reloadConfig re-reads the configuration from its sources and applies it, returning the options which changed but can't be applied until uniqush-push is restarted.
+// If the configuration is invalid, nothing is applied.
+func (api *RestAPI) reloadConfig() ([]string, error) {
+	api.reloadLock.Lock()
+	defer api.reloadLock.Unlock()
+	if api.config == nil {
+		return nil, errors.New("uniqush-push wasn't started with a configuration file")
+	}
+	c, err := LoadConfig(api.configSources)
+	if err != nil {
+		return nil, err
+	}
+	// Load everything before applying anything, so that a mistake in the configuration doesn't leave a mix of old and new settings.
+	settings, err := loadReloadableSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := api.psm.ValidateConfigFile(c); err != nil {
+		return nil, err
+	}
+	loggers, logfile, err := loadLoggers(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := api.applySettings(settings); err != nil {
+		if logfile != nil {
+			logfile.Close()
+		}
+		return nil, err
+	}
+	// Reopening the logfile also lets it be rotated.
+	replaceLoggers(api.loggers, loggers)
+	if api.logfile != nil {
+		api.logfile.Close()
+	}
+	api.logfile = logfile
+
+	var notApplied []string
+	// The HTTP server and the database connections are only set up when uniqush-push starts.
+	oldAddr, _ := LoadRestAddr(api.config)
+	if addr, _ := LoadRestAddr(c); addr != oldAddr {
+		notApplied = append(notApplied, "[WebFrontend] addr")
+	}
+	for _, option := range push.ChangedOptions(api.config, c, "Database") {
+		if !reloadedDatabaseOptions[option] {
+			notApplied = append(notApplied, "[Database] "+option)
+		}
+	}
+	notApplied = append(notApplied, api.psm.ReloadConfigFile(c)...)
+	api.config = c
+	return notApplied, nil
+}
+
+// reloadableLogger is a log.Logger which can be replaced while it's being used, e.g. to change the log level when uniqush.conf is reloaded.
+type reloadableLogger struct {
+	lock   sync.RWMutex
+	logger log.Logger
+}
+
+var _ log.Logger = &reloadableLogger{}
+
+// newReloadableLoggers wraps loggers so that they can be replaced by replaceLoggers.
+func newReloadableLoggers(loggers []log.Logger) []log.Logger {
+	ret := make([]log.Logger, len(loggers))
+	for i, logger := range loggers {
+		ret[i] = &reloadableLogger{logger: logger}
+	}
+	return ret
+}
+
+// replaceLoggers replaces the loggers wrapped by newReloadableLoggers with newLoggers, waiting for messages being logged to be written.
+// Loggers which weren't created by newReloadableLoggers are left unchanged.
+func replaceLoggers(loggers []log.Logger, newLoggers []log.Logger) {
+	for i, logger := range loggers {
+		if r, ok := logger.(*reloadableLogger); ok && i < len(newLoggers) {
+			r.lock.Lock()
+			r.logger = newLoggers[i]
+			r.lock.Unlock()
+		}
+	}
+}
+
+func (l *reloadableLogger) get() (log.Logger, func()) {
+	l.lock.RLock()
+	return l.logger, l.lock.RUnlock
+}
+
+func (l *reloadableLogger) Alert(v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Alert(v...)
+}
+
+func (l *reloadableLogger) Alertf(f string, v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Alertf(f, v...)
+}
+
+func (l *reloadableLogger) Error(v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Error(v...)
+}
+
+func (l *reloadableLogger) Errorf(f string, v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Errorf(f, v...)
+}
+
+func (l *reloadableLogger) Warn(v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Warn(v...)
+}
+
+func (l *reloadableLogger) Warnf(f string, v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Warnf(f, v...)
+}
+
+func (l *reloadableLogger) Config(v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Config(v...)
+}
+
+func (l *reloadableLogger) Configf(f string, v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Configf(f, v...)
+}
+
+func (l *reloadableLogger) Info(v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Info(v...)
+}
+
+func (l *reloadableLogger) Infof(f string, v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Infof(f, v...)
+}
+
+func (l *reloadableLogger) Debug(v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Debug(v...)
+}
+
+func (l *reloadableLogger) Debugf(f string, v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Debugf(f, v...)
+}
+
+func (l *reloadableLogger) Fatal(v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Fatal(v...)
+}
+
+func (l *reloadableLogger) Fatalf(f string, v ...interface{}) {
+	logger, done := l.get()
+	defer done()
+	logger.Fatalf(f, v...)
+}
@@ -18,12 +18,14 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -32,18 +34,48 @@ import (
 	"sync"
 	"time"
 
+	"github.com/uniqush/goconf/conf"
 	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
 	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/util"
 )
 
 // RestAPI implements uniqush's REST API (/push, /subscribe, /addpsp, etc).
 type RestAPI struct {
-	psm       *push.PushServiceManager
-	loggers   []log.Logger
-	backend   *PushBackEnd
-	version   string
-	waitGroup *sync.WaitGroup
-	stopChan  chan<- bool
+	psm      *push.PushServiceManager
+	loggers  []log.Logger
+	backend  *PushBackEnd
+	version  string
+	stopChan chan<- bool
+	server   *http.Server
+	// inFlight counts the requests being processed, which stop waits for.
+	inFlight util.PendingWork
+	// stopping is set once stop is called, after which new requests are refused.
+	stopping     bool
+	stoppingLock sync.Mutex
+	// settingsLock guards shutdownTimeout, idempotencyTTL, auditMaxEntries, auditTrustedProxies, and apiKeys, which can be changed by reloading uniqush.conf.
+	settingsLock sync.RWMutex
+	// shutdownTimeout is how long stop waits for requests, pushes and retries to finish before closing connections to push services.
+	shutdownTimeout time.Duration
+	// idempotencyTTL is how long the responses of /push requests with an idempotency key are kept.
+	idempotencyTTL time.Duration
+	// auditMaxEntries is about how many entries of the audit log are kept, or 0 to keep every entry.
+	auditMaxEntries int64
+	// auditTrustedProxies are the addresses of the proxies whose AuditActorHeader is recorded in the audit log.
+	auditTrustedProxies []*net.IPNet
+	// apiKeys are the API keys accepted by the REST API, or nil if requests don't need one (See authenticate).
+	apiKeys *APIKeys
+
+	// reloadLock is held while uniqush.conf is reloaded (See reload).
+	reloadLock sync.Mutex
+	// configSources are the sources of the configuration, and config is the config last loaded from them.
+	configSources ConfigSources
+	config        *conf.ConfigFile
+	// settings are the settings from config which were applied.
+	settings *reloadableSettings
+	// logfile is the file the loggers write to, which is closed when the loggers are replaced. It's nil for stderr.
+	logfile io.Closer
 }
 
 func randomUniqID() string {
@@ -52,6 +84,17 @@ func randomUniqID() string {
 	return fmt.Sprintf("%x-%v", time.Now().Unix(), base64.URLEncoding.EncodeToString(d[:]))
 }
 
+// validRequestIDPattern is the request IDs accepted from the X-Request-ID header. Spaces and quotes aren't allowed, so that request IDs can be logged as RequestID=<id>.
+var validRequestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9._:@/+=-]{1,128}$`)
+
+// getRequestID returns the request ID from the X-Request-ID header of r, or a new random ID if there is none or it's invalid.
+func getRequestID(r *http.Request) string {
+	if reqID := r.Header.Get(push.RequestIDHeader); validRequestIDPattern.MatchString(reqID) {
+		return reqID
+	}
+	return randomUniqID()
+}
+
 // NewRestAPI constructs the data structures for the singleton REST API of uniqush-push
 func NewRestAPI(psm *push.PushServiceManager, loggers []log.Logger, version string, backend *PushBackEnd) *RestAPI {
 	ret := new(RestAPI)
@@ -59,10 +102,39 @@ func NewRestAPI(psm *push.PushServiceManager, loggers []log.Logger, version stri
 	ret.loggers = loggers
 	ret.version = version
 	ret.backend = backend
-	ret.waitGroup = new(sync.WaitGroup)
+	ret.server = &http.Server{}
+	ret.shutdownTimeout = defaultShutdownTimeout
+	ret.idempotencyTTL = defaultIdempotencyTTL
+	ret.auditMaxEntries = defaultAuditMaxEntries
 	return ret
 }
 
+// SetShutdownTimeout sets how long stopping waits for requests, pushes and retries to finish.
+func (api *RestAPI) SetShutdownTimeout(timeout time.Duration) {
+	api.settingsLock.Lock()
+	defer api.settingsLock.Unlock()
+	api.shutdownTimeout = timeout
+}
+
+func (api *RestAPI) getShutdownTimeout() time.Duration {
+	api.settingsLock.RLock()
+	defer api.settingsLock.RUnlock()
+	return api.shutdownTimeout
+}
+
+// SetIdempotencyTTL sets how long the responses of /push requests with an idempotency key are kept.
+func (api *RestAPI) SetIdempotencyTTL(ttl time.Duration) {
+	api.settingsLock.Lock()
+	defer api.settingsLock.Unlock()
+	api.idempotencyTTL = ttl
+}
+
+func (api *RestAPI) getIdempotencyTTL() time.Duration {
+	api.settingsLock.RLock()
+	defer api.settingsLock.RUnlock()
+	return api.idempotencyTTL
+}
+
 // Constants for the paths of the REST API
 const (
 	AddPushServiceProviderToServiceURL      = "/addpsp"
@@ -77,6 +149,38 @@ const (
 	QuerySubscriptionsURL                   = "/subscriptions"
 	QueryPushServiceProviders               = "/psps"
 	RebuildServiceSetURL                    = "/rebuildserviceset"
+	PreferencesURL                          = "/preferences"
+	PushBatchURL                            = "/pushbatch"
+	AddDeliveryPointsBatchURL               = "/subscribebatch"
+	RemoveDeliveryPointsBatchURL            = "/unsubscribebatch"
+	RemoveAllDeliveryPointsURL              = "/unsubscribeall"
+	RemoveDeviceURL                         = "/unsubscribedevice"
+	ReencryptPushServiceProvidersURL        = "/reencryptpsps"
+	MetricsURL                              = "/metrics"
+	HealthzURL                              = "/healthz"
+	ReadyzURL                               = "/readyz"
+	AuditURL                                = "/audit"
+	ReloadConfigURL                         = "/reload"
+)
+
+const (
+	// IdempotencyKeyHeader is the HTTP header with the optional idempotency key of a /push request. uniqush.idempotency_key may be used instead.
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// MaxBatchSize is the maximum number of entries in the JSON array of a batch request, such as /pushbatch.
+	MaxBatchSize = 1000
+	// maxBatchBodySize is the maximum size of the body of a batch request, in bytes.
+	maxBatchBodySize = 16 << 20
+	// batchConcurrency is the maximum number of entries of a batch request processed at the same time.
+	batchConcurrency = 32
+
+	defaultIdempotencyTTL  = 24 * time.Hour
+	maxIdempotencyKeyLen   = 255
+	idempotencyPendingTTL  = 5 * time.Minute
+	idempotencyKeyParamKey = "uniqush.idempotency_key"
+
+	// defaultShutdownTimeout is how long stopping waits for work in progress, if shutdown_timeout isn't set in [WebFrontend].
+	defaultShutdownTimeout = 30 * time.Second
 )
 
 // TODO: Switch to the stricter regex in a subsequent release.
@@ -98,8 +202,13 @@ func validateSubscribers(subs []string) error {
 	return nil
 }
 
+// validateService checks the name of a service, which may be namespaced by a tenant (e.g. team-a/myservice, See Tenant).
 func validateService(service string) error {
-	if !validServicePattern.MatchString(service) {
+	name := service
+	if i := strings.Index(service, tenantSeparator); i >= 0 && validTenantPattern.MatchString(service[:i]) {
+		name = service[i+len(tenantSeparator):]
+	}
+	if !validServicePattern.MatchString(name) {
 		return fmt.Errorf("invalid service name: %q. Accepted characters: a-z, A-Z, 0-9, -, _, @ or .", service)
 	}
 	return nil
@@ -155,6 +264,37 @@ func getDeliveryPointIdsFromMap(kv map[string]string) (deliveryPointNames []stri
 	return
 }
 
+// Get the optional uniqush.fallback from a map: an ordered list of push service types to try for each subscriber.
+func getFallbackFromMap(kv map[string]string) (fallback []string, err error) {
+	var v string
+	var ok bool
+	if v, ok = kv["uniqush.fallback"]; !ok {
+		return nil, nil
+	}
+	for _, pushServiceType := range strings.Split(v, ",") {
+		pushServiceType = strings.TrimSpace(pushServiceType)
+		if len(pushServiceType) > 0 {
+			fallback = append(fallback, pushServiceType)
+		}
+	}
+	if len(fallback) == 0 {
+		return nil, fmt.Errorf("EmptyFallback")
+	}
+	return
+}
+
+// Get the optional idempotency key of a /push request, from the Idempotency-Key header or uniqush.idempotency_key.
+func getIdempotencyKey(header http.Header, kv map[string]string) (string, error) {
+	key := header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		key = kv[idempotencyKeyParamKey]
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		return "", fmt.Errorf("the idempotency key is longer than %d characters", maxIdempotencyKeyLen)
+	}
+	return key, nil
+}
+
 func getServiceFromMap(kv map[string]string) (service string, err error) {
 	var ok bool
 	if service, ok = kv["service"]; !ok {
@@ -169,7 +309,11 @@ func getServiceFromMap(kv map[string]string) (service string, err error) {
 	return
 }
 
-func (api *RestAPI) changePushServiceProvider(kv map[string]string, logger log.Logger, remoteAddr string, add bool) APIResponseDetails {
+// changePushServiceProvider adds or removes a PSP, recording the PSP before and after the change and the result in entry, for the audit log.
+func (api *RestAPI) changePushServiceProvider(kv map[string]string, logger log.Logger, remoteAddr string, add bool, entry *db.AuditEntry) (details APIResponseDetails) {
+	defer func() {
+		setAuditResult(entry, details.Code, details.ErrorMsg)
+	}()
 	psp, err := api.psm.BuildPushServiceProviderFromMap(kv)
 	if err != nil {
 		logger.Errorf("From=%v Cannot build push service provider: %v", remoteAddr, err)
@@ -180,6 +324,9 @@ func (api *RestAPI) changePushServiceProvider(kv map[string]string, logger log.L
 		logger.Errorf("From=%v Cannot get service name: %v; %v", remoteAddr, service, err)
 		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
 	}
+	entry.Service = service
+	entry.PushServiceProvider = psp.Name()
+	entry.Before = auditPSP(api.findPushServiceProvider(psp.Name(), logger))
 	if add {
 		err = api.backend.AddPushServiceProvider(service, psp)
 	} else {
@@ -189,50 +336,195 @@ func (api *RestAPI) changePushServiceProvider(kv map[string]string, logger log.L
 		logger.Errorf("From=%v Failed: %v", remoteAddr, err)
 		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
 	}
+	if add {
+		entry.After = auditPSP(psp)
+		api.backend.checkCertificate(psp, time.Now(), logger)
+	} else {
+		api.backend.forgetCertificate(psp)
+	}
 	pspName := psp.Name()
 	logger.Infof("From=%v Service=%v PushServiceProvider=%v Success!", remoteAddr, service, pspName)
 	return APIResponseDetails{From: &remoteAddr, Service: &service, PushServiceProvider: &pspName, Code: UNIQUSH_SUCCESS}
 }
 
-func (api *RestAPI) changeSubscription(kv map[string]string, logger log.Logger, remoteAddr string, issub bool) APIResponseDetails {
+// buildSubscription gets the service, subscriber and delivery point of /subscribe or /unsubscribe, or returns the details of the error.
+func (api *RestAPI) buildSubscription(kv map[string]string, logger log.Logger, remoteAddr string) (db.Subscription, *APIResponseDetails) {
 	dp, err := api.psm.BuildDeliveryPointFromMap(kv)
 	if err != nil {
 		logger.Errorf("Cannot build delivery point: %v", err)
-		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_BUILD_DELIVERY_POINT, ErrorMsg: strPtrOfErr(err)}
+		return db.Subscription{}, &APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_BUILD_DELIVERY_POINT, ErrorMsg: strPtrOfErr(err)}
 	}
 	service, err := getServiceFromMap(kv)
 	if err != nil {
 		logger.Errorf("From=%v Cannot get service name: %v; %v", remoteAddr, service, err)
-		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
+		return db.Subscription{}, &APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
 	}
 	subs, err := getSubscribersFromMap(kv, true)
+	if err == nil && len(subs) == 0 {
+		err = errors.New("NoSubscriber")
+	}
 	if err != nil {
 		logger.Errorf("From=%v Service=%v Cannot get subscriber: %v", remoteAddr, service, err)
-		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER, ErrorMsg: strPtrOfErr(err)}
+		return db.Subscription{}, &APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER, ErrorMsg: strPtrOfErr(err)}
+	}
+	return db.Subscription{Service: service, Subscriber: subs[0], DeliveryPoint: dp}, nil
+}
+
+// subscriptionResult logs and returns the details of the result of subscribing or unsubscribing (psp is nil when unsubscribing).
+func subscriptionResult(sub db.Subscription, psp *push.PushServiceProvider, err error, logger log.Logger, remoteAddr string) APIResponseDetails {
+	if err != nil {
+		logger.Errorf("From=%v Failed: %v", remoteAddr, err)
+		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
+	}
+	service, subscriber := sub.Service, sub.Subscriber
+	dpName := sub.DeliveryPoint.Name()
+	if psp == nil {
+		logger.Infof("From=%v Service=%v Subscriber=%v DeliveryPoint=%v Success!", remoteAddr, service, subscriber, dpName)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subscriber, DeliveryPoint: &dpName, Code: UNIQUSH_SUCCESS}
+	}
+	pspName := psp.Name()
+	logger.Infof("From=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Success!", remoteAddr, service, subscriber, pspName, dpName)
+	return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subscriber, DeliveryPoint: &dpName, PushServiceProvider: &pspName, Code: UNIQUSH_SUCCESS}
+}
+
+func (api *RestAPI) changeSubscription(kv map[string]string, logger log.Logger, remoteAddr string, issub bool) APIResponseDetails {
+	sub, details := api.buildSubscription(kv, logger, remoteAddr)
+	if details != nil {
+		return *details
 	}
 
 	var psp *push.PushServiceProvider
+	var err error
 	if issub {
-		psp, err = api.backend.Subscribe(service, subs[0], dp)
+		psp, err = api.backend.Subscribe(sub.Service, sub.Subscriber, sub.DeliveryPoint)
 	} else {
-		err = api.backend.Unsubscribe(service, subs[0], dp)
+		err = api.backend.Unsubscribe(sub.Service, sub.Subscriber, sub.DeliveryPoint)
 	}
+	return subscriptionResult(sub, psp, err, logger, remoteAddr)
+}
+
+// changeSubscriptionBatch handles /subscribebatch and /unsubscribebatch.
+// The body is a JSON array (See decodeBatch) of objects with the parameters of /subscribe, and the response is a JSON array with the result for each object.
+// The services are namespaced for tenant (See Tenant).
+func (api *RestAPI) changeSubscriptionBatch(tenant *Tenant, body io.Reader, logger log.Logger, remoteAddr string, issub bool) []byte {
+	batch, err := decodeBatch(body)
 	if err != nil {
+		logger.Errorf("From=%v Invalid batch: %v", remoteAddr, err)
+		response, _ := json.Marshal(APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)})
+		return response
+	}
+	logger.Infof("From=%v NrEntries=%v Batch", remoteAddr, len(batch))
+
+	results := make([]APIResponseDetails, len(batch))
+	var subscriptions []db.Subscription
+	var indices []int
+	for i, kv := range batch {
+		tenant.namespaceKV(kv)
+		sub, details := api.buildSubscription(kv, logger, remoteAddr)
+		if details != nil {
+			results[i] = *details
+			continue
+		}
+		subscriptions = append(subscriptions, sub)
+		indices = append(indices, i)
+	}
+
+	if len(subscriptions) > 0 {
+		var psps []*push.PushServiceProvider
+		var errs []error
+		if issub {
+			psps, errs = api.backend.SubscribeBatch(subscriptions)
+		} else {
+			psps = make([]*push.PushServiceProvider, len(subscriptions))
+			errs = api.backend.UnsubscribeBatch(subscriptions)
+		}
+		for j, i := range indices {
+			results[i] = subscriptionResult(subscriptions[j], psps[j], errs[j], logger, remoteAddr)
+		}
+	}
+
+	response, err := json.Marshal(results)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return response
+}
+
+// unsubscribeMany handles /unsubscribeall, which removes every delivery point of the subscribers of a service,
+// and /unsubscribedevice, which removes every subscription of a device token (devtoken or regid) from all services and subscribers.
+// The response is a JSON array with the result for each subscription that was found. For a tenant, only the subscriptions of its services are removed.
+func (api *RestAPI) unsubscribeMany(tenant *Tenant, kv map[string]string, logger log.Logger, remoteAddr string, bydevice bool) []byte {
+	fail := func(code string, err error) []byte {
 		logger.Errorf("From=%v Failed: %v", remoteAddr, err)
-		return APIResponseDetails{From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
+		response, _ := json.Marshal(APIResponseDetails{From: &remoteAddr, Code: code, ErrorMsg: strPtrOfErr(err)})
+		return response
 	}
-	dpName := dp.Name()
-	if psp == nil {
-		logger.Infof("From=%v Service=%v Subscriber=%v DeliveryPoint=%v Success!", remoteAddr, service, subs[0], dpName)
-		return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subs[0], DeliveryPoint: &dpName, Code: UNIQUSH_SUCCESS}
+
+	results := []APIResponseDetails{}
+	addResults := func(refs []db.SubscriptionRef, errs []error) {
+		for i, ref := range refs {
+			service, subscriber, dpName := ref.Service, ref.Subscriber, ref.DeliveryPointName
+			details := APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subscriber, DeliveryPoint: &dpName, Code: UNIQUSH_SUCCESS}
+			if errs[i] != nil {
+				logger.Errorf("From=%v Service=%v Subscriber=%v DeliveryPoint=%v Failed: %v", remoteAddr, service, subscriber, dpName, errs[i])
+				details.Code = UNIQUSH_ERROR_GENERIC
+				details.ErrorMsg = strPtrOfErr(errs[i])
+			} else {
+				logger.Infof("From=%v Service=%v Subscriber=%v DeliveryPoint=%v Success!", remoteAddr, service, subscriber, dpName)
+			}
+			results = append(results, details)
+		}
 	}
-	pspName := psp.Name()
-	logger.Infof("From=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Success!", remoteAddr, service, subs[0], pspName, dpName)
-	return APIResponseDetails{From: &remoteAddr, Service: &service, Subscriber: &subs[0], DeliveryPoint: &dpName, PushServiceProvider: &pspName, Code: UNIQUSH_SUCCESS}
+
+	if bydevice {
+		var field, token string
+		for _, f := range push.DeviceTokenFields {
+			if t, ok := kv[f]; ok && t != "" {
+				if field != "" {
+					return fail(UNIQUSH_ERROR_GENERIC, fmt.Errorf("Expected only one of %s", strings.Join(push.DeviceTokenFields, ", ")))
+				}
+				field, token = f, t
+			}
+		}
+		if field == "" {
+			return fail(UNIQUSH_ERROR_GENERIC, fmt.Errorf("NoDeviceToken: expected one of %s", strings.Join(push.DeviceTokenFields, ", ")))
+		}
+		refs, errs, err := api.backend.UnsubscribeDevice(field, token, tenant.servicePrefix())
+		if err != nil {
+			return fail(UNIQUSH_ERROR_DATABASE, err)
+		}
+		addResults(refs, errs)
+	} else {
+		service, err := getServiceFromMap(kv)
+		if err != nil {
+			return fail(UNIQUSH_ERROR_CANNOT_GET_SERVICE, err)
+		}
+		subs, err := getSubscribersFromMap(kv, true)
+		if err == nil && len(subs) == 0 {
+			err = errors.New("NoSubscriber")
+		}
+		if err != nil {
+			return fail(UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER, err)
+		}
+		for _, sub := range subs {
+			refs, errs, err := api.backend.UnsubscribeAll(service, sub)
+			if err != nil {
+				return fail(UNIQUSH_ERROR_DATABASE, err)
+			}
+			addResults(refs, errs)
+		}
+	}
+
+	response, err := json.Marshal(results)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return response
 }
 
 func (api *RestAPI) buildNotificationFromKV(reqID string, kv map[string]string, logger log.Logger, remoteAddr string, service string, subs []string) (notif *push.Notification, details *APIResponseDetails, err error) {
 	notif = push.NewEmptyNotification()
+	notif.RequestID = reqID
 
 	for k, v := range kv {
 		if len(v) <= 0 {
@@ -266,7 +558,8 @@ func (api *RestAPI) buildNotificationFromKV(reqID string, kv map[string]string,
 	return notif, nil, nil
 }
 
-func (api *RestAPI) pushNotification(reqID string, kv map[string]string, perdp map[string][]string, logger log.Logger, remoteAddr string, handler APIResponseHandler) {
+// pushNotification sends a push for the parameters of /push, if it doesn't exceed the quota of tenant (See Tenant).
+func (api *RestAPI) pushNotification(tenant *Tenant, reqID string, kv map[string]string, perdp map[string][]string, logger log.Logger, remoteAddr string, handler APIResponseHandler) {
 	service, err := getServiceFromMap(kv)
 	if err != nil {
 		logger.Errorf("RequestId=%v From=%v Cannot get service name: %v; %v", reqID, remoteAddr, service, err)
@@ -296,15 +589,174 @@ func (api *RestAPI) pushNotification(reqID string, kv map[string]string, perdp m
 		return
 	}
 
+	fallback, err := getFallbackFromMap(kv)
+	if err != nil {
+		logger.Errorf("RequestId=%v From=%v Service=%v Cannot get fallback: %v", reqID, remoteAddr, service, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)})
+		return
+	}
+
 	notif, details, err := api.buildNotificationFromKV(reqID, kv, logger, remoteAddr, service, subs)
 	if err != nil {
 		handler.AddDetailsToHandler(*details)
 		return
 	}
+	delete(notif.Data, "uniqush.fallback")
+	if _, _, err := getDedupFromNotification(notif); err != nil {
+		logger.Errorf("RequestId=%v From=%v Service=%v Cannot get dedup key: %v", reqID, remoteAddr, service, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)})
+		return
+	}
+
+	if tenant != nil && tenant.Quota.IsEnabled() {
+		admitted, err := api.backend.AdmitTenantPushes(tenant.Name, len(subs), tenant.Quota)
+		if err != nil {
+			logger.Errorf("RequestId=%v From=%v Service=%v Tenant=%v Failed to check the quota: Database Error: %v", reqID, remoteAddr, service, tenant.Name, err)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)})
+			return
+		}
+		if !admitted {
+			err := fmt.Errorf("The quota of tenant %s (%v) is exceeded", tenant.Name, tenant.Quota)
+			logger.Errorf("RequestId=%v From=%v Service=%v Tenant=%v NrSubscribers=%v Rejected: Quota exceeded", reqID, remoteAddr, service, tenant.Name, len(subs))
+			handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_TENANT_QUOTA_EXCEEDED, ErrorMsg: strPtrOfErr(err)})
+			return
+		}
+	}
 
 	logger.Infof("RequestId=%v From=%v Service=%v NrSubscribers=%v Subscribers=\"%+v\"", reqID, remoteAddr, service, len(subs), subs)
 
-	api.backend.Push(reqID, remoteAddr, service, subs, dpIds, notif, perdp, logger, handler)
+	api.backend.Push(reqID, remoteAddr, service, subs, dpIds, notif, perdp, fallback, logger, handler)
+}
+
+// pushFromKV sends a push for the parameters of /push, and returns the handler with the response.
+// If the request has an idempotency key (in header, which may be nil, or kv), the push is sent with pushIdempotently.
+// The service and idempotency key are namespaced for tenant (See Tenant).
+func (api *RestAPI) pushFromKV(tenant *Tenant, reqID string, header http.Header, kv map[string]string, perdp map[string][]string, logger log.Logger, remoteAddr string) APIResponseHandler {
+	handler := newPushResponseHandler(logger)
+	idempotencyKey, err := getIdempotencyKey(header, kv)
+	delete(kv, idempotencyKeyParamKey)
+	if err != nil {
+		logger.Errorf("RequestId=%v From=%v Cannot get idempotency key: %v", reqID, remoteAddr, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)})
+		return handler
+	}
+	tenant.namespaceKV(kv)
+	if idempotencyKey != "" {
+		return api.pushIdempotently(tenant, reqID, idempotencyKey, kv, perdp, logger, remoteAddr, handler)
+	}
+	api.pushNotification(tenant, reqID, kv, perdp, logger, remoteAddr, handler)
+	return handler
+}
+
+// decodeBatch decodes the JSON array of objects in the body of a batch request, such as /pushbatch.
+// String values are used as is, other values (e.g. numbers or objects) are used as JSON, and null values are ignored.
+func decodeBatch(body io.Reader) ([]map[string]string, error) {
+	var entries []map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("the body must be a JSON array of objects: %v", err)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("the batch is empty")
+	}
+	if len(entries) > MaxBatchSize {
+		return nil, fmt.Errorf("the batch has %d entries, the maximum is %d", len(entries), MaxBatchSize)
+	}
+	batch := make([]map[string]string, len(entries))
+	for i, entry := range entries {
+		kv := make(map[string]string, len(entry))
+		for k, raw := range entry {
+			value := strings.TrimSpace(string(raw))
+			if value == "null" {
+				continue
+			}
+			if strings.HasPrefix(value, `"`) {
+				if err := json.Unmarshal(raw, &value); err != nil {
+					return nil, fmt.Errorf("invalid value for %q in entry %d: %v", k, i, err)
+				}
+			}
+			kv[k] = value
+		}
+		batch[i] = kv
+	}
+	return batch, nil
+}
+
+// pushBatch sends the pushes of /pushbatch concurrently, and returns a JSON array of their responses (in the same order as the batch).
+// Each entry of the batch has the same parameters as /push, except for uniqush.perdp.*. The request ID of each entry is reqID followed by its index.
+func (api *RestAPI) pushBatch(tenant *Tenant, reqID string, body io.Reader, logger log.Logger, remoteAddr string) []byte {
+	batch, err := decodeBatch(body)
+	if err != nil {
+		logger.Errorf("RequestID=%v From=%v Invalid batch: %v", reqID, remoteAddr, err)
+		response, _ := json.Marshal(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)})
+		return response
+	}
+	logger.Infof("RequestID=%v From=%v NrEntries=%v Batch", reqID, remoteAddr, len(batch))
+
+	responses := make([]json.RawMessage, len(batch))
+	semaphore := make(chan struct{}, batchConcurrency)
+	wg := new(sync.WaitGroup)
+	for i, kv := range batch {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, kv map[string]string) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			handler := api.pushFromKV(tenant, fmt.Sprintf("%s-%d", reqID, i), nil, kv, nil, logger, remoteAddr)
+			responses[i] = handler.ToJSON()
+		}(i, kv)
+	}
+	wg.Wait()
+
+	response, err := json.Marshal(responses)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return response
+}
+
+// pushIdempotently sends a push with an idempotency key, unless a request with that key was already made.
+// It returns the handler with the response: the stored response of an earlier request, or the response of this push, which is stored for the idempotency TTL.
+// Idempotency keys are scoped by the service (including its tenant), so different services may use the same keys.
+func (api *RestAPI) pushIdempotently(tenant *Tenant, reqID string, idempotencyKey string, kv map[string]string, perdp map[string][]string, logger log.Logger, remoteAddr string, handler APIResponseHandler) APIResponseHandler {
+	service := kv["service"]
+	reserved, response, err := api.backend.ReserveIdempotencyKey(service, idempotencyKey, idempotencyPendingTTL)
+	if err != nil {
+		logger.Errorf("RequestId=%v From=%v IdempotencyKey=%q Failed: Database Error: %v", reqID, remoteAddr, idempotencyKey, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)})
+		return handler
+	}
+	if !reserved {
+		if response == nil {
+			logger.Errorf("RequestId=%v From=%v IdempotencyKey=%q Failed: A request with this key is in progress", reqID, remoteAddr, idempotencyKey)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestId: &reqID, From: &remoteAddr, Code: UNIQUSH_ERROR_IDEMPOTENCY_KEY_IN_USE})
+			return handler
+		}
+		logger.Infof("RequestId=%v From=%v IdempotencyKey=%q Returning the stored response", reqID, remoteAddr, idempotencyKey)
+		return &storedResponseHandler{response: response}
+	}
+
+	api.pushNotification(tenant, reqID, kv, perdp, logger, remoteAddr, handler)
+	if err := api.backend.SetIdempotentResponse(service, idempotencyKey, handler.ToJSON(), api.getIdempotencyTTL()); err != nil {
+		logger.Errorf("RequestId=%v From=%v IdempotencyKey=%q Failed to store the response: %v", reqID, remoteAddr, idempotencyKey, err)
+	}
+	return handler
+}
+
+// storedResponseHandler returns the stored response of an earlier request with the same idempotency key.
+type storedResponseHandler struct {
+	response []byte
+}
+
+var _ APIResponseHandler = &storedResponseHandler{}
+
+// AddDetailsToHandler does nothing, the response was already generated.
+func (handler *storedResponseHandler) AddDetailsToHandler(v APIResponseDetails) {}
+
+// ToJSON returns the stored response.
+func (handler *storedResponseHandler) ToJSON() []byte {
+	return handler.response
 }
 
 // preview takes key-value pairs (pushservicetype, plus data for building the payload), a logger, and logging data.
@@ -342,13 +794,58 @@ func apiBytesToObject(data []byte) interface{} {
 	return obj
 }
 
-func (api *RestAPI) stop(w io.Writer, remoteAddr string) {
-	api.waitGroup.Wait()
+// beginRequest records that a request is being processed, returning false if uniqush-push is stopping and the request should be refused.
+// If it returns true, api.inFlight.Done() must be called once the request is processed.
+func (api *RestAPI) beginRequest() bool {
+	api.stoppingLock.Lock()
+	defer api.stoppingLock.Unlock()
+	if api.stopping {
+		return false
+	}
+	api.inFlight.Add()
+	return true
+}
+
+// stop refuses new requests, then waits (until the shutdown timeout) for requests in progress, pushes and retries to finish before closing connections to push services and stopping.
+// The request to stop is recorded in the audit log with entry.
+func (api *RestAPI) stop(w io.Writer, entry *db.AuditEntry) {
+	logger := api.loggers[LoggerWeb]
+	remoteAddr := entry.RemoteAddr
+	api.stoppingLock.Lock()
+	alreadyStopping := api.stopping
+	api.stopping = true
+	api.stoppingLock.Unlock()
+	if alreadyStopping {
+		errorMsg := "Already stopping"
+		setAuditResult(entry, UNIQUSH_ERROR_GENERIC, &errorMsg)
+		api.audit(entry, logger)
+		if w != nil {
+			fmt.Fprintf(w, "%s\r\n", errorMsg)
+		}
+		return
+	}
+	// Record this before the database is closed.
+	setAuditResult(entry, UNIQUSH_SUCCESS, nil)
+	api.audit(entry, logger)
+
+	shutdownTimeout := api.getShutdownTimeout()
+	logger.Infof("Stopping (requested by %v), waiting up to %v for work in progress", remoteAddr, shutdownTimeout)
+	deadline := time.Now().Add(shutdownTimeout)
+	if !api.inFlight.Wait(deadline) {
+		logger.Errorf("Timed out after %v waiting for requests to finish", shutdownTimeout)
+	} else if !api.backend.Drain(deadline) {
+		logger.Errorf("Timed out after %v waiting for pushes and retries to finish", shutdownTimeout)
+	}
 	api.backend.Finalize()
-	api.loggers[LoggerWeb].Infof("stopped by %v", remoteAddr)
+	logger.Infof("stopped by %v", remoteAddr)
 	if w != nil {
 		fmt.Fprintf(w, "Stopped\r\n")
 	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		api.server.Shutdown(ctx)
+	}()
 	api.stopChan <- true
 }
 
@@ -374,7 +871,9 @@ func (api *RestAPI) numberOfDeliveryPoints(kv map[string][]string, logger log.Lo
 	return ret
 }
 
-func (api *RestAPI) querySubscriptions(kv map[string][]string, logger log.Logger) []byte {
+// querySubscriptions returns the subscriptions of a subscriber as JSON, for /subscriptions.
+// For a tenant, only its services are searched (the services in kv must already be namespaced, See Tenant.namespaceForm).
+func (api *RestAPI) querySubscriptions(tenant *Tenant, kv map[string][]string, logger log.Logger) []byte {
 	// "subscriber" is a required parameter
 	subscriberParam, ok := kv["subscriber"]
 	if !ok || len(subscriberParam) == 0 {
@@ -387,6 +886,22 @@ func (api *RestAPI) querySubscriptions(kv map[string][]string, logger log.Logger
 	if ok && len(servicesParam) > 0 {
 		services = strings.Split(servicesParam[0], ",")
 	}
+	if tenant != nil && len(services) == 0 {
+		// An empty list of services would search every service.
+		allServices, err := api.backend.GetServiceNames()
+		if err != nil {
+			logger.Errorf("Query=Subscriptions Subscriber=%v Failed to get the services: %v", subscriberParam[0], err)
+			return []byte("[]")
+		}
+		for _, service := range allServices {
+			if tenant.ownsService(service) {
+				services = append(services, service)
+			}
+		}
+		if len(services) == 0 {
+			return []byte("[]")
+		}
+	}
 	includeDPIds := false
 	if v, ok := kv["include_delivery_point_ids"]; ok && len(v) > 0 && v[0] == "1" {
 		includeDPIds = true
@@ -401,19 +916,25 @@ func (api *RestAPI) querySubscriptions(kv map[string][]string, logger log.Logger
 	return json
 }
 
+// redactedSecret replaces the values of push.SecretFields in /psps and the audit log.
+const redactedSecret = "<redacted>"
+
 func encodePSPForAPI(psp *push.PushServiceProvider) map[string]string {
 	result := make(map[string]string)
-	for key, value := range psp.VolatileData {
-		result[key] = value
-	}
-	for key, value := range psp.FixedData {
-		result[key] = value
+	for _, data := range []map[string]string{psp.VolatileData, psp.FixedData} {
+		for key, value := range data {
+			if value != "" && push.IsSecretField(key) {
+				value = redactedSecret
+			}
+			result[key] = value
+		}
 	}
 	return result
 }
 
 // queryPSPs returns JSON describing the set of all PSPs stored in Uniqush. This API is intended for debugging/verifying that uniqush is set up properly.
-func (api *RestAPI) queryPSPs(logger log.Logger) []byte {
+// Credentials are always redacted. For a tenant, only the PSPs of its services are listed.
+func (api *RestAPI) queryPSPs(tenant *Tenant, logger log.Logger) []byte {
 	psps, err := api.backend.GetPushServiceProviderConfigs()
 	type responseType struct {
 		Services     map[string][]map[string]string `json:"services"`
@@ -423,7 +944,25 @@ func (api *RestAPI) queryPSPs(logger log.Logger) []byte {
 	var r responseType
 	r.Services = make(map[string][]map[string]string)
 	for _, psp := range psps {
+		if !tenant.ownsService(psp.FixedData["service"]) {
+			continue
+		}
 		data := encodePSPForAPI(psp)
+		status := api.psm.CircuitBreakerStatus(psp)
+		data["circuit_breaker"] = status.State
+		if status.State != push.CircuitClosed {
+			data["circuit_breaker_retry_at"] = status.RetryAt.Format(time.RFC3339)
+			data["circuit_breaker_failures"] = strconv.Itoa(status.ConsecutiveFailures)
+			data["circuit_breaker_last_error"] = status.LastError
+		}
+		if certInfo, certErr := api.psm.InspectCertificate(psp); certErr != nil {
+			data["cert_error"] = certErr.Error()
+		} else if certInfo != nil {
+			data["cert_not_after"] = certInfo.NotAfter.UTC().Format(time.RFC3339)
+			data["cert_subject"] = certInfo.Subject
+			data["cert_topic"] = certInfo.Topic
+			data["cert_environment"] = certInfo.Environment
+		}
 		service := data["service"]
 		r.Services[service] = append(r.Services[service], data)
 	}
@@ -442,8 +981,114 @@ func (api *RestAPI) queryPSPs(logger log.Logger) []byte {
 	return json
 }
 
+// preferences returns the preferences of a subscriber of a service as JSON, for /preferences.
+// If any of muted_categories, time_zone or quiet_hours are given, those preferences are replaced first (an empty value clears them).
+func (api *RestAPI) preferences(kv map[string]string, logger log.Logger, remoteAddr string) []byte {
+	type responseType struct {
+		Code         string                      `json:"code"`
+		ErrorMessage *string                     `json:"errorMsg,omitempty"`
+		Service      string                      `json:"service,omitempty"`
+		Subscriber   string                      `json:"subscriber,omitempty"`
+		Preferences  *push.SubscriberPreferences `json:"preferences,omitempty"`
+	}
+	var r responseType
+	fail := func(code string, err error) []byte {
+		logger.Errorf("From=%v Service=%v Subscriber=%v Preferences Failed: %v", remoteAddr, r.Service, r.Subscriber, err)
+		r.Code = code
+		r.ErrorMessage = strPtrOfErr(err)
+		r.Preferences = nil
+		json, _ := json.Marshal(r)
+		return json
+	}
+
+	service, err := getServiceFromMap(kv)
+	if err != nil {
+		return fail(UNIQUSH_ERROR_CANNOT_GET_SERVICE, err)
+	}
+	r.Service = service
+	sub, ok := kv["subscriber"]
+	if !ok {
+		return fail(UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER, errors.New("NoSubscriber"))
+	}
+	if err := validateSubscribers([]string{sub}); err != nil {
+		return fail(UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER, err)
+	}
+	r.Subscriber = sub
+
+	prefs, err := api.backend.GetSubscriberPreferences(service, sub)
+	if err != nil {
+		return fail(UNIQUSH_ERROR_DATABASE, err)
+	}
+	if prefs == nil {
+		prefs = new(push.SubscriberPreferences)
+	}
+
+	modified := false
+	if v, ok := kv["muted_categories"]; ok {
+		prefs.MutedCategories = nil
+		for _, category := range strings.Split(v, ",") {
+			if category = strings.TrimSpace(category); category != "" {
+				prefs.MutedCategories = append(prefs.MutedCategories, category)
+			}
+		}
+		modified = true
+	}
+	if v, ok := kv["time_zone"]; ok {
+		prefs.TimeZone = strings.TrimSpace(v)
+		modified = true
+	}
+	if v, ok := kv["quiet_hours"]; ok {
+		if prefs.QuietHours, err = push.ParseQuietHours(v); err != nil {
+			return fail(UNIQUSH_ERROR_GENERIC, err)
+		}
+		modified = true
+	}
+	if modified {
+		if err := prefs.Validate(); err != nil {
+			return fail(UNIQUSH_ERROR_GENERIC, err)
+		}
+		if err := api.backend.SetSubscriberPreferences(service, sub, prefs); err != nil {
+			return fail(UNIQUSH_ERROR_DATABASE, err)
+		}
+		logger.Infof("From=%v Service=%v Subscriber=%v Preferences=%s Updated preferences", remoteAddr, service, sub, prefs.Marshal())
+	}
+
+	r.Code = UNIQUSH_SUCCESS
+	r.Preferences = prefs
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// reencryptPSPs saves every PSP again after the secrets key is set or rotated, so that old keys can be removed from the configuration.
+func (api *RestAPI) reencryptPSPs(logger log.Logger, entry *db.AuditEntry) []byte {
+	n, err := api.backend.ReencryptPushServiceProviders()
+	type responseType struct {
+		Code        string  `json:"code"`
+		ErrorMsg    *string `json:"errorMsg,omitempty"`
+		Reencrypted int     `json:"reencrypted"`
+	}
+	r := responseType{Code: UNIQUSH_SUCCESS, Reencrypted: n}
+	if err != nil {
+		logger.Errorf("Error in /reencryptpsps after saving %d PSPs: %v", n, err)
+		errorMsg := err.Error()
+		r.Code = UNIQUSH_ERROR_GENERIC
+		r.ErrorMsg = &errorMsg
+	} else {
+		logger.Infof("Re-encrypted the secrets of %d PSPs", n)
+	}
+	setAuditResult(entry, r.Code, r.ErrorMsg)
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to encode response")
+	}
+	return json
+}
+
 // rebuildServiceSet is used to make sure that the /subscriptions and /psps APIs work properly, on uniqush setups created before those APIs existed.
-func (api *RestAPI) rebuildServiceSet(logger log.Logger) []byte {
+func (api *RestAPI) rebuildServiceSet(logger log.Logger, entry *db.AuditEntry) []byte {
 	err := api.backend.RebuildServiceSet()
 	var details APIResponseDetails
 	if err != nil {
@@ -456,6 +1101,7 @@ func (api *RestAPI) rebuildServiceSet(logger log.Logger) []byte {
 	} else {
 		details = APIResponseDetails{Code: UNIQUSH_SUCCESS}
 	}
+	setAuditResult(entry, details.Code, details.ErrorMsg)
 	json, err := json.Marshal(details)
 	if err != nil {
 		return []byte("Failed to encode response")
@@ -485,31 +1131,90 @@ func parseKV(form url.Values) (kv map[string]string, perdp map[string][]string)
 func (api *RestAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	remoteAddr := r.RemoteAddr
+	reqID := getRequestID(r)
+	w.Header().Set(push.RequestIDHeader, reqID)
+
+	tenant, identity, status, err := api.authenticate(r)
+	if err != nil {
+		api.loggers[LoggerWeb].Errorf("RequestId=%v From=%v Path=%v Refused: %v", reqID, remoteAddr, r.URL.Path, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	switch r.URL.Path {
+	case StopProgramURL:
+		api.stop(w, api.newAuditEntry(r, reqID, identity))
+		return
+	case HealthzURL:
+		// The process is still alive while stopping.
+		api.writeHealth(w, api.liveness())
+		return
+	}
+	if !api.beginRequest() {
+		http.Error(w, "uniqush-push is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer api.inFlight.Done()
 
 	switch r.URL.Path {
 	case QuerySubscriptionsURL:
 		r.ParseForm()
-		n := api.querySubscriptions(r.Form, api.loggers[LoggerSubscriptions])
+		tenant.namespaceForm(r.Form)
+		n := api.querySubscriptions(tenant, r.Form, api.loggers[LoggerSubscriptions])
 		fmt.Fprintf(w, "%s\r\n", n)
 		return
 	case QueryPushServiceProviders:
-		n := api.queryPSPs(api.loggers[LoggerPSPs])
+		n := api.queryPSPs(tenant, api.loggers[LoggerPSPs])
 		fmt.Fprintf(w, "%s\r\n", n)
 		return
 	case RebuildServiceSetURL:
-		n := api.rebuildServiceSet(api.loggers[LoggerServices])
+		entry := api.newAuditEntry(r, reqID, identity)
+		n := api.rebuildServiceSet(api.loggers[LoggerServices], entry)
+		api.audit(entry, api.loggers[LoggerServices])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case ReadyzURL:
+		r.ParseForm()
+		api.writeHealth(w, api.readiness(r.Form.Get("providers") == "1", api.loggers[LoggerWeb]))
+		return
+	case MetricsURL:
+		w.Header().Set("Content-Type", metricsContentType)
+		api.writeMetrics(w, time.Now())
+		return
+	case ReencryptPushServiceProvidersURL:
+		entry := api.newAuditEntry(r, reqID, identity)
+		n := api.reencryptPSPs(api.loggers[LoggerPSPs], entry)
+		api.audit(entry, api.loggers[LoggerPSPs])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case ReloadConfigURL:
+		entry := api.newAuditEntry(r, reqID, identity)
+		n := api.reload(entry)
+		api.audit(entry, api.loggers[LoggerWeb])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case AuditURL:
+		r.ParseForm()
+		n := api.queryAudit(r.Form, api.loggers[LoggerWeb])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case PreferencesURL:
+		r.ParseForm()
+		tenant.namespaceForm(r.Form)
+		kv, _ := parseKV(r.Form)
+		n := api.preferences(kv, api.loggers[LoggerPreferences], remoteAddr)
 		fmt.Fprintf(w, "%s\r\n", n)
 		return
 	case QueryNumberOfDeliveryPointsURL:
 		r.ParseForm()
+		tenant.namespaceForm(r.Form)
 		n := api.numberOfDeliveryPoints(r.Form, api.loggers[LoggerWeb])
 		fmt.Fprintf(w, "%v\r\n", n)
 		return
 	case PreviewPushNotificationURL:
 		r.ParseForm()
 		kv, _ := parseKV(r.Form)
-		rid := randomUniqID()
-		details := api.preview(rid, kv, api.loggers[LoggerPreview], remoteAddr)
+		details := api.preview(reqID, kv, api.loggers[LoggerPreview], remoteAddr)
 		bytes, err := json.Marshal(details)
 		if err != nil {
 			fmt.Fprintf(w, "%s\r\n", err.Error())
@@ -521,25 +1226,46 @@ func (api *RestAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "%v\r\n", api.version)
 		api.loggers[LoggerWeb].Infof("Checked version from %v", remoteAddr)
 		return
-	case StopProgramURL:
-		api.stop(w, remoteAddr)
+	case PushBatchURL:
+		// The bodies of batch requests are JSON, so this doesn't call r.ParseForm().
+		n := api.pushBatch(tenant, reqID, http.MaxBytesReader(w, r.Body, maxBatchBodySize), api.loggers[LoggerPush], remoteAddr)
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case AddDeliveryPointsBatchURL, RemoveDeliveryPointsBatchURL:
+		issub := r.URL.Path == AddDeliveryPointsBatchURL
+		logger := api.loggers[LoggerUnsub]
+		if issub {
+			logger = api.loggers[LoggerSub]
+		}
+		n := api.changeSubscriptionBatch(tenant, http.MaxBytesReader(w, r.Body, maxBatchBodySize), logger, remoteAddr, issub)
+		fmt.Fprintf(w, "%s\r\n", n)
 		return
 	}
 	r.ParseForm()
+	tenant.namespaceForm(r.Form)
 	kv, perdp := parseKV(r.Form)
 
-	api.waitGroup.Add(1)
-	defer api.waitGroup.Done()
+	switch r.URL.Path {
+	case RemoveAllDeliveryPointsURL, RemoveDeviceURL:
+		n := api.unsubscribeMany(tenant, kv, api.loggers[LoggerUnsub], remoteAddr, r.URL.Path == RemoveDeviceURL)
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	}
+
 	var handler APIResponseHandler
 	var details APIResponseDetails
 	switch r.URL.Path {
 	case AddPushServiceProviderToServiceURL:
 		handler = newSimpleResponseHandler(api.loggers[LoggerAddPSP], "AddPushServiceProvider")
-		details = api.changePushServiceProvider(kv, api.loggers[LoggerAddPSP], remoteAddr, true)
+		entry := api.newAuditEntry(r, reqID, identity)
+		details = api.changePushServiceProvider(kv, api.loggers[LoggerAddPSP], remoteAddr, true, entry)
+		api.audit(entry, api.loggers[LoggerAddPSP])
 		handler.AddDetailsToHandler(details)
 	case RemovePushServiceProviderFromServiceURL:
 		handler = newSimpleResponseHandler(api.loggers[LoggerRemovePSP], "RemovePushServiceProvider")
-		details = api.changePushServiceProvider(kv, api.loggers[LoggerRemovePSP], remoteAddr, false)
+		entry := api.newAuditEntry(r, reqID, identity)
+		details = api.changePushServiceProvider(kv, api.loggers[LoggerRemovePSP], remoteAddr, false, entry)
+		api.audit(entry, api.loggers[LoggerRemovePSP])
 		handler.AddDetailsToHandler(details)
 	case AddDeliveryPointToServiceURL:
 		handler = newSimpleResponseHandler(api.loggers[LoggerSub], "Subscribe")
@@ -550,9 +1276,7 @@ func (api *RestAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		details = api.changeSubscription(kv, api.loggers[LoggerUnsub], remoteAddr, false)
 		handler.AddDetailsToHandler(details)
 	case PushNotificationURL:
-		handler = newPushResponseHandler(api.loggers[LoggerPush])
-		rid := randomUniqID()
-		api.pushNotification(rid, kv, perdp, api.loggers[LoggerPush], remoteAddr, handler)
+		handler = api.pushFromKV(tenant, reqID, r.Header, kv, perdp, api.loggers[LoggerPush], remoteAddr)
 	}
 	if handler != nil {
 		// Be consistent about ending responses in \r\n
@@ -580,10 +1304,23 @@ func (api *RestAPI) Run(addr string, stopChan chan<- bool) {
 	http.Handle(QuerySubscriptionsURL, api)
 	http.Handle(QueryPushServiceProviders, api)
 	http.Handle(RebuildServiceSetURL, api)
+	http.Handle(PreferencesURL, api)
+	http.Handle(PushBatchURL, api)
+	http.Handle(AddDeliveryPointsBatchURL, api)
+	http.Handle(RemoveDeliveryPointsBatchURL, api)
+	http.Handle(RemoveAllDeliveryPointsURL, api)
+	http.Handle(RemoveDeviceURL, api)
+	http.Handle(ReencryptPushServiceProvidersURL, api)
+	http.Handle(MetricsURL, api)
+	http.Handle(HealthzURL, api)
+	http.Handle(ReadyzURL, api)
+	http.Handle(AuditURL, api)
+	http.Handle(ReloadConfigURL, api)
 
 	api.stopChan = stopChan
-	err := http.ListenAndServe(addr, nil)
-	if err != nil {
+	api.server.Addr = addr
+	err := api.server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		api.loggers[LoggerWeb].Fatalf("HTTPServerError \"%v\"", err)
 	}
 }
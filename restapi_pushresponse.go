@@ -27,6 +27,10 @@ type APIPushResponse struct {
 	SuccessDetails []APIResponseDetails `json:"successDetails"`
 	FailureDetails []APIResponseDetails `json:"failureDetails"`
 	DroppedDetails []APIResponseDetails `json:"droppedDetails"`
+	// SuppressedCount is the number of subscribers which weren't sent the push because of their preferences (muted or deferred),
+	// or because the push was rejected as a duplicate or by a frequency cap.
+	SuppressedCount   int                  `json:"suppressedCount"`
+	SuppressedDetails []APIResponseDetails `json:"suppressedDetails"`
 }
 
 func newPushResponseHandler(logger log.Logger) *APIPushResponseHandler {
@@ -43,6 +47,8 @@ func newAPIPushResponse() APIPushResponse {
 		SuccessDetails: make([]APIResponseDetails, 0),
 		FailureDetails: make([]APIResponseDetails, 0),
 		DroppedDetails: make([]APIResponseDetails, 0),
+
+		SuppressedDetails: make([]APIResponseDetails, 0),
 	}
 }
 
@@ -55,6 +61,9 @@ func (handler *APIPushResponseHandler) AddDetailsToHandler(v APIResponseDetails)
 	} else if v.Code == UNIQUSH_UPDATE_UNSUBSCRIBE || v.Code == UNIQUSH_REMOVE_INVALID_REG {
 		handler.response.DroppedDetails = append(handler.response.DroppedDetails, v)
 		handler.response.DroppedCount++
+	} else if isSuppressedCode(v.Code) {
+		handler.response.SuppressedDetails = append(handler.response.SuppressedDetails, v)
+		handler.response.SuppressedCount++
 	} else {
 		handler.response.FailureDetails = append(handler.response.FailureDetails, v)
 		handler.response.FailureCount++
@@ -62,6 +71,14 @@ func (handler *APIPushResponseHandler) AddDetailsToHandler(v APIResponseDetails)
 	handler.mutex.Unlock()
 }
 
+func isSuppressedCode(code string) bool {
+	switch code {
+	case UNIQUSH_SUPPRESSED_MUTED, UNIQUSH_DEFERRED_QUIET_HOURS, UNIQUSH_REJECTED_DUPLICATE, UNIQUSH_REJECTED_FREQUENCY_CAP:
+		return true
+	}
+	return false
+}
+
 // ToJSON serializes this push response as JSON to send to the client of uniqush-push.
 func (handler *APIPushResponseHandler) ToJSON() []byte {
 	json, err := json.Marshal(handler.response)
@@ -8,6 +8,15 @@ const (
 	UNIQUSH_REMOVE_INVALID_REG = "UNIQUSH_REMOVE_INVALID_REG"
 	UNIQUSH_UPDATE_UNSUBSCRIBE = "UNIQUSH_UPDATE_UNSUBSCRIBE"
 
+	// UNIQUSH_SUPPRESSED_MUTED is returned when a push isn't sent to a subscriber, because they muted its uniqush.category in /preferences.
+	UNIQUSH_SUPPRESSED_MUTED = "UNIQUSH_SUPPRESSED_MUTED"
+	// UNIQUSH_DEFERRED_QUIET_HOURS is returned when a push to a subscriber is delayed until the end of their quiet hours (See deferredUntil).
+	UNIQUSH_DEFERRED_QUIET_HOURS = "UNIQUSH_DEFERRED_QUIET_HOURS"
+	// UNIQUSH_REJECTED_DUPLICATE is returned when a push isn't sent to a subscriber, because they were recently sent a push with the same uniqush.dedup_key.
+	UNIQUSH_REJECTED_DUPLICATE = "UNIQUSH_REJECTED_DUPLICATE"
+	// UNIQUSH_REJECTED_FREQUENCY_CAP is returned when a push isn't sent to a subscriber, because they reached the frequency cap of the service.
+	UNIQUSH_REJECTED_FREQUENCY_CAP = "UNIQUSH_REJECTED_FREQUENCY_CAP"
+
 	/* Errors */
 
 	UNIQUSH_ERROR_GENERIC            = "UNIQUSH_ERROR_GENERIC"
@@ -31,6 +40,15 @@ const (
 	UNIQUSH_ERROR_NO_PUSH_SERVICE_PROVIDER = "UNIQUSH_ERROR_NO_PUSH_SERVICE_PROVIDER"
 	UNIQUSH_ERROR_NO_SUBSCRIBER            = "UNIQUSH_ERROR_NO_SUBSCRIBER"
 	UNIQUSH_ERROR_NO_PUSH_SERVICE_TYPE     = "UNIQUSH_ERROR_NO_PUSH_SERVICE_TYPE"
+
+	// UNIQUSH_ERROR_PSP_UNAVAILABLE is returned without sending a push, when the push service provider failed repeatedly and the cooldown of its circuit breaker hasn't elapsed.
+	UNIQUSH_ERROR_PSP_UNAVAILABLE = "UNIQUSH_ERROR_PSP_UNAVAILABLE"
+
+	// UNIQUSH_ERROR_IDEMPOTENCY_KEY_IN_USE is returned when a /push request has the idempotency key of a request which is still in progress.
+	UNIQUSH_ERROR_IDEMPOTENCY_KEY_IN_USE = "UNIQUSH_ERROR_IDEMPOTENCY_KEY_IN_USE"
+
+	// UNIQUSH_ERROR_TENANT_QUOTA_EXCEEDED is returned without sending a push, when it would exceed the quota of the tenant of the API key (See [TenantQuotas]).
+	UNIQUSH_ERROR_TENANT_QUOTA_EXCEEDED = "UNIQUSH_ERROR_TENANT_QUOTA_EXCEEDED"
 )
 
 // APIResponseDetails is used to represent responses of various APIs. Different APIs use different subsets of fields.
@@ -45,6 +63,10 @@ type APIResponseDetails struct {
 	Code                string  `json:"code"`
 	ErrorMsg            *string `json:"errorMsg,omitempty"`
 	ModifiedDp          bool    `json:"modifiedDp,omitempty"`
+	// FallbackTier is the push service type used for this delivery point, for pushes with uniqush.fallback.
+	FallbackTier *string `json:"fallbackTier,omitempty"`
+	// DeferredUntil is the time (RFC 3339) at which a push deferred by quiet hours will be sent.
+	DeferredUntil *string `json:"deferredUntil,omitempty"`
 }
 
 // PreviewAPIResponseDetails respresents the response of /preview. It contains a representation of the payload that would be sent to externalpush services
@@ -1,8 +1,24 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/srv/apns"
 	"github.com/uniqush/uniqush-push/test_util"
 )
 
@@ -58,3 +74,618 @@ func TestValidateLegacyService(t *testing.T) {
 	err := validateSubscribers([]string{legacyName})
 	test_util.ExpectEquals(t, nil, err, "expected valid for "+legacyName)
 }
+
+func TestPushWithIdempotencyKey(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	pst := &mockPushServiceType{name: "mockidempotent"}
+	psm.RegisterPushServiceType(pst)
+	mockDB := &mockPushDatabase{pairs: []db.PushServiceProviderDeliveryPointPair{newMockPair(t, psm, "mockidempotent", "idempotent1")}}
+	backend, _ := newMockPushBackEnd(psm, mockDB)
+	api := NewRestAPI(psm, backend.loggers, "test", backend)
+
+	pushWithKey := func(service string, idempotencyKey string) APIPushResponse {
+		form := url.Values{"service": {service}, "subscriber": {"mysubscriber"}, "msg": {"hello"}}
+		r := httptest.NewRequest("POST", PushNotificationURL, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set(IdempotencyKeyHeader, idempotencyKey)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		test_util.ExpectEquals(t, http.StatusOK, w.Code, "status code")
+		var response APIPushResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unexpected error parsing the response %q: %v", w.Body.String(), err)
+		}
+		return response
+	}
+
+	first := pushWithKey("myservice", "key1")
+	test_util.ExpectEquals(t, 1, first.SuccessCount, "success count")
+	repeated := pushWithKey("myservice", "key1")
+	test_util.ExpectEquals(t, first, repeated, "response to a repeated request")
+	test_util.ExpectEquals(t, 1, pst.sent, "delivery points sent to")
+
+	pushWithKey("myservice", "key2")
+	test_util.ExpectEquals(t, 2, pst.sent, "delivery points sent to with another key")
+
+	pushWithKey("otherservice", "key1")
+	test_util.ExpectEquals(t, 3, pst.sent, "delivery points sent to by another service with the same key")
+
+	mockDB.idempotentResponses["myservice:key3"] = ""
+	inProgress := pushWithKey("myservice", "key3")
+	if inProgress.FailureCount != 1 || inProgress.FailureDetails[0].Code != UNIQUSH_ERROR_IDEMPOTENCY_KEY_IN_USE {
+		t.Errorf("Expected UNIQUSH_ERROR_IDEMPOTENCY_KEY_IN_USE, got %#v", inProgress)
+	}
+	test_util.ExpectEquals(t, 3, pst.sent, "delivery points sent to while a request is in progress")
+}
+
+func TestPushBatch(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	pst := &mockPushServiceType{name: "mockbatch"}
+	psm.RegisterPushServiceType(pst)
+	mockDB := &mockPushDatabase{pairs: []db.PushServiceProviderDeliveryPointPair{newMockPair(t, psm, "mockbatch", "batch1")}}
+	backend, _ := newMockPushBackEnd(psm, mockDB)
+	api := NewRestAPI(psm, backend.loggers, "test", backend)
+
+	body := `[
+		{"service": "myservice", "subscriber": "alice", "msg": "Hi Alice", "badge": 3},
+		{"service": "myservice", "subscriber": "bob", "msg": "Hi Bob"},
+		{"subscriber": "carol", "msg": "Hi Carol"}
+	]`
+	r := httptest.NewRequest("POST", PushBatchURL, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+
+	var responses []APIPushResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("Unexpected error parsing the response %q: %v", w.Body.String(), err)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("Expected 3 responses, got %d", len(responses))
+	}
+	test_util.ExpectEquals(t, 1, responses[0].SuccessCount, "success count of the first response")
+	test_util.ExpectEquals(t, 1, responses[1].SuccessCount, "success count of the second response")
+	test_util.ExpectStringEquals(t, UNIQUSH_ERROR_CANNOT_GET_SERVICE, responses[2].FailureDetails[0].Code, "code of the entry without a service")
+	sort.Strings(pst.msgs)
+	test_util.ExpectEquals(t, []string{"Hi Alice", "Hi Bob"}, pst.msgs, "messages sent")
+}
+
+func TestDecodeBatch(t *testing.T) {
+	batch, err := decodeBatch(strings.NewReader(`[{"service": "myservice", "badge": 3, "uniqush.payload.webhook": {"a": [1]}, "sound": null}]`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test_util.ExpectEquals(t, []map[string]string{{"service": "myservice", "badge": "3", "uniqush.payload.webhook": `{"a": [1]}`}}, batch, "batch")
+
+	tooLarge := "[" + strings.Repeat("{},", MaxBatchSize) + "{}]"
+	for _, body := range []string{`{"service": "myservice"}`, `[]`, tooLarge} {
+		if _, err := decodeBatch(strings.NewReader(body)); err == nil {
+			t.Errorf("Expected an error for %.40q", body)
+		}
+	}
+}
+
+func TestSubscribeBatch(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	pst := &mockPushServiceType{name: "mocksubscribebatch"}
+	psm.RegisterPushServiceType(pst)
+	mockDB := &mockPushDatabase{pairs: []db.PushServiceProviderDeliveryPointPair{newMockPair(t, psm, "mocksubscribebatch", "batch1")}}
+	backend, _ := newMockPushBackEnd(psm, mockDB)
+	api := NewRestAPI(psm, backend.loggers, "test", backend)
+
+	body := `[
+		{"service": "myservice", "subscriber": "alice", "pushservicetype": "mocksubscribebatch", "regid": "alice1"},
+		{"service": "myservice", "subscriber": "bob", "pushservicetype": "unknown", "regid": "bob1"},
+		{"service": "myservice", "subscriber": "bad subscriber", "pushservicetype": "mocksubscribebatch", "regid": "bad1"},
+		{"service": "myservice", "subscriber": "carol", "pushservicetype": "mocksubscribebatch", "regid": "carol1"}
+	]`
+	r := httptest.NewRequest("POST", AddDeliveryPointsBatchURL, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+
+	var results []APIResponseDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("Unexpected error parsing the response %q: %v", w.Body.String(), err)
+	}
+	var codes []string
+	for _, result := range results {
+		codes = append(codes, result.Code)
+	}
+	test_util.ExpectEquals(t, []string{UNIQUSH_SUCCESS, UNIQUSH_ERROR_BUILD_DELIVERY_POINT, UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER, UNIQUSH_SUCCESS}, codes, "codes")
+	test_util.ExpectStringEquals(t, "carol", *results[3].Subscriber, "subscriber of the last result")
+	if len(mockDB.subscriptions) != 2 || mockDB.subscriptions[1].DeliveryPoint.FixedData["regid"] != "carol1" {
+		t.Errorf("Expected the 2 valid subscriptions to be added, got %#v", mockDB.subscriptions)
+	}
+}
+
+func TestUnsubscribeAllAndDevice(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	pst := &mockPushServiceType{name: "mockunsubscribeall"}
+	psm.RegisterPushServiceType(pst)
+	alice := newMockPair(t, psm, "mockunsubscribeall", "alice1")
+	mockDB := &mockPushDatabase{
+		subscriptions: []db.Subscription{
+			{Service: "myservice", Subscriber: "alice", DeliveryPoint: alice.DeliveryPoint},
+			{Service: "myservice", Subscriber: "bob", DeliveryPoint: alice.DeliveryPoint},
+		},
+		deviceSubscriptions: map[string][]db.SubscriptionRef{
+			"regid:shared": {
+				{Service: "myservice", Subscriber: "carol", DeliveryPointName: "dp1"},
+				{Service: "otherservice", Subscriber: "dave", DeliveryPointName: "dp2"},
+			},
+		},
+	}
+	backend, _ := newMockPushBackEnd(psm, mockDB)
+	api := NewRestAPI(psm, backend.loggers, "test", backend)
+
+	request := func(path string, form url.Values) []APIResponseDetails {
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		var results []APIResponseDetails
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatalf("Unexpected error parsing the response %q: %v", w.Body.String(), err)
+		}
+		return results
+	}
+
+	results := request(RemoveAllDeliveryPointsURL, url.Values{"service": {"myservice"}, "subscriber": {"alice"}})
+	if len(results) != 1 || results[0].Code != UNIQUSH_SUCCESS || *results[0].Subscriber != "alice" {
+		t.Errorf("Expected alice's subscription to be removed, got %#v", results)
+	}
+	test_util.ExpectEquals(t, 1, len(mockDB.subscriptions), "remaining subscriptions")
+
+	results = request(RemoveDeviceURL, url.Values{"regid": {"shared"}})
+	var subscribers []string
+	for _, result := range results {
+		test_util.ExpectStringEquals(t, UNIQUSH_SUCCESS, result.Code, "code")
+		subscribers = append(subscribers, *result.Service+":"+*result.Subscriber)
+	}
+	test_util.ExpectEquals(t, []string{"myservice:carol", "otherservice:dave"}, subscribers, "removed subscriptions")
+	test_util.ExpectEquals(t, 0, len(request(RemoveDeviceURL, url.Values{"regid": {"shared"}})), "number of subscriptions removed twice")
+
+	r := httptest.NewRequest("POST", RemoveDeviceURL, strings.NewReader(""))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	var details APIResponseDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &details); err != nil || details.Code != UNIQUSH_ERROR_GENERIC {
+		t.Errorf("Expected an error without a device token, got %q", w.Body.String())
+	}
+}
+
+func TestEncodePSPForAPIRedactsSecrets(t *testing.T) {
+	psp := push.NewEmptyPushServiceProvider()
+	psp.FixedData["service"] = "myservice"
+	psp.FixedData["clientsecret"] = "fixed-secret"
+	psp.VolatileData["apikey"] = "volatile-secret"
+	psp.VolatileData["params"] = `{"api_key":"sms-secret"}`
+	psp.VolatileData["addr"] = "https://example.com"
+
+	data := encodePSPForAPI(psp)
+	test_util.ExpectStringEquals(t, redactedSecret, data["clientsecret"], "expected FixedData secrets to be redacted")
+	test_util.ExpectStringEquals(t, redactedSecret, data["apikey"], "expected VolatileData secrets to be redacted")
+	test_util.ExpectStringEquals(t, redactedSecret, data["params"], "expected the params of SMS PSPs to be redacted")
+	test_util.ExpectStringEquals(t, "https://example.com", data["addr"], "expected other fields to be returned")
+	test_util.ExpectStringEquals(t, "myservice", data["service"], "expected other fields to be returned")
+}
+
+func TestEncodePSPForAPIRedactsAPNSPrivateKey(t *testing.T) {
+	readFile := func(path string) string {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", path, err)
+		}
+		return string(data)
+	}
+	// The private key may be included in cert_pem instead of key_pem.
+	combinedPEM := readFile("srv/apns/apns-test/localhost.cert") + readFile("srv/apns/apns-test/localhost.key")
+	psp := push.NewEmptyPushServiceProvider()
+	kv := map[string]string{"service": "myservice", "pushservicetype": "apns", "certname": "prod", "cert_pem": combinedPEM}
+	if err := apns.NewPushService().BuildPushServiceProviderFromMap(kv, psp); err != nil {
+		t.Fatalf("Unexpected error building the PSP: %v", err)
+	}
+
+	data := encodePSPForAPI(psp)
+	test_util.ExpectStringEquals(t, redactedSecret, data["key_pem"], "expected the private key to be redacted")
+	if strings.Contains(data["cert_pem"], "PRIVATE KEY") {
+		t.Errorf("Expected no private key in cert_pem, got %q", data["cert_pem"])
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	mockDB := &mockPushDatabase{pingErrors: map[string]error{"redis_master": nil, "redis_slave": nil}}
+	backend, _ := newMockPushBackEnd(psm, mockDB)
+	api := NewRestAPI(psm, backend.loggers, "test", backend)
+
+	request := func(path string) (int, healthResponse) {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var response healthResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unexpected error parsing the response %q: %v", w.Body.String(), err)
+		}
+		return w.Code, response
+	}
+
+	code, response := request(HealthzURL)
+	test_util.ExpectEquals(t, http.StatusOK, code, "status code of /healthz")
+	test_util.ExpectStringEquals(t, healthStatusOK, response.Status, "status of /healthz")
+
+	code, response = request(ReadyzURL)
+	test_util.ExpectEquals(t, http.StatusOK, code, "status code of /readyz")
+	test_util.ExpectEquals(t, healthResponse{Status: healthStatusOK, Checks: map[string]healthCheck{
+		"redis_master":           {Status: healthStatusOK},
+		"redis_slave":            {Status: healthStatusOK},
+		"push_service_providers": {Status: healthStatusOK},
+	}}, response, "response of /readyz")
+
+	mockDB.pingErrors["redis_slave"] = errors.New("connection refused")
+	mockDB.pspConfigsError = errors.New("Unknown Push Service Type: mockmissing")
+	code, response = request(ReadyzURL)
+	test_util.ExpectEquals(t, http.StatusServiceUnavailable, code, "status code of /readyz")
+	test_util.ExpectStringEquals(t, healthStatusError, response.Status, "status of /readyz")
+	test_util.ExpectEquals(t, healthCheck{Status: healthStatusError, Error: "connection refused"}, response.Checks["redis_slave"], "redis_slave check")
+	test_util.ExpectEquals(t, healthCheck{Status: healthStatusError, Error: "Unknown Push Service Type: mockmissing"}, response.Checks["push_service_providers"], "push_service_providers check")
+	test_util.ExpectStringEquals(t, healthStatusOK, response.Checks["redis_master"].Status, "redis_master check")
+
+	code, _ = request(HealthzURL)
+	test_util.ExpectEquals(t, http.StatusOK, code, "status code of /healthz when not ready")
+}
+
+func TestStopWaitsForRequests(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	mockDB := &mockPushDatabase{}
+	backend, _ := newMockPushBackEnd(psm, mockDB)
+	backend.errChan = make(chan push.Error)
+	api := NewRestAPI(psm, backend.loggers, "test", backend)
+	stopChan := make(chan bool, 1)
+	api.stopChan = stopChan
+
+	request := func(path string) int {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	test_util.ExpectEquals(t, http.StatusOK, request(VersionInfoURL), "status code before stopping")
+	// Simulate a request in progress.
+	if !api.beginRequest() {
+		t.Fatal("Expected the request to be accepted")
+	}
+	go api.stop(nil, &db.AuditEntry{Action: StopProgramURL, RemoteAddr: "test"})
+
+	for deadline := time.Now().Add(5 * time.Second); request(VersionInfoURL) != http.StatusServiceUnavailable; {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected requests to be refused while stopping")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	test_util.ExpectEquals(t, http.StatusOK, request(HealthzURL), "status code of /healthz while stopping")
+	select {
+	case <-stopChan:
+		t.Fatal("Expected stop to wait for the request in progress")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	api.inFlight.Done()
+	select {
+	case <-stopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected stop to finish once the request finished")
+	}
+	if !mockDB.flushed {
+		t.Error("Expected the database cache to be flushed")
+	}
+	if len(mockDB.auditEntries) != 1 || mockDB.auditEntries[0].Code != UNIQUSH_SUCCESS {
+		t.Errorf("Expected stopping to be recorded in the audit log, got %v", mockDB.auditEntries)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	backend, _ := newMockPushBackEnd(psm, &mockPushDatabase{})
+	api := NewRestAPI(psm, backend.loggers, "test", backend)
+
+	request := func(reqID string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", VersionInfoURL, nil)
+		if reqID != "" {
+			r.Header.Set(push.RequestIDHeader, reqID)
+		}
+		api.ServeHTTP(w, r)
+		return w.Header().Get(push.RequestIDHeader)
+	}
+
+	test_util.ExpectStringEquals(t, "my-request.1", request("my-request.1"), "request ID from the X-Request-ID header")
+	for _, reqID := range []string{"", "has spaces", `"quoted"`, strings.Repeat("a", 129)} {
+		if generated := request(reqID); generated == reqID || generated == "" {
+			t.Errorf("Expected a random request ID instead of %q, got %q", reqID, generated)
+		}
+	}
+}
+
+func TestAuditPushServiceProviderChanges(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	psm.RegisterPushServiceType(&mockPushServiceType{name: "mockaudit"})
+	mockDB := &mockPushDatabase{}
+	backend, _ := newMockPushBackEnd(psm, mockDB)
+	api := NewRestAPI(psm, backend.loggers, "test", backend)
+	c := conf.NewConfigFile()
+	c.AddOption("WebFrontend", "admin_api_keys", "adminkey")
+	c.AddOption("Audit", "trusted_proxies", "192.0.2.1, 2001:db8::/32")
+	keys, err := LoadAPIKeys(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	api.SetAPIKeys(keys)
+	proxies, err := LoadAuditTrustedProxies(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	api.SetAuditTrustedProxies(proxies)
+
+	remoteAddr := "192.0.2.1:1234"
+	request := func(method string, path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set(AuditActorHeader, "admin")
+		r.Header.Set(APIKeyHeader, "adminkey")
+		r.Header.Set(push.RequestIDHeader, "request1")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+	form := url.Values{"pushservicetype": {"mockaudit"}, "service": {"myservice"}, "apikey": {"secretkey"}}
+	request("POST", AddPushServiceProviderToServiceURL, form)
+	// The actor is only recorded from trusted proxies.
+	remoteAddr = "198.51.100.1:1234"
+	request("POST", RemovePushServiceProviderFromServiceURL, form)
+
+	var response struct {
+		Code    string           `json:"code"`
+		Entries []*db.AuditEntry `json:"entries"`
+	}
+	w := request("GET", AuditURL+"?count=10", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unexpected error parsing %q: %v", w.Body.String(), err)
+	}
+	test_util.ExpectStringEquals(t, UNIQUSH_SUCCESS, response.Code, "code of /audit")
+	if len(response.Entries) != 2 {
+		t.Fatalf("Expected 2 audit entries, got %d", len(response.Entries))
+	}
+	removed, added := response.Entries[0], response.Entries[1]
+
+	test_util.ExpectStringEquals(t, AddPushServiceProviderToServiceURL, added.Action, "action of the first entry")
+	test_util.ExpectStringEquals(t, "admin", added.Actor, "actor")
+	test_util.ExpectStringEquals(t, "admin:"+hashAPIKey("adminkey")[:adminIdentityHashLen], added.Identity, "identity")
+	test_util.ExpectStringEquals(t, "request1", added.RequestID, "request ID")
+	test_util.ExpectStringEquals(t, "myservice", added.Service, "service")
+	test_util.ExpectStringEquals(t, UNIQUSH_SUCCESS, added.Code, "code of adding the PSP")
+	test_util.ExpectEquals(t, 0, len(added.Before), "PSP before it was added")
+	test_util.ExpectStringEquals(t, redactedSecret, added.After["apikey"], "redacted secret after the PSP was added")
+
+	test_util.ExpectStringEquals(t, RemovePushServiceProviderFromServiceURL, removed.Action, "action of the second entry")
+	test_util.ExpectStringEquals(t, added.PushServiceProvider, removed.PushServiceProvider, "PSP name")
+	test_util.ExpectStringEquals(t, redactedSecret, removed.Before["apikey"], "redacted secret before the PSP was removed")
+	test_util.ExpectEquals(t, 0, len(removed.After), "PSP after it was removed")
+	test_util.ExpectStringEquals(t, "", removed.Actor, "actor from an untrusted address")
+	test_util.ExpectStringEquals(t, added.Identity, removed.Identity, "identity")
+	if strings.Contains(w.Body.String(), "secretkey") {
+		t.Errorf("Expected secrets to be redacted from the audit log, got %s", w.Body.String())
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniqush-reload")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "uniqush.conf")
+	logfilename := filepath.Join(dir, "uniqush.log")
+	writeConfig := func(addr string, host string, maxEntries string) {
+		contents := "[default]\nlogfile=" + logfilename + "\n[WebFrontend]\naddr=" + addr + "\n[Database]\nhost=" + host + "\n[Audit]\nmax_entries=" + maxEntries + "\n"
+		if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+			t.Fatalf("Unexpected error writing %s: %v", filename, err)
+		}
+	}
+	writeConfig("localhost:9898", "localhost", "5")
+	c, err := OpenConfig(filename)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	settings, err := loadReloadableSettings(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	psm := push.GetPushServiceManager()
+	mockDB := &mockPushDatabase{}
+	backend, _ := newMockPushBackEnd(psm, mockDB)
+	backend.loggers = newReloadableLoggers(backend.loggers)
+	api := NewRestAPI(psm, backend.loggers, "test", backend)
+	api.SetConfigSources(ConfigSources{File: filename, Environ: []string{}}, c, nil)
+	if err := api.applySettings(settings); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer backend.stopDeliveryPointSweeper()
+	defer backend.stopCertificateMonitor()
+	test_util.ExpectEquals(t, int64(5), api.getAuditMaxEntries(), "max_entries before reloading")
+
+	var response struct {
+		Code       string   `json:"code"`
+		ErrorMsg   string   `json:"errorMsg"`
+		NotApplied []string `json:"notApplied"`
+	}
+	reload := func() {
+		r := httptest.NewRequest("POST", ReloadConfigURL, nil)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		response.ErrorMsg = ""
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unexpected error parsing %q: %v", w.Body.String(), err)
+		}
+	}
+
+	writeConfig("0.0.0.0:9898", "redis.example.com", "7")
+	reload()
+	test_util.ExpectStringEquals(t, UNIQUSH_SUCCESS, response.Code, "code of /reload")
+	if expected := []string{"[WebFrontend] addr", "[Database] host"}; !reflect.DeepEqual(expected, response.NotApplied) {
+		t.Errorf("Expected the options not applied to be %v, got %v", expected, response.NotApplied)
+	}
+	test_util.ExpectEquals(t, int64(7), api.getAuditMaxEntries(), "max_entries after reloading")
+	contents, err := ioutil.ReadFile(logfilename)
+	if err != nil || !strings.Contains(string(contents), "Reloaded the configuration") {
+		t.Errorf("Expected the reloaded loggers to write to the logfile, got %q (%v)", contents, err)
+	}
+
+	// Nothing is applied if uniqush.conf is invalid.
+	writeConfig("0.0.0.0:9898", "redis.example.com", "-1")
+	reload()
+	test_util.ExpectStringEquals(t, UNIQUSH_ERROR_GENERIC, response.Code, "code of /reload with an invalid config")
+	test_util.ExpectStringEquals(t, "[Audit] max_entries must be a non-negative number", response.ErrorMsg, "error of /reload")
+	test_util.ExpectEquals(t, int64(7), api.getAuditMaxEntries(), "max_entries after failing to reload")
+
+	if len(mockDB.auditEntries) != 2 {
+		t.Fatalf("Expected 2 audit entries, got %d", len(mockDB.auditEntries))
+	}
+	test_util.ExpectStringEquals(t, ReloadConfigURL, mockDB.auditEntries[0].Action, "action of the audit entry")
+	test_util.ExpectStringEquals(t, "[WebFrontend] addr, [Database] host", mockDB.auditEntries[0].After["notApplied"], "options not applied in the audit entry")
+	test_util.ExpectStringEquals(t, UNIQUSH_ERROR_GENERIC, mockDB.auditEntries[1].Code, "code of the failed reload in the audit log")
+	api.logfile.Close()
+}
+
+func TestTenants(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	psm.RegisterPushServiceType(&mockPushServiceType{name: "mocktenants"})
+	mockDB := &mockPushDatabase{
+		serviceNames: []string{"myservice", "team-a/myservice", "team-b/myservice"},
+		deviceSubscriptions: map[string][]db.SubscriptionRef{
+			"regid:shared": {
+				{Service: "team-a/myservice", Subscriber: "carol", DeliveryPointName: "dp1"},
+				{Service: "team-b/myservice", Subscriber: "dave", DeliveryPointName: "dp2"},
+			},
+		},
+	}
+	mockDB.pairs = []db.PushServiceProviderDeliveryPointPair{newMockPair(t, psm, "mocktenants", "tenants1")}
+	backend, _ := newMockPushBackEnd(psm, mockDB)
+	api := NewRestAPI(psm, backend.loggers, "test", backend)
+
+	c := conf.NewConfigFile()
+	c.AddOption("WebFrontend", "admin_api_keys", "adminkey")
+	c.AddOption("Tenants", "team-a", "akey1, akey2")
+	c.AddOption("Tenants", "team-b", "bkey")
+	c.AddOption("TenantQuotas", "team-a", "3/1h")
+	keys, err := LoadAPIKeys(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	api.SetAPIKeys(keys)
+
+	request := func(apiKey string, path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if apiKey != "" {
+			r.Header.Set(APIKeyHeader, apiKey)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+	test_util.ExpectEquals(t, http.StatusUnauthorized, request("", PushNotificationURL, nil).Code, "status code without an API key")
+	test_util.ExpectEquals(t, http.StatusUnauthorized, request("wrongkey", PushNotificationURL, nil).Code, "status code with an invalid API key")
+	test_util.ExpectEquals(t, http.StatusForbidden, request("akey1", AuditURL, nil).Code, "status code of /audit for a tenant")
+	test_util.ExpectEquals(t, http.StatusOK, request("adminkey", AuditURL, nil).Code, "status code of /audit for an admin")
+	test_util.ExpectEquals(t, http.StatusOK, request("", HealthzURL, nil).Code, "status code of /healthz without an API key")
+	test_util.ExpectEquals(t, http.StatusUnauthorized, request("", MetricsURL, nil).Code, "status code of /metrics without an API key")
+	test_util.ExpectEquals(t, http.StatusForbidden, request("akey1", MetricsURL, nil).Code, "status code of /metrics for a tenant")
+	test_util.ExpectEquals(t, http.StatusOK, request("adminkey", MetricsURL, nil).Code, "status code of /metrics for an admin")
+	test_util.ExpectEquals(t, http.StatusUnauthorized, request("", ReadyzURL, url.Values{"providers": {"1"}}).Code, "status code of /readyz?providers=1 without an API key")
+
+	// Both tenants add a PSP to a service named myservice, which are different services.
+	for _, apiKey := range []string{"akey2", "bkey"} {
+		request(apiKey, AddPushServiceProviderToServiceURL, url.Values{"pushservicetype": {"mocktenants"}, "service": {"myservice"}})
+	}
+	var psps struct {
+		Services map[string][]map[string]string `json:"services"`
+	}
+	w := request("akey1", QueryPushServiceProviders, nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &psps); err != nil {
+		t.Fatalf("Unexpected error parsing %q: %v", w.Body.String(), err)
+	}
+	if len(psps.Services) != 1 || len(psps.Services["team-a/myservice"]) != 1 {
+		t.Errorf("Expected /psps to only list the PSP of team-a, got %v", psps.Services)
+	}
+	w = request("adminkey", QueryPushServiceProviders, nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &psps); err != nil {
+		t.Fatalf("Unexpected error parsing %q: %v", w.Body.String(), err)
+	}
+	test_util.ExpectEquals(t, 3, len(psps.Services), "number of services in /psps for an admin")
+
+	for _, apiKey := range []string{"akey1", "bkey"} {
+		r := httptest.NewRequest("POST", AddDeliveryPointsBatchURL, strings.NewReader(`[{"service": "myservice", "subscriber": "alice", "pushservicetype": "mocktenants", "regid": "alice1"}]`))
+		r.Header.Set(APIKeyHeader, apiKey)
+		api.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if len(mockDB.subscriptions) != 2 || mockDB.subscriptions[0].Service != "team-a/myservice" || mockDB.subscriptions[1].Service != "team-b/myservice" {
+		t.Errorf("Expected the subscriptions to be namespaced, got %#v", mockDB.subscriptions)
+	}
+	var subscriptions []map[string]string
+	w = request("akey1", QuerySubscriptionsURL, url.Values{"subscriber": {"alice"}})
+	if err := json.Unmarshal(w.Body.Bytes(), &subscriptions); err != nil {
+		t.Fatalf("Unexpected error parsing %q: %v", w.Body.String(), err)
+	}
+	if len(subscriptions) != 1 || subscriptions[0]["service"] != "team-a/myservice" {
+		t.Errorf("Expected /subscriptions to only find the subscription of team-a, got %v", subscriptions)
+	}
+
+	var removed []APIResponseDetails
+	w = request("bkey", RemoveDeviceURL, url.Values{"regid": {"shared"}})
+	if err := json.Unmarshal(w.Body.Bytes(), &removed); err != nil {
+		t.Fatalf("Unexpected error parsing %q: %v", w.Body.String(), err)
+	}
+	if len(removed) != 1 || *removed[0].Subscriber != "dave" {
+		t.Errorf("Expected /unsubscribedevice to only remove the subscription of team-b, got %v", w.Body.String())
+	}
+
+	pushAs := func(apiKey string, service string, subscribers string) APIPushResponse {
+		w := request(apiKey, PushNotificationURL, url.Values{"service": {service}, "subscribers": {subscribers}, "msg": {"hello"}})
+		var response APIPushResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unexpected error parsing the response %q: %v", w.Body.String(), err)
+		}
+		return response
+	}
+	if response := pushAs("akey1", "team-b/myservice", "alice"); response.FailureCount != 1 || response.FailureDetails[0].Code != UNIQUSH_ERROR_CANNOT_GET_SERVICE {
+		t.Errorf("Expected pushing to the service of another tenant to fail, got %#v", response)
+	}
+	if response := pushAs("akey1", "myservice", "alice,bob"); response.SuccessCount != 2 {
+		t.Errorf("Expected pushes within the quota to succeed, got %#v", response)
+	}
+	if response := pushAs("akey1", "team-a/myservice", "carol,dave"); response.FailureCount != 1 || response.FailureDetails[0].Code != UNIQUSH_ERROR_TENANT_QUOTA_EXCEEDED {
+		t.Errorf("Expected pushes exceeding the quota to be rejected, got %#v", response)
+	}
+	test_util.ExpectEquals(t, map[string]int{"team-a": 2}, mockDB.tenantPushes, "pushes counted for quotas")
+}
+
+func TestLoadAPIKeysErrors(t *testing.T) {
+	for _, options := range []map[string]string{
+		{"Tenants.team a": "key"},
+		{"Tenants.team-a": " , "},
+		{"Tenants.team-a": "key", "Tenants.team-b": "key"},
+		{"WebFrontend.admin_api_keys": "key", "Tenants.team-a": "key"},
+		{"Tenants.team-a": "key", "TenantQuotas.team-b": "10/1h"},
+		{"Tenants.team-a": "key", "TenantQuotas.team-a": "10"},
+	} {
+		c := conf.NewConfigFile()
+		for option, value := range options {
+			parts := strings.SplitN(option, ".", 2)
+			c.AddOption(parts[0], parts[1], value)
+		}
+		if _, err := LoadAPIKeys(c); err == nil {
+			t.Errorf("Expected an error loading API keys from %v", options)
+		}
+	}
+}
@@ -26,7 +26,13 @@ import (
 func (api *RestAPI) signalSetup() {
 	ch := make(chan os.Signal, 1)
 	// TODO: Figure out what the equivalent should be on Windows.
-	signal.Notify(ch, syscall.SIGTERM, os.Kill) // nolint: megacheck
-	<-ch
-	api.stop(nil, "SIGTERM")
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGHUP, os.Interrupt, os.Kill) // nolint: megacheck
+	for sig := range ch {
+		if sig == syscall.SIGHUP {
+			api.reloadOnSignal(sig)
+			continue
+		}
+		api.stop(nil, newSignalAuditEntry(StopProgramURL, sig))
+		return
+	}
 }
@@ -25,7 +25,7 @@ import (
 
 func (self *RestAPI) signalSetup() {
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Kill)
-	<-ch
-	self.stop(nil, "SIGTERM")
+	signal.Notify(ch, os.Interrupt, os.Kill)
+	sig := <-ch
+	self.stop(nil, newSignalAuditEntry(StopProgramURL, sig))
 }
@@ -31,6 +31,7 @@ import (
 	"time"
 
 	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/util"
 )
 
 const (
@@ -45,18 +46,31 @@ type pspLockResponse struct {
 
 type pspLockRequest struct {
 	psp    *push.PushServiceProvider
+	client *http.Client
 	respCh chan<- *pspLockResponse
 }
 
 type admPushService struct {
 	pspLock chan *pspLockRequest
+	// client is shared by all ADM PSPs. It is replaced only when the service is registered, before any pushes are sent.
+	client *http.Client
+}
+
+// defaultADMHTTPClientConfig contains the HTTP client settings used for ADM, if they are not overridden in the [adm] section of uniqush.conf.
+var defaultADMHTTPClientConfig = util.HTTPClientConfig{
+	Timeout:             time.Second * 10,
+	TLSHandshakeTimeout: time.Second * 5,
+	MaxIdleConnsPerHost: 100,
 }
 
 var _ push.PushServiceType = &admPushService{}
+var _ push.ReachabilityChecker = &admPushService{}
 
 func newADMPushService() *admPushService {
 	ret := new(admPushService)
 	ret.pspLock = make(chan *pspLockRequest)
+	// The defaults can't fail to create a client (no CA file or proxy)
+	ret.client, _ = defaultADMHTTPClientConfig.NewClient()
 	go admPspLocker(ret.pspLock)
 	return ret
 }
@@ -70,13 +84,36 @@ func InstallADM() {
 	}
 }
 
-func (adm *admPushService) Finalize() {}
+func (adm *admPushService) Finalize() {
+	if transport, ok := adm.client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+}
 func (adm *admPushService) Name() string {
 	return "adm"
 }
 func (adm *admPushService) SetErrorReportChan(errChan chan<- push.Error) {
 }
+
+// ValidatePushServiceConfig rejects an invalid http_proxy or http_ca_file, which SetPushServiceConfig can't use.
+func (adm *admPushService) ValidatePushServiceConfig(c *push.PushServiceConfig) error {
+	return util.CheckHTTPClientConfig(c)
+}
+
 func (adm *admPushService) SetPushServiceConfig(c *push.PushServiceConfig) {
+	// This uses the fact that registration takes place before any requests are sent.
+	// The push service manager calls ValidatePushServiceConfig first, so this only fails if the CA file was removed since.
+	client, err := util.NewHTTPClientFromConfig(c, defaultADMHTTPClientConfig)
+	if err != nil {
+		return
+	}
+	adm.Finalize()
+	adm.client = client
+}
+
+// CheckReachability checks that the ADM endpoint can be reached, for /readyz.
+func (adm *admPushService) CheckReachability(timeout time.Duration) error {
+	return util.CheckHTTPReachable(adm.client, admServiceURL, timeout)
 }
 
 func (adm *admPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
@@ -134,7 +171,7 @@ func admPspLocker(lockChan <-chan *pspLockRequest) {
 			psp = req.psp
 			pspLockMap[clientid] = psp
 		}
-		resp.err = requestToken(psp)
+		resp.err = requestToken(req.client, psp)
 		resp.psp = psp
 		if resp.err != nil {
 			if _, ok := resp.err.(*push.PushServiceProviderUpdate); ok {
@@ -159,7 +196,7 @@ type tokenFailObj struct {
 	Description string `json:"error_description"`
 }
 
-func requestToken(psp *push.PushServiceProvider) push.Error {
+func requestToken(client *http.Client, psp *push.PushServiceProvider) push.Error {
 	var ok bool
 	var clientid string
 	var cserect string
@@ -195,7 +232,6 @@ func requestToken(psp *push.PushServiceProvider) push.Error {
 	defer req.Body.Close()
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		return push.NewErrorf("Do error: %v", err)
@@ -297,7 +333,7 @@ func admURL(dp *push.DeliveryPoint) (url string, err push.Error) {
 	return
 }
 
-func admNewRequest(psp *push.PushServiceProvider, dp *push.DeliveryPoint, data []byte) (req *http.Request, err push.Error) {
+func admNewRequest(psp *push.PushServiceProvider, dp *push.DeliveryPoint, data []byte, notif *push.Notification) (req *http.Request, err push.Error) {
 	var token string
 	var ok bool
 	if token, ok = psp.VolatileData["token"]; !ok {
@@ -316,6 +352,7 @@ func admNewRequest(psp *push.PushServiceProvider, dp *push.DeliveryPoint, data [
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
+	util.SetRequestIDHeader(req, notif)
 	req.Header.Set("x-amzn-type-version", "com.amazon.device.messaging.ADMMessage@1.0")
 	req.Header.Set("x-amzn-accept-type", "com.amazon.device.messaging.ADMSendResult@1.0")
 	req.Header.Set("Authorization", "Bearer "+token)
@@ -327,9 +364,8 @@ type admPushFailResponse struct {
 	Reason string `json:"reason"`
 }
 
-func admSinglePush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, data []byte, notif *push.Notification) (string, push.Error) {
-	client := &http.Client{}
-	req, err := admNewRequest(psp, dp, data)
+func admSinglePush(client *http.Client, psp *push.PushServiceProvider, dp *push.DeliveryPoint, data []byte, notif *push.Notification) (string, push.Error) {
+	req, err := admNewRequest(psp, dp, data, notif)
 	if err != nil {
 		return "", err
 	}
@@ -392,6 +428,7 @@ func (adm *admPushService) lockPsp(psp *push.PushServiceProvider) (*push.PushSer
 	respCh := make(chan *pspLockResponse)
 	req := &pspLockRequest{
 		psp:    psp,
+		client: adm.client,
 		respCh: respCh,
 	}
 
@@ -430,6 +467,8 @@ func (adm *admPushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *p
 	res.Content = notif
 	res.Provider = psp
 
+	// The PSP returned by lockPsp may be a copy without rate limits, so keep the original for those.
+	limitedPSP := psp
 	var err push.Error
 	psp, err = adm.lockPsp(psp)
 	if err != nil {
@@ -456,8 +495,10 @@ func (adm *admPushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *p
 		res.Content = notif
 		res.Provider = psp
 		res.Destination = dp
+		release := limitedPSP.AcquireRequestSlot()
 		go func(dp *push.DeliveryPoint) {
-			res.MsgID, res.Err = admSinglePush(psp, dp, data, notif)
+			res.MsgID, res.Err = admSinglePush(adm.client, psp, dp, data, notif)
+			release()
 			resQueue <- res
 			wg.Done()
 		}(dp)
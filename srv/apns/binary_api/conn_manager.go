@@ -75,7 +75,7 @@ var _ ConnManager = &connManagerImpl{}
 
 func newAPNSConnManager(psp *push.PushServiceProvider, resultChan chan<- *common.APNSResult) ConnManager {
 	manager := new(connManagerImpl)
-	manager.cert, manager.err = tls.LoadX509KeyPair(psp.FixedData["cert"], psp.FixedData["key"])
+	manager.cert, manager.err = common.LoadCertificate(psp)
 	if manager.err != nil {
 		return manager
 	}
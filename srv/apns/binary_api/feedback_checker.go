@@ -31,6 +31,7 @@ import (
 
 	cache "github.com/uniqush/cache2"
 	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/srv/apns/common"
 )
 
 const (
@@ -39,7 +40,7 @@ const (
 )
 
 func connectFeedback(psp *push.PushServiceProvider) (net.Conn, error) {
-	cert, err := tls.LoadX509KeyPair(psp.FixedData["cert"], psp.FixedData["key"])
+	cert, err := common.LoadCertificate(psp)
 	if err != nil {
 		return nil, push.NewBadPushServiceProviderWithDetails(psp, err.Error())
 	}
@@ -72,6 +72,25 @@ func (pool *Pool) Close() {
 	pool.wg.Wait()
 }
 
+// Size returns the number of workers in the pool.
+func (pool *Pool) Size() int {
+	return pool.maxWorkers
+}
+
+// Resize changes the number of workers in the pool, e.g. when pool_size is changed by reloading uniqush.conf.
+// Removed workers close their connections after finishing the requests they already accepted.
+// This must not be called concurrently with Resize or Close.
+func (pool *Pool) Resize(numWorkers int) {
+	for ; pool.maxWorkers < numWorkers; pool.maxWorkers++ {
+		pool.wg.Add(1)
+		go poolWorker(&pool.wg, pool.manager, pool.requests, pool.maxWaitTime)
+	}
+	for ; pool.maxWorkers > numWorkers; pool.maxWorkers-- {
+		// A request without a payload tells whichever worker receives it to stop.
+		pool.requests <- workerRequest{}
+	}
+}
+
 // Push will send the push payload to APNS, and respond with nil, TemporaryError, or PermanentError.
 func (pool *Pool) Push(payload []byte) error {
 	responseChan := make(chan error)
@@ -94,6 +113,10 @@ func poolWorker(wg *sync.WaitGroup, manager ConnManager, requests <-chan workerR
 
 	lastRequestTime := time.Now()
 	for request := range requests {
+		if request.Response == nil {
+			// The pool was resized.
+			break
+		}
 		curTime := time.Now()
 		if conn != nil {
 			// Ensure we'll automatically reconnect on a request if we know the connection was closed. This is non-blocking.
@@ -48,8 +48,10 @@ type BinaryPushRequestProcessor struct {
 	errChan    chan<- push.Error
 	wgFinalize sync.WaitGroup
 	poolSize   int
-	reqLock    sync.RWMutex
-	finished   bool
+	// poolSizeLock guards poolSize, which can be changed by reloading uniqush.conf.
+	poolSizeLock sync.Mutex
+	reqLock      sync.RWMutex
+	finished     bool
 
 	// connManagerMaker is called to create a ConnManager for a given push.PushServiceProvider
 	connManagerMaker func(psp *push.PushServiceProvider, resultChan chan<- *common.APNSResult) ConnManager
@@ -100,17 +102,25 @@ func (prp *BinaryPushRequestProcessor) SetErrorReportChan(errChan chan<- push.Er
 	prp.errChan = errChan
 }
 
+// SetPushServiceConfig sets the size of the pools of connections to APNS for each PSP.
+// If this is called again because uniqush.conf was reloaded, existing pools are resized before they send their next push.
 func (prp *BinaryPushRequestProcessor) SetPushServiceConfig(c *push.PushServiceConfig) {
-	// This uses the fact that registration takes place before any requests are sent, so pools aren't created yet.
-
 	if poolSize, err := c.GetInt("pool_size"); err == nil && poolSize > 0 {
 		if poolSize > 50 { // More than you would ever use
 			poolSize = 50
 		}
+		prp.poolSizeLock.Lock()
+		defer prp.poolSizeLock.Unlock()
 		prp.poolSize = poolSize
 	}
 }
 
+func (prp *BinaryPushRequestProcessor) getPoolSize() int {
+	prp.poolSizeLock.Lock()
+	defer prp.poolSizeLock.Unlock()
+	return prp.poolSize
+}
+
 func (prp *BinaryPushRequestProcessor) AddRequest(req *common.PushRequest) {
 	prp.reqLock.RLock()
 	defer prp.reqLock.RUnlock()
@@ -329,7 +339,7 @@ func (prp *BinaryPushRequestProcessor) pushWorkerGroup(psp *push.PushServiceProv
 	// This will create a goroutine listening on each connection it creates, to be sent to us on resultChan.
 	manager := newLoggingConnManager(prp.connManagerMaker(psp, (chan<- *common.APNSResult)(resultChan)), prp.errChan)
 	// There's a pool for each push endpoint.
-	workerpool := NewPool(manager, prp.poolSize, maxWaitTime)
+	workerpool := NewPool(manager, prp.getPoolSize(), maxWaitTime)
 	defer workerpool.Close()
 
 	workerid := fmt.Sprintf("workder-%v-%v", time.Now().Unix(), rand.Int63())
@@ -376,6 +386,10 @@ func (prp *BinaryPushRequestProcessor) pushWorkerGroup(psp *push.PushServiceProv
 				}
 			}
 
+			if poolSize := prp.getPoolSize(); poolSize != workerpool.Size() {
+				workerpool.Resize(poolSize)
+			}
+
 			for i := range req.Devtokens {
 				mid := req.GetID(i)
 				reqMap[mid] = req
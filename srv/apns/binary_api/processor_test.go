@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	cache "github.com/uniqush/cache2"
+	"github.com/uniqush/goconf/conf"
 	"github.com/uniqush/uniqush-push/push"
 	"github.com/uniqush/uniqush-push/srv/apns/binary_api/mocks"
 	"github.com/uniqush/uniqush-push/srv/apns/common"
@@ -143,6 +144,29 @@ func TestPoolSize(t *testing.T) {
 	requestProcessor.Finalize()
 }
 
+// TestReloadPoolSize verifies that pool_size can be changed after pools are created, and that pools can be resized.
+func TestReloadPoolSize(t *testing.T) {
+	requestProcessor := NewRequestProcessor(MockConnectionCount)
+	defer requestProcessor.Finalize()
+	c := conf.NewConfigFile()
+	c.AddSection("apns")
+	c.AddOption("apns", "pool_size", "5")
+	requestProcessor.SetPushServiceConfig(push.NewPushServiceConfig(c, "apns"))
+	if poolSize := requestProcessor.getPoolSize(); poolSize != 5 {
+		t.Errorf("Want the reloaded pool size to be 5, got %d", poolSize)
+	}
+
+	// Workers don't open connections until they're sent a push.
+	pool := NewPool(nil, 2, 1)
+	for _, size := range []int{4, 1, 3} {
+		pool.Resize(size)
+		if pool.Size() != size {
+			t.Errorf("Want the pool size to be %d after resizing, got %d", size, pool.Size())
+		}
+	}
+	pool.Close()
+}
+
 func createSinglePushRequest(psp *push.PushServiceProvider) (*common.PushRequest, chan push.Error, chan *common.APNSResult) {
 	devtoken := "01234567890abcdef01234567890abcdef01234567890abcdef01234567890abcdef"
 	dp := push.NewEmptyDeliveryPoint()
@@ -0,0 +1,125 @@
+package common
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	// CertNameKey is the FixedData key for the stable name of a certificate stored in an APNS PSP.
+	// It identifies the certificate in the PSP's name instead of the certificate's content, so that certificates can be rotated without changing the PSP's name.
+	CertNameKey = "certname"
+	// CertPEMKey and KeyPEMKey are the VolatileData keys for the PEM encoded certificate and private key of an APNS PSP.
+	CertPEMKey = "cert_pem"
+	KeyPEMKey  = "key_pem"
+	// CertFileKey and KeyFileKey are the FixedData keys for the paths of the certificate and private key, for PSPs which don't store them.
+	CertFileKey = "cert"
+	KeyFileKey  = "key"
+)
+
+// LoadCertificate loads the client certificate of an APNS PSP, from the PEM content stored in the PSP,
+// or from the files at the paths in the PSP (for PSPs added without content).
+func LoadCertificate(psp *push.PushServiceProvider) (tls.Certificate, error) {
+	if certPEM := psp.VolatileData[CertPEMKey]; certPEM != "" {
+		keyPEM := psp.VolatileData[KeyPEMKey]
+		if keyPEM == "" {
+			// The private key may be in the same PEM content as the certificate.
+			keyPEM = certPEM
+		}
+		return tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	}
+	return tls.LoadX509KeyPair(psp.FixedData[CertFileKey], psp.FixedData[KeyFileKey])
+}
+
+// CertificateVersion returns a value which changes when the certificate stored in an APNS PSP is rotated, so that connections using the old certificate can be replaced.
+// It is empty for PSPs using certificate files.
+func CertificateVersion(psp *push.PushServiceProvider) string {
+	certPEM := psp.VolatileData[CertPEMKey]
+	if certPEM == "" {
+		return ""
+	}
+	hash := sha1.New()
+	hash.Write([]byte(certPEM))
+	// PEM content never contains NUL bytes, so this separates the certificate from the key.
+	hash.Write([]byte{0})
+	hash.Write([]byte(psp.VolatileData[KeyPEMKey]))
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// Environments of APNS certificates, in CertificateInfo.Environment.
+const (
+	EnvironmentSandbox    = "sandbox"
+	EnvironmentProduction = "production"
+	// EnvironmentUniversal is used by "Apple Push Services" certificates, which can push in both environments.
+	EnvironmentUniversal = "sandbox+production"
+)
+
+var (
+	// Apple's certificate extensions marking certificates for the development (sandbox) and production APNS environments.
+	oidAPNSDevelopment = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 1}
+	oidAPNSProduction  = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 2}
+	// oidUserID is the UID attribute of the subject, which is the bundle id in APNS certificates.
+	oidUserID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+)
+
+// IsSandboxAddress returns whether the address of an APNS PSP (The addr of its VolatileData) is in the sandbox environment.
+func IsSandboxAddress(addr string) bool {
+	return strings.Contains(addr, "sandbox") || strings.Contains(addr, "api.development.")
+}
+
+// ParseCertificateInfo returns the expiry, subject, topic and environment of the client certificate of an APNS PSP.
+// The environment is empty if the certificate is not an Apple push certificate (e.g. in tests).
+func ParseCertificateInfo(cert tls.Certificate) (*push.CertificateInfo, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("No certificate found")
+	}
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse certificate: %v", err)
+	}
+	info := &push.CertificateInfo{
+		NotAfter: x509Cert.NotAfter,
+		Subject:  x509Cert.Subject.CommonName,
+	}
+	for _, name := range x509Cert.Subject.Names {
+		if topic, ok := name.Value.(string); ok && name.Type.Equal(oidUserID) {
+			info.Topic = topic
+		}
+	}
+	sandbox, production := false, false
+	for _, extension := range x509Cert.Extensions {
+		if extension.Id.Equal(oidAPNSDevelopment) {
+			sandbox = true
+		} else if extension.Id.Equal(oidAPNSProduction) {
+			production = true
+		}
+	}
+	switch {
+	case sandbox && production:
+		info.Environment = EnvironmentUniversal
+	case sandbox:
+		info.Environment = EnvironmentSandbox
+	case production:
+		info.Environment = EnvironmentProduction
+	}
+	return info, nil
+}
+
+// CheckEnvironment returns an error if a certificate can't be used in the environment of a PSP (sandbox or production).
+// Such PSPs would fail to connect to APNS, or fail to push to every device token.
+func CheckEnvironment(info *push.CertificateInfo, sandbox bool) error {
+	if sandbox && info.Environment == EnvironmentProduction {
+		return errors.New("CertificateEnvironmentMismatch: the certificate is for the production environment, but sandbox is true")
+	}
+	if !sandbox && info.Environment == EnvironmentSandbox {
+		return errors.New("CertificateEnvironmentMismatch: the certificate is for the sandbox environment, but sandbox is not true")
+	}
+	return nil
+}
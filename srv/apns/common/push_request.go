@@ -37,6 +37,7 @@ type PushRequestProcessor interface {
 	SetErrorReportChan(errChan chan<- push.Error)
 
 	// SetPushServiceConfig sets the config of this PushRequestProcessor when the service is registered.
+	// It's called again if uniqush.conf is reloaded, possibly while pushes are being sent.
 	SetPushServiceConfig(c *push.PushServiceConfig)
 }
 
@@ -22,8 +22,14 @@ func (pst *MockPushServiceType) BuildPushServiceProviderFromMap(kv map[string]st
 	}
 	return nil
 }
-func (pst *MockPushServiceType) BuildDeliveryPointFromMap(map[string]string, *push.DeliveryPoint) error {
-	panic("Not implemented")
+func (pst *MockPushServiceType) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
+	for key, value := range kv {
+		switch key {
+		case "service", "subscriber", "devtoken":
+			dp.FixedData[key] = value
+		}
+	}
+	return nil
 }
 func (pst *MockPushServiceType) Name() string {
 	return "apns"
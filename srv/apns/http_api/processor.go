@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
@@ -16,6 +15,7 @@ import (
 
 	"github.com/uniqush/uniqush-push/push"
 	"github.com/uniqush/uniqush-push/srv/apns/common"
+	"github.com/uniqush/uniqush-push/util"
 )
 
 // HTTPClient is a mockable interface for the parts of http.Client used by the APNS HTTP2 module.
@@ -27,17 +27,32 @@ type ClientFactory func(*http.Transport) HTTPClient
 
 // HTTPPushRequestProcessor sends push notification requests to APNS using HTTP API
 type HTTPPushRequestProcessor struct {
-	clients       map[string]HTTPClient
-	clientsLock   sync.RWMutex
-	clientFactory ClientFactory // can be overridden by test
+	clients map[string]HTTPClient
+	// clientCertVersions are the certificate versions (See common.CertificateVersion) the clients were created with, so that clients are replaced when certificates are rotated.
+	clientCertVersions map[string]string
+	clientsLock        sync.RWMutex
+	clientFactory      ClientFactory // can be overridden by test
+	httpConfig         util.HTTPClientConfig
+}
+
+// defaultHTTPClientConfig contains the HTTP client settings used for APNS HTTP/2, if they are not overridden in the [apns] section of uniqush.conf.
+var defaultHTTPClientConfig = util.HTTPClientConfig{
+	// Note: It's likely that fewer idle clients should be needed than GCM, since HTTP2 allows multiple in-flight requests
+	Timeout:             20 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+	MaxIdleConns:        20,
+	MaxIdleConnsPerHost: 20,
 }
 
 // NewRequestProcessor returns a new HTTPPushProcessor using net/http DefaultClient connection pool
 func NewRequestProcessor() common.PushRequestProcessor {
-	return &HTTPPushRequestProcessor{
-		clients:       make(map[string]HTTPClient),
-		clientFactory: defaultClientFactory,
+	prp := &HTTPPushRequestProcessor{
+		clients:            make(map[string]HTTPClient),
+		clientCertVersions: make(map[string]string),
+		httpConfig:         defaultHTTPClientConfig,
 	}
+	prp.clientFactory = prp.defaultClientFactory
+	return prp
 }
 
 func (prp *HTTPPushRequestProcessor) AddRequest(request *common.PushRequest) {
@@ -50,31 +65,33 @@ func (prp *HTTPPushRequestProcessor) GetMaxPayloadSize() int {
 
 func (prp *HTTPPushRequestProcessor) GetClient(psp *push.PushServiceProvider) (HTTPClient, error) {
 	pspName := psp.Name()
-	if client := prp.TryGetClient(pspName); client != nil {
+	certVersion := common.CertificateVersion(psp)
+	if client := prp.TryGetClient(pspName, certVersion); client != nil {
 		return client, nil
 	}
 	tlsClientConfig, err := createTLSConfig(psp)
 	if err != nil {
-		return nil, fmt.Errorf("GetClient failed, couldn't create TLS config: %v", err)
+		// This is a *push.BadPushServiceProvider, which is returned as is so that the PSP's circuit breaker counts it.
+		return nil, err
 	}
 	prp.clientsLock.Lock()
 	defer prp.clientsLock.Unlock()
 	if client, ok := prp.clients[pspName]; ok {
-		// Maybe something else locked before this goroutine did.
-		return client, nil
+		if prp.clientCertVersions[pspName] == certVersion {
+			// Maybe something else locked before this goroutine did.
+			return client, nil
+		}
+		// The certificate was rotated. Requests in flight can finish with the old client.
+		closeIdleConnections(client)
 	}
-	transport := &http.Transport{
-		// The same as GCM.
-		// TODO: Make the maximum number of idle connections configurable.
-		// Note: It's likely that fewer idle clients should be needed than GCM, since HTTP2 allows multiple in-flight requests
-		// Note: Do not set IdleTimeout, it may be a cause of errors in setups where pushes are infrequent.
-		MaxIdleConns:          20,
-		MaxIdleConnsPerHost:   20,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		// Because TLSClientConfig is provided, have to manually configure this client for http2 support.
-		TLSClientConfig: tlsClientConfig,
+	// Note: Do not set IdleTimeout, it may be a cause of errors in setups where pushes are infrequent.
+	transport, err := prp.httpConfig.NewTransport()
+	if err != nil {
+		return nil, fmt.Errorf("GetClient failed, couldn't create transport: %v", err)
 	}
+	// Because TLSClientConfig is provided, have to manually configure this client for http2 support.
+	tlsClientConfig.RootCAs = transport.TLSClientConfig.RootCAs
+	transport.TLSClientConfig = tlsClientConfig
 
 	// Requires Go 1.6 or later
 	err = http2.ConfigureTransport(transport)
@@ -84,18 +101,19 @@ func (prp *HTTPPushRequestProcessor) GetClient(psp *push.PushServiceProvider) (H
 
 	client := prp.clientFactory(transport)
 	prp.clients[pspName] = client
+	prp.clientCertVersions[pspName] = certVersion
 	return client, nil
 }
 
-func defaultClientFactory(transport *http.Transport) HTTPClient {
+func (prp *HTTPPushRequestProcessor) defaultClientFactory(transport *http.Transport) HTTPClient {
 	return &http.Client{
 		Transport: transport,
-		Timeout:   20 * time.Second,
+		Timeout:   prp.httpConfig.Timeout,
 	}
 }
 
 func createTLSConfig(psp *push.PushServiceProvider) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(psp.FixedData["cert"], psp.FixedData["key"])
+	cert, err := common.LoadCertificate(psp)
 	if err != nil {
 		return nil, push.NewBadPushServiceProviderWithDetails(psp, err.Error())
 	}
@@ -107,31 +125,70 @@ func createTLSConfig(psp *push.PushServiceProvider) (*tls.Config, error) {
 	return conf, nil
 }
 
-func (prp *HTTPPushRequestProcessor) TryGetClient(pspName string) HTTPClient {
+// TryGetClient returns the client for a PSP if one was created with the given certificate version, or nil.
+func (prp *HTTPPushRequestProcessor) TryGetClient(pspName string, certVersion string) HTTPClient {
 	prp.clientsLock.RLock()
 	defer prp.clientsLock.RUnlock()
-	if client, exists := prp.clients[pspName]; exists {
+	if client, exists := prp.clients[pspName]; exists && prp.clientCertVersions[pspName] == certVersion {
 		return client
 	}
 	return nil
 }
 
+func closeIdleConnections(client HTTPClient) {
+	if httpClient, isClient := client.(*http.Client); isClient {
+		switch transport := httpClient.Transport.(type) {
+		case *http.Transport:
+			transport.CloseIdleConnections()
+		default:
+		}
+	}
+}
+
 func (prp *HTTPPushRequestProcessor) Finalize() {
 	prp.clientsLock.Lock()
+	defer prp.clientsLock.Unlock()
 	for _, client := range prp.clients {
-		if httpClient, isClient := client.(*http.Client); isClient {
-			switch transport := httpClient.Transport.(type) {
-			case *http.Transport:
-				transport.CloseIdleConnections()
-			default:
-			}
-		}
+		closeIdleConnections(client)
 	}
 }
 
 func (prp *HTTPPushRequestProcessor) SetErrorReportChan(errChan chan<- push.Error) {}
 
-func (prp *HTTPPushRequestProcessor) SetPushServiceConfig(c *push.PushServiceConfig) {}
+// SetPushServiceConfig sets the HTTP client settings for APNS.
+// If this is called again because uniqush.conf was reloaded and the settings changed, the clients of PSPs are replaced. Requests in flight can finish with the old clients.
+func (prp *HTTPPushRequestProcessor) SetPushServiceConfig(c *push.PushServiceConfig) {
+	// The push service manager calls ValidatePushServiceConfig first, so invalid settings aren't expected here.
+	prp.ReloadPushServiceConfig(c)
+}
+
+// ReloadPushServiceConfig applies new HTTP client settings, returning the options which are invalid. The previous settings are kept if any option is invalid.
+func (prp *HTTPPushRequestProcessor) ReloadPushServiceConfig(c *push.PushServiceConfig) []string {
+	httpConfig, err := util.LoadHTTPClientConfig(c, defaultHTTPClientConfig)
+	if err != nil {
+		return []string{util.HTTPProxyOption}
+	}
+	// Check that the CA file is usable now, rather than on the first push.
+	if _, err = httpConfig.TLSConfig(); err != nil {
+		return []string{util.HTTPCAFileOption}
+	}
+	prp.setHTTPConfig(httpConfig)
+	return nil
+}
+
+func (prp *HTTPPushRequestProcessor) setHTTPConfig(httpConfig util.HTTPClientConfig) {
+	prp.clientsLock.Lock()
+	defer prp.clientsLock.Unlock()
+	if prp.httpConfig == httpConfig {
+		return
+	}
+	prp.httpConfig = httpConfig
+	for _, client := range prp.clients {
+		closeIdleConnections(client)
+	}
+	prp.clients = make(map[string]HTTPClient)
+	prp.clientCertVersions = make(map[string]string)
+}
 
 func (prp *HTTPPushRequestProcessor) sendRequests(request *common.PushRequest) {
 	defer close(request.ErrChan)
@@ -159,15 +216,21 @@ func (prp *HTTPPushRequestProcessor) sendRequests(request *common.PushRequest) {
 	psp := request.PSP
 	binaryProtocolAddress := psp.VolatileData["addr"]
 	var http2UrlHost string
-	if strings.Contains(binaryProtocolAddress, "sandbox") || strings.Contains(binaryProtocolAddress, "api.development.") {
+	if common.IsSandboxAddress(binaryProtocolAddress) {
 		http2UrlHost = "https://api.development.push.apple.com"
 	} else {
 		http2UrlHost = "https://api.push.apple.com"
 	}
 	client, err := prp.GetClient(psp)
 	if err != nil {
+		var clientErr push.Error
+		if pspErr, isPSPErr := err.(*push.BadPushServiceProvider); isPSPErr {
+			clientErr = pspErr
+		} else {
+			clientErr = push.NewErrorf("Could not create a client: %v", err)
+		}
 		for range request.Devtokens {
-			request.ErrChan <- push.NewErrorf("Could not create a client: %v", err)
+			request.ErrChan <- clientErr
 		}
 		return
 	}
@@ -183,7 +246,12 @@ func (prp *HTTPPushRequestProcessor) sendRequests(request *common.PushRequest) {
 		}
 		httpRequest.Header = header
 
-		go prp.sendRequest(wg, client, httpRequest, msgID, request.ErrChan, request.ResChan)
+		// Queue excess requests here instead of starting a goroutine for each one, if the PSP has rate limits.
+		release := psp.AcquireRequestSlot()
+		go func() {
+			defer release()
+			prp.sendRequest(wg, client, httpRequest, msgID, request.ErrChan, request.ResChan)
+		}()
 	}
 
 	wg.Wait()
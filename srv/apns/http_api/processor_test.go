@@ -10,9 +10,11 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/uniqush/goconf/conf"
 	"github.com/uniqush/uniqush-push/push"
 	"github.com/uniqush/uniqush-push/srv/apns/common"
 	apns_mocks "github.com/uniqush/uniqush-push/srv/apns/http_api/mocks"
+	"github.com/uniqush/uniqush-push/test_util"
 )
 
 const (
@@ -302,3 +304,26 @@ func TestGetMaxPayloadSize(t *testing.T) {
 		t.Fatalf("Wrong max payload, expected `4096`, got `%d`", maxPayloadSize)
 	}
 }
+
+func TestReloadPushServiceConfigRejectsInvalidOptions(t *testing.T) {
+	prp := NewRequestProcessor().(*HTTPPushRequestProcessor)
+	newConfig := func(options map[string]string) *push.PushServiceConfig {
+		c := conf.NewConfigFile()
+		c.AddSection("apns")
+		for option, value := range options {
+			c.AddOption("apns", option, value)
+		}
+		return push.NewPushServiceConfig(c, "apns")
+	}
+
+	if notApplied := prp.ReloadPushServiceConfig(newConfig(map[string]string{"http_proxy": "http://proxy.example.com:3128"})); len(notApplied) != 0 {
+		t.Fatalf("Expected a valid proxy to be applied, got %v", notApplied)
+	}
+	test_util.ExpectStringEquals(t, "http://proxy.example.com:3128", prp.httpConfig.ProxyURL, "proxy URL")
+
+	notApplied := prp.ReloadPushServiceConfig(newConfig(map[string]string{"http_proxy": "proxy.example.com"}))
+	test_util.ExpectEquals(t, []string{"http_proxy"}, notApplied, "options not applied")
+	notApplied = prp.ReloadPushServiceConfig(newConfig(map[string]string{"http_ca_file": "/nonexistent/uniqush-ca.pem"}))
+	test_util.ExpectEquals(t, []string{"http_ca_file"}, notApplied, "options not applied")
+	test_util.ExpectStringEquals(t, "http://proxy.example.com:3128", prp.httpConfig.ProxyURL, "proxy URL kept after invalid reloads")
+}
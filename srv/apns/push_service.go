@@ -29,20 +29,26 @@
 package apns
 
 import (
-	"crypto/tls"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/crypto/pkcs12"
+
 	// There are two different protocols we use to connect to APNS: binary and HTTP2.
 	// TODO: Make this configurable.
 	"github.com/uniqush/uniqush-push/push"
 	"github.com/uniqush/uniqush-push/srv/apns/binary_api"
 	"github.com/uniqush/uniqush-push/srv/apns/common"
 	"github.com/uniqush/uniqush-push/srv/apns/http_api"
+	"github.com/uniqush/uniqush-push/util"
 )
 
 const (
@@ -55,9 +61,15 @@ type pushService struct {
 	httpRequestProcessor   common.PushRequestProcessor
 	errChan                chan<- push.Error
 	nextMessageID          uint32
+	// pendingResults counts the goroutines waiting for the responses of pushes sent to APNS (See Drain).
+	pendingResults util.PendingWork
 }
 
 var _ push.PushServiceType = &pushService{}
+var _ push.CertificateInspector = &pushService{}
+var _ push.ReachabilityChecker = &pushService{}
+var _ push.Drainer = &pushService{}
+var _ push.ConfigReloader = &pushService{}
 
 // NewPushService creates a new APNS push service.
 func NewPushService() *pushService {
@@ -88,12 +100,26 @@ func (ps *pushService) SetErrorReportChan(errChan chan<- push.Error) {
 	ps.httpRequestProcessor.SetErrorReportChan(errChan)
 }
 
+// ValidatePushServiceConfig rejects an invalid http_proxy or http_ca_file, which the HTTP/2 request processor can't use.
+func (ps *pushService) ValidatePushServiceConfig(c *push.PushServiceConfig) error {
+	return util.CheckHTTPClientConfig(c)
+}
+
 // SetPushServiceConfig sets the config for this and the requestProcessor when the service is registered.
 func (ps *pushService) SetPushServiceConfig(c *push.PushServiceConfig) {
-	// This uses the fact that registration takes place before any requests are sent, so pools aren't created yet.
+	ps.binaryRequestProcessor.SetPushServiceConfig(c)
+	ps.httpRequestProcessor.SetPushServiceConfig(c)
+}
 
+// ReloadPushServiceConfig applies a new config while pushes are being sent, returning the HTTP client options which are invalid and weren't applied.
+// Both request processors can do this safely: connection pools are resized, and HTTP clients are replaced if their settings changed.
+func (ps *pushService) ReloadPushServiceConfig(c *push.PushServiceConfig) []string {
 	ps.binaryRequestProcessor.SetPushServiceConfig(c)
+	if reloader, ok := ps.httpRequestProcessor.(push.ConfigReloader); ok {
+		return reloader.ReloadPushServiceConfig(c)
+	}
 	ps.httpRequestProcessor.SetPushServiceConfig(c)
+	return nil
 }
 
 func (ps *pushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
@@ -107,19 +133,15 @@ func (ps *pushService) BuildPushServiceProviderFromMap(kv map[string]string, psp
 }
 
 func (ps *pushService) buildBinaryPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
-	if cert, ok := kv["cert"]; ok && len(cert) > 0 {
-		psp.FixedData["cert"] = cert
-	} else {
-		return errors.New("NoCertificate")
+	if err := buildCertificateFromMap(kv, psp); err != nil {
+		return err
 	}
 
-	if key, ok := kv["key"]; ok && len(key) > 0 {
-		psp.FixedData["key"] = key
-	} else {
-		return errors.New("NoPrivateKey")
+	cert, err := common.LoadCertificate(psp)
+	if err != nil {
+		return err
 	}
-
-	_, err := tls.LoadX509KeyPair(psp.FixedData["cert"], psp.FixedData["key"])
+	certInfo, err := common.ParseCertificateInfo(cert)
 	if err != nil {
 		return err
 	}
@@ -148,9 +170,131 @@ func (ps *pushService) buildBinaryPushServiceProviderFromMap(kv map[string]strin
 			psp.VolatileData["addr"] = "gateway.push.apple.com:2195"
 		}
 	}
+	return common.CheckEnvironment(certInfo, common.IsSandboxAddress(psp.VolatileData["addr"]))
+}
+
+// apnsReachabilityAddr is connected to by CheckReachability. Connections to APNS use per-PSP client certificates, so this only checks that a TCP connection can be made.
+const apnsReachabilityAddr = "api.push.apple.com:443"
+
+// CheckReachability checks that APNS can be reached, for /readyz.
+func (ps *pushService) CheckReachability(timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", apnsReachabilityAddr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// InspectCertificate returns the expiry, subject, topic and environment of the certificate of an APNS PSP, to warn about certificates which will expire soon.
+func (ps *pushService) InspectCertificate(psp *push.PushServiceProvider) (*push.CertificateInfo, error) {
+	cert, err := common.LoadCertificate(psp)
+	if err != nil {
+		return nil, err
+	}
+	return common.ParseCertificateInfo(cert)
+}
+
+// buildCertificateFromMap adds the certificate and private key used to connect to APNS to a PSP.
+// They are either paths of files which must exist on every uniqush node (cert and key),
+// or content stored in the PSP and identified by a stable certname, so that the certificate can be rotated with /addpsp without changing the PSP's name.
+// The content is PEM (cert_pem, and key_pem unless cert_pem includes the key) or base64 encoded PKCS#12 (p12, with p12_password).
+// A private key included in cert_pem is moved to key_pem, which is encrypted and redacted like other credentials.
+func buildCertificateFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
+	certPEM, keyPEM := kv[common.CertPEMKey], kv[common.KeyPEMKey]
+	certPEM, includedKeyPEM := splitPrivateKeyPEM(certPEM)
+	if len(includedKeyPEM) > 0 {
+		if len(keyPEM) > 0 {
+			return errors.New("Expected the private key in only one of cert_pem and key_pem")
+		}
+		keyPEM = includedKeyPEM
+	}
+	if p12, ok := kv["p12"]; ok && len(p12) > 0 {
+		if len(certPEM) > 0 || len(keyPEM) > 0 {
+			return errors.New("Expected only one of cert_pem and p12")
+		}
+		var err error
+		certPEM, keyPEM, err = pkcs12ToPEM(p12, kv["p12_password"])
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(certPEM) == 0 {
+		if cert, ok := kv[common.CertFileKey]; ok && len(cert) > 0 {
+			psp.FixedData[common.CertFileKey] = cert
+		} else {
+			return errors.New("NoCertificate")
+		}
+
+		if key, ok := kv[common.KeyFileKey]; ok && len(key) > 0 {
+			psp.FixedData[common.KeyFileKey] = key
+		} else {
+			return errors.New("NoPrivateKey")
+		}
+		return nil
+	}
+
+	if len(kv[common.CertFileKey]) > 0 || len(kv[common.KeyFileKey]) > 0 {
+		return errors.New("Expected either certificate files (cert and key) or certificate content (cert_pem or p12), not both")
+	}
+	if certName, ok := kv[common.CertNameKey]; ok && len(certName) > 0 {
+		psp.FixedData[common.CertNameKey] = certName
+	} else {
+		return errors.New("NoCertificateName: certname is required with cert_pem or p12")
+	}
+	psp.VolatileData[common.CertPEMKey] = certPEM
+	if len(keyPEM) > 0 {
+		psp.VolatileData[common.KeyPEMKey] = keyPEM
+	}
 	return nil
 }
 
+// splitPrivateKeyPEM separates the private keys in PEM content from the certificates (and anything else it contains).
+func splitPrivateKeyPEM(content string) (string, string) {
+	var certPEM, keyPEM []byte
+	rest := []byte(content)
+	for {
+		block, remaining := pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			keyPEM = append(keyPEM, pem.EncodeToMemory(block)...)
+		} else {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		}
+		rest = remaining
+	}
+	if len(keyPEM) == 0 {
+		// Keep the content unchanged, so that the certificate version (See common.CertificateVersion) doesn't change.
+		return content, ""
+	}
+	return string(certPEM), string(keyPEM)
+}
+
+// pkcs12ToPEM converts base64 encoded PKCS#12 content to the PEM encoded certificates and private key it contains.
+func pkcs12ToPEM(p12 string, password string) (string, string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(p12))
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid p12, expected base64 encoded PKCS#12 content: %v", err)
+	}
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid p12: %v", err)
+	}
+	var certPEM, keyPEM []byte
+	for _, block := range blocks {
+		// Omit attributes such as friendlyName, which aren't needed to load the certificate.
+		block.Headers = nil
+		if block.Type == "PRIVATE KEY" {
+			keyPEM = append(keyPEM, pem.EncodeToMemory(block)...)
+		} else {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		}
+	}
+	return string(certPEM), string(keyPEM), nil
+}
+
 func (ps *pushService) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
 	dp.AddCommonData(kv)
 	if devtoken, ok := kv["devtoken"]; ok && len(devtoken) > 0 {
@@ -369,5 +513,14 @@ func (ps *pushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.
 
 	// Wait for the unserialized responses from APNS asyncronously - these will not affect what we send our clients for this request, but will affect subsequent requests.
 	// TODO: With HTTP/2, this can be refactored to become synchronous (not in this PR, not while binary provider is supported for a PSP). The map[string]T can be removed.
-	go ps.waitResults(psp, dpList, lastID, resChan)
+	ps.pendingResults.Add()
+	go func() {
+		defer ps.pendingResults.Done()
+		ps.waitResults(psp, dpList, lastID, resChan)
+	}()
+}
+
+// Drain waits for the responses of pushes which were already sent to APNS, which may unsubscribe delivery points.
+func (ps *pushService) Drain(deadline time.Time) bool {
+	return ps.pendingResults.Wait(deadline)
 }
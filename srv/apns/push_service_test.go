@@ -2,10 +2,22 @@ package apns
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/uniqush/uniqush-push/push"
 	"github.com/uniqush/uniqush-push/srv/apns/common"
@@ -97,6 +109,155 @@ func commonAPNSMocks(status uint8) (*push.PushServiceProvider, *MockPushRequestP
 	return psp, mockRequestProcessor, service, errChan
 }
 
+func TestBuildPushServiceProviderWithCertificateContent(t *testing.T) {
+	service, _, _ := newPushServiceWithErrorChannel(APNSSuccess)
+	psm := push.GetPushServiceManager()
+	psm.RegisterPushServiceType(service)
+	readFile := func(filename string) string {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", filename, err)
+		}
+		return string(data)
+	}
+	certPEM, keyPEM := readFile("apns-test/localhost.cert"), readFile("apns-test/localhost.key")
+	p12 := base64.StdEncoding.EncodeToString([]byte(readFile("apns-test/localhost.p12")))
+	build := func(kv map[string]string) (*push.PushServiceProvider, error) {
+		kv["pushservicetype"] = service.Name()
+		kv["service"] = "mockservice"
+		return psm.BuildPushServiceProviderFromMap(kv)
+	}
+
+	psp, err := build(map[string]string{"certname": "prod", "cert_pem": certPEM, "key_pem": keyPEM})
+	if err != nil {
+		t.Fatalf("Unexpected error building a PSP with PEM content: %v", err)
+	}
+	test_util.ExpectEquals(t, map[string]string{"service": "mockservice", "certname": "prod"}, psp.FixedData, "fixed data")
+
+	// Rotating the certificate keeps the name of the PSP, so that its subscriptions still use it.
+	rotated, err := build(map[string]string{"certname": "prod", "cert_pem": certPEM + keyPEM})
+	if err != nil {
+		t.Fatalf("Unexpected error building a PSP with a combined PEM: %v", err)
+	}
+	test_util.ExpectStringEquals(t, psp.Name(), rotated.Name(), "name of the rotated PSP")
+	if strings.Contains(rotated.VolatileData["cert_pem"], "PRIVATE KEY") || !strings.Contains(rotated.VolatileData["key_pem"], "PRIVATE KEY") {
+		t.Errorf("Expected the private key to be moved from cert_pem to key_pem, got %v", rotated.VolatileData)
+	}
+	if _, err := common.LoadCertificate(rotated); err != nil {
+		t.Errorf("Unexpected error loading the certificate split from a combined PEM: %v", err)
+	}
+	rotated.VolatileData["key_pem"] += "\n"
+	if common.CertificateVersion(psp) == common.CertificateVersion(rotated) {
+		t.Error("Expected the certificate version to change")
+	}
+
+	fromP12, err := build(map[string]string{"certname": "prod", "p12": p12, "p12_password": "uniqush"})
+	if err != nil {
+		t.Fatalf("Unexpected error building a PSP with PKCS#12 content: %v", err)
+	}
+	test_util.ExpectStringEquals(t, psp.Name(), fromP12.Name(), "name of the PSP built from PKCS#12")
+	if _, err := common.LoadCertificate(fromP12); err != nil {
+		t.Errorf("Unexpected error loading the certificate converted from PKCS#12: %v", err)
+	}
+
+	for _, kv := range []map[string]string{
+		{"certname": "prod", "p12": p12, "p12_password": "wrong"},
+		{"cert_pem": certPEM, "key_pem": keyPEM},
+		{"certname": "prod", "cert_pem": certPEM},
+		{"certname": "prod", "cert_pem": certPEM, "key_pem": keyPEM, "cert": "apns-test/localhost.cert"},
+		{"certname": "prod", "cert_pem": certPEM + keyPEM, "key_pem": keyPEM},
+	} {
+		if _, err := build(kv); err == nil {
+			t.Errorf("Expected an error for %v", kv)
+		}
+	}
+}
+
+// newTestAPNSCertificate creates a self-signed certificate resembling an APNS certificate for the given environment extensions, returning the PEM encoded certificate and key.
+func newTestAPNSCertificate(t *testing.T, notAfter time.Time, environmentOIDs ...asn1.ObjectIdentifier) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "Apple Development IOS Push Services: com.example.app",
+			ExtraNames: []pkix.AttributeTypeAndValue{{Type: asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}, Value: "com.example.app"}},
+		},
+		NotBefore: notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:  notAfter,
+	}
+	for _, oid := range environmentOIDs {
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oid, Value: []byte{5, 0}})
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return string(certPEM), string(keyPEM)
+}
+
+func TestBuildPushServiceProviderChecksCertificateEnvironment(t *testing.T) {
+	service, _, _ := newPushServiceWithErrorChannel(APNSSuccess)
+	psm := push.GetPushServiceManager()
+	psm.RegisterPushServiceType(service)
+	development := asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 1}
+	production := asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 2}
+	notAfter := time.Date(2030, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+	testCases := []struct {
+		oids        []asn1.ObjectIdentifier
+		sandbox     string
+		environment string
+		valid       bool
+	}{
+		{[]asn1.ObjectIdentifier{development}, "true", common.EnvironmentSandbox, true},
+		{[]asn1.ObjectIdentifier{development}, "false", common.EnvironmentSandbox, false},
+		{[]asn1.ObjectIdentifier{production}, "true", common.EnvironmentProduction, false},
+		{[]asn1.ObjectIdentifier{production}, "false", common.EnvironmentProduction, true},
+		{[]asn1.ObjectIdentifier{development, production}, "true", common.EnvironmentUniversal, true},
+		{[]asn1.ObjectIdentifier{development, production}, "false", common.EnvironmentUniversal, true},
+	}
+	for _, testCase := range testCases {
+		certPEM, keyPEM := newTestAPNSCertificate(t, notAfter, testCase.oids...)
+		psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+			"pushservicetype": service.Name(),
+			"service":         "mockservice",
+			"certname":        "app",
+			"cert_pem":        certPEM,
+			"key_pem":         keyPEM,
+			"sandbox":         testCase.sandbox,
+		})
+		if !testCase.valid {
+			if err == nil {
+				t.Errorf("Expected an error for a %s certificate with sandbox=%s", testCase.environment, testCase.sandbox)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for a %s certificate with sandbox=%s: %v", testCase.environment, testCase.sandbox, err)
+		}
+		info, err := psm.InspectCertificate(psp)
+		if err != nil {
+			t.Fatalf("Unexpected error inspecting the certificate: %v", err)
+		}
+		expected := push.CertificateInfo{
+			NotAfter:    notAfter,
+			Subject:     "Apple Development IOS Push Services: com.example.app",
+			Topic:       "com.example.app",
+			Environment: testCase.environment,
+		}
+		test_util.ExpectEquals(t, expected, *info, "certificate info")
+	}
+}
+
 func createNotification(expectedContentID int, pushType string, msg string) *push.Notification {
 	return &push.Notification{
 		Data: map[string]string{
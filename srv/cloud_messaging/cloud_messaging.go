@@ -23,7 +23,6 @@ package cloud_messaging
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -45,6 +44,15 @@ type HTTPClient interface {
 
 var _ HTTPClient = &http.Client{}
 
+// defaultHTTPClientConfig contains the HTTP client settings used for GCM/FCM, if they are not overridden in the [gcm]/[fcm] sections of uniqush.conf.
+var defaultHTTPClientConfig = util.HTTPClientConfig{
+	Timeout:             time.Second * 10, // Add a timeout for all requests, in case of network issues.
+	TLSHandshakeTimeout: time.Second * 5,
+	// goals: (1) new connections should not be opened and closed frequently, (2) we should not run out of sockets.
+	// This doesn't seem to need much tuning. The number of connections open at a given time seems to be less than 500, even when sending hundreds of pushes per second.
+	MaxIdleConnsPerHost: 500,
+}
+
 // PushServiceBase contains the data structures common to Uniqush's GCM and FCM push service implementations.
 // This struct is included in the GCM and FCM push service structs.
 type PushServiceBase struct {
@@ -77,23 +85,17 @@ func (psb *PushServiceBase) OverrideClient(client HTTPClient) {
 	psb.client = client
 }
 
+// CheckReachability checks that the GCM/FCM endpoint can be reached, for /readyz.
+func (psb *PushServiceBase) CheckReachability(timeout time.Duration) error {
+	return util.CheckHTTPReachable(psb.client, psb.serviceURL, timeout)
+}
+
 // MakePushServiceBase instantiates the fields of the FCM/GCM base class PushServiceBase.
 // Note: Make sure that this can be copied by value (it's a collection of pointers right now).
 // If it can no longer be copied by value, then change this into an initializer function.
 func MakePushServiceBase(initialism string, rawPayloadKey string, rawNotificationKey string, serviceURL string, pushServiceName string) PushServiceBase {
-	conf := &tls.Config{InsecureSkipVerify: false}
-	tr := &http.Transport{
-		TLSClientConfig:     conf,
-		TLSHandshakeTimeout: time.Second * 5,
-		// TODO: Make this configurable later on? The default of 2 is too low.
-		// goals: (1) new connections should not be opened and closed frequently, (2) we should not run out of sockets.
-		// This doesn't seem to need much tuning. The number of connections open at a given time seems to be less than 500, even when sending hundreds of pushes per second.
-		MaxIdleConnsPerHost: 500,
-	}
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   time.Second * 10, // Add a timeout for all requests, in case of network issues.
-	}
+	// The defaults can't fail to create a client (no CA file or proxy)
+	client, _ := defaultHTTPClientConfig.NewClient()
 	return PushServiceBase{
 		client:             client,
 		initialism:         initialism,
@@ -303,8 +305,11 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 
 	req.Header.Set("Authorization", "key="+apikey)
 	req.Header.Set("Content-Type", "application/json")
+	util.SetRequestIDHeader(req, notif)
 
-	// Perform a request, using a connection from the connection pool of a shared http.Client instance.
+	// Wait for the PSP's rate limits (if any), then perform a request, using a connection from the connection pool of a shared http.Client instance.
+	release := psp.AcquireRequestSlot()
+	defer release()
 	r, e2 := psb.client.Do(req)
 	if r != nil {
 		defer r.Body.Close()
@@ -510,5 +515,18 @@ func (psb *PushServiceBase) Preview(notif *push.Notification) ([]byte, push.Erro
 func (psb *PushServiceBase) SetErrorReportChan(errChan chan<- push.Error) {
 }
 
+// ValidatePushServiceConfig rejects an invalid http_proxy or http_ca_file, which SetPushServiceConfig can't use.
+func (psb *PushServiceBase) ValidatePushServiceConfig(c *push.PushServiceConfig) error {
+	return util.CheckHTTPClientConfig(c)
+}
+
 func (psb *PushServiceBase) SetPushServiceConfig(c *push.PushServiceConfig) {
+	// This uses the fact that registration takes place before any requests are sent.
+	// The push service manager calls ValidatePushServiceConfig first, so this only fails if the CA file was removed since.
+	client, err := util.NewHTTPClientFromConfig(c, defaultHTTPClientConfig)
+	if err != nil {
+		return
+	}
+	psb.Finalize()
+	psb.client = client
 }
@@ -48,6 +48,7 @@ type fcmPushService struct {
 }
 
 var _ push.PushServiceType = &fcmPushService{}
+var _ push.ReachabilityChecker = &fcmPushService{}
 
 func newFCMPushService() *fcmPushService {
 	return &fcmPushService{
@@ -48,6 +48,7 @@ type gcmPushService struct {
 }
 
 var _ push.PushServiceType = &gcmPushService{}
+var _ push.ReachabilityChecker = &gcmPushService{}
 
 func newGCMPushService() *gcmPushService {
 	return &gcmPushService{
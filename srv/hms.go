@@ -0,0 +1,532 @@
+/*
+ * This contains the implementation of the Huawei Push Kit (HMS) push service type.
+ * HMS is used to send pushes to Android devices without Google Play Services.
+ */
+
+package srv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/util"
+)
+
+const (
+	// OAuth 2.0 endpoint for the client credentials grant
+	hmsTokenURL string = "https://oauth-login.cloud.huawei.com/oauth2/v3/token"
+	// HMS endpoint, formatted with the app id
+	hmsServiceURLFormat string = "https://push-api.cloud.huawei.com/v1/%s/messages:send"
+	// payload key to extract from push requests to uniqush. The corresponding value is a JSON object sent as the HMS data message.
+	hmsRawPayloadKey = "uniqush.payload.hms"
+	// notification key to extract from push requests to uniqush. The corresponding value is a JSON object sent as message.android.notification.
+	hmsRawNotificationKey = "uniqush.notification.hms"
+	// push service type(name), for requests to uniqush
+	hmsPushServiceName = "hms"
+	// HMS accepts at most 1000 tokens per request
+	hmsMaxTokensPerRequest = 1000
+)
+
+// Result codes from https://developer.huawei.com/consumer/en/doc/development/HMSCore-References/https-send-api-0000001050986197
+const (
+	hmsCodeSuccess              = "80000000"
+	hmsCodePartialSuccess       = "80100000" // Some tokens were invalid. msg contains the list of illegal_tokens.
+	hmsCodeInvalidParameter     = "80100001"
+	hmsCodeInvalidMessage       = "80100003"
+	hmsCodeInvalidTTL           = "80100004"
+	hmsCodeAuthenticationFailed = "80200001" // The access token is invalid.
+	hmsCodeTokenExpired         = "80200003"
+	hmsCodeNoPermission         = "80300002"
+	hmsCodeAllTokensInvalid     = "80300007"
+	hmsCodeMessageTooLarge      = "80300008"
+	hmsCodeInternalError        = "81000001"
+)
+
+// defaultHMSHTTPClientConfig contains the HTTP client settings used for HMS, if they are not overridden in the [hms] section of uniqush.conf.
+var defaultHMSHTTPClientConfig = util.HTTPClientConfig{
+	Timeout:             time.Second * 10,
+	TLSHandshakeTimeout: time.Second * 5,
+	MaxIdleConnsPerHost: 100,
+}
+
+type hmsPushService struct {
+	// client is shared by all HMS PSPs. It is replaced only when the service is registered, before any pushes are sent.
+	client *http.Client
+	// tokenURL and serviceURLFormat can be overridden by tests.
+	tokenURL         string
+	serviceURLFormat string
+
+	// accessTokens caches OAuth access tokens by client id and client secret, so that a token is requested only once for concurrent pushes.
+	accessTokensLock sync.Mutex
+	accessTokens     map[string]*hmsAccessToken
+}
+
+type hmsAccessToken struct {
+	sync.Mutex
+	token  string
+	expire time.Time
+}
+
+var _ push.PushServiceType = &hmsPushService{}
+var _ push.ReachabilityChecker = &hmsPushService{}
+
+func newHMSPushService() *hmsPushService {
+	ret := &hmsPushService{
+		tokenURL:         hmsTokenURL,
+		serviceURLFormat: hmsServiceURLFormat,
+		accessTokens:     make(map[string]*hmsAccessToken),
+	}
+	// The defaults can't fail to create a client (no CA file or proxy)
+	ret.client, _ = defaultHMSHTTPClientConfig.NewClient()
+	return ret
+}
+
+// InstallHMS registers the only instance of the HMS push service. It is called only once.
+func InstallHMS() {
+	psm := push.GetPushServiceManager()
+	err := psm.RegisterPushServiceType(newHMSPushService())
+	if err != nil {
+		panic(fmt.Sprintf("Failed to install HMS module: %v", err))
+	}
+}
+
+func (hms *hmsPushService) Finalize() {
+	if transport, ok := hms.client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+func (hms *hmsPushService) Name() string {
+	return hmsPushServiceName
+}
+
+func (hms *hmsPushService) SetErrorReportChan(errChan chan<- push.Error) {
+}
+
+// ValidatePushServiceConfig rejects an invalid http_proxy or http_ca_file, which SetPushServiceConfig can't use.
+func (hms *hmsPushService) ValidatePushServiceConfig(c *push.PushServiceConfig) error {
+	return util.CheckHTTPClientConfig(c)
+}
+
+func (hms *hmsPushService) SetPushServiceConfig(c *push.PushServiceConfig) {
+	// This uses the fact that registration takes place before any requests are sent.
+	// The push service manager calls ValidatePushServiceConfig first, so this only fails if the CA file was removed since.
+	client, err := util.NewHTTPClientFromConfig(c, defaultHMSHTTPClientConfig)
+	if err != nil {
+		return
+	}
+	hms.Finalize()
+	hms.client = client
+}
+
+// CheckReachability checks that the HMS OAuth and push endpoints can be reached, for /readyz.
+func (hms *hmsPushService) CheckReachability(timeout time.Duration) error {
+	if err := util.CheckHTTPReachable(hms.client, hms.tokenURL, timeout); err != nil {
+		return err
+	}
+	return util.CheckHTTPReachable(hms.client, fmt.Sprintf(hms.serviceURLFormat, "0"), timeout)
+}
+
+// BuildPushServiceProviderFromMap builds an HMS PSP. clientid defaults to appid, which is the same for most apps.
+func (hms *hmsPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+
+	if appid, ok := kv["appid"]; ok && len(appid) > 0 {
+		psp.FixedData["appid"] = appid
+	} else {
+		return errors.New("NoAppID")
+	}
+
+	if clientid, ok := kv["clientid"]; ok && len(clientid) > 0 {
+		psp.FixedData["clientid"] = clientid
+	} else {
+		psp.FixedData["clientid"] = psp.FixedData["appid"]
+	}
+
+	if clientsecret, ok := kv["clientsecret"]; ok && len(clientsecret) > 0 {
+		psp.VolatileData["clientsecret"] = clientsecret
+	} else {
+		return errors.New("NoClientSecret")
+	}
+
+	return nil
+}
+
+func (hms *hmsPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
+	err := dp.AddCommonData(kv)
+	if err != nil {
+		return err
+	}
+
+	if regid, ok := kv["regid"]; ok && len(regid) > 0 {
+		dp.FixedData["regid"] = regid
+	} else {
+		return errors.New("NoRegId")
+	}
+
+	return nil
+}
+
+type hmsTokenSuccess struct {
+	Token  string `json:"access_token"`
+	Expire int    `json:"expires_in"`
+	Type   string `json:"token_type"`
+}
+
+type hmsTokenFailure struct {
+	Reason      interface{} `json:"error"`
+	SubReason   interface{} `json:"sub_error"`
+	Description string      `json:"error_description"`
+}
+
+// getAccessToken returns a cached access token for the PSP, or requests a new one if it expired.
+// If invalidToken is non-empty, then that token was rejected by HMS and will not be returned.
+func (hms *hmsPushService) getAccessToken(psp *push.PushServiceProvider, invalidToken string) (string, push.Error) {
+	clientid := psp.FixedData["clientid"]
+	clientsecret := psp.VolatileData["clientsecret"]
+	if clientid == "" {
+		return "", push.NewBadPushServiceProviderWithDetails(psp, "NoClientID")
+	}
+	if clientsecret == "" {
+		return "", push.NewBadPushServiceProviderWithDetails(psp, "NoClientSecret")
+	}
+
+	key := clientid + ":" + clientsecret
+	hms.accessTokensLock.Lock()
+	accessToken, ok := hms.accessTokens[key]
+	if !ok {
+		accessToken = new(hmsAccessToken)
+		hms.accessTokens[key] = accessToken
+	}
+	hms.accessTokensLock.Unlock()
+
+	// Other pushes with this PSP wait until the token is requested.
+	accessToken.Lock()
+	defer accessToken.Unlock()
+	if accessToken.token != "" && accessToken.token != invalidToken && time.Now().Before(accessToken.expire) {
+		return accessToken.token, nil
+	}
+	token, expire, err := hms.requestToken(psp, clientid, clientsecret)
+	if err != nil {
+		return "", err
+	}
+	accessToken.token = token
+	accessToken.expire = expire
+	return token, nil
+}
+
+func (hms *hmsPushService) requestToken(psp *push.PushServiceProvider, clientid, clientsecret string) (string, time.Time, push.Error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", clientid)
+	form.Set("client_secret", clientsecret)
+	req, err := http.NewRequest("POST", hms.tokenURL, bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, push.NewErrorf("NewRequest error: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := hms.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, push.NewErrorf("Failed to request HMS access token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, push.NewErrorf("Failed to read HMS access token: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		var fail hmsTokenFailure
+		if jsonErr := json.Unmarshal(content, &fail); jsonErr != nil || fail.Reason == nil {
+			return "", time.Time{}, push.NewBadPushServiceProviderWithDetails(psp, fmt.Sprintf("%v: %s", resp.StatusCode, content))
+		}
+		return "", time.Time{}, push.NewBadPushServiceProviderWithDetails(psp, fmt.Sprintf("%v:%v/%v (%v)", resp.StatusCode, fail.Reason, fail.SubReason, fail.Description))
+	}
+
+	var succ hmsTokenSuccess
+	if err = json.Unmarshal(content, &succ); err != nil || succ.Token == "" {
+		return "", time.Time{}, push.NewBadPushServiceProviderWithDetails(psp, fmt.Sprintf("Invalid HMS access token response: %s", content))
+	}
+	// Request a new token a minute before this one expires.
+	expire := time.Now().Add(time.Duration(succ.Expire-60) * time.Second)
+	return succ.Token, expire, nil
+}
+
+type hmsRequest struct {
+	ValidateOnly bool       `json:"validate_only"`
+	Message      hmsMessage `json:"message"`
+}
+
+type hmsMessage struct {
+	// Data is a JSON encoded object, passed to the app.
+	Data    string            `json:"data,omitempty"`
+	Android *hmsAndroidConfig `json:"android,omitempty"`
+	Token   []string          `json:"token"`
+}
+
+type hmsAndroidConfig struct {
+	TTL          string                 `json:"ttl,omitempty"`
+	Notification map[string]interface{} `json:"notification,omitempty"`
+}
+
+type hmsResponse struct {
+	Code      string `json:"code"`
+	Msg       string `json:"msg"`
+	RequestID string `json:"requestId"`
+}
+
+// hmsPartialFailure is JSON encoded in the msg of a response with the code hmsCodePartialSuccess.
+type hmsPartialFailure struct {
+	Success       int      `json:"success"`
+	Failure       int      `json:"failure"`
+	IllegalTokens []string `json:"illegal_tokens"`
+}
+
+// notifToHMSRequest converts a uniqush notification to an HMS request.
+// title and msg are displayed in a notification (unless uniqush.notification.hms is provided), msggroup is used as the notification tag,
+// and the remaining keys are sent as data (unless uniqush.payload.hms is provided).
+func notifToHMSRequest(notif *push.Notification, tokens []string) (*hmsRequest, push.Error) {
+	if notif == nil || len(notif.Data) == 0 {
+		return nil, push.NewBadNotificationWithDetails("empty notification")
+	}
+	postData := notif.Data
+	android := new(hmsAndroidConfig)
+
+	if rawTTL, ok := postData["ttl"]; ok {
+		if ttl, err := strconv.ParseUint(rawTTL, 10, 32); err == nil {
+			android.TTL = fmt.Sprintf("%ds", ttl)
+		}
+	}
+
+	if rawNotification, ok := postData[hmsRawNotificationKey]; ok {
+		var notification map[string]interface{}
+		if err := json.Unmarshal([]byte(rawNotification), &notification); err != nil || notification == nil {
+			return nil, push.NewBadNotificationWithDetails(fmt.Sprintf("invalid %s: expected a JSON object", hmsRawNotificationKey))
+		}
+		android.Notification = notification
+	} else if postData["title"] != "" || postData["msg"] != "" {
+		android.Notification = map[string]interface{}{
+			// Open the app when the notification is tapped.
+			"click_action": map[string]interface{}{"type": 3},
+		}
+		if title := postData["title"]; title != "" {
+			android.Notification["title"] = title
+		}
+		if body := postData["msg"]; body != "" {
+			android.Notification["body"] = body
+		}
+		if tag := postData["msggroup"]; tag != "" {
+			android.Notification["tag"] = tag
+		}
+	}
+
+	var data string
+	if rawPayload, ok := postData[hmsRawPayloadKey]; ok {
+		var payload map[string]interface{}
+		if err := json.Unmarshal([]byte(rawPayload), &payload); err != nil || payload == nil {
+			return nil, push.NewBadNotificationWithDetails(fmt.Sprintf("invalid %s: expected a JSON object", hmsRawPayloadKey))
+		}
+		data = rawPayload
+	} else {
+		payload := make(map[string]string, len(postData))
+		for k, v := range postData {
+			if strings.HasPrefix(k, "uniqush.") { // The "uniqush." keys are reserved for uniqush use.
+				continue
+			}
+			switch k {
+			case "msggroup", "ttl":
+				continue
+			default:
+				payload[k] = v
+			}
+		}
+		if len(payload) > 0 {
+			encoded, err := util.MarshalJSONUnescaped(payload)
+			if err != nil {
+				return nil, push.NewErrorf("Error converting payload to JSON: %v", err)
+			}
+			data = string(encoded)
+		}
+	}
+
+	if data == "" && android.Notification == nil {
+		return nil, push.NewBadNotificationWithDetails("empty notification")
+	}
+
+	return &hmsRequest{
+		Message: hmsMessage{
+			Data:    data,
+			Android: android,
+			Token:   tokens,
+		},
+	}, nil
+}
+
+func (hms *hmsPushService) Preview(notif *push.Notification) ([]byte, push.Error) {
+	req, err := notifToHMSRequest(notif, []string{"placeholderRegId"})
+	if err != nil {
+		return nil, err
+	}
+	data, jsonErr := json.Marshal(req)
+	if jsonErr != nil {
+		return nil, push.NewErrorf("Failed to marshal message: %v", jsonErr)
+	}
+	return data, nil
+}
+
+// Push sends a push notification to 1 or more delivery points in dpQueue, in batches of up to 1000, and sends results on resQueue.
+func (hms *hmsPushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	defer close(resQueue)
+
+	dpList := make([]*push.DeliveryPoint, 0, hmsMaxTokensPerRequest)
+	for dp := range dpQueue {
+		if psp.PushServiceName() != dp.PushServiceName() || psp.PushServiceName() != hmsPushServiceName {
+			resQueue <- &push.Result{Provider: psp, Destination: dp, Content: notif, Err: push.NewIncompatibleError()}
+			continue
+		}
+		if _, ok := dp.FixedData["regid"]; !ok {
+			resQueue <- &push.Result{Provider: psp, Destination: dp, Content: notif, Err: push.NewBadDeliveryPoint(dp)}
+			continue
+		}
+		dpList = append(dpList, dp)
+		if len(dpList) >= hmsMaxTokensPerRequest {
+			hms.multicast(psp, dpList, resQueue, notif)
+			dpList = dpList[:0]
+		}
+	}
+	if len(dpList) > 0 {
+		hms.multicast(psp, dpList, resQueue, notif)
+	}
+}
+
+func hmsSendErrToEachDP(psp *push.PushServiceProvider, dpList []*push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification, err push.Error) {
+	for _, dp := range dpList {
+		resQueue <- &push.Result{Provider: psp, Destination: dp, Content: notif, Err: err}
+	}
+}
+
+func (hms *hmsPushService) multicast(psp *push.PushServiceProvider, dpList []*push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	tokens := make([]string, 0, len(dpList))
+	for _, dp := range dpList {
+		tokens = append(tokens, dp.FixedData["regid"])
+	}
+	req, err := notifToHMSRequest(notif, tokens)
+	if err != nil {
+		hmsSendErrToEachDP(psp, dpList, resQueue, notif, err)
+		return
+	}
+	data, jsonErr := json.Marshal(req)
+	if jsonErr != nil {
+		hmsSendErrToEachDP(psp, dpList, resQueue, notif, push.NewErrorf("Failed to marshal message: %v", jsonErr))
+		return
+	}
+
+	accessToken, err := hms.getAccessToken(psp, "")
+	if err != nil {
+		hmsSendErrToEachDP(psp, dpList, resQueue, notif, err)
+		return
+	}
+	statusCode, header, resp, err := hms.send(psp, accessToken, data, notif)
+	if err == nil && (resp.Code == hmsCodeAuthenticationFailed || resp.Code == hmsCodeTokenExpired) {
+		// The cached token was revoked or expired early. Request a new one and try again once.
+		accessToken, err = hms.getAccessToken(psp, accessToken)
+		if err == nil {
+			statusCode, header, resp, err = hms.send(psp, accessToken, data, notif)
+		}
+	}
+	if err != nil {
+		hmsSendErrToEachDP(psp, dpList, resQueue, notif, err)
+		return
+	}
+	hms.handleResponse(psp, dpList, resQueue, notif, statusCode, header, resp)
+}
+
+// send sends the JSON encoded request to HMS. It returns an error if no response could be parsed.
+func (hms *hmsPushService) send(psp *push.PushServiceProvider, accessToken string, data []byte, notif *push.Notification) (int, http.Header, *hmsResponse, push.Error) {
+	req, err := http.NewRequest("POST", fmt.Sprintf(hms.serviceURLFormat, url.PathEscape(psp.FixedData["appid"])), bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, nil, push.NewErrorf("Error constructing HTTP request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json;charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	util.SetRequestIDHeader(req, notif)
+
+	release := psp.AcquireRequestSlot()
+	defer release()
+	resp, err := hms.client.Do(req)
+	if err != nil {
+		return 0, nil, nil, push.NewConnectionError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, nil, push.NewErrorf("Failed to read HMS response: %v", err)
+	}
+	result := new(hmsResponse)
+	if jsonErr := json.Unmarshal(body, result); jsonErr != nil || result.Code == "" {
+		if resp.StatusCode >= 500 || resp.StatusCode == 429 {
+			// Let handleResponse retry without a parsed response.
+			return resp.StatusCode, resp.Header, result, nil
+		}
+		return 0, nil, nil, push.NewErrorf("HMSError: %v: %s", resp.StatusCode, body)
+	}
+	return resp.StatusCode, resp.Header, result, nil
+}
+
+func (hms *hmsPushService) handleResponse(psp *push.PushServiceProvider, dpList []*push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification, statusCode int, header http.Header, resp *hmsResponse) {
+	msgID := fmt.Sprintf("%v:%v", psp.Name(), resp.RequestID)
+	switch {
+	case resp.Code == hmsCodeSuccess:
+		for _, dp := range dpList {
+			resQueue <- &push.Result{Provider: psp, Destination: dp, Content: notif, MsgID: msgID}
+		}
+	case resp.Code == hmsCodePartialSuccess:
+		var partial hmsPartialFailure
+		if err := json.Unmarshal([]byte(resp.Msg), &partial); err != nil {
+			hmsSendErrToEachDP(psp, dpList, resQueue, notif, push.NewErrorf("HMSError: %v: could not parse %q", resp.Code, resp.Msg))
+			return
+		}
+		illegalTokens := make(map[string]bool, len(partial.IllegalTokens))
+		for _, token := range partial.IllegalTokens {
+			illegalTokens[token] = true
+		}
+		for _, dp := range dpList {
+			if illegalTokens[dp.FixedData["regid"]] {
+				resQueue <- &push.Result{Provider: psp, Destination: dp, Content: notif, Err: push.NewUnsubscribeUpdate(psp, dp)}
+			} else {
+				resQueue <- &push.Result{Provider: psp, Destination: dp, Content: notif, MsgID: msgID}
+			}
+		}
+	case resp.Code == hmsCodeAllTokensInvalid:
+		for _, dp := range dpList {
+			resQueue <- &push.Result{Provider: psp, Destination: dp, Content: notif, Err: push.NewUnsubscribeUpdate(psp, dp)}
+		}
+	case resp.Code == hmsCodeInternalError || statusCode >= 500 || statusCode == 429:
+		after := retryAfter(header)
+		for _, dp := range dpList {
+			resQueue <- &push.Result{Provider: psp, Destination: dp, Content: notif, Err: push.NewRetryErrorWithReason(psp, dp, notif, after, fmt.Errorf("HMSError: %v: %v %v", statusCode, resp.Code, resp.Msg))}
+		}
+	case resp.Code == hmsCodeAuthenticationFailed || resp.Code == hmsCodeTokenExpired || resp.Code == hmsCodeNoPermission:
+		hmsSendErrToEachDP(psp, dpList, resQueue, notif, push.NewBadPushServiceProviderWithDetails(psp, fmt.Sprintf("%v %v", resp.Code, resp.Msg)))
+	case resp.Code == hmsCodeInvalidParameter || resp.Code == hmsCodeInvalidMessage || resp.Code == hmsCodeInvalidTTL || resp.Code == hmsCodeMessageTooLarge:
+		hmsSendErrToEachDP(psp, dpList, resQueue, notif, push.NewBadNotificationWithDetails(fmt.Sprintf("%v %v", resp.Code, resp.Msg)))
+	default:
+		hmsSendErrToEachDP(psp, dpList, resQueue, notif, push.NewErrorf("HMSError: %v: %v %v", statusCode, resp.Code, resp.Msg))
+	}
+}
@@ -0,0 +1,213 @@
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/test_util"
+)
+
+func testNotifToHMSRequest(t *testing.T, postData map[string]string, expectedPayload string) {
+	notif := push.NewEmptyNotification()
+	notif.Data = postData
+	req, err := notifToHMSRequest(notif, []string{"token1"})
+	if err != nil {
+		t.Fatalf("Encountered error %v\n", err)
+	}
+	payload, jsonErr := json.Marshal(req)
+	if jsonErr != nil {
+		t.Fatalf("Encountered error encoding json: %v\n", jsonErr)
+	}
+	test_util.ExpectJSONIsEquivalent(t, []byte(expectedPayload), payload)
+}
+
+func TestNotifToHMSRequestWithCommonParameters(t *testing.T) {
+	postData := map[string]string{
+		"msggroup":        "somegroup",
+		"ttl":             "3600",
+		"title":           "Hello",
+		"msg":             "hello world",
+		"other":           "value",
+		"uniqush.foo":     "bar",
+		"pushservicetype": "hms",
+	}
+	expectedPayload := `{"validate_only":false,"message":{"data":"{\"msg\":\"hello world\",\"other\":\"value\",\"pushservicetype\":\"hms\",\"title\":\"Hello\"}","android":{"ttl":"3600s","notification":{"body":"hello world","click_action":{"type":3},"tag":"somegroup","title":"Hello"}},"token":["token1"]}}`
+	testNotifToHMSRequest(t, postData, expectedPayload)
+}
+
+func TestNotifToHMSRequestWithRawPayloads(t *testing.T) {
+	postData := map[string]string{
+		"uniqush.payload.hms":      `{"foo":{"bar":1}}`,
+		"uniqush.notification.hms": `{"title":"Raw","body":"raw body","click_action":{"type":1,"intent":"#Intent"}}`,
+		"other":                    "ignored",
+	}
+	expectedPayload := `{"validate_only":false,"message":{"data":"{\"foo\":{\"bar\":1}}","android":{"notification":{"title":"Raw","body":"raw body","click_action":{"type":1,"intent":"#Intent"}}},"token":["token1"]}}`
+	testNotifToHMSRequest(t, postData, expectedPayload)
+}
+
+func TestNotifToHMSRequestInvalid(t *testing.T) {
+	for _, postData := range []map[string]string{
+		{},
+		{"ttl": "100"},
+		{"uniqush.payload.hms": `[1]`},
+		{"uniqush.notification.hms": `not json`},
+	} {
+		notif := push.NewEmptyNotification()
+		notif.Data = postData
+		if _, err := notifToHMSRequest(notif, []string{"token1"}); err == nil {
+			t.Errorf("Expected an error for %v", postData)
+		}
+	}
+}
+
+// mockHMSServer serves both the token endpoint and the push endpoint, responding to pushes with the given responses in order.
+type mockHMSServer struct {
+	server        *httptest.Server
+	pushResponses []string
+	pushRequests  []*http.Request
+	pushBodies    []string
+	tokenRequests int
+}
+
+func newMockHMSServer(pushResponses ...string) *mockHMSServer {
+	m := &mockHMSServer{pushResponses: pushResponses}
+	m.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			m.tokenRequests++
+			fmt.Fprintf(w, `{"access_token":"accesstoken%d","expires_in":3600,"token_type":"Bearer"}`, m.tokenRequests)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		m.pushRequests = append(m.pushRequests, r)
+		m.pushBodies = append(m.pushBodies, string(body))
+		response := m.pushResponses[0]
+		if len(m.pushResponses) > 1 {
+			m.pushResponses = m.pushResponses[1:]
+		}
+		w.Write([]byte(response))
+	}))
+	return m
+}
+
+func hmsPushToMockServer(t *testing.T, mock *mockHMSServer, regids ...string) []*push.Result {
+	service := newHMSPushService()
+	service.tokenURL = mock.server.URL + "/token"
+	service.serviceURLFormat = mock.server.URL + "/v1/%s/messages:send"
+	psm := push.GetPushServiceManager()
+	psm.RegisterPushServiceType(service)
+
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{"pushservicetype": "hms", "service": "mockservice", "appid": "12345", "clientsecret": "secret"})
+	if err != nil {
+		t.Fatalf("Unexpected error building PSP: %v", err)
+	}
+
+	dpQueue := make(chan *push.DeliveryPoint, len(regids))
+	for _, regid := range regids {
+		dp, err := psm.BuildDeliveryPointFromMap(map[string]string{"pushservicetype": "hms", "service": "mockservice", "subscriber": "mocksubscriber", "regid": regid})
+		if err != nil {
+			t.Fatalf("Unexpected error building delivery point: %v", err)
+		}
+		dpQueue <- dp
+	}
+	close(dpQueue)
+
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"msg": "hello"}
+	resQueue := make(chan *push.Result)
+	go service.Push(psp, dpQueue, resQueue, notif)
+	var results []*push.Result
+	for res := range resQueue {
+		results = append(results, res)
+	}
+	return results
+}
+
+func TestHMSPushSuccess(t *testing.T) {
+	mock := newMockHMSServer(`{"code":"80000000","msg":"Success","requestId":"req1"}`)
+	defer mock.server.Close()
+
+	results := hmsPushToMockServer(t, mock, "token1", "token2")
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	for _, res := range results {
+		if res.Err != nil {
+			t.Errorf("Unexpected error: %v", res.Err)
+		}
+	}
+	if len(mock.pushRequests) != 1 {
+		t.Fatalf("Expected 1 push request, got %d", len(mock.pushRequests))
+	}
+	test_util.ExpectStringEquals(t, "/v1/12345/messages:send", mock.pushRequests[0].URL.Path, "push URL")
+	test_util.ExpectStringEquals(t, "Bearer accesstoken1", mock.pushRequests[0].Header.Get("Authorization"), "Authorization header")
+	expectedBody := `{"validate_only":false,"message":{"data":"{\"msg\":\"hello\"}","android":{"notification":{"body":"hello","click_action":{"type":3}}},"token":["token1","token2"]}}`
+	test_util.ExpectJSONIsEquivalent(t, []byte(expectedBody), []byte(mock.pushBodies[0]))
+}
+
+func TestHMSPushIllegalTokens(t *testing.T) {
+	mock := newMockHMSServer(`{"code":"80100000","msg":"{\"success\":1,\"failure\":1,\"illegal_tokens\":[\"token2\"]}","requestId":"req1"}`)
+	defer mock.server.Close()
+
+	results := hmsPushToMockServer(t, mock, "token1", "token2")
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	for _, res := range results {
+		regid := res.Destination.FixedData["regid"]
+		switch regid {
+		case "token1":
+			if res.Err != nil {
+				t.Errorf("Unexpected error for token1: %v", res.Err)
+			}
+		case "token2":
+			if _, ok := res.Err.(*push.UnsubscribeUpdate); !ok {
+				t.Errorf("Expected UnsubscribeUpdate for token2, got %v", res.Err)
+			}
+		}
+	}
+}
+
+func TestHMSPushRefreshesExpiredAccessToken(t *testing.T) {
+	mock := newMockHMSServer(
+		`{"code":"80200003","msg":"OAuth token expired","requestId":"req1"}`,
+		`{"code":"80000000","msg":"Success","requestId":"req2"}`,
+	)
+	defer mock.server.Close()
+
+	results := hmsPushToMockServer(t, mock, "token1")
+	if len(results) != 1 || results[0].Err != nil {
+		t.Fatalf("Expected 1 successful result, got %v", results)
+	}
+	test_util.ExpectEquals(t, 2, mock.tokenRequests, "number of token requests")
+	test_util.ExpectStringEquals(t, "Bearer accesstoken2", mock.pushRequests[1].Header.Get("Authorization"), "Authorization header after refreshing")
+}
+
+func TestHMSPushRetriesInternalError(t *testing.T) {
+	mock := newMockHMSServer(`{"code":"81000001","msg":"System inner error","requestId":"req1"}`)
+	defer mock.server.Close()
+
+	results := hmsPushToMockServer(t, mock, "token1")
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+	if _, ok := results[0].Err.(*push.RetryError); !ok {
+		t.Errorf("Expected RetryError, got %v", results[0].Err)
+	}
+}
+
+func TestHMSPreview(t *testing.T) {
+	service := newHMSPushService()
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"title": "Hi", "other": "value"}
+	payload, err := service.Preview(notif)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectedPayload := `{"validate_only":false,"message":{"data":"{\"other\":\"value\",\"title\":\"Hi\"}","android":{"notification":{"click_action":{"type":3},"title":"Hi"}},"token":["placeholderRegId"]}}`
+	test_util.ExpectJSONIsEquivalent(t, []byte(expectedPayload), payload)
+}
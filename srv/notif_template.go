@@ -0,0 +1,35 @@
+/*
+ * This contains the templates used to render notifications as text, for push service types without structured payloads (smtp and sms).
+ */
+
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// parseNotifTemplate parses a template for the keys of a notification, e.g. "{{.title}}: {{.msg}}". Missing keys are rendered as empty strings.
+func parseNotifTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid%sTemplate: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+// renderNotifTemplate renders the template text of psp with the keys of notif.
+func renderNotifTemplate(psp *push.PushServiceProvider, name, text string, notif *push.Notification) (string, push.Error) {
+	tmpl, err := parseNotifTemplate(name, text)
+	if err != nil {
+		return "", push.NewBadPushServiceProviderWithDetails(psp, err.Error())
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, notif.Data); err != nil {
+		return "", push.NewBadNotificationWithDetails(fmt.Sprintf("Could not render %s template: %v", name, err))
+	}
+	return buf.String(), nil
+}
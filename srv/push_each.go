@@ -0,0 +1,67 @@
+/*
+ * This contains the helpers shared by the push service types which send a request for each delivery point (webhook, webpush, sms and smtp).
+ */
+
+package srv
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	// At most this many bytes of responses are read, for error messages.
+	maxResponseSize = 4096
+	// By default, we retry after one minute.
+	defaultRetryAfter = 60 * time.Second
+)
+
+// pushEach pushes notif to every delivery point in dpQueue concurrently with singlePush, which is called after acquiring a request slot of psp.
+// Delivery points of other push service types than serviceName get an IncompatibleError. It closes resQueue after sending every result.
+func pushEach(serviceName string, psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification, singlePush func(dp *push.DeliveryPoint) (string, push.Error)) {
+	defer close(resQueue)
+
+	wg := sync.WaitGroup{}
+	for dp := range dpQueue {
+		if psp.PushServiceName() != dp.PushServiceName() || psp.PushServiceName() != serviceName {
+			resQueue <- &push.Result{Provider: psp, Destination: dp, Content: notif, Err: push.NewIncompatibleError()}
+			continue
+		}
+		wg.Add(1)
+		release := psp.AcquireRequestSlot()
+		go func(dp *push.DeliveryPoint) {
+			res := &push.Result{Provider: psp, Destination: dp, Content: notif}
+			res.MsgID, res.Err = singlePush(dp)
+			release()
+			resQueue <- res
+			wg.Done()
+		}(dp)
+	}
+	wg.Wait()
+}
+
+// pushFailed sends err as the only result of a push which can't be sent to any delivery point (e.g. an invalid notification),
+// then drains dpQueue and closes resQueue.
+func pushFailed(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification, err push.Error) {
+	resQueue <- &push.Result{Provider: psp, Content: notif, Err: err}
+	for range dpQueue {
+	}
+	close(resQueue)
+}
+
+// retryAfter returns the delay from the Retry-After header, defaulting to one minute.
+func retryAfter(header http.Header) time.Duration {
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultRetryAfter
+}
+
+// newRetryErrorFromResponse returns the RetryError for a response which asks to retry later (e.g. 429 or 503), after the delay from its Retry-After header.
+func newRetryErrorFromResponse(psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification, resp *http.Response, reason error) *push.RetryError {
+	return push.NewRetryErrorWithReason(psp, dp, notif, retryAfter(resp.Header), reason)
+}
@@ -0,0 +1,76 @@
+package srv
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/test_util"
+)
+
+func TestRetryAfter(t *testing.T) {
+	header := http.Header{}
+	test_util.ExpectEquals(t, defaultRetryAfter, retryAfter(header), "delay without Retry-After")
+	header.Set("Retry-After", "5")
+	test_util.ExpectEquals(t, 5*time.Second, retryAfter(header), "delay with Retry-After")
+	header.Set("Retry-After", "Wed, 21 Oct 2015 07:28:00 GMT")
+	test_util.ExpectEquals(t, defaultRetryAfter, retryAfter(header), "delay with an HTTP date")
+}
+
+func TestPushEach(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	psm.RegisterPushServiceType(newWebhookPushService())
+	psm.RegisterPushServiceType(newSMSPushService())
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{"pushservicetype": "webhook", "service": "mockservice"})
+	if err != nil {
+		t.Fatalf("Unexpected error building PSP: %v", err)
+	}
+	webhookDP, err := psm.BuildDeliveryPointFromMap(map[string]string{"pushservicetype": "webhook", "service": "mockservice", "subscriber": "mocksubscriber", "url": "https://example.com/hook"})
+	if err != nil {
+		t.Fatalf("Unexpected error building delivery point: %v", err)
+	}
+	smsDP, err := psm.BuildDeliveryPointFromMap(map[string]string{"pushservicetype": "sms", "service": "mockservice", "subscriber": "mocksubscriber", "phone": "+15550100100"})
+	if err != nil {
+		t.Fatalf("Unexpected error building delivery point: %v", err)
+	}
+
+	notif := push.NewEmptyNotification()
+	dpQueue := make(chan *push.DeliveryPoint, 2)
+	dpQueue <- webhookDP
+	dpQueue <- smsDP
+	close(dpQueue)
+	resQueue := make(chan *push.Result)
+	go pushEach(webhookPushServiceName, psp, dpQueue, resQueue, notif, func(dp *push.DeliveryPoint) (string, push.Error) {
+		return "mockid", nil
+	})
+	results := map[*push.DeliveryPoint]*push.Result{}
+	for res := range resQueue {
+		results[res.Destination] = res
+	}
+	test_util.ExpectEquals(t, 2, len(results), "number of results")
+	if res := results[webhookDP]; res == nil || res.Err != nil || res.MsgID != "mockid" {
+		t.Errorf("Expected the webhook delivery point to be pushed to, got %v", res)
+	}
+	if res := results[smsDP]; res == nil {
+		t.Error("Expected a result for the sms delivery point")
+	} else if _, ok := res.Err.(*push.IncompatibleError); !ok {
+		t.Errorf("Expected IncompatibleError for the sms delivery point, got %v", res.Err)
+	}
+
+	dpQueue = make(chan *push.DeliveryPoint, 1)
+	dpQueue <- webhookDP
+	close(dpQueue)
+	resQueue = make(chan *push.Result)
+	go pushFailed(psp, dpQueue, resQueue, notif, push.NewBadNotification())
+	var failed []*push.Result
+	for res := range resQueue {
+		failed = append(failed, res)
+	}
+	if len(failed) != 1 || failed[0].Destination != nil {
+		t.Fatalf("Expected a single result without a delivery point, got %v", failed)
+	}
+	if _, ok := failed[0].Err.(*push.BadNotification); !ok {
+		t.Errorf("Expected BadNotification, got %v", failed[0].Err)
+	}
+}
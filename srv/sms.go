@@ -0,0 +1,280 @@
+/*
+ * This contains the implementation of the sms push service type, which sends notifications as text messages through a generic HTTP SMS gateway.
+ *
+ * - The PSP is the URL of the gateway, optional credentials, and the names of the form parameters the gateway expects.
+ * - Each delivery point is a phone number.
+ */
+
+package srv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/util"
+)
+
+const (
+	// push service type(name), for requests to uniqush
+	smsPushServiceName = "sms"
+	// The template used if the PSP has no template.
+	smsDefaultTemplate = "{{.msg}}"
+)
+
+// smsPhoneRegexp matches phone numbers in E.164 format, with an optional leading +.
+var smsPhoneRegexp = regexp.MustCompile(`^\+?[1-9][0-9]{5,14}$`)
+
+// smsDefaultParams are the names of the form parameters sent to the gateway, if they are not overridden by the PSP.
+var smsDefaultParams = map[string]string{
+	"to_param":   "to",
+	"from_param": "from",
+	"body_param": "body",
+}
+
+// defaultSMSHTTPClientConfig contains the HTTP client settings used for SMS gateways, if they are not overridden in the [sms] section of uniqush.conf.
+var defaultSMSHTTPClientConfig = util.HTTPClientConfig{
+	Timeout:             time.Second * 10,
+	TLSHandshakeTimeout: time.Second * 5,
+	MaxIdleConnsPerHost: 20,
+}
+
+type smsPushService struct {
+	// client is shared by all sms PSPs. It is replaced only when the service is registered, before any pushes are sent.
+	client *http.Client
+}
+
+var _ push.PushServiceType = &smsPushService{}
+
+func newSMSPushService() *smsPushService {
+	ret := new(smsPushService)
+	// The defaults can't fail to create a client (no CA file or proxy)
+	ret.client, _ = defaultSMSHTTPClientConfig.NewClient()
+	return ret
+}
+
+// InstallSMS registers the only instance of the sms service. It is called only once.
+func InstallSMS() {
+	psm := push.GetPushServiceManager()
+	err := psm.RegisterPushServiceType(newSMSPushService())
+	if err != nil {
+		panic(fmt.Sprintf("Failed to install sms module: %v", err))
+	}
+}
+
+func (s *smsPushService) Finalize() {
+	if transport, ok := s.client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+func (s *smsPushService) Name() string {
+	return smsPushServiceName
+}
+
+func (s *smsPushService) SetErrorReportChan(errChan chan<- push.Error) {
+}
+
+// ValidatePushServiceConfig rejects an invalid http_proxy or http_ca_file, which SetPushServiceConfig can't use.
+func (s *smsPushService) ValidatePushServiceConfig(c *push.PushServiceConfig) error {
+	return util.CheckHTTPClientConfig(c)
+}
+
+func (s *smsPushService) SetPushServiceConfig(c *push.PushServiceConfig) {
+	// This uses the fact that registration takes place before any requests are sent.
+	// The push service manager calls ValidatePushServiceConfig first, so this only fails if the CA file was removed since.
+	client, err := util.NewHTTPClientFromConfig(c, defaultSMSHTTPClientConfig)
+	if err != nil {
+		return
+	}
+	s.Finalize()
+	s.client = client
+}
+
+// parseSMSParams parses the extra form parameters of an sms PSP, a JSON object mapping parameter names to values (e.g. an API key).
+func parseSMSParams(value string) (map[string]string, error) {
+	params := make(map[string]string)
+	if value == "" {
+		return params, nil
+	}
+	if err := json.Unmarshal([]byte(value), &params); err != nil {
+		return nil, errors.New("InvalidParams: expected a JSON object of parameter names and string values")
+	}
+	return params, nil
+}
+
+// BuildPushServiceProviderFromMap builds an sms PSP from the URL of an HTTP SMS gateway.
+// The gateway is sent a form with the phone number, the sender and the rendered template, in parameters named by to_param, from_param and body_param.
+func (s *smsPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+
+	if gatewayURL, ok := kv["url"]; ok && len(gatewayURL) > 0 {
+		if u, err := url.Parse(gatewayURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New("InvalidURL: expected an http or https URL")
+		}
+		psp.FixedData["url"] = gatewayURL
+	} else {
+		return errors.New("NoURL")
+	}
+
+	if from, ok := kv["from"]; ok && len(from) > 0 {
+		psp.FixedData["from"] = from
+	}
+
+	if username, ok := kv["username"]; ok && len(username) > 0 {
+		psp.VolatileData["username"] = username
+		psp.VolatileData["password"] = kv["password"]
+	}
+
+	if params, ok := kv["params"]; ok && len(params) > 0 {
+		if _, err := parseSMSParams(params); err != nil {
+			return err
+		}
+		psp.VolatileData["params"] = params
+	}
+
+	for key := range smsDefaultParams {
+		if name, ok := kv[key]; ok && len(name) > 0 {
+			psp.VolatileData[key] = name
+		}
+	}
+
+	if text, ok := kv["template"]; ok && len(text) > 0 {
+		if _, err := parseNotifTemplate("Message", text); err != nil {
+			return err
+		}
+		psp.VolatileData["template"] = text
+	}
+
+	return nil
+}
+
+// BuildDeliveryPointFromMap builds an sms delivery point from a phone number.
+func (s *smsPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
+	err := dp.AddCommonData(kv)
+	if err != nil {
+		return err
+	}
+
+	if phone, ok := kv["phone"]; ok && len(phone) > 0 {
+		// Allow common separators, e.g. "+1 555-0100".
+		phone = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "").Replace(phone)
+		if !smsPhoneRegexp.MatchString(phone) {
+			return errors.New("InvalidPhone: expected a phone number in E.164 format")
+		}
+		dp.FixedData["phone"] = phone
+	} else {
+		return errors.New("NoPhone")
+	}
+
+	return nil
+}
+
+// renderSMS renders the text message sent for notif.
+func renderSMS(psp *push.PushServiceProvider, notif *push.Notification) (string, push.Error) {
+	if notif == nil || len(notif.Data) == 0 {
+		return "", push.NewBadNotificationWithDetails("empty notification")
+	}
+	text := smsDefaultTemplate
+	if customTemplate, ok := psp.VolatileData["template"]; ok && customTemplate != "" {
+		text = customTemplate
+	}
+	body, err := renderNotifTemplate(psp, "Message", text, notif)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(body) == "" {
+		return "", push.NewBadNotificationWithDetails("empty text message")
+	}
+	return body, nil
+}
+
+// Preview returns the text message, rendered with the default template.
+func (s *smsPushService) Preview(notif *push.Notification) ([]byte, push.Error) {
+	body, err := renderSMS(push.NewEmptyPushServiceProvider(), notif)
+	if err != nil {
+		return nil, err
+	}
+	data, jsonErr := util.MarshalJSONUnescaped(map[string]string{"body": body})
+	if jsonErr != nil {
+		return nil, push.NewErrorf("Error converting payload to JSON: %v", jsonErr)
+	}
+	return data, nil
+}
+
+// smsParamName returns the name of the form parameter key (e.g. to_param) for the gateway of psp.
+func smsParamName(psp *push.PushServiceProvider, key string) string {
+	if name, ok := psp.VolatileData[key]; ok && name != "" {
+		return name
+	}
+	return smsDefaultParams[key]
+}
+
+// Push sends a text message to each delivery point in dpQueue concurrently, and sends results on resQueue.
+func (s *smsPushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	body, err := renderSMS(psp, notif)
+	if err != nil {
+		pushFailed(psp, dpQueue, resQueue, notif, err)
+		return
+	}
+	params, paramsErr := parseSMSParams(psp.VolatileData["params"])
+	if paramsErr != nil {
+		pushFailed(psp, dpQueue, resQueue, notif, push.NewBadPushServiceProviderWithDetails(psp, paramsErr.Error()))
+		return
+	}
+
+	pushEach(smsPushServiceName, psp, dpQueue, resQueue, notif, func(dp *push.DeliveryPoint) (string, push.Error) {
+		form := url.Values{}
+		for name, value := range params {
+			form.Set(name, value)
+		}
+		form.Set(smsParamName(psp, "to_param"), dp.FixedData["phone"])
+		if from := psp.FixedData["from"]; from != "" {
+			form.Set(smsParamName(psp, "from_param"), from)
+		}
+		form.Set(smsParamName(psp, "body_param"), body)
+		return s.singlePush(psp, dp, form, notif)
+	})
+}
+
+func (s *smsPushService) singlePush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, form url.Values, notif *push.Notification) (string, push.Error) {
+	req, reqErr := http.NewRequest("POST", psp.FixedData["url"], strings.NewReader(form.Encode()))
+	if reqErr != nil {
+		return "", push.NewBadPushServiceProviderWithDetails(psp, reqErr.Error())
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	util.SetRequestIDHeader(req, notif)
+	if username := psp.VolatileData["username"]; username != "" {
+		req.SetBasicAuth(username, psp.VolatileData["password"])
+	}
+
+	resp, httpErr := s.client.Do(req)
+	if httpErr != nil {
+		return "", push.NewConnectionError(httpErr)
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return fmt.Sprintf("%v:%v", psp.Name(), dp.FixedData["phone"]), nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return "", newRetryErrorFromResponse(psp, dp, notif, resp, fmt.Errorf("SMSGatewayError: %v: %s", resp.StatusCode, respBody))
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return "", push.NewBadPushServiceProviderWithDetails(psp, fmt.Sprintf("%v: %s", resp.StatusCode, respBody))
+	default:
+		return "", push.NewErrorf("SMSGatewayError: %v: %s", resp.StatusCode, respBody)
+	}
+}
@@ -0,0 +1,112 @@
+package srv
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/test_util"
+)
+
+func TestSMSBuildDeliveryPoint(t *testing.T) {
+	service := newSMSPushService()
+	dp := push.NewEmptyDeliveryPoint()
+	if err := service.BuildDeliveryPointFromMap(map[string]string{"service": "mockservice", "subscriber": "mocksubscriber", "phone": "+1 (555) 010-0100"}, dp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test_util.ExpectStringEquals(t, "+15550100100", dp.FixedData["phone"], "phone")
+
+	if err := service.BuildDeliveryPointFromMap(map[string]string{"service": "mockservice", "subscriber": "mocksubscriber", "phone": "not a number"}, push.NewEmptyDeliveryPoint()); err == nil {
+		t.Error("Expected an error for an invalid phone number")
+	}
+}
+
+func TestSMSPush(t *testing.T) {
+	var received url.Values
+	var username, password string
+	status := http.StatusOK
+	var responseBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		received = r.PostForm
+		username, password, _ = r.BasicAuth()
+		w.WriteHeader(status)
+		io.WriteString(w, responseBody)
+	}))
+	defer server.Close()
+
+	service := newSMSPushService()
+	psm := push.GetPushServiceManager()
+	psm.RegisterPushServiceType(service)
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": "sms",
+		"service":         "mockservice",
+		"url":             server.URL + "/send",
+		"from":            "Example",
+		"username":        "user",
+		"password":        "pass",
+		"params":          `{"api_key":"secretkey"}`,
+		"to_param":        "To",
+		"body_param":      "Text",
+		"template":        "{{.title}}: {{.msg}}",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error building PSP: %v", err)
+	}
+	dp, err := psm.BuildDeliveryPointFromMap(map[string]string{"pushservicetype": "sms", "service": "mockservice", "subscriber": "mocksubscriber", "phone": "+15550100100"})
+	if err != nil {
+		t.Fatalf("Unexpected error building delivery point: %v", err)
+	}
+
+	pushOnce := func() *push.Result {
+		notif := push.NewEmptyNotification()
+		notif.Data = map[string]string{"title": "Alert", "msg": "Disk full"}
+		dpQueue := make(chan *push.DeliveryPoint, 1)
+		dpQueue <- dp
+		close(dpQueue)
+		resQueue := make(chan *push.Result)
+		go service.Push(psp, dpQueue, resQueue, notif)
+		var results []*push.Result
+		for res := range resQueue {
+			results = append(results, res)
+		}
+		if len(results) != 1 {
+			t.Fatalf("Expected 1 result, got %d", len(results))
+		}
+		return results[0]
+	}
+
+	res := pushOnce()
+	if res.Err != nil {
+		t.Fatalf("Unexpected error: %v", res.Err)
+	}
+	test_util.ExpectStringEquals(t, "+15550100100", received.Get("To"), "To parameter")
+	test_util.ExpectStringEquals(t, "Example", received.Get("from"), "from parameter")
+	test_util.ExpectStringEquals(t, "Alert: Disk full", received.Get("Text"), "Text parameter")
+	test_util.ExpectStringEquals(t, "secretkey", received.Get("api_key"), "api_key parameter")
+	test_util.ExpectStringEquals(t, "user:pass", username+":"+password, "basic auth")
+
+	status = http.StatusUnauthorized
+	res = pushOnce()
+	if _, ok := res.Err.(*push.BadPushServiceProvider); !ok {
+		t.Errorf("Expected BadPushServiceProvider for 401, got %v", res.Err)
+	}
+
+	status = http.StatusBadGateway
+	res = pushOnce()
+	if _, ok := res.Err.(*push.RetryError); !ok {
+		t.Errorf("Expected RetryError for 502, got %v", res.Err)
+	}
+
+	status = http.StatusBadRequest
+	responseBody = strings.Repeat("x", 1<<20)
+	res = pushOnce()
+	if res.Err == nil || len(res.Err.Error()) > maxResponseSize+100 {
+		t.Errorf("Expected an error with at most %d bytes of the response, got %d bytes", maxResponseSize, len(fmt.Sprint(res.Err)))
+	}
+}
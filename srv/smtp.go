@@ -0,0 +1,283 @@
+/*
+ * This contains the implementation of the smtp push service type, which sends notifications as emails.
+ *
+ * - The PSP is an SMTP server (with optional authentication), a From address and templates for the subject and body.
+ * - Each delivery point is an email address.
+ */
+
+package srv
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/util"
+)
+
+const (
+	// push service type(name), for requests to uniqush
+	smtpPushServiceName = "smtp"
+	// The templates used if the PSP has no templates.
+	smtpDefaultSubjectTemplate = "{{.title}}"
+	smtpDefaultBodyTemplate    = "{{.msg}}"
+	// The timeouts for connecting to the SMTP server, and for sending each email.
+	smtpDialTimeout = 10 * time.Second
+	smtpSendTimeout = 30 * time.Second
+)
+
+type smtpPushService struct{}
+
+var _ push.PushServiceType = &smtpPushService{}
+
+func newSMTPPushService() *smtpPushService {
+	return new(smtpPushService)
+}
+
+// InstallSMTP registers the only instance of the smtp service. It is called only once.
+func InstallSMTP() {
+	psm := push.GetPushServiceManager()
+	err := psm.RegisterPushServiceType(newSMTPPushService())
+	if err != nil {
+		panic(fmt.Sprintf("Failed to install smtp module: %v", err))
+	}
+}
+
+func (s *smtpPushService) Finalize() {
+}
+
+func (s *smtpPushService) Name() string {
+	return smtpPushServiceName
+}
+
+func (s *smtpPushService) SetErrorReportChan(errChan chan<- push.Error) {
+}
+
+func (s *smtpPushService) SetPushServiceConfig(c *push.PushServiceConfig) {
+}
+
+// BuildPushServiceProviderFromMap builds an smtp PSP from the address of an SMTP server (host:port), the From address and optional credentials and templates.
+func (s *smtpPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+
+	if server, ok := kv["server"]; ok && len(server) > 0 {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return errors.New("InvalidServer: expected host:port")
+		}
+		psp.FixedData["server"] = server
+	} else {
+		return errors.New("NoServer")
+	}
+
+	if from, ok := kv["from"]; ok && len(from) > 0 {
+		if _, err := mail.ParseAddress(from); err != nil {
+			return errors.New("InvalidFrom: expected an email address")
+		}
+		psp.FixedData["from"] = from
+	} else {
+		return errors.New("NoFrom")
+	}
+
+	if username, ok := kv["username"]; ok && len(username) > 0 {
+		psp.VolatileData["username"] = username
+		psp.VolatileData["password"] = kv["password"]
+	}
+
+	for key, name := range map[string]string{"subject": "Subject", "body": "Body"} {
+		if text, ok := kv[key]; ok && len(text) > 0 {
+			if _, err := parseNotifTemplate(name, text); err != nil {
+				return err
+			}
+			psp.VolatileData[key] = text
+		}
+	}
+
+	return nil
+}
+
+// BuildDeliveryPointFromMap builds an smtp delivery point from an email address.
+func (s *smtpPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
+	err := dp.AddCommonData(kv)
+	if err != nil {
+		return err
+	}
+
+	if email, ok := kv["email"]; ok && len(email) > 0 {
+		address, err := mail.ParseAddress(email)
+		if err != nil {
+			return errors.New("InvalidEmail")
+		}
+		dp.FixedData["email"] = address.Address
+	} else {
+		return errors.New("NoEmail")
+	}
+
+	return nil
+}
+
+// smtpTemplates returns the subject and body templates of psp.
+func smtpTemplates(psp *push.PushServiceProvider) (subject, body string) {
+	subject, body = smtpDefaultSubjectTemplate, smtpDefaultBodyTemplate
+	if text, ok := psp.VolatileData["subject"]; ok && text != "" {
+		subject = text
+	}
+	if text, ok := psp.VolatileData["body"]; ok && text != "" {
+		body = text
+	}
+	return subject, body
+}
+
+// renderEmail renders the subject and body of the email sent for notif.
+func renderEmail(psp *push.PushServiceProvider, notif *push.Notification) (subject, body string, err push.Error) {
+	if notif == nil || len(notif.Data) == 0 {
+		return "", "", push.NewBadNotificationWithDetails("empty notification")
+	}
+	subjectTemplate, bodyTemplate := smtpTemplates(psp)
+	if subject, err = renderNotifTemplate(psp, "Subject", subjectTemplate, notif); err != nil {
+		return "", "", err
+	}
+	if body, err = renderNotifTemplate(psp, "Body", bodyTemplate, notif); err != nil {
+		return "", "", err
+	}
+	if strings.TrimSpace(body) == "" {
+		return "", "", push.NewBadNotificationWithDetails("empty email body")
+	}
+	// Headers can't contain line breaks.
+	subject = strings.Join(strings.Fields(subject), " ")
+	return subject, body, nil
+}
+
+// Preview returns the subject and body of the email, rendered with the default templates.
+func (s *smtpPushService) Preview(notif *push.Notification) ([]byte, push.Error) {
+	subject, body, err := renderEmail(push.NewEmptyPushServiceProvider(), notif)
+	if err != nil {
+		return nil, err
+	}
+	data, jsonErr := util.MarshalJSONUnescaped(map[string]string{"subject": subject, "body": body})
+	if jsonErr != nil {
+		return nil, push.NewErrorf("Error converting payload to JSON: %v", jsonErr)
+	}
+	return data, nil
+}
+
+// formatEmail returns the message sent to the SMTP server, with the headers and a plain text body.
+func formatEmail(from, to, subject, body string, now time.Time) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.Replace(strings.Replace(body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// Push sends an email to each delivery point in dpQueue concurrently, and sends results on resQueue.
+func (s *smtpPushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	subject, body, err := renderEmail(psp, notif)
+	if err != nil {
+		pushFailed(psp, dpQueue, resQueue, notif, err)
+		return
+	}
+
+	pushEach(smtpPushServiceName, psp, dpQueue, resQueue, notif, func(dp *push.DeliveryPoint) (string, push.Error) {
+		if err := sendEmail(psp, dp, notif, formatEmail(psp.FixedData["from"], dp.FixedData["email"], subject, body, time.Now())); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%v:%v", psp.Name(), dp.FixedData["email"]), nil
+	})
+}
+
+// smtpError converts an error from the SMTP server. Permanent errors for a recipient are errors of the delivery point.
+func smtpError(psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification, err error, isRecipientError bool) push.Error {
+	protocolErr, ok := err.(*textproto.Error)
+	if !ok {
+		return push.NewConnectionError(err)
+	}
+	switch {
+	case protocolErr.Code >= 400 && protocolErr.Code < 500:
+		return push.NewRetryErrorWithReason(psp, dp, notif, defaultRetryAfter, fmt.Errorf("SMTPError: %v", protocolErr))
+	case protocolErr.Code == 530 || protocolErr.Code == 534 || protocolErr.Code == 535:
+		// Authentication is required, or the credentials are invalid.
+		return push.NewBadPushServiceProviderWithDetails(psp, protocolErr.Error())
+	case isRecipientError:
+		return push.NewBadDeliveryPointWithDetails(dp, protocolErr.Error())
+	default:
+		return push.NewErrorf("SMTPError: %v", protocolErr)
+	}
+}
+
+// sendEmail sends msg to the email address of dp, using STARTTLS if the server supports it.
+func sendEmail(psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification, msg []byte) push.Error {
+	server := psp.FixedData["server"]
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return push.NewBadPushServiceProviderWithDetails(psp, "InvalidServer")
+	}
+	from, err := mail.ParseAddress(psp.FixedData["from"])
+	if err != nil {
+		return push.NewBadPushServiceProviderWithDetails(psp, "InvalidFrom")
+	}
+
+	conn, err := net.DialTimeout("tcp", server, smtpDialTimeout)
+	if err != nil {
+		return push.NewConnectionError(err)
+	}
+	conn.SetDeadline(time.Now().Add(smtpSendTimeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return smtpError(psp, dp, notif, err, false)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return smtpError(psp, dp, notif, err, false)
+		}
+	}
+	if username := psp.VolatileData["username"]; username != "" {
+		// PlainAuth refuses to send credentials without TLS, unless the server is localhost.
+		if err = client.Auth(smtp.PlainAuth("", username, psp.VolatileData["password"], host)); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return push.NewBadPushServiceProviderWithDetails(psp, err.Error())
+			}
+			return smtpError(psp, dp, notif, err, false)
+		}
+	}
+	if err = client.Mail(from.Address); err != nil {
+		return smtpError(psp, dp, notif, err, false)
+	}
+	if err = client.Rcpt(dp.FixedData["email"]); err != nil {
+		return smtpError(psp, dp, notif, err, true)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return smtpError(psp, dp, notif, err, false)
+	}
+	if _, err = w.Write(msg); err != nil {
+		return push.NewConnectionError(err)
+	}
+	if err = w.Close(); err != nil {
+		return smtpError(psp, dp, notif, err, false)
+	}
+	client.Quit()
+	return nil
+}
@@ -0,0 +1,199 @@
+package srv
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/test_util"
+)
+
+// mockSMTPServer is a minimal SMTP server which accepts PLAIN authentication and records the messages it receives.
+// Recipients starting with "rejected" are rejected with 550.
+type mockSMTPServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	auths    []string
+	messages []string
+}
+
+func newMockSMTPServer(t *testing.T) *mockSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	m := &mockSMTPServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *mockSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO", "HELO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			m.lock.Lock()
+			m.auths = append(m.auths, line)
+			m.lock.Unlock()
+			reply("235 Authentication successful")
+		case "MAIL":
+			reply("250 OK")
+		case "RCPT":
+			if strings.Contains(line, "<rejected") {
+				reply("550 No such user")
+			} else {
+				reply("250 OK")
+			}
+		case "DATA":
+			reply("354 Go ahead")
+			var message []string
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				message = append(message, dataLine)
+			}
+			m.lock.Lock()
+			m.messages = append(m.messages, strings.Join(message, ""))
+			m.lock.Unlock()
+			reply("250 Queued")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Not implemented")
+		}
+	}
+}
+
+func smtpPushToMockServer(t *testing.T, m *mockSMTPServer, notifData map[string]string, emails ...string) []*push.Result {
+	service := newSMTPPushService()
+	psm := push.GetPushServiceManager()
+	psm.RegisterPushServiceType(service)
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": "smtp",
+		"service":         "mockservice",
+		"server":          m.listener.Addr().String(),
+		"from":            "alerts@example.com",
+		"username":        "user",
+		"password":        "pass",
+		"subject":         "[Alert] {{.title}}",
+		"body":            "{{.msg}}\n{{.missing}}-- Example",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error building PSP: %v", err)
+	}
+	dpQueue := make(chan *push.DeliveryPoint, len(emails))
+	for _, email := range emails {
+		dp, err := psm.BuildDeliveryPointFromMap(map[string]string{"pushservicetype": "smtp", "service": "mockservice", "subscriber": "mocksubscriber", "email": email})
+		if err != nil {
+			t.Fatalf("Unexpected error building delivery point: %v", err)
+		}
+		dpQueue <- dp
+	}
+	close(dpQueue)
+
+	notif := push.NewEmptyNotification()
+	notif.Data = notifData
+	resQueue := make(chan *push.Result)
+	go service.Push(psp, dpQueue, resQueue, notif)
+	var results []*push.Result
+	for res := range resQueue {
+		results = append(results, res)
+	}
+	return results
+}
+
+func TestSMTPPush(t *testing.T) {
+	m := newMockSMTPServer(t)
+	defer m.listener.Close()
+
+	results := smtpPushToMockServer(t, m, map[string]string{"title": "Disk full", "msg": "Disk is 99% full"}, "user@example.com")
+	if len(results) != 1 || results[0].Err != nil {
+		t.Fatalf("Expected 1 successful result, got %v", results)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(m.messages))
+	}
+	message := m.messages[0]
+	for _, expected := range []string{
+		"From: alerts@example.com\r\n",
+		"To: user@example.com\r\n",
+		"Subject: [Alert] Disk full\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"\r\n\r\nDisk is 99% full\r\n-- Example\r\n",
+	} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("Expected message to contain %q, got %q", expected, message)
+		}
+	}
+	test_util.ExpectEquals(t, 1, len(m.auths), "number of AUTH commands")
+}
+
+func TestSMTPPushRejectedRecipient(t *testing.T) {
+	m := newMockSMTPServer(t)
+	defer m.listener.Close()
+
+	results := smtpPushToMockServer(t, m, map[string]string{"msg": "hello"}, "rejected@example.com")
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+	if _, ok := results[0].Err.(*push.BadDeliveryPoint); !ok {
+		t.Errorf("Expected BadDeliveryPoint, got %v", results[0].Err)
+	}
+}
+
+func TestSMTPBuildPushServiceProviderValidates(t *testing.T) {
+	service := newSMTPPushService()
+	for _, kv := range []map[string]string{
+		{"service": "mockservice", "server": "localhost", "from": "alerts@example.com"},
+		{"service": "mockservice", "server": "localhost:25", "from": "not an address"},
+		{"service": "mockservice", "server": "localhost:25", "from": "alerts@example.com", "body": "{{.msg"},
+	} {
+		if err := service.BuildPushServiceProviderFromMap(kv, push.NewEmptyPushServiceProvider()); err == nil {
+			t.Errorf("Expected an error for %v", kv)
+		}
+	}
+}
+
+func TestSMTPPreview(t *testing.T) {
+	service := newSMTPPushService()
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"title": "Hi\nthere", "msg": "hello"}
+	payload, err := service.Preview(notif)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test_util.ExpectJSONIsEquivalent(t, []byte(`{"subject":"Hi there","body":"hello"}`), payload)
+}
@@ -0,0 +1,263 @@
+/*
+ * This contains the implementation of the webhook push service type, which POSTs notifications to arbitrary HTTP(S) URLs.
+ *
+ * - The request body is the JSON object returned by /previewpush for pushservicetype=webhook.
+ * - If the delivery point has a secret, the body is signed with HMAC-SHA256 in the X-Uniqush-Signature header.
+ */
+
+package srv
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/util"
+)
+
+const (
+	// payload key to extract from push requests to uniqush. The corresponding value is sent as the request body as is.
+	webhookRawPayloadKey = "uniqush.payload.webhook"
+	// push service type(name), for requests to uniqush
+	webhookPushServiceName = "webhook"
+	// The timeout of each request, if the PSP has no timeout.
+	webhookDefaultTimeout = 10 * time.Second
+)
+
+// defaultWebhookHTTPClientConfig contains the HTTP client settings used for webhooks, if they are not overridden in the [webhook] section of uniqush.conf.
+// The client has no overall timeout, because each PSP sets its own.
+var defaultWebhookHTTPClientConfig = util.HTTPClientConfig{
+	TLSHandshakeTimeout: time.Second * 5,
+	MaxIdleConnsPerHost: 20,
+}
+
+type webhookPushService struct {
+	// client is shared by all webhook PSPs. It is replaced only when the service is registered, before any pushes are sent.
+	client *http.Client
+}
+
+var _ push.PushServiceType = &webhookPushService{}
+
+func newWebhookPushService() *webhookPushService {
+	ret := new(webhookPushService)
+	// The defaults can't fail to create a client (no CA file or proxy)
+	ret.client, _ = defaultWebhookHTTPClientConfig.NewClient()
+	return ret
+}
+
+// InstallWebhook registers the only instance of the webhook service. It is called only once.
+func InstallWebhook() {
+	psm := push.GetPushServiceManager()
+	err := psm.RegisterPushServiceType(newWebhookPushService())
+	if err != nil {
+		panic(fmt.Sprintf("Failed to install webhook module: %v", err))
+	}
+}
+
+func (wh *webhookPushService) Finalize() {
+	if transport, ok := wh.client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+func (wh *webhookPushService) Name() string {
+	return webhookPushServiceName
+}
+
+func (wh *webhookPushService) SetErrorReportChan(errChan chan<- push.Error) {
+}
+
+// ValidatePushServiceConfig rejects an invalid http_proxy or http_ca_file, which SetPushServiceConfig can't use.
+func (wh *webhookPushService) ValidatePushServiceConfig(c *push.PushServiceConfig) error {
+	return util.CheckHTTPClientConfig(c)
+}
+
+func (wh *webhookPushService) SetPushServiceConfig(c *push.PushServiceConfig) {
+	// This uses the fact that registration takes place before any requests are sent.
+	// The push service manager calls ValidatePushServiceConfig first, so this only fails if the CA file was removed since.
+	client, err := util.NewHTTPClientFromConfig(c, defaultWebhookHTTPClientConfig)
+	if err != nil {
+		return
+	}
+	wh.Finalize()
+	wh.client = client
+}
+
+// parseWebhookHeaders parses the headers of a webhook PSP, a JSON object mapping header names to values.
+func parseWebhookHeaders(value string) (map[string]string, error) {
+	headers := make(map[string]string)
+	if value == "" {
+		return headers, nil
+	}
+	if err := json.Unmarshal([]byte(value), &headers); err != nil {
+		return nil, errors.New("InvalidHeaders: expected a JSON object of header names and string values")
+	}
+	return headers, nil
+}
+
+// BuildPushServiceProviderFromMap builds a webhook PSP. headers (a JSON object) are added to every request, and timeout is the request timeout in seconds.
+func (wh *webhookPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+
+	if headers, ok := kv["headers"]; ok && len(headers) > 0 {
+		if _, err := parseWebhookHeaders(headers); err != nil {
+			return err
+		}
+		psp.VolatileData["headers"] = headers
+	}
+
+	if timeout, ok := kv["timeout"]; ok && len(timeout) > 0 {
+		seconds, err := strconv.Atoi(timeout)
+		if err != nil || seconds <= 0 {
+			return errors.New("InvalidTimeout: expected a positive number of seconds")
+		}
+		psp.VolatileData["timeout"] = timeout
+	}
+
+	return nil
+}
+
+// BuildDeliveryPointFromMap builds a webhook delivery point from a URL and an optional secret for signing requests.
+func (wh *webhookPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
+	err := dp.AddCommonData(kv)
+	if err != nil {
+		return err
+	}
+
+	if rawURL, ok := kv["url"]; ok && len(rawURL) > 0 {
+		if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New("InvalidURL: expected an http or https URL")
+		}
+		dp.FixedData["url"] = rawURL
+	} else {
+		return errors.New("NoURL")
+	}
+
+	if secret, ok := kv["secret"]; ok && len(secret) > 0 {
+		dp.VolatileData["secret"] = secret
+	}
+
+	return nil
+}
+
+// notifToWebhookPayload returns the request body: uniqush.payload.webhook if provided, or else the JSON encoded non-reserved keys.
+func notifToWebhookPayload(notif *push.Notification) ([]byte, push.Error) {
+	if notif == nil || len(notif.Data) == 0 {
+		return nil, push.NewBadNotificationWithDetails("empty notification")
+	}
+	if rawPayload, ok := notif.Data[webhookRawPayloadKey]; ok {
+		if !json.Valid([]byte(rawPayload)) {
+			return nil, push.NewBadNotificationWithDetails(fmt.Sprintf("%s is not valid JSON", webhookRawPayloadKey))
+		}
+		return []byte(rawPayload), nil
+	}
+	payload := make(map[string]string, len(notif.Data))
+	for k, v := range notif.Data {
+		if strings.HasPrefix(k, "uniqush.") { // The "uniqush." keys are reserved for uniqush use.
+			continue
+		}
+		payload[k] = v
+	}
+	if len(payload) == 0 {
+		return nil, push.NewBadNotificationWithDetails("empty notification")
+	}
+	data, err := util.MarshalJSONUnescaped(payload)
+	if err != nil {
+		return nil, push.NewErrorf("Error converting payload to JSON: %v", err)
+	}
+	return data, nil
+}
+
+func (wh *webhookPushService) Preview(notif *push.Notification) ([]byte, push.Error) {
+	return notifToWebhookPayload(notif)
+}
+
+// webhookSignature returns the value of the X-Uniqush-Signature header, the hex encoded HMAC-SHA256 of body.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Push POSTs the notification to each delivery point in dpQueue concurrently, and sends results on resQueue.
+func (wh *webhookPushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	payload, err := notifToWebhookPayload(notif)
+	if err != nil {
+		pushFailed(psp, dpQueue, resQueue, notif, err)
+		return
+	}
+	headers, headersErr := parseWebhookHeaders(psp.VolatileData["headers"])
+	if headersErr != nil {
+		pushFailed(psp, dpQueue, resQueue, notif, push.NewBadPushServiceProviderWithDetails(psp, headersErr.Error()))
+		return
+	}
+	timeout := webhookDefaultTimeout
+	if seconds, err := strconv.Atoi(psp.VolatileData["timeout"]); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	pushEach(webhookPushServiceName, psp, dpQueue, resQueue, notif, func(dp *push.DeliveryPoint) (string, push.Error) {
+		return wh.singlePush(psp, dp, payload, headers, timeout, notif)
+	})
+}
+
+func (wh *webhookPushService) singlePush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, payload []byte, headers map[string]string, timeout time.Duration, notif *push.Notification) (string, push.Error) {
+	rawURL := dp.FixedData["url"]
+	if rawURL == "" {
+		return "", push.NewBadDeliveryPointWithDetails(dp, "NoURL")
+	}
+	req, reqErr := http.NewRequest("POST", rawURL, bytes.NewReader(payload))
+	if reqErr != nil {
+		return "", push.NewBadDeliveryPointWithDetails(dp, reqErr.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	util.SetRequestIDHeader(req, notif)
+
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Uniqush-Service", dp.FixedData["service"])
+	req.Header.Set("X-Uniqush-Subscriber", dp.FixedData["subscriber"])
+	if secret := dp.VolatileData["secret"]; secret != "" {
+		req.Header.Set("X-Uniqush-Signature", webhookSignature(secret, payload))
+	}
+
+	resp, httpErr := wh.client.Do(req)
+	if httpErr != nil {
+		return "", push.NewConnectionError(httpErr)
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return fmt.Sprintf("%v:%v", psp.Name(), resp.Header.Get("X-Message-Id")), nil
+	case resp.StatusCode == http.StatusGone:
+		// The receiver no longer wants pushes for this delivery point.
+		return "", push.NewUnsubscribeUpdate(psp, dp)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return "", newRetryErrorFromResponse(psp, dp, notif, resp, fmt.Errorf("WebhookError: %v: %s", resp.StatusCode, respBody))
+	default:
+		return "", push.NewErrorf("WebhookError: %v: %s", resp.StatusCode, respBody)
+	}
+}
@@ -0,0 +1,131 @@
+package srv
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/test_util"
+)
+
+func TestWebhookPreview(t *testing.T) {
+	service := newWebhookPushService()
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"msg": "hello", "ttl": "60", "uniqush.foo": "bar"}
+	payload, err := service.Preview(notif)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test_util.ExpectJSONIsEquivalent(t, []byte(`{"msg":"hello","ttl":"60"}`), payload)
+
+	notif.Data = map[string]string{"uniqush.payload.webhook": "not json"}
+	if _, err := service.Preview(notif); err == nil {
+		t.Error("Expected an error for an invalid raw payload")
+	}
+}
+
+func TestWebhookBuildPushServiceProviderValidates(t *testing.T) {
+	service := newWebhookPushService()
+	for _, kv := range []map[string]string{
+		{"service": "mockservice", "headers": `["X-Foo"]`},
+		{"service": "mockservice", "timeout": "-1"},
+		{"headers": `{"X-Foo":"bar"}`},
+	} {
+		if err := service.BuildPushServiceProviderFromMap(kv, push.NewEmptyPushServiceProvider()); err == nil {
+			t.Errorf("Expected an error for %v", kv)
+		}
+	}
+}
+
+func TestWebhookPush(t *testing.T) {
+	var received *http.Request
+	var receivedBody []byte
+	status := http.StatusOK
+	var responseBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(status)
+		io.WriteString(w, responseBody)
+	}))
+	defer server.Close()
+
+	service := newWebhookPushService()
+	psm := push.GetPushServiceManager()
+	psm.RegisterPushServiceType(service)
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": "webhook",
+		"service":         "mockservice",
+		"headers":         `{"Authorization":"Bearer token"}`,
+		"timeout":         "5",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error building PSP: %v", err)
+	}
+	dp, err := psm.BuildDeliveryPointFromMap(map[string]string{
+		"pushservicetype": "webhook",
+		"service":         "mockservice",
+		"subscriber":      "mocksubscriber",
+		"url":             server.URL + "/hook",
+		"secret":          "key",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error building delivery point: %v", err)
+	}
+
+	pushOnce := func() *push.Result {
+		notif := push.NewEmptyNotification()
+		notif.Data = map[string]string{"msg": "hello"}
+		notif.RequestID = "myrequestid"
+		dpQueue := make(chan *push.DeliveryPoint, 1)
+		dpQueue <- dp
+		close(dpQueue)
+		resQueue := make(chan *push.Result)
+		go service.Push(psp, dpQueue, resQueue, notif)
+		var results []*push.Result
+		for res := range resQueue {
+			results = append(results, res)
+		}
+		if len(results) != 1 {
+			t.Fatalf("Expected 1 result, got %d", len(results))
+		}
+		return results[0]
+	}
+
+	res := pushOnce()
+	if res.Err != nil {
+		t.Fatalf("Unexpected error: %v", res.Err)
+	}
+	test_util.ExpectStringEquals(t, "/hook", received.URL.Path, "webhook path")
+	test_util.ExpectStringEquals(t, "Bearer token", received.Header.Get("Authorization"), "Authorization header")
+	test_util.ExpectStringEquals(t, "mocksubscriber", received.Header.Get("X-Uniqush-Subscriber"), "X-Uniqush-Subscriber header")
+	test_util.ExpectStringEquals(t, "myrequestid", received.Header.Get(push.RequestIDHeader), "X-Request-ID header")
+	test_util.ExpectStringEquals(t, `{"msg":"hello"}`, string(receivedBody), "webhook body")
+	// echo -n '{"msg":"hello"}' | openssl dgst -sha256 -hmac key
+	test_util.ExpectStringEquals(t, "sha256=b1bf29a5dd4320156c1deaebdeab85d98b0eb1e4aad7ea607e98dda2b91dc580", received.Header.Get("X-Uniqush-Signature"), "X-Uniqush-Signature header")
+
+	status = http.StatusGone
+	res = pushOnce()
+	if _, ok := res.Err.(*push.UnsubscribeUpdate); !ok {
+		t.Errorf("Expected UnsubscribeUpdate for 410, got %v", res.Err)
+	}
+
+	status = http.StatusServiceUnavailable
+	res = pushOnce()
+	if _, ok := res.Err.(*push.RetryError); !ok {
+		t.Errorf("Expected RetryError for 503, got %v", res.Err)
+	}
+
+	status = http.StatusBadRequest
+	responseBody = strings.Repeat("x", 1<<20)
+	res = pushOnce()
+	if res.Err == nil || len(res.Err.Error()) > maxResponseSize+100 {
+		t.Errorf("Expected an error with at most %d bytes of the response, got %d bytes", maxResponseSize, len(fmt.Sprint(res.Err)))
+	}
+}
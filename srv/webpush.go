@@ -0,0 +1,453 @@
+/*
+ * This contains the implementation of the Web Push push service type, for sending pushes to browsers.
+ *
+ * - Payloads are encrypted with aes128gcm (RFC 8291, RFC 8188).
+ * - The application server is identified with VAPID (RFC 8292).
+ * - Each delivery point is a browser's PushSubscription (RFC 8030).
+ */
+
+package srv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/util"
+)
+
+const (
+	// payload key to extract from push requests to uniqush. The corresponding value is sent to the browser's service worker as is.
+	webPushRawPayloadKey = "uniqush.payload.webpush"
+	// push service type(name), for requests to uniqush
+	webPushPushServiceName = "webpush"
+	// The record size of the encrypted payload. Payloads are sent in a single record.
+	webPushRecordSize = 4096
+	// Push services must accept encrypted payloads of up to 4096 bytes.
+	webPushMaxBodySize = 4096
+	// The JWTs for VAPID are valid for 12 hours. Push services reject JWTs which expire more than 24 hours in the future.
+	webPushJWTExpiry = 12 * time.Hour
+)
+
+// webPushTopicRegexp matches valid values of the Topic header (at most 32 characters of the URL and filename safe base64 alphabet).
+var webPushTopicRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// defaultWebPushHTTPClientConfig contains the HTTP client settings used for Web Push, if they are not overridden in the [webpush] section of uniqush.conf.
+var defaultWebPushHTTPClientConfig = util.HTTPClientConfig{
+	Timeout:             time.Second * 10,
+	TLSHandshakeTimeout: time.Second * 5,
+	MaxIdleConnsPerHost: 100,
+}
+
+type webPushService struct {
+	// client is shared by all Web Push PSPs. It is replaced only when the service is registered, before any pushes are sent.
+	client *http.Client
+}
+
+var _ push.PushServiceType = &webPushService{}
+
+func newWebPushService() *webPushService {
+	ret := new(webPushService)
+	// The defaults can't fail to create a client (no CA file or proxy)
+	ret.client, _ = defaultWebPushHTTPClientConfig.NewClient()
+	return ret
+}
+
+// InstallWebPush registers the only instance of the Web Push service. It is called only once.
+func InstallWebPush() {
+	psm := push.GetPushServiceManager()
+	err := psm.RegisterPushServiceType(newWebPushService())
+	if err != nil {
+		panic(fmt.Sprintf("Failed to install Web Push module: %v", err))
+	}
+}
+
+func (wp *webPushService) Finalize() {
+	if transport, ok := wp.client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+func (wp *webPushService) Name() string {
+	return webPushPushServiceName
+}
+
+func (wp *webPushService) SetErrorReportChan(errChan chan<- push.Error) {
+}
+
+// ValidatePushServiceConfig rejects an invalid http_proxy or http_ca_file, which SetPushServiceConfig can't use.
+func (wp *webPushService) ValidatePushServiceConfig(c *push.PushServiceConfig) error {
+	return util.CheckHTTPClientConfig(c)
+}
+
+func (wp *webPushService) SetPushServiceConfig(c *push.PushServiceConfig) {
+	// This uses the fact that registration takes place before any requests are sent.
+	// The push service manager calls ValidatePushServiceConfig first, so this only fails if the CA file was removed since.
+	client, err := util.NewHTTPClientFromConfig(c, defaultWebPushHTTPClientConfig)
+	if err != nil {
+		return
+	}
+	wp.Finalize()
+	wp.client = client
+}
+
+// decodeWebPushBase64 decodes the base64 encoded keys used by Web Push. Browsers use the URL safe alphabet without padding, but other encodings are accepted.
+func decodeWebPushBase64(value string) ([]byte, error) {
+	value = strings.TrimRight(value, "=")
+	if strings.ContainsAny(value, "+/") {
+		return base64.RawStdEncoding.DecodeString(value)
+	}
+	return base64.RawURLEncoding.DecodeString(value)
+}
+
+// parseVAPIDKeyPair parses the VAPID private key (the base64 encoded 32 byte scalar) and checks that it matches the public key (the base64 encoded uncompressed point).
+func parseVAPIDKeyPair(publicKey, privateKey string) (*ecdsa.PrivateKey, error) {
+	d, err := decodeWebPushBase64(privateKey)
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("InvalidVAPIDPrivateKey: expected a base64 encoded 32 byte P-256 private key")
+	}
+	curve := elliptic.P256()
+	key := new(ecdsa.PrivateKey)
+	key.Curve = curve
+	key.D = new(big.Int).SetBytes(d)
+	if key.D.Sign() == 0 || key.D.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("InvalidVAPIDPrivateKey: not a valid P-256 private key")
+	}
+	key.X, key.Y = curve.ScalarBaseMult(d)
+	if publicKey != "" {
+		pub, err := decodeWebPushBase64(publicKey)
+		if err != nil || !bytes.Equal(pub, elliptic.Marshal(curve, key.X, key.Y)) {
+			return nil, errors.New("InvalidVAPIDPublicKey: expected the base64 encoded uncompressed P-256 public key of vapid_private_key")
+		}
+	}
+	return key, nil
+}
+
+// BuildPushServiceProviderFromMap builds a Web Push PSP from a VAPID key pair and a subject (a mailto: or https: URL for push services to contact).
+// vapid_public_key is the applicationServerKey used by browsers to subscribe.
+func (wp *webPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+
+	publicKey, ok := kv["vapid_public_key"]
+	if !ok || len(publicKey) == 0 {
+		return errors.New("NoVAPIDPublicKey")
+	}
+	privateKey, ok := kv["vapid_private_key"]
+	if !ok || len(privateKey) == 0 {
+		return errors.New("NoVAPIDPrivateKey")
+	}
+	if _, err := parseVAPIDKeyPair(publicKey, privateKey); err != nil {
+		return err
+	}
+	psp.FixedData["vapid_public_key"] = publicKey
+	psp.VolatileData["vapid_private_key"] = privateKey
+
+	if subject, ok := kv["subject"]; ok && (strings.HasPrefix(subject, "mailto:") || strings.HasPrefix(subject, "https://")) {
+		psp.VolatileData["subject"] = subject
+	} else {
+		return errors.New("NoSubject: expected a mailto: or https: URL")
+	}
+
+	return nil
+}
+
+// BuildDeliveryPointFromMap builds a Web Push delivery point from the fields of a browser's PushSubscription: endpoint, and the keys p256dh and auth.
+func (wp *webPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
+	err := dp.AddCommonData(kv)
+	if err != nil {
+		return err
+	}
+
+	if endpoint, ok := kv["endpoint"]; ok && len(endpoint) > 0 {
+		if u, err := url.Parse(endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.New("InvalidEndpoint: expected an https URL")
+		}
+		dp.FixedData["endpoint"] = endpoint
+	} else {
+		return errors.New("NoEndpoint")
+	}
+
+	if p256dh, ok := kv["p256dh"]; ok && len(p256dh) > 0 {
+		key, err := decodeWebPushBase64(p256dh)
+		if err != nil {
+			return errors.New("InvalidP256dh: expected a base64 encoded P-256 public key")
+		}
+		if x, _ := elliptic.Unmarshal(elliptic.P256(), key); x == nil {
+			return errors.New("InvalidP256dh: expected a base64 encoded P-256 public key")
+		}
+		dp.VolatileData["p256dh"] = p256dh
+	} else {
+		return errors.New("NoP256dh")
+	}
+
+	if auth, ok := kv["auth"]; ok && len(auth) > 0 {
+		secret, err := decodeWebPushBase64(auth)
+		if err != nil || len(secret) != 16 {
+			return errors.New("InvalidAuth: expected a base64 encoded 16 byte secret")
+		}
+		dp.VolatileData["auth"] = auth
+	} else {
+		return errors.New("NoAuth")
+	}
+
+	return nil
+}
+
+// notifToWebPushPayload returns the plaintext sent to the browser: uniqush.payload.webpush if provided, or else the JSON encoded non-reserved keys.
+func notifToWebPushPayload(notif *push.Notification) ([]byte, push.Error) {
+	if notif == nil || len(notif.Data) == 0 {
+		return nil, push.NewBadNotificationWithDetails("empty notification")
+	}
+	if rawPayload, ok := notif.Data[webPushRawPayloadKey]; ok {
+		if rawPayload == "" {
+			return nil, push.NewBadNotificationWithDetails("empty notification")
+		}
+		return []byte(rawPayload), nil
+	}
+	payload := make(map[string]string, len(notif.Data))
+	for k, v := range notif.Data {
+		if strings.HasPrefix(k, "uniqush.") { // The "uniqush." keys are reserved for uniqush use.
+			continue
+		}
+		switch k {
+		case "msggroup", "ttl":
+			continue
+		default:
+			payload[k] = v
+		}
+	}
+	if len(payload) == 0 {
+		return nil, push.NewBadNotificationWithDetails("empty notification")
+	}
+	data, err := util.MarshalJSONUnescaped(payload)
+	if err != nil {
+		return nil, push.NewErrorf("Error converting payload to JSON: %v", err)
+	}
+	return data, nil
+}
+
+func (wp *webPushService) Preview(notif *push.Notification) ([]byte, push.Error) {
+	return notifToWebPushPayload(notif)
+}
+
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpand implements HKDF-Expand for lengths of at most 32 bytes (a single block of SHA-256).
+func hkdfExpand(prk, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
+
+// webPushEncrypt encrypts plaintext for the user agent's public key uaPublic and authentication secret authSecret, as a single aes128gcm record (RFC 8291).
+// asPrivate is an ephemeral key pair of the application server, and salt is 16 random bytes. These are parameters for testing.
+func webPushEncrypt(plaintext, uaPublic, authSecret []byte, asPrivate *ecdsa.PrivateKey, salt []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, errors.New("invalid p256dh")
+	}
+	if len(plaintext)+17 > webPushRecordSize {
+		return nil, fmt.Errorf("payload is too large: %d bytes", len(plaintext))
+	}
+	sharedX, _ := curve.ScalarMult(uaX, uaY, asPrivate.D.Bytes())
+	ecdhSecret := make([]byte, 32)
+	sharedBytes := sharedX.Bytes()
+	copy(ecdhSecret[32-len(sharedBytes):], sharedBytes)
+	asPublic := elliptic.Marshal(curve, asPrivate.X, asPrivate.Y)
+
+	// Combine the ECDH shared secret with the authentication secret
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdfExpand(hkdfExtract(authSecret, ecdhSecret), keyInfo, 32)
+
+	// Derive the content encryption key and nonce (RFC 8188)
+	prk := hkdfExtract(salt, ikm)
+	cek := hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// A single record, terminated by the padding delimiter 0x02
+	record := append(append([]byte{}, plaintext...), 2)
+
+	header := make([]byte, 0, 21+len(asPublic))
+	header = append(header, salt...)
+	rs := make([]byte, 4)
+	binary.BigEndian.PutUint32(rs, webPushRecordSize)
+	header = append(header, rs...)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+// encryptForDeliveryPoint encrypts the payload for the browser of a delivery point, using a new ephemeral key and salt.
+func encryptForDeliveryPoint(dp *push.DeliveryPoint, payload []byte) ([]byte, push.Error) {
+	uaPublic, err := decodeWebPushBase64(dp.VolatileData["p256dh"])
+	if err != nil {
+		return nil, push.NewBadDeliveryPointWithDetails(dp, "InvalidP256dh")
+	}
+	authSecret, err := decodeWebPushBase64(dp.VolatileData["auth"])
+	if err != nil || len(authSecret) == 0 {
+		return nil, push.NewBadDeliveryPointWithDetails(dp, "InvalidAuth")
+	}
+	asPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, push.NewErrorf("Failed to generate an ephemeral key: %v", err)
+	}
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, push.NewErrorf("Failed to generate a salt: %v", err)
+	}
+	body, err := webPushEncrypt(payload, uaPublic, authSecret, asPrivate, salt)
+	if err != nil {
+		return nil, push.NewBadDeliveryPointWithDetails(dp, err.Error())
+	}
+	if len(body) > webPushMaxBodySize {
+		return nil, push.NewBadNotificationWithDetails(fmt.Sprintf("payload is too large: %d > %d", len(body), webPushMaxBodySize))
+	}
+	return body, nil
+}
+
+// vapidAuthorization returns the value of the Authorization header for sending pushes to endpoint, with a JWT signed with the PSP's VAPID key (RFC 8292).
+func vapidAuthorization(psp *push.PushServiceProvider, endpoint string, now time.Time) (string, push.Error) {
+	key, err := parseVAPIDKeyPair(psp.FixedData["vapid_public_key"], psp.VolatileData["vapid_private_key"])
+	if err != nil {
+		return "", push.NewBadPushServiceProviderWithDetails(psp, err.Error())
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", push.NewErrorf("Invalid endpoint %q: %v", endpoint, err)
+	}
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(webPushJWTExpiry).Unix(),
+		"sub": psp.VolatileData["subject"],
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", push.NewErrorf("Failed to sign VAPID JWT: %v", err)
+	}
+	// ES256 signatures are the concatenation of r and s, each padded to 32 bytes.
+	signature := make([]byte, 64)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rBytes):32], rBytes)
+	copy(signature[64-len(sBytes):], sBytes)
+	jwt := signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+	publicKey := base64.RawURLEncoding.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y))
+	return fmt.Sprintf("vapid t=%s, k=%s", jwt, publicKey), nil
+}
+
+// Push sends a push notification to each delivery point in dpQueue concurrently, and sends results on resQueue.
+func (wp *webPushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	payload, err := notifToWebPushPayload(notif)
+	if err != nil {
+		pushFailed(psp, dpQueue, resQueue, notif, err)
+		return
+	}
+
+	// By default, the notification expires in an hour if the ttl is omitted, the same as the other push service types.
+	ttl := "3600"
+	if rawTTL, ok := notif.Data["ttl"]; ok {
+		if parsed, err := strconv.ParseUint(rawTTL, 10, 32); err == nil {
+			ttl = strconv.FormatUint(parsed, 10)
+		}
+	}
+
+	pushEach(webPushPushServiceName, psp, dpQueue, resQueue, notif, func(dp *push.DeliveryPoint) (string, push.Error) {
+		return wp.singlePush(psp, dp, payload, ttl, notif)
+	})
+}
+
+func (wp *webPushService) singlePush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, payload []byte, ttl string, notif *push.Notification) (string, push.Error) {
+	endpoint := dp.FixedData["endpoint"]
+	if endpoint == "" {
+		return "", push.NewBadDeliveryPointWithDetails(dp, "NoEndpoint")
+	}
+	body, err := encryptForDeliveryPoint(dp, payload)
+	if err != nil {
+		return "", err
+	}
+	authorization, err := vapidAuthorization(psp, endpoint, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	req, reqErr := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if reqErr != nil {
+		return "", push.NewBadDeliveryPointWithDetails(dp, reqErr.Error())
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", ttl)
+	req.Header.Set("Authorization", authorization)
+	if topic := notif.Data["msggroup"]; webPushTopicRegexp.MatchString(topic) {
+		// Replaces undelivered pushes with the same topic.
+		req.Header.Set("Topic", topic)
+	}
+
+	resp, httpErr := wp.client.Do(req)
+	if httpErr != nil {
+		return "", push.NewConnectionError(httpErr)
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		// The Location header is the URL of the push message resource
+		return fmt.Sprintf("%v:%v", psp.Name(), resp.Header.Get("Location")), nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		// The subscription expired or the user unsubscribed.
+		return "", push.NewUnsubscribeUpdate(psp, dp)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return "", newRetryErrorFromResponse(psp, dp, notif, resp, fmt.Errorf("WebPushError: %v: %s", resp.StatusCode, respBody))
+	case resp.StatusCode == http.StatusUnauthorized:
+		return "", push.NewBadPushServiceProviderWithDetails(psp, fmt.Sprintf("%v: %s", resp.StatusCode, respBody))
+	case resp.StatusCode == http.StatusForbidden:
+		// The subscription was created with a different applicationServerKey.
+		return "", push.NewBadDeliveryPointWithDetails(dp, fmt.Sprintf("%v: %s", resp.StatusCode, respBody))
+	case resp.StatusCode == http.StatusRequestEntityTooLarge:
+		return "", push.NewBadNotificationWithDetails(fmt.Sprintf("%v: %s", resp.StatusCode, respBody))
+	default:
+		return "", push.NewErrorf("WebPushError: %v: %s", resp.StatusCode, respBody)
+	}
+}
@@ -0,0 +1,294 @@
+package srv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/test_util"
+)
+
+func mustDecodeWebPushBase64(t *testing.T, value string) []byte {
+	result, err := decodeWebPushBase64(value)
+	if err != nil {
+		t.Fatalf("Invalid base64 %q: %v", value, err)
+	}
+	return result
+}
+
+func mustParseP256PrivateKey(t *testing.T, value string) *ecdsa.PrivateKey {
+	key, err := parseVAPIDKeyPair("", value)
+	if err != nil {
+		t.Fatalf("Invalid private key %q: %v", value, err)
+	}
+	return key
+}
+
+// webPushDecrypt decrypts a single aes128gcm record, as a browser would.
+func webPushDecrypt(t *testing.T, body []byte, uaPrivate *ecdsa.PrivateKey, authSecret []byte) []byte {
+	salt := body[:16]
+	rs := binary.BigEndian.Uint32(body[16:20])
+	idlen := int(body[20])
+	asPublic := body[21 : 21+idlen]
+	ciphertext := body[21+idlen:]
+	if int(rs) < len(ciphertext) {
+		t.Fatalf("Expected a single record of at most %d bytes, got %d", rs, len(ciphertext))
+	}
+
+	curve := elliptic.P256()
+	asX, asY := elliptic.Unmarshal(curve, asPublic)
+	sharedX, _ := curve.ScalarMult(asX, asY, uaPrivate.D.Bytes())
+	ecdhSecret := make([]byte, 32)
+	copy(ecdhSecret[32-len(sharedX.Bytes()):], sharedX.Bytes())
+	uaPublic := elliptic.Marshal(curve, uaPrivate.X, uaPrivate.Y)
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdfExpand(hkdfExtract(authSecret, ecdhSecret), keyInfo, 32)
+	prk := hkdfExtract(salt, ikm)
+	cek := hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	record, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Failed to decrypt: %v", err)
+	}
+	if len(record) == 0 || record[len(record)-1] != 2 {
+		t.Fatalf("Expected the record to end with the padding delimiter 2, got %v", record)
+	}
+	return record[:len(record)-1]
+}
+
+// TestWebPushEncryptRFC8291 checks the example from RFC 8291 Appendix A.
+func TestWebPushEncryptRFC8291(t *testing.T) {
+	plaintext := []byte("When I grow up, I want to be a watermelon")
+	asPrivate := mustParseP256PrivateKey(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw")
+	uaPublic := mustDecodeWebPushBase64(t, "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4")
+	salt := mustDecodeWebPushBase64(t, "DGv6ra1nlYgDCS1FRnbzlw")
+	authSecret := mustDecodeWebPushBase64(t, "BTBZMqHH6r4Tts7J_aSIgg")
+
+	body, err := webPushEncrypt(plaintext, uaPublic, authSecret, asPrivate, salt)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	test_util.ExpectStringEquals(t, expected, base64.RawURLEncoding.EncodeToString(body), "encrypted body")
+
+	uaPrivate := mustParseP256PrivateKey(t, "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94")
+	test_util.ExpectStringEquals(t, string(plaintext), string(webPushDecrypt(t, body, uaPrivate, authSecret)), "decrypted body")
+}
+
+type webPushTestSubscription struct {
+	private *ecdsa.PrivateKey
+	auth    []byte
+}
+
+func newWebPushTestSubscription(t *testing.T) *webPushTestSubscription {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	return &webPushTestSubscription{private: private, auth: auth}
+}
+
+func (s *webPushTestSubscription) p256dh() string {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), s.private.X, s.private.Y))
+}
+
+func newWebPushTestPSP(t *testing.T, psm *push.PushServiceManager) (*push.PushServiceProvider, *ecdsa.PrivateKey) {
+	vapidKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	d := make([]byte, 32)
+	dBytes := vapidKey.D.Bytes()
+	copy(d[32-len(dBytes):], dBytes)
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype":   "webpush",
+		"service":           "mockservice",
+		"vapid_public_key":  base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), vapidKey.X, vapidKey.Y)),
+		"vapid_private_key": base64.RawURLEncoding.EncodeToString(d),
+		"subject":           "mailto:admin@example.com",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error building PSP: %v", err)
+	}
+	return psp, vapidKey
+}
+
+func TestWebPushBuildPushServiceProviderRejectsMismatchedKeys(t *testing.T) {
+	service := newWebPushService()
+	keyA, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyB, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	psp := push.NewEmptyPushServiceProvider()
+	err := service.BuildPushServiceProviderFromMap(map[string]string{
+		"service":           "mockservice",
+		"vapid_public_key":  base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), keyA.X, keyA.Y)),
+		"vapid_private_key": base64.RawURLEncoding.EncodeToString(keyB.D.Bytes()),
+		"subject":           "mailto:admin@example.com",
+	}, psp)
+	if err == nil {
+		t.Error("Expected an error for a VAPID public key which doesn't match the private key")
+	}
+}
+
+func TestWebPushBuildDeliveryPointValidatesKeys(t *testing.T) {
+	service := newWebPushService()
+	sub := newWebPushTestSubscription(t)
+	valid := map[string]string{
+		"service":    "mockservice",
+		"subscriber": "mocksubscriber",
+		"endpoint":   "https://push.example.com/send/abc",
+		"p256dh":     sub.p256dh(),
+		"auth":       base64.RawURLEncoding.EncodeToString(sub.auth),
+	}
+	if err := service.BuildDeliveryPointFromMap(valid, push.NewEmptyDeliveryPoint()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for key, value := range map[string]string{
+		"endpoint": "http://push.example.com/send/abc",
+		"p256dh":   "notakey",
+		"auth":     base64.RawURLEncoding.EncodeToString([]byte("short")),
+	} {
+		kv := make(map[string]string)
+		for k, v := range valid {
+			kv[k] = v
+		}
+		kv[key] = value
+		if err := service.BuildDeliveryPointFromMap(kv, push.NewEmptyDeliveryPoint()); err == nil {
+			t.Errorf("Expected an error for an invalid %s %q", key, value)
+		}
+	}
+}
+
+func TestWebPushPush(t *testing.T) {
+	sub := newWebPushTestSubscription(t)
+	var received *http.Request
+	var receivedBody []byte
+	status := http.StatusCreated
+	var responseBody string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("Location", "https://push.example.com/message/1")
+		w.WriteHeader(status)
+		io.WriteString(w, responseBody)
+	}))
+	defer server.Close()
+
+	service := newWebPushService()
+	service.client = server.Client()
+	psm := push.GetPushServiceManager()
+	psm.RegisterPushServiceType(service)
+	psp, vapidKey := newWebPushTestPSP(t, psm)
+	dp, err := psm.BuildDeliveryPointFromMap(map[string]string{
+		"pushservicetype": "webpush",
+		"service":         "mockservice",
+		"subscriber":      "mocksubscriber",
+		"endpoint":        server.URL + "/send/abc",
+		"p256dh":          sub.p256dh(),
+		"auth":            base64.RawURLEncoding.EncodeToString(sub.auth),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error building delivery point: %v", err)
+	}
+
+	pushOnce := func() *push.Result {
+		notif := push.NewEmptyNotification()
+		notif.Data = map[string]string{"msg": "hello", "ttl": "60", "msggroup": "news"}
+		dpQueue := make(chan *push.DeliveryPoint, 1)
+		dpQueue <- dp
+		close(dpQueue)
+		resQueue := make(chan *push.Result)
+		go service.Push(psp, dpQueue, resQueue, notif)
+		var results []*push.Result
+		for res := range resQueue {
+			results = append(results, res)
+		}
+		if len(results) != 1 {
+			t.Fatalf("Expected 1 result, got %d", len(results))
+		}
+		return results[0]
+	}
+
+	res := pushOnce()
+	if res.Err != nil {
+		t.Fatalf("Unexpected error: %v", res.Err)
+	}
+	test_util.ExpectStringEquals(t, "aes128gcm", received.Header.Get("Content-Encoding"), "Content-Encoding")
+	test_util.ExpectStringEquals(t, "60", received.Header.Get("TTL"), "TTL")
+	test_util.ExpectStringEquals(t, "news", received.Header.Get("Topic"), "Topic")
+	test_util.ExpectJSONIsEquivalent(t, []byte(`{"msg":"hello"}`), webPushDecrypt(t, receivedBody, sub.private, sub.auth))
+	verifyVAPIDAuthorization(t, received.Header.Get("Authorization"), vapidKey, server.URL)
+
+	status = http.StatusGone
+	res = pushOnce()
+	if _, ok := res.Err.(*push.UnsubscribeUpdate); !ok {
+		t.Errorf("Expected UnsubscribeUpdate for 410, got %v", res.Err)
+	}
+
+	status = http.StatusTooManyRequests
+	res = pushOnce()
+	if _, ok := res.Err.(*push.RetryError); !ok {
+		t.Errorf("Expected RetryError for 429, got %v", res.Err)
+	}
+
+	status = http.StatusBadRequest
+	responseBody = strings.Repeat("x", 1<<20)
+	res = pushOnce()
+	if res.Err == nil || len(res.Err.Error()) > maxResponseSize+100 {
+		t.Errorf("Expected an error with at most %d bytes of the response, got %d bytes", maxResponseSize, len(fmt.Sprint(res.Err)))
+	}
+}
+
+func verifyVAPIDAuthorization(t *testing.T, authorization string, vapidKey *ecdsa.PrivateKey, audience string) {
+	t.Helper()
+	if !strings.HasPrefix(authorization, "vapid t=") {
+		t.Fatalf("Unexpected Authorization header %q", authorization)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(authorization, "vapid t="), ", k=", 2)
+	expectedKey := base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), vapidKey.X, vapidKey.Y))
+	test_util.ExpectStringEquals(t, expectedKey, parts[1], "VAPID public key")
+
+	jwtParts := strings.Split(parts[0], ".")
+	if len(jwtParts) != 3 {
+		t.Fatalf("Invalid JWT %q", parts[0])
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(jwtParts[2])
+	digest := sha256.Sum256([]byte(jwtParts[0] + "." + jwtParts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&vapidKey.PublicKey, digest[:], r, s) {
+		t.Error("Invalid JWT signature")
+	}
+	claimsJSON, _ := base64.RawURLEncoding.DecodeString(jwtParts[1])
+	var claims struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		t.Fatalf("Invalid JWT claims %s: %v", claimsJSON, err)
+	}
+	test_util.ExpectStringEquals(t, audience, claims.Aud, "JWT aud")
+	test_util.ExpectStringEquals(t, "mailto:admin@example.com", claims.Sub, "JWT sub")
+	if exp := time.Unix(claims.Exp, 0); exp.Before(time.Now()) || exp.After(time.Now().Add(24*time.Hour)) {
+		t.Errorf("Unexpected JWT exp %v", exp)
+	}
+}
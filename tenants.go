@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+const (
+	// APIKeyHeader is the HTTP header with the API key of a request, which is required if any API keys are configured (See LoadAPIKeys).
+	APIKeyHeader = "X-API-Key"
+
+	// tenantSeparator separates the name of a tenant from the names of its services in the database, e.g. team-a/myservice.
+	tenantSeparator = "/"
+
+	// adminIdentityHashLen is how many hex digits of the hash of an admin API key identify it in the audit log.
+	adminIdentityHashLen = 8
+)
+
+var validTenantPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// adminURLs are the paths of the REST API which can't be called with the API key of a tenant.
+// /metrics lists the services and PSPs of every tenant.
+var adminURLs = map[string]bool{
+	StopProgramURL:                   true,
+	ReloadConfigURL:                  true,
+	AuditURL:                         true,
+	RebuildServiceSetURL:             true,
+	ReencryptPushServiceProvidersURL: true,
+	MetricsURL:                       true,
+}
+
+// publicURLs are the paths of the REST API which can be called without an API key, by load balancers and liveness/readiness probes.
+var publicURLs = map[string]bool{
+	VersionInfoURL: true,
+	HealthzURL:     true,
+	ReadyzURL:      true,
+}
+
+// isAdminRequest returns true if r needs an admin API key. /readyz?providers=1 sends requests to push services, so it isn't public.
+func isAdminRequest(r *http.Request) bool {
+	if r.URL.Path == ReadyzURL {
+		return r.FormValue("providers") == "1"
+	}
+	return adminURLs[r.URL.Path]
+}
+
+// Tenant is a team sharing uniqush-push. Requests with the API key of a tenant can only see and change its own services,
+// which are namespaced in the database as <tenant>/<service>.
+type Tenant struct {
+	Name string
+	// Quota limits the pushes sent by the tenant (one for each subscriber of a /push), if it's enabled.
+	Quota push.FrequencyCap
+}
+
+// servicePrefix returns the prefix of the names of the tenant's services in the database, or "" for a nil tenant (an admin, or if there are no tenants).
+func (tenant *Tenant) servicePrefix() string {
+	if tenant == nil {
+		return ""
+	}
+	return tenant.Name + tenantSeparator
+}
+
+// namespace returns the name in the database of a service of the tenant.
+// Names which already start with the tenant's prefix (e.g. from a response) are unchanged.
+func (tenant *Tenant) namespace(service string) string {
+	prefix := tenant.servicePrefix()
+	if service == "" || strings.HasPrefix(service, prefix) {
+		return service
+	}
+	return prefix + service
+}
+
+// ownsService returns true if a service in the database belongs to the tenant. A nil tenant owns every service.
+func (tenant *Tenant) ownsService(service string) bool {
+	return strings.HasPrefix(service, tenant.servicePrefix())
+}
+
+// namespaceKV namespaces the service in the parameters of a request, such as /subscribe or an entry of /pushbatch.
+func (tenant *Tenant) namespaceKV(kv map[string]string) {
+	if service, ok := kv["service"]; ok {
+		kv["service"] = tenant.namespace(service)
+	}
+}
+
+// namespaceForm namespaces the service and services (comma separated, for /subscriptions) in a form.
+func (tenant *Tenant) namespaceForm(form url.Values) {
+	for i, service := range form["service"] {
+		form["service"][i] = tenant.namespace(service)
+	}
+	for i, value := range form["services"] {
+		services := strings.Split(value, ",")
+		for j, service := range services {
+			services[j] = tenant.namespace(service)
+		}
+		form["services"][i] = strings.Join(services, ",")
+	}
+}
+
+// APIKeys are the API keys accepted by the REST API, by their SHA-256 hashes.
+type APIKeys struct {
+	// admin are the hashes of API keys which can use every service (by the full name in the database, e.g. team-a/myservice) and every path.
+	admin map[string]bool
+	// tenants are the tenants of the other API keys, by hash.
+	tenants map[string]*Tenant
+}
+
+// hashAPIKey returns the SHA-256 hash of key, so that looking up API keys doesn't reveal them through timing.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// isEmpty returns true if no API keys are configured, in which case requests don't need one.
+func (keys *APIKeys) isEmpty() bool {
+	return keys == nil || (len(keys.admin) == 0 && len(keys.tenants) == 0)
+}
+
+// SetAPIKeys replaces the API keys accepted by the REST API. If keys is empty, requests don't need an API key.
+func (api *RestAPI) SetAPIKeys(keys *APIKeys) {
+	api.settingsLock.Lock()
+	defer api.settingsLock.Unlock()
+	api.apiKeys = keys
+}
+
+func (api *RestAPI) getAPIKeys() *APIKeys {
+	api.settingsLock.RLock()
+	defer api.settingsLock.RUnlock()
+	return api.apiKeys
+}
+
+// authenticate returns the tenant of the API key of r, or nil for an admin API key, a public path, or if no API keys are configured.
+// It also returns the identity of the API key for the audit log: "tenant:<name>", "admin:<the start of the hash of the key>", or "" without an API key.
+// If r isn't allowed, it returns the HTTP status to respond with and an error.
+func (api *RestAPI) authenticate(r *http.Request) (*Tenant, string, int, error) {
+	keys := api.getAPIKeys()
+	if keys.isEmpty() || (publicURLs[r.URL.Path] && !isAdminRequest(r)) {
+		return nil, "", http.StatusOK, nil
+	}
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, "", http.StatusUnauthorized, fmt.Errorf("Missing API key, expected the %s header", APIKeyHeader)
+	}
+	hash := hashAPIKey(key)
+	if keys.admin[hash] {
+		return nil, "admin:" + hash[:adminIdentityHashLen], http.StatusOK, nil
+	}
+	tenant, ok := keys.tenants[hash]
+	if !ok {
+		return nil, "", http.StatusUnauthorized, errors.New("Invalid API key")
+	}
+	if isAdminRequest(r) {
+		return nil, "", http.StatusForbidden, fmt.Errorf("%s requires an admin API key", r.URL.Path)
+	}
+	return tenant, "tenant:" + tenant.Name, http.StatusOK, nil
+}
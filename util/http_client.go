@@ -0,0 +1,183 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// HTTPClientConfig contains the settings of the HTTP clients used to connect to push service providers (GCM, FCM, APNS HTTP/2, ADM).
+// These are read from the section of uniqush.conf with the name of the push service type, e.g. [fcm].
+type HTTPClientConfig struct {
+	// Timeout is the timeout for an entire request, including reading the response body. 0 means no timeout.
+	Timeout time.Duration
+	// TLSHandshakeTimeout is the maximum amount of time to wait for a TLS handshake.
+	TLSHandshakeTimeout time.Duration
+	// MaxIdleConns is the maximum number of idle connections across all hosts. 0 means no limit.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost is the maximum number of idle connections to keep per host.
+	MaxIdleConnsPerHost int
+	// ProxyURL is the URL of the HTTP proxy to send requests through. If empty, the HTTP_PROXY/HTTPS_PROXY environment variables are used.
+	ProxyURL string
+	// CAFile is the path to a PEM encoded bundle of CA certificates used to verify the servers. If empty, the system roots are used.
+	CAFile string
+}
+
+// Options for HTTP clients in each push service type's section of uniqush.conf
+const (
+	HTTPTimeoutOption             = "http_timeout"               // seconds
+	HTTPTLSHandshakeTimeoutOption = "http_tls_handshake_timeout" // seconds
+	HTTPMaxIdleConnsOption        = "http_max_idle_conns"
+	HTTPMaxIdleConnsPerHostOption = "http_max_idle_conns_per_host"
+	HTTPProxyOption               = "http_proxy"
+	HTTPCAFileOption              = "http_ca_file"
+)
+
+// proxySchemes are the schemes of proxy URLs supported by http.Transport.
+var proxySchemes = map[string]bool{"http": true, "https": true, "socks5": true}
+
+// LoadHTTPClientConfig overrides the settings in defaults with any settings found in the config c.
+// Invalid or missing numbers are ignored. An error is returned if the proxy URL is invalid.
+func LoadHTTPClientConfig(c *push.PushServiceConfig, defaults HTTPClientConfig) (HTTPClientConfig, error) {
+	result := defaults
+	if c == nil {
+		return result, nil
+	}
+	if seconds, err := c.GetInt(HTTPTimeoutOption); err == nil && seconds >= 0 {
+		result.Timeout = time.Duration(seconds) * time.Second
+	}
+	if seconds, err := c.GetInt(HTTPTLSHandshakeTimeoutOption); err == nil && seconds > 0 {
+		result.TLSHandshakeTimeout = time.Duration(seconds) * time.Second
+	}
+	if n, err := c.GetInt(HTTPMaxIdleConnsOption); err == nil && n >= 0 {
+		result.MaxIdleConns = n
+	}
+	if n, err := c.GetInt(HTTPMaxIdleConnsPerHostOption); err == nil && n > 0 {
+		result.MaxIdleConnsPerHost = n
+	}
+	if proxyURL, err := c.GetString(HTTPProxyOption); err == nil && proxyURL != "" {
+		parsed, err := url.Parse(proxyURL)
+		if err != nil {
+			return defaults, fmt.Errorf("invalid %s %q: %v", HTTPProxyOption, proxyURL, err)
+		}
+		if !proxySchemes[parsed.Scheme] || parsed.Host == "" {
+			return defaults, fmt.Errorf("invalid %s %q: expected a URL such as http://proxy.example.com:3128", HTTPProxyOption, proxyURL)
+		}
+		result.ProxyURL = proxyURL
+	}
+	if caFile, err := c.GetString(HTTPCAFileOption); err == nil && caFile != "" {
+		result.CAFile = caFile
+	}
+	return result, nil
+}
+
+// CheckHTTPClientConfig returns an error if the http_proxy or http_ca_file in the config c can't be used.
+// Push service types call this from ValidatePushServiceConfig, so that uniqush-push doesn't start (or reload) with settings that would be ignored.
+func CheckHTTPClientConfig(c *push.PushServiceConfig) error {
+	httpConfig, err := LoadHTTPClientConfig(c, HTTPClientConfig{})
+	if err != nil {
+		return err
+	}
+	_, err = httpConfig.TLSConfig()
+	return err
+}
+
+// NewHTTPClientFromConfig creates an http.Client using the settings in the config c, which override the settings in defaults.
+func NewHTTPClientFromConfig(c *push.PushServiceConfig, defaults HTTPClientConfig) (*http.Client, error) {
+	httpConfig, err := LoadHTTPClientConfig(c, defaults)
+	if err != nil {
+		return nil, err
+	}
+	return httpConfig.NewClient()
+}
+
+// TLSConfig returns a TLS config which verifies servers using the configured CA bundle (or the system roots).
+func (c HTTPClientConfig) TLSConfig() (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: false}
+	if c.CAFile == "" {
+		return conf, nil
+	}
+	pem, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s %q: %v", HTTPCAFileOption, c.CAFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM encoded certificates found in %s %q", HTTPCAFileOption, c.CAFile)
+	}
+	conf.RootCAs = pool
+	return conf, nil
+}
+
+// NewTransport creates a transport with the configured proxy, CA bundle, timeouts and idle pool sizes.
+// Callers may add client certificates to the returned transport's TLSClientConfig.
+func (c HTTPClientConfig) NewTransport() (*http.Transport, error) {
+	tlsConfig, err := c.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy := http.ProxyFromEnvironment
+	if c.ProxyURL != "" {
+		proxyURL, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", HTTPProxyOption, c.ProxyURL, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	return &http.Transport{
+		Proxy:                 proxy,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		ExpectContinueTimeout: 1 * time.Second,
+	}, nil
+}
+
+// NewClient creates an http.Client using a transport from NewTransport.
+func (c HTTPClientConfig) NewClient() (*http.Client, error) {
+	transport, err := c.NewTransport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   c.Timeout,
+	}, nil
+}
+
+// SetRequestIDHeader sets the X-Request-ID header of a request to a push service to the ID of the request which sent notif, if there is one.
+func SetRequestIDHeader(req *http.Request, notif *push.Notification) {
+	if notif != nil && notif.RequestID != "" {
+		req.Header.Set(push.RequestIDHeader, notif.RequestID)
+	}
+}
+
+// HTTPDoer is implemented by *http.Client, and by the clients of push service types which can be overridden by tests.
+type HTTPDoer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// CheckHTTPReachable sends a HEAD request to url with client, returning an error if no response is received within timeout.
+// Any response, whatever its status code, means that the server is reachable (e.g. through the configured proxy).
+func CheckHTTPReachable(client HTTPDoer, url string, timeout time.Duration) error {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uniqush/goconf/conf"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/test_util"
+)
+
+var testDefaultHTTPConfig = HTTPClientConfig{
+	Timeout:             10 * time.Second,
+	TLSHandshakeTimeout: 5 * time.Second,
+	MaxIdleConnsPerHost: 500,
+}
+
+func newTestPushServiceConfig(options map[string]string) *push.PushServiceConfig {
+	c := conf.NewConfigFile()
+	c.AddSection("fcm")
+	for k, v := range options {
+		c.AddOption("fcm", k, v)
+	}
+	return push.NewPushServiceConfig(c, "fcm")
+}
+
+func TestLoadHTTPClientConfigDefaults(t *testing.T) {
+	result, err := LoadHTTPClientConfig(newTestPushServiceConfig(nil), testDefaultHTTPConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test_util.ExpectEquals(t, testDefaultHTTPConfig, result, "should use defaults when nothing is configured")
+
+	result, err = LoadHTTPClientConfig(nil, testDefaultHTTPConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test_util.ExpectEquals(t, testDefaultHTTPConfig, result, "should use defaults when there is no config")
+}
+
+func TestLoadHTTPClientConfigOverrides(t *testing.T) {
+	c := newTestPushServiceConfig(map[string]string{
+		"http_timeout":                 "30",
+		"http_tls_handshake_timeout":   "7",
+		"http_max_idle_conns":          "100",
+		"http_max_idle_conns_per_host": "50",
+		"http_proxy":                   "http://proxy.example.com:3128",
+	})
+	result, err := LoadHTTPClientConfig(c, testDefaultHTTPConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := HTTPClientConfig{
+		Timeout:             30 * time.Second,
+		TLSHandshakeTimeout: 7 * time.Second,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 50,
+		ProxyURL:            "http://proxy.example.com:3128",
+	}
+	test_util.ExpectEquals(t, expected, result, "should override defaults")
+
+	client, err := result.NewClient()
+	if err != nil {
+		t.Fatalf("Unexpected error creating client: %v", err)
+	}
+	test_util.ExpectEquals(t, 30*time.Second, client.Timeout, "client timeout")
+	transport := client.Transport.(*http.Transport)
+	test_util.ExpectEquals(t, 50, transport.MaxIdleConnsPerHost, "transport MaxIdleConnsPerHost")
+	req, _ := http.NewRequest("GET", "https://fcm.googleapis.com/fcm/send", nil)
+	proxyURL, err := transport.Proxy(req)
+	if err != nil || proxyURL == nil {
+		t.Fatalf("Expected a proxy URL, got %v, %v", proxyURL, err)
+	}
+	test_util.ExpectStringEquals(t, "proxy.example.com:3128", proxyURL.Host, "proxy host")
+}
+
+func TestLoadHTTPClientConfigInvalid(t *testing.T) {
+	c := newTestPushServiceConfig(map[string]string{
+		"http_timeout": "notanumber",
+		"http_proxy":   "http://[::1",
+	})
+	_, err := LoadHTTPClientConfig(c, testDefaultHTTPConfig)
+	if err == nil {
+		t.Fatal("Expected an error for an invalid proxy URL")
+	}
+
+	c = newTestPushServiceConfig(map[string]string{
+		"http_timeout": "notanumber",
+	})
+	result, err := LoadHTTPClientConfig(c, testDefaultHTTPConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	test_util.ExpectEquals(t, testDefaultHTTPConfig, result, "should ignore invalid numbers")
+}
+
+func TestCheckHTTPClientConfig(t *testing.T) {
+	if err := CheckHTTPClientConfig(newTestPushServiceConfig(map[string]string{"http_proxy": "http://proxy.example.com:3128"})); err != nil {
+		t.Errorf("Unexpected error for a valid proxy: %v", err)
+	}
+	for _, options := range []map[string]string{
+		{"http_proxy": "proxy.example.com:3128"},
+		{"http_proxy": "htp//proxy.example.com"},
+		{"http_ca_file": "/nonexistent/uniqush-ca.pem"},
+	} {
+		if err := CheckHTTPClientConfig(newTestPushServiceConfig(options)); err == nil {
+			t.Errorf("Expected an error for %v", options)
+		}
+	}
+}
+
+func TestHTTPClientConfigMissingCAFile(t *testing.T) {
+	config := testDefaultHTTPConfig
+	config.CAFile = "/nonexistent/uniqush-ca.pem"
+	if _, err := config.NewClient(); err == nil {
+		t.Fatal("Expected an error for a missing CA file")
+	}
+}
+
+func TestCheckHTTPReachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test_util.ExpectStringEquals(t, "HEAD", r.Method, "method")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	if err := CheckHTTPReachable(http.DefaultClient, server.URL, time.Second); err != nil {
+		t.Errorf("Expected a server responding with an error status to be reachable: %v", err)
+	}
+	server.Close()
+	if err := CheckHTTPReachable(http.DefaultClient, server.URL, time.Second); err == nil {
+		t.Error("Expected a closed server to be unreachable")
+	}
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// PendingWork counts work in progress, such as requests or retries, which should finish before uniqush-push shuts down.
+// Unlike sync.WaitGroup, work may be added while waiting, and waiting stops at a deadline. The zero value is ready to use.
+type PendingWork struct {
+	mutex sync.Mutex
+	count int
+	// idle is closed when count becomes 0, if anything is waiting.
+	idle chan struct{}
+}
+
+// Add records that work has started. Done must be called once it finishes.
+func (p *PendingWork) Add() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.count++
+}
+
+// Done records that work started with Add has finished.
+func (p *PendingWork) Done() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.count--
+	if p.count < 0 {
+		panic("PendingWork: Done called more times than Add")
+	}
+	if p.count == 0 && p.idle != nil {
+		close(p.idle)
+		p.idle = nil
+	}
+}
+
+// Idle returns whether there is no work in progress.
+func (p *PendingWork) Idle() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.count == 0
+}
+
+// Wait waits until there is no work in progress, returning false if there still is at the deadline.
+func (p *PendingWork) Wait(deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		p.mutex.Lock()
+		if p.count == 0 {
+			p.mutex.Unlock()
+			return true
+		}
+		if p.idle == nil {
+			p.idle = make(chan struct{})
+		}
+		idle := p.idle
+		p.mutex.Unlock()
+
+		select {
+		case <-idle:
+		case <-timer.C:
+			return false
+		}
+	}
+}
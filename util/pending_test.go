@@ -0,0 +1,36 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingWork(t *testing.T) {
+	var p PendingWork
+	if !p.Wait(time.Now()) {
+		t.Error("Expected Wait to succeed without work in progress")
+	}
+
+	p.Add()
+	if p.Idle() {
+		t.Error("Expected work to be in progress")
+	}
+	if p.Wait(time.Now().Add(10 * time.Millisecond)) {
+		t.Error("Expected Wait to time out with work in progress")
+	}
+
+	done := make(chan bool)
+	go func() {
+		done <- p.Wait(time.Now().Add(5 * time.Second))
+	}()
+	// Work may be added while waiting.
+	p.Add()
+	p.Done()
+	p.Done()
+	if !<-done {
+		t.Error("Expected Wait to succeed once the work finished")
+	}
+	if !p.Idle() {
+		t.Error("Expected no work to be in progress")
+	}
+}